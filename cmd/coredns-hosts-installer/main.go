@@ -4,8 +4,15 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/devincd/coredns-hosts-api/pkg/common"
 	"github.com/devincd/coredns-hosts-api/pkg/installer"
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+	"github.com/devincd/coredns-hosts-api/pkg/version"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"k8s.io/klog/v2"
@@ -23,9 +30,10 @@ func main() {
 
 func newCommand() *cobra.Command {
 	command := &cobra.Command{
-		Use:   "coredns-hosts-install",
-		Short: "coredns web apis service for hosts",
-		Args:  cobra.ExactArgs(0),
+		Use:     "coredns-hosts-install",
+		Short:   "coredns web apis service for hosts",
+		Args:    cobra.ExactArgs(0),
+		Version: version.Get().String(),
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			return nil
 		},
@@ -35,6 +43,15 @@ func newCommand() *cobra.Command {
 			if err != nil {
 				return fmt.Errorf("failed to create server: %v", err)
 			}
+			defer s.Close()
+			if installerArgs.Watch {
+				stopCh := make(chan struct{})
+				go WaitSignal(stopCh)
+				if err := s.Watch(stopCh, installerArgs.WatchResyncPeriod); err != nil {
+					return fmt.Errorf("failed to watch: %v", err)
+				}
+				return nil
+			}
 			if err := s.RunOnce(); err != nil {
 				return fmt.Errorf("failed to RunOnce server: %v", err)
 			}
@@ -42,19 +59,154 @@ func newCommand() *cobra.Command {
 		},
 	}
 	addFlags(command)
+	command.Flags().BoolVar(&installerArgs.Wait, "wait", false, "wait for the rollout of the CoreDNS Deployment after changing it, and fail if it does not complete within --wait-timeout")
+	command.Flags().DurationVar(&installerArgs.WaitTimeout, "wait-timeout", 5*time.Minute, "the timeout of --wait")
+	command.Flags().BoolVar(&installerArgs.DryRun, "dry-run", false, "print the changes to the CoreDNS resources which would be made without persisting any of them, the apiserver still validates them")
+	command.Flags().BoolVar(&installerArgs.Watch, "watch", false, "keep running and re-apply the installation once the CoreDNS Deployment, Service or ConfigMap drifts")
+	command.Flags().DurationVar(&installerArgs.WatchResyncPeriod, "watch-resync-period", 10*time.Minute, "the interval of re-applying the installation in the watch mode regardless of events, 0 means disabled")
+	command.AddCommand(newVerifyCommand())
+	command.AddCommand(newCompactCommand())
+	command.AddCommand(newUninstallCommand())
+	command.AddCommand(newStatusCommand())
+	command.AddCommand(version.NewCommand())
 	return command
 }
 
+func newVerifyCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "verify",
+		Short: "verify the installation is still intact without changing anything",
+		Args:  cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, err := installer.NewServer(installerArgs)
+			if err != nil {
+				return fmt.Errorf("failed to create server: %v", err)
+			}
+			var failed int
+			for _, result := range s.Verify() {
+				if result.Passed {
+					fmt.Printf("[PASS] %s\n", result.Name)
+					continue
+				}
+				failed++
+				fmt.Printf("[FAIL] %s: %s\n", result.Name, result.Message)
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d checks failed", failed)
+			}
+			return nil
+		},
+	}
+}
+
+func newCompactCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "compact",
+		Short: "rewrite the records in the configmap coredns-hosts-api into the canonical form",
+		Args:  cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, err := installer.NewServer(installerArgs)
+			if err != nil {
+				return fmt.Errorf("failed to create server: %v", err)
+			}
+			result, err := s.Compact()
+			if err != nil {
+				return fmt.Errorf("failed to compact: %v", err)
+			}
+			fmt.Printf("keys: %d -> %d\n", result.KeysBefore, result.KeysAfter)
+			fmt.Printf("bytes: %d -> %d\n", result.BytesBefore, result.BytesAfter)
+			for _, key := range result.Dropped {
+				fmt.Printf("dropped: %s\n", key)
+			}
+			return nil
+		},
+	}
+}
+
+func newUninstallCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "uninstall",
+		Short: "revert every change made by the installation, which is safe to run again",
+		Args:  cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			printFlags(cmd)
+			s, err := installer.NewServer(installerArgs)
+			if err != nil {
+				return fmt.Errorf("failed to create server: %v", err)
+			}
+			if err := s.Uninstall(); err != nil {
+				return fmt.Errorf("failed to uninstall: %v", err)
+			}
+			return nil
+		},
+	}
+}
+
+func newStatusCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "status",
+		Aliases: []string{"diagnose"},
+		Short:   "print a table of whether every part of the installation is wired up",
+		Args:    cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, err := installer.NewServer(installerArgs)
+			if err != nil {
+				return fmt.Errorf("failed to create server: %v", err)
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "CHECK\tSTATUS\tMESSAGE")
+			var failed int
+			for _, result := range s.Verify() {
+				status := "PASS"
+				if !result.Passed {
+					status = "FAIL"
+					failed++
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", result.Name, status, result.Message)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d checks failed", failed)
+			}
+			return nil
+		},
+	}
+}
+
 func addFlags(c *cobra.Command) {
 	klog.InitFlags(flag.CommandLine)
 
 	c.PersistentFlags().AddGoFlagSet(flag.CommandLine)
 	c.PersistentFlags().StringVar(&installerArgs.Kubeconfig, "kubeconfig", "", "absolute path to the kubeconfig file")
-	c.PersistentFlags().StringVar(&installerArgs.CoreDNSName, "coredns-name", "coredns", "the name of coreDNS component, including the Deployment and Service.")
+	c.PersistentFlags().StringVar(&installerArgs.CoreDNSName, "coredns-name", "coredns", "the name of coreDNS component, including the Deployment, Service and ConfigMap. The Deployment and Service are looked up as coredns and kube-dns too, and then by the label k8s-app=kube-dns, each on its own.")
 	c.PersistentFlags().StringVar(&installerArgs.CoreDNSNamespace, "coredns-namespace", "kube-system", "the namespace of coreDNS component, including the Deployment and Service.")
 	c.PersistentFlags().StringVar(&installerArgs.CoreDNSHostsServerVersion, "corednsHostsServer-version", "v1.0.0", "")
+	c.PersistentFlags().StringVar(&installerArgs.ServerImageRepository, "server-image-repository", installer.DefaultServerImageRepository, "the image of coredns-hosts-server component without the tag, e.g. a private registry mirroring it")
+	c.PersistentFlags().StringVar(&installerArgs.ServerImagePullPolicy, "server-image-pull-policy", "Always", "the image pull policy of coredns-hosts-server component, Always, IfNotPresent or Never")
+	c.PersistentFlags().StringVar(&installerArgs.ServerImagePullSecret, "server-image-pull-secret", "", "the Secret added to the imagePullSecrets of the CoreDNS pod to pull the image of coredns-hosts-server component")
+	c.PersistentFlags().StringVar(&installerArgs.ServerCPURequest, "server-cpu-request", installer.DefaultServerCPURequest, "the cpu request of coredns-hosts-server component, empty means unset")
+	c.PersistentFlags().StringVar(&installerArgs.ServerMemoryRequest, "server-memory-request", installer.DefaultServerMemoryRequest, "the memory request of coredns-hosts-server component, empty means unset")
+	c.PersistentFlags().StringVar(&installerArgs.ServerCPULimit, "server-cpu-limit", "", "the cpu limit of coredns-hosts-server component, empty means unset")
+	c.PersistentFlags().StringVar(&installerArgs.ServerMemoryLimit, "server-memory-limit", installer.DefaultServerMemoryLimit, "the memory limit of coredns-hosts-server component, empty means unset")
+	c.PersistentFlags().BoolVar(&installerArgs.ServerLivenessProbe, "server-liveness-probe", true, "add the liveness probe against /healthz to coredns-hosts-server component")
+	c.PersistentFlags().BoolVar(&installerArgs.ServerReadinessProbe, "server-readiness-probe", true, "add the readiness probe against /readyz to coredns-hosts-server component, which gates the readiness of the whole CoreDNS pod")
+	c.PersistentFlags().StringVar(&installerArgs.HostsVolumeClaim, "hosts-volume-claim", "", "the PersistentVolumeClaim keeping the hosts file across restarts, EmptyDir is used if empty")
+	c.PersistentFlags().StringVar(&installerArgs.HostsDir, "hosts-dir", common.CoreDNSHostsDir, "the directory the shared volume is mounted at, the hosts file in it is written by the server and read by CoreDNS")
+	c.PersistentFlags().BoolVar(&installerArgs.HostsFallthrough, "hosts-fallthrough", false, "add fallthrough to the hosts directive so the queries not in the hosts file reach the next plugin")
+	c.PersistentFlags().IntVar(&installerArgs.HostsTTL, "hosts-ttl", 0, "add ttl to the hosts directive, 0 means the default of the plugin")
+	c.PersistentFlags().BoolVar(&installerArgs.HostsNoReverse, "hosts-no-reverse", false, "add no_reverse to the hosts directive to disable the generated PTR records")
+	c.PersistentFlags().StringToIntVar(&installerArgs.HostsZoneTTLs, "hosts-zone-ttl", nil, "the ttls of the server blocks of the zones, e.g. example.org=30, whose hosts directive reads the hosts file hosts-<zone> of their own")
 	c.PersistentFlags().StringVar(&installerArgs.ServerArgs.Kubeconfig, "server-kubeconfig", "", "absolute path to the kubeconfig file of coredns-hosts-server component")
 	c.PersistentFlags().Int32Var(&installerArgs.ServerArgs.Port, "server-port", 9080, "the web service port of coredns-hosts-server component")
+	c.PersistentFlags().StringVar(&installerArgs.ServerArgs.ControllerArgs.ConfigmapName, "server-record-configmap-name", controller.DefaultConfigmapName, "the configmap holding the records of coredns-hosts-server component")
+	c.PersistentFlags().StringVar(&installerArgs.ServerArgs.ControllerArgs.ConfigmapNamespace, "server-record-configmap-namespace", controller.DefaultConfigmapNamespace, "the namespace of the configmap holding the global records of coredns-hosts-server component")
+	c.PersistentFlags().BoolVar(&installerArgs.ServerArgs.EnableLeaderElection, "server-enable-leader-election", false, "enable the leader election of coredns-hosts-server component, which adds the leases rule to the ClusterRole")
+	c.PersistentFlags().BoolVar(&installerArgs.ServerArgs.RestartCoreDNSOnChange, "server-restart-coredns-on-change", false, "make coredns-hosts-server component restart CoreDNS once the hosts file changes, which adds the deployments rule to the ClusterRole")
+	c.PersistentFlags().BoolVar(&installerArgs.ServerArgs.ControllerArgs.ReloadCoreDNS, "server-reload-coredns", false, "make coredns-hosts-server component signal CoreDNS to reload once the hosts file changes, which sets shareProcessNamespace in the CoreDNS pod")
+	c.PersistentFlags().BoolVar(&installerArgs.ServerArgs.ControllerArgs.CompressRecords, "server-compress-records", false, "make coredns-hosts-server component store the records gzip-compressed, which the compaction of the records follows as well")
+	c.PersistentFlags().BoolVar(&installerArgs.HostsRecordNoReverse, "hosts-record-no-reverse", false, "serve the PTR records from a reverse server block so that the records with noReverse are left out of them, the hosts directive of the root zone gets no_reverse")
 }
 
 func printFlags(c *cobra.Command) {
@@ -62,3 +214,12 @@ func printFlags(c *cobra.Command) {
 		klog.Infof("FLAG: --%s=%q", flag.Name, flag.Value)
 	})
 }
+
+func WaitSignal(stop chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	sigsInfo := <-sigs
+	klog.Infof("Receive the signal %s, and the installer is terminating", sigsInfo.String())
+	close(stop)
+}
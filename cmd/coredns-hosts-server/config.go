@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+// loadConfigFile sets the flags from the config file in YAML or JSON, whose keys are the flag names
+// without the leading dashes, e.g.
+//
+//	port: 9080
+//	file-path: [/etc/coredns/hosts]
+//	sync-debounce: 500ms
+//
+// The flags set on the command line win over the file, and an unknown key fails the load.
+func loadConfigFile(flags *pflag.FlagSet, path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read the config file: %v", err)
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return fmt.Errorf("failed to parse the config file %s: %v", path, err)
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		flag := flags.Lookup(key)
+		if flag == nil || key == "config" {
+			return fmt.Errorf("unknown key %q in the config file %s", key, path)
+		}
+		if flag.Changed {
+			continue
+		}
+		if err := setFlag(flag, values[key]); err != nil {
+			return fmt.Errorf("invalid value of the key %q in the config file %s: %v", key, path, err)
+		}
+	}
+	return nil
+}
+
+// setFlag sets the flag from the value decoded from the config file,
+// a list is only accepted by the flags taking several values.
+func setFlag(flag *pflag.Flag, value interface{}) error {
+	if list, ok := value.([]interface{}); ok {
+		sliceValue, ok := flag.Value.(pflag.SliceValue)
+		if !ok {
+			return fmt.Errorf("a list is not accepted by --%s", flag.Name)
+		}
+		items := make([]string, 0, len(list))
+		for _, item := range list {
+			str, err := scalarString(item)
+			if err != nil {
+				return err
+			}
+			items = append(items, str)
+		}
+		return sliceValue.Replace(items)
+	}
+	str, err := scalarString(value)
+	if err != nil {
+		return err
+	}
+	return flag.Value.Set(str)
+}
+
+func scalarString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case nil:
+		return "", nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/devincd/coredns-hosts-api/pkg/server"
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+	"github.com/spf13/pflag"
+)
+
+// newTestFlags returns the flags of some of the args like addFlags
+func newTestFlags(args *server.Args) *pflag.FlagSet {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.StringVar(&configFile, "config", "", "")
+	flags.Int32Var(&args.Port, "port", 9080, "")
+	flags.StringSliceVar(&args.ControllerArgs.FilePaths, "file-path", []string{"/etc/coredns/hosts"}, "")
+	flags.DurationVar(&args.ControllerArgs.SyncDebounce, "sync-debounce", 200*time.Millisecond, "")
+	flags.BoolVar(&args.EnableLeaderElection, "enable-leader-election", false, "")
+	flags.StringVar(&args.AuthToken, "auth-token", "", "")
+	return flags
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		cmdline []string
+		want    server.Args
+		wantErr bool
+	}{
+		{
+			name:   "yaml",
+			config: "port: 9090\nfile-path: [/a/hosts, /b/hosts]\nsync-debounce: 500ms\nenable-leader-election: true\nauth-token: ''\n",
+			want: server.Args{Port: 9090, EnableLeaderElection: true,
+				ControllerArgs: argsWith([]string{"/a/hosts", "/b/hosts"}, 500*time.Millisecond)},
+		},
+		{
+			name:   "json",
+			config: `{"port": 9091, "file-path": "/c/hosts"}`,
+			want:   server.Args{Port: 9091, ControllerArgs: argsWith([]string{"/c/hosts"}, 200*time.Millisecond)},
+		},
+		{
+			name:    "the command line wins",
+			config:  "port: 9090\nsync-debounce: 1s\n",
+			cmdline: []string{"--port", "9092"},
+			want:    server.Args{Port: 9092, ControllerArgs: argsWith([]string{"/etc/coredns/hosts"}, time.Second)},
+		},
+		{name: "unknown key", config: "prot: 9090\n", wantErr: true},
+		{name: "config key", config: "config: other.yaml\n", wantErr: true},
+		{name: "invalid value", config: "port: nine\n", wantErr: true},
+		{name: "list of a single value", config: "port: [9090]\n", wantErr: true},
+		{name: "malformed", config: "port: [9090\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args server.Args
+			flags := newTestFlags(&args)
+			if err := flags.Parse(tt.cmdline); err != nil {
+				t.Fatal(err)
+			}
+			err := loadConfigFile(flags, writeConfig(t, tt.config))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfigFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(args, tt.want) {
+				t.Errorf("args = %+v, want %+v", args, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileMissing(t *testing.T) {
+	var args server.Args
+	if err := loadConfigFile(newTestFlags(&args), filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("loadConfigFile() error = nil, want the missing file")
+	}
+}
+
+func argsWith(filePaths []string, syncDebounce time.Duration) controller.Args {
+	return controller.Args{FilePaths: filePaths, SyncDebounce: syncDebounce}
+}
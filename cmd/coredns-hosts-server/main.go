@@ -6,14 +6,22 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/devincd/coredns-hosts-api/pkg/common"
 	"github.com/devincd/coredns-hosts-api/pkg/server"
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+	"github.com/devincd/coredns-hosts-api/pkg/version"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"k8s.io/klog/v2"
 )
 
-var serverArgs server.Args
+var (
+	serverArgs server.Args
+	// configFile is the file holding the flags, see loadConfigFile
+	configFile string
+)
 
 func main() {
 	cmd := newCommand()
@@ -25,11 +33,15 @@ func main() {
 
 func newCommand() *cobra.Command {
 	command := &cobra.Command{
-		Use:   "coredns-hosts-server",
-		Short: "coredns web apis service for hosts",
-		Args:  cobra.ExactArgs(0),
+		Use:     "coredns-hosts-server",
+		Short:   "coredns web apis service for hosts",
+		Args:    cobra.ExactArgs(0),
+		Version: version.Get().String(),
 		PreRunE: func(cmd *cobra.Command, args []string) error {
-			return nil
+			if configFile == "" {
+				return nil
+			}
+			return loadConfigFile(cmd.Flags(), configFile)
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			printFlags(cmd)
@@ -39,15 +51,16 @@ func newCommand() *cobra.Command {
 			if err != nil {
 				return fmt.Errorf("failed to create server: %v", err)
 			}
+			go WaitSignal(stopCh)
 			if err := s.Run(stopCh); err != nil {
-				return fmt.Errorf("failed to start server: %v", err)
+				return fmt.Errorf("failed to run server: %v", err)
 			}
-			WaitSignal(stopCh)
 			return nil
 		},
 	}
 
 	addFlags(command)
+	command.AddCommand(version.NewCommand())
 	return command
 }
 
@@ -55,12 +68,70 @@ func addFlags(c *cobra.Command) {
 	klog.InitFlags(flag.CommandLine)
 
 	c.PersistentFlags().AddGoFlagSet(flag.CommandLine)
+	c.PersistentFlags().StringVar(&configFile, "config", "", "the YAML or JSON file holding the flags by name, the flags on the command line win over it")
 	c.PersistentFlags().StringVar(&serverArgs.Kubeconfig, "kubeconfig", "", "absolute path to the kubeconfig file")
 	c.PersistentFlags().Int32Var(&serverArgs.Port, "port", 9080, "the web service port")
+	c.PersistentFlags().StringVar(&serverArgs.MetricsAddr, "metrics-addr", "", "the address (e.g. :9154) the metrics are served on by a listener of their own, empty means they are served on --port with the api")
+	c.PersistentFlags().StringVar(&serverArgs.MetricsPath, "metrics-path", server.DefaultMetricsPath, "the path of the metrics in the Prometheus format")
+	c.PersistentFlags().StringVar(&serverArgs.ControllerArgs.ConfigmapName, "record-configmap-name", controller.DefaultConfigmapName, "the configmap holding the records in every record namespace, the shards are named after it")
+	c.PersistentFlags().StringVar(&serverArgs.ControllerArgs.ConfigmapNamespace, "record-configmap-namespace", controller.DefaultConfigmapNamespace, "the namespace of the configmap holding the global records, the status configmap and the Lease of the leader election")
+	c.PersistentFlags().StringSliceVar(&serverArgs.ControllerArgs.FilePaths, "file-path", []string{common.CoreDNSHostsPath}, "the hosts files to write, can be repeated to keep several CoreDNS instances in sync")
+	c.PersistentFlags().StringSliceVar(&serverArgs.ControllerArgs.RecordNamespaces, "record-namespaces", nil, "the namespaces permitted to hold records via the namespace scoped routes, merged into the hosts file in order")
+	c.PersistentFlags().DurationVar(&serverArgs.ControllerArgs.FullResyncPeriod, "full-resync-period", 10*time.Minute, "the interval of re-rendering the hosts file from the configmap regardless of events, 0 means disabled")
+	c.PersistentFlags().DurationVar(&serverArgs.ControllerArgs.WatchFailureThreshold, "watch-failure-threshold", 5*time.Minute, "how long the configmap watch may keep failing before the status turns unhealthy, 0 means never")
+	c.PersistentFlags().IntVar(&serverArgs.ControllerArgs.MaxHostsLines, "max-hosts-lines", 0, "the max number of lines of the hosts file, the last good file is kept if exceeded, 0 means unlimited")
+	c.PersistentFlags().IntVar(&serverArgs.ControllerArgs.MaxHostsBytes, "max-hosts-bytes", 0, "the max size in bytes of the hosts file, the last good file is kept if exceeded, 0 means unlimited")
+	c.PersistentFlags().StringVar(&serverArgs.ControllerArgs.LineEnding, "line-ending", controller.LineEndingLF, "the line ending of the hosts file, lf or crlf")
+	c.PersistentFlags().BoolVar(&serverArgs.ControllerArgs.ReloadCoreDNS, "reload-coredns", false, "send SIGUSR1 to the coredns process once the hosts file changes, which requires shareProcessNamespace in the pod")
+	c.PersistentFlags().DurationVar(&serverArgs.ControllerArgs.SyncDebounce, "sync-debounce", 200*time.Millisecond, "the delay of writing the hosts file after a change, the changes within it are written once, 0 means disabled")
+	c.PersistentFlags().StringVar(&serverArgs.ControllerArgs.IPOrder, "ip-order", controller.IPOrderSorted, "the order of the ips of a domain in the hosts file, sorted or weighted which shuffles them by their weights")
+	c.PersistentFlags().DurationVar(&serverArgs.ControllerArgs.IPRotationPeriod, "ip-rotation-period", time.Minute, "how often the weighted order of --ip-order=weighted changes, 0 means never")
+	c.PersistentFlags().IntVar(&serverArgs.ControllerArgs.MaxIPsPerDomain, "max-ips-per-domain", 0, "the max number of the ips of a domain rendered into the hosts file, the ones of the highest weights are rendered while all of them are stored, 0 means unlimited")
+	c.PersistentFlags().BoolVar(&serverArgs.NoCreateConfigmap, "no-create-configmap", false, "wait for the configmap coredns-hosts-api to exist rather than creating it")
+	c.PersistentFlags().IntVar(&serverArgs.ConfigmapShardBytes, "configmap-shard-bytes", controller.DefaultShardBytes, "the size of the records in a configmap beyond which they spill into the next shard coredns-hosts-api-<n>")
+	c.PersistentFlags().BoolVar(&serverArgs.ControllerArgs.CompressRecords, "compress-records", false, "store the records of every shard gzip-compressed in the binaryData of the configmap, the shards are migrated to the encoding of the flag on their next write")
+	c.PersistentFlags().BoolVar(&serverArgs.ControllerArgs.ReverseFile, "reverse-file", false, "also write <file-path>-reverse of the records without noReverse, from which CoreDNS serves the PTR records while the hosts file has no_reverse")
+	c.PersistentFlags().StringVar(&serverArgs.DefaultIP, "default-ip", "", "the ip assigned to the record posted without one, empty means the ip is required")
+	c.PersistentFlags().StringVar(&serverArgs.VerifyResolver, "verify-resolver", "", "the DNS server address (e.g. 127.0.0.1:53) queried after a write until the record resolves, empty means disabled")
+	c.PersistentFlags().DurationVar(&serverArgs.VerifyTimeout, "verify-timeout", 10*time.Second, "the timeout of the verification against --verify-resolver")
+	c.PersistentFlags().StringSliceVar(&serverArgs.AllowedDomains, "allowed-domains", nil, "the domains the api may manage, a pattern starting with . (e.g. .svc.cluster.local) matches the subdomains, empty means all")
+	c.PersistentFlags().StringSliceVar(&serverArgs.DeniedDomains, "denied-domains", nil, "the domains the api may not manage, answered with 403, which win over --allowed-domains")
+	c.PersistentFlags().StringVar(&serverArgs.ChangeWebhookURL, "change-webhook-url", "", "the url every change of the records is posted to as JSON, empty means disabled")
+	c.PersistentFlags().DurationVar(&serverArgs.ChangeWebhookTimeout, "change-webhook-timeout", 5*time.Second, "the timeout of a post to --change-webhook-url")
+	c.PersistentFlags().IntVar(&serverArgs.ChangeWebhookRetries, "change-webhook-retries", 3, "how many times a failed post to --change-webhook-url is retried with a backoff")
+	c.PersistentFlags().IntVar(&serverArgs.HistorySize, "history-size", 10, "the max number of changes kept in memory per domain for the history endpoint, 0 means disabled")
+	c.PersistentFlags().IntVar(&serverArgs.HistoryMaxDomains, "history-max-domains", 10000, "the max number of domains whose changes are kept in memory, the domain changed least recently is forgotten beyond it, 0 means unlimited")
+	c.PersistentFlags().StringVar(&serverArgs.AuditLogPath, "audit-log-path", "", "the file every change of the records is appended to as a JSON line, empty means the klog output only")
+	c.PersistentFlags().DurationVar(&serverArgs.StatusUpdatePeriod, "status-update-period", time.Minute, "the interval of updating the status configmap coredns-hosts-api-status, 0 means disabled")
+	c.PersistentFlags().DurationVar(&serverArgs.ExpiryGCPeriod, "expiry-gc-period", time.Minute, "the interval of deleting the records expired by their ttlSeconds, 0 means they are only hidden but never deleted")
+	c.PersistentFlags().BoolVar(&serverArgs.EnableLeaderElection, "enable-leader-election", false, "only the replica holding the Lease coredns-hosts-api-leader updates the status configmap, deletes the expired records and annotates the hosts checksum, which requires the RBAC of leases")
+	c.PersistentFlags().BoolVar(&serverArgs.RestartCoreDNSOnChange, "restart-coredns-on-change", false, "annotate the CoreDNS Deployment with the checksum of the hosts file, which restarts CoreDNS once the content changes and requires the RBAC of deployments")
+	c.PersistentFlags().StringVar(&serverArgs.CoreDNSDeployment, "coredns-deployment", "coredns", "the CoreDNS Deployment annotated by --restart-coredns-on-change")
+	c.PersistentFlags().StringVar(&serverArgs.CoreDNSNamespace, "coredns-namespace", "kube-system", "the namespace of the CoreDNS Deployment annotated by --restart-coredns-on-change")
+	c.PersistentFlags().StringSliceVar(&serverArgs.CORSAllowedOrigins, "cors-allowed-origins", nil, "the origins of the browser pages allowed to call the api, e.g. https://dashboard.example.com, * allows every origin, empty means CORS is disabled")
+	c.PersistentFlags().StringSliceVar(&serverArgs.CORSAllowedMethods, "cors-allowed-methods", []string{"GET", "POST", "PUT", "DELETE"}, "the methods the allowed origins may use")
+	c.PersistentFlags().StringSliceVar(&serverArgs.CORSAllowedHeaders, "cors-allowed-headers", []string{"Authorization", "Content-Type", "If-Match"}, "the request headers the allowed origins may send")
+	c.PersistentFlags().StringVar(&serverArgs.TLSCertFile, "tls-cert-file", "", "the certificate file to serve HTTPS, plaintext is served if it and --tls-key-file are empty")
+	c.PersistentFlags().StringVar(&serverArgs.TLSKeyFile, "tls-key-file", "", "the private key file matching --tls-cert-file")
+	c.PersistentFlags().DurationVar(&serverArgs.ShutdownTimeout, "shutdown-timeout", 20*time.Second, "how long the in-flight requests are drained on termination before the server exits")
+	c.PersistentFlags().StringVar(&serverArgs.AuthToken, "auth-token", "", "the bearer token required by the api, empty means the api is open")
+	c.PersistentFlags().StringVar(&serverArgs.AuthTokenFile, "auth-token-file", "", "the file holding the bearer token required by the api, e.g. a key of a mounted Secret")
+	c.PersistentFlags().Float64Var(&serverArgs.WriteRateLimit, "write-rate-limit", 0, "the POST, PUT and DELETE requests per second allowed to a client, identified by its token or else by its ip, 0 means unlimited")
+	c.PersistentFlags().IntVar(&serverArgs.WriteRateBurst, "write-rate-burst", 0, "the burst of --write-rate-limit, 0 means the same as the limit")
+	c.PersistentFlags().Float64Var(&serverArgs.ReadRateLimit, "read-rate-limit", 0, "the GET requests per second allowed to a client, 0 means unlimited")
+	c.PersistentFlags().IntVar(&serverArgs.ReadRateBurst, "read-rate-burst", 0, "the burst of --read-rate-limit, 0 means the same as the limit")
+	c.PersistentFlags().StringVar(&serverArgs.AuthzURL, "authz-url", "", "the external authorization service every api request is posted to, empty means disabled")
+	c.PersistentFlags().DurationVar(&serverArgs.AuthzTimeout, "authz-timeout", 3*time.Second, "the timeout of a call of the authorization service, the request is denied on timeout")
+	c.PersistentFlags().DurationVar(&serverArgs.AuthzCacheTTL, "authz-cache-ttl", 30*time.Second, "how long a decision of the authorization service is cached, 0 means disabled")
 }
 
 func printFlags(c *cobra.Command) {
 	c.PersistentFlags().VisitAll(func(flag *pflag.Flag) {
+		// The token is a secret and never logged
+		if flag.Name == "auth-token" && flag.Value.String() != "" {
+			klog.Infof("FLAG: --%s=%q", flag.Name, "<redacted>")
+			return
+		}
 		klog.Infof("FLAG: --%s=%q", flag.Name, flag.Value)
 	})
 }
@@ -0,0 +1,13 @@
+package installer
+
+import (
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+)
+
+// Compact rewrites the global records in the configmap of the server into the canonical form,
+// the same as the maintenance endpoint of coredns-hosts-server.
+func (s *Server) Compact() (*controller.CompactResult, error) {
+	args := s.args.ServerArgs.ControllerArgs
+	store := controller.NewConfigmapStore(s.clientset, nil, args, false, 0)
+	return controller.Compact(store, args.Namespace())
+}
@@ -0,0 +1,176 @@
+package installer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coredns/caddy/caddyfile"
+)
+
+// defaultIndent is the indent of a directive when the server block has none to copy
+const defaultIndent = "    "
+
+// corefileDirective is a directive found in a server block or a snippet of the Corefile,
+// which spans the lines [start, end].
+type corefileDirective struct {
+	name  string
+	start int
+	end   int
+}
+
+// corefileBlock is a server block or a snippet at the top level of the Corefile, which spans
+// the lines [start, end].
+type corefileBlock struct {
+	keys       []string
+	snippet    bool
+	start      int
+	end        int
+	directives []corefileDirective
+}
+
+// scanCorefile finds the top-level blocks of the Corefile and their directives by tracking the
+// braces line by line, so that the Corefile can be edited without touching anything else.
+func scanCorefile(lines []string) ([]corefileBlock, error) {
+	var blocks []corefileBlock
+	var current *corefileBlock
+	var directive *corefileDirective
+	depth := 0
+	for i, line := range lines {
+		tokens := strings.Fields(stripComment(line))
+		if len(tokens) == 0 {
+			continue
+		}
+		startDepth := depth
+		if depth == 0 {
+			current = &corefileBlock{snippet: strings.HasPrefix(tokens[0], "("), start: i}
+			for _, token := range tokens {
+				if token != "{" {
+					current.keys = append(current.keys, token)
+				}
+			}
+		} else if depth == 1 && directive == nil && tokens[0] != "}" {
+			directive = &corefileDirective{name: tokens[0], start: i}
+		}
+		for _, token := range tokens {
+			switch {
+			case token == "{" || strings.HasSuffix(token, "{"):
+				depth++
+			case token == "}" || strings.HasPrefix(token, "}"):
+				depth--
+			}
+		}
+		if depth < 0 {
+			return nil, fmt.Errorf("unexpected '}' on the line %d of the Corefile", i+1)
+		}
+		if directive != nil && depth == 1 {
+			directive.end = i
+			current.directives = append(current.directives, *directive)
+			directive = nil
+		}
+		// A top-level line without a block, e.g. `import`, belongs to no block
+		if startDepth == 0 && depth == 0 {
+			current = nil
+			continue
+		}
+		if depth == 0 && current != nil {
+			current.end = i
+			blocks = append(blocks, *current)
+			current = nil
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("the Corefile has %d unclosed '{'", depth)
+	}
+	return blocks, nil
+}
+
+// stripComment drops the comment of a line of the Corefile
+func stripComment(line string) string {
+	if i := strings.Index(line, "#"); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+// leadingIndent returns the whitespace the line starts with
+func leadingIndent(line string) string {
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// parseDirective parses the lines of a directive into the structure of constructLine
+func parseDirective(lines []string) []interface{} {
+	disp := caddyfile.NewDispenser(filename, strings.NewReader(strings.Join(lines, "\n")))
+	if !disp.Next() {
+		return nil
+	}
+	return constructLine(&disp)
+}
+
+// formatDirective renders the structure of constructLine back into the lines of the Corefile
+func formatDirective(item []interface{}, indent, unit string) []string {
+	var tokens []string
+	var lines []string
+	for _, v := range item {
+		switch val := v.(type) {
+		case string:
+			tokens = append(tokens, val)
+		case [][]interface{}:
+			lines = append(lines, indent+strings.Join(tokens, " ")+" {")
+			for _, inner := range val {
+				lines = append(lines, formatDirective(inner, indent+unit, unit)...)
+			}
+			tokens = []string{"}"}
+		}
+	}
+	return append(lines, indent+strings.Join(tokens, " "))
+}
+
+// importedSnippets returns the snippets imported by the directives of the block
+func importedSnippets(lines []string, block corefileBlock) []string {
+	var snippets []string
+	for _, directive := range block.directives {
+		if directive.name != "import" {
+			continue
+		}
+		for _, token := range strings.Fields(stripComment(lines[directive.start]))[1:] {
+			snippets = append(snippets, token)
+		}
+	}
+	return snippets
+}
+
+// snippetsWithHosts returns the names of the snippets having a hosts directive
+func snippetsWithHosts(blocks []corefileBlock) []string {
+	var names []string
+	for _, block := range blocks {
+		if !block.snippet || len(block.keys) == 0 {
+			continue
+		}
+		for _, directive := range block.directives {
+			if directive.name == "hosts" {
+				names = append(names, strings.Trim(block.keys[0], "()"))
+				break
+			}
+		}
+	}
+	return names
+}
+
+// withoutFileImports blanks the lines importing files rather than snippets, which can not be
+// resolved outside of the CoreDNS pod, so that the rest of the Corefile can still be parsed.
+func withoutFileImports(lines []string, blocks []corefileBlock) []string {
+	var snippets []string
+	for _, block := range blocks {
+		if block.snippet && len(block.keys) > 0 {
+			snippets = append(snippets, strings.Trim(block.keys[0], "()"))
+		}
+	}
+	ret := append([]string(nil), lines...)
+	for i, line := range lines {
+		tokens := strings.Fields(stripComment(line))
+		if len(tokens) == 2 && tokens[0] == "import" && !ExistStringSlice(tokens[1], snippets) {
+			ret[i] = ""
+		}
+	}
+	return ret
+}
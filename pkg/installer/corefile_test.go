@@ -0,0 +1,371 @@
+package installer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy/caddyfile"
+)
+
+// hostsDirectiveOf returns the lines of the first hosts directive of the Corefile
+func hostsDirectiveOf(t *testing.T, corefile []byte) []string {
+	t.Helper()
+	lines := strings.Split(string(corefile), "\n")
+	blocks, err := scanCorefile(lines)
+	if err != nil {
+		t.Fatalf("scanCorefile: %v", err)
+	}
+	for _, block := range blocks {
+		for _, directive := range block.directives {
+			if directive.name == "hosts" {
+				return lines[directive.start : directive.end+1]
+			}
+		}
+	}
+	t.Fatalf("no hosts directive in %q", corefile)
+	return nil
+}
+
+func TestBuildNewCoreFileHostsOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		corefile string
+		opts     HostsOptions
+		want     []string
+	}{
+		{
+			name:     "bare",
+			corefile: ".:53 {\n    forward . /etc/resolv.conf\n}\n",
+			opts:     HostsOptions{Path: "/etc/coredns/hosts/hosts"},
+			want:     []string{"    hosts /etc/coredns/hosts/hosts"},
+		},
+		{
+			name:     "every option",
+			corefile: ".:53 {\n    forward . /etc/resolv.conf\n}\n",
+			opts:     HostsOptions{Path: "/etc/coredns/hosts/hosts", Fallthrough: true, TTL: 60, NoReverse: true},
+			want: []string{
+				"    hosts /etc/coredns/hosts/hosts {",
+				"        ttl 60",
+				"        no_reverse",
+				"        fallthrough",
+				"    }",
+			},
+		},
+		{
+			name:     "no reverse",
+			corefile: ".:53 {\n    forward . /etc/resolv.conf\n}\n",
+			opts:     HostsOptions{Path: "/etc/coredns/hosts/hosts", NoReverse: true},
+			want: []string{
+				"    hosts /etc/coredns/hosts/hosts {",
+				"        no_reverse",
+				"    }",
+			},
+		},
+		{
+			name:     "the present options are kept",
+			corefile: ".:53 {\n    hosts /etc/coredns/hosts/hosts {\n        ttl 10\n        reload 5s\n    }\n    forward . /etc/resolv.conf\n}\n",
+			opts:     HostsOptions{Path: "/etc/coredns/hosts/hosts", Fallthrough: true, TTL: 60},
+			want: []string{
+				"    hosts /etc/coredns/hosts/hosts {",
+				"        ttl 10",
+				"        reload 5s",
+				"        fallthrough",
+				"    }",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			corefile, needUpdate, err := BuildNewCoreFile([]byte(tt.corefile), tt.opts)
+			if err != nil {
+				t.Fatalf("BuildNewCoreFile: %v", err)
+			}
+			if !needUpdate {
+				t.Fatal("needUpdate = false, want true")
+			}
+			if got := hostsDirectiveOf(t, corefile); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("the hosts directive = %q, want %q", got, tt.want)
+			}
+			// The Corefile survives the JSON form CoreDNS tooling converts it to and from
+			encoded, err := caddyfile.ToJSON(corefile)
+			if err != nil {
+				t.Fatalf("ToJSON: %v", err)
+			}
+			decoded, err := caddyfile.FromJSON(encoded)
+			if err != nil {
+				t.Fatalf("FromJSON: %v", err)
+			}
+			reencoded, err := caddyfile.ToJSON(decoded)
+			if err != nil {
+				t.Fatalf("ToJSON: %v", err)
+			}
+			if !bytes.Equal(encoded, reencoded) {
+				t.Errorf("the round trip = %s, want %s", reencoded, encoded)
+			}
+			// Building again changes nothing
+			if again, needUpdate, err := BuildNewCoreFile(corefile, tt.opts); err != nil || needUpdate || !bytes.Equal(again, corefile) {
+				t.Errorf("BuildNewCoreFile again = %q, %v, %v, want it unchanged", again, needUpdate, err)
+			}
+		})
+	}
+}
+
+// importsCorefile is a multi-zone Corefile using imports and snippets
+const importsCorefile = `# The common plugins of every zone
+(common) {
+    errors
+    log . {
+        class denial error
+    }
+}
+
+import custom/*.conf
+
+.:53 {
+    import common
+    health {
+       lameduck 5s
+    }
+    kubernetes cluster.local in-addr.arpa ip6.arpa {
+       pods insecure
+       fallthrough in-addr.arpa ip6.arpa
+    }
+    forward . /etc/resolv.conf
+    cache 30
+}
+
+example.com:53 {
+    import common
+    import example.conf
+    file /etc/coredns/example.db
+}
+`
+
+func TestBuildNewCoreFileZoneTTLs(t *testing.T) {
+	corefile := `.:53 {
+    forward . /etc/resolv.conf
+}
+
+example.org:53 {
+    hosts /etc/coredns-dir/hosts {
+        fallthrough
+    }
+    forward . 8.8.8.8
+}
+
+dns://corp.local.:5353 {
+    cache 30
+}
+`
+	args := NewEmptyArgs()
+	args.HostsTTL = 60
+	args.HostsZoneTTLs = map[string]int{"example.org": 10, "corp.local": 300}
+	want := `.:53 {
+    forward . /etc/resolv.conf
+    hosts /etc/coredns-dir/hosts {
+        ttl 60
+    }
+}
+
+example.org:53 {
+    hosts /etc/coredns-dir/hosts-example.org {
+        fallthrough
+        ttl 10
+    }
+    forward . 8.8.8.8
+}
+
+dns://corp.local.:5353 {
+    cache 30
+    hosts /etc/coredns-dir/hosts-corp.local {
+        ttl 300
+    }
+}
+`
+	built, needUpdate, err := BuildNewCoreFile([]byte(corefile), args.HostsOptions())
+	if err != nil || !needUpdate {
+		t.Fatalf("BuildNewCoreFile = %v, %v, want the Corefile updated", needUpdate, err)
+	}
+	if string(built) != want {
+		t.Errorf("the Corefile = %s\nwant %s", built, want)
+	}
+	if err := ValidateCoreFile(built); err != nil {
+		t.Errorf("ValidateCoreFile: %v", err)
+	}
+	wantPaths := []string{"/etc/coredns-dir/hosts", "/etc/coredns-dir/hosts-corp.local", "/etc/coredns-dir/hosts-example.org"}
+	if got := args.HostsPaths(); strings.Join(got, " ") != strings.Join(wantPaths, " ") {
+		t.Errorf("HostsPaths = %v, want %v", got, wantPaths)
+	}
+}
+
+func TestValidateCoreFile(t *testing.T) {
+	built, _, err := BuildNewCoreFile([]byte(importsCorefile), HostsOptions{Path: "/etc/coredns/hosts/hosts"})
+	if err != nil {
+		t.Fatalf("BuildNewCoreFile: %v", err)
+	}
+	tests := []struct {
+		name     string
+		corefile string
+		wantErr  bool
+	}{
+		{name: "imports and snippets", corefile: importsCorefile},
+		{name: "built from imports and snippets", corefile: string(built)},
+		{name: "unclosed block", corefile: ".:53 {\n    forward . /etc/resolv.conf\n", wantErr: true},
+		{name: "unexpected brace", corefile: ".:53 {\n    forward . /etc/resolv.conf\n}\n}\n", wantErr: true},
+		{name: "no server block", corefile: "# nothing\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateCoreFile([]byte(tt.corefile)); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateCoreFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildNewCoreFileKeepsImportsAndSnippets(t *testing.T) {
+	corefile, needUpdate, err := BuildNewCoreFile([]byte(importsCorefile), HostsOptions{Path: "/etc/coredns/hosts/hosts"})
+	if err != nil {
+		t.Fatalf("BuildNewCoreFile: %v", err)
+	}
+	if !needUpdate {
+		t.Fatal("needUpdate = false, want true")
+	}
+	// Dropping the added hosts lines gives back the original Corefile verbatim
+	var kept []string
+	added := 0
+	for _, line := range strings.Split(string(corefile), "\n") {
+		if line == "    hosts /etc/coredns/hosts/hosts" {
+			added++
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if added != 2 {
+		t.Errorf("added %d hosts directives in %q, want one per server block", added, corefile)
+	}
+	if got := strings.Join(kept, "\n"); got != importsCorefile {
+		t.Errorf("the rest of the Corefile = %q, want %q", got, importsCorefile)
+	}
+}
+
+func TestBuildNewCoreFileHostsInASnippet(t *testing.T) {
+	corefile := "(common) {\n    hosts /etc/coredns/hosts/hosts\n}\n\n.:53 {\n    import common\n    forward . /etc/resolv.conf\n}\n"
+	got, needUpdate, err := BuildNewCoreFile([]byte(corefile), HostsOptions{Path: "/etc/coredns/hosts/hosts"})
+	if err != nil {
+		t.Fatalf("BuildNewCoreFile: %v", err)
+	}
+	if needUpdate || string(got) != corefile {
+		t.Errorf("BuildNewCoreFile = %q, %v, want the Corefile unchanged", got, needUpdate)
+	}
+}
+
+func TestScanCorefileDirectives(t *testing.T) {
+	lines := strings.Split(testCorefile, "\n")
+	blocks, err := scanCorefile(lines)
+	if err != nil {
+		t.Fatalf("scanCorefile: %v", err)
+	}
+	if len(blocks) != 1 {
+		t.Fatalf("got %d blocks, want 1", len(blocks))
+	}
+	var names []string
+	for _, directive := range blocks[0].directives {
+		if directive.name == "" {
+			t.Errorf("the lines %d-%d are an empty directive", directive.start+1, directive.end+1)
+		}
+		names = append(names, directive.name)
+	}
+	want := []string{"errors", "health", "ready", "kubernetes", "prometheus", "forward", "cache", "loop", "reload", "loadbalance"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("the directives = %v, want %v", names, want)
+	}
+}
+
+func TestBuildNewCoreFileRecordNoReverse(t *testing.T) {
+	corefile := `.:53 {
+    errors
+    health {
+       lameduck 5s
+    }
+    ready
+    kubernetes cluster.local in-addr.arpa ip6.arpa {
+       pods insecure
+       fallthrough in-addr.arpa ip6.arpa
+    }
+    forward . /etc/resolv.conf
+    cache 30
+}
+
+10.in-addr.arpa:53 in-addr.arpa:53 {
+    forward . 10.0.0.53
+}
+`
+	args := NewEmptyArgs()
+	args.HostsFallthrough = true
+	args.HostsRecordNoReverse = true
+	want := `.:53 {
+    errors
+    health {
+       lameduck 5s
+    }
+    ready
+    kubernetes cluster.local in-addr.arpa ip6.arpa {
+       pods insecure
+       fallthrough in-addr.arpa ip6.arpa
+    }
+    forward . /etc/resolv.conf
+    cache 30
+    hosts /etc/coredns-dir/hosts {
+        no_reverse
+        fallthrough
+    }
+}
+
+ip6.arpa:53 { # coredns-hosts-api/managed-by: coredns-hosts-installer
+    hosts /etc/coredns-dir/hosts-reverse {
+        fallthrough
+    }
+    errors
+    kubernetes cluster.local in-addr.arpa ip6.arpa {
+       pods insecure
+       fallthrough in-addr.arpa ip6.arpa
+    }
+    forward . /etc/resolv.conf
+    cache 30
+}
+
+10.in-addr.arpa:53 in-addr.arpa:53 {
+    forward . 10.0.0.53
+    hosts /etc/coredns-dir/hosts-reverse {
+        fallthrough
+    }
+}
+`
+	built, needUpdate, err := BuildNewCoreFile([]byte(corefile), args.HostsOptions())
+	if err != nil || !needUpdate {
+		t.Fatalf("BuildNewCoreFile = %v, %v, want the Corefile updated", needUpdate, err)
+	}
+	if string(built) != want {
+		t.Errorf("the Corefile = %s\nwant %s", built, want)
+	}
+	if err := ValidateCoreFile(built); err != nil {
+		t.Errorf("ValidateCoreFile: %v", err)
+	}
+	if _, needUpdate, err := BuildNewCoreFile(built, args.HostsOptions()); err != nil || needUpdate {
+		t.Errorf("BuildNewCoreFile again = %v, %v, want the Corefile unchanged", needUpdate, err)
+	}
+
+	// The uninstall removes the added block and the hosts directives
+	removed := built
+	for _, path := range []string{args.HostsPath(), args.HostsReversePath()} {
+		removed, _, err = RemoveHostsFromCoreFile(removed, path)
+		if err != nil {
+			t.Fatalf("RemoveHostsFromCoreFile: %v", err)
+		}
+	}
+	if string(removed) != corefile {
+		t.Errorf("the Corefile after the removal = %s\nwant %s", removed, corefile)
+	}
+}
@@ -0,0 +1,103 @@
+package installer
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// coreDNSNames are the well-known names of the CoreDNS Deployment and Service, which may differ
+// from each other, e.g. kubeadm names the Deployment coredns but the Service kube-dns.
+var coreDNSNames = []string{"coredns", "kube-dns"}
+
+// coreDNSLabelSelector selects the CoreDNS Deployment and Service of the most distributions
+const coreDNSLabelSelector = "k8s-app=kube-dns"
+
+// candidateNames returns the name given by --coredns-name followed by the other well-known names
+func candidateNames(name string) []string {
+	names := []string{name}
+	for _, n := range coreDNSNames {
+		if !ExistStringSlice(n, names) {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// discoverName finds a resource of CoreDNS by trying the candidate names in order, and then by
+// listing the resources labeled as CoreDNS, which must be a single one. The way it was found is
+// returned for logging.
+func discoverName(candidates []string, get func(name string) error, list func() ([]string, error)) (string, string, error) {
+	for _, name := range candidates {
+		err := get(name)
+		if err == nil {
+			return name, "name", nil
+		}
+		if !apierrors.IsNotFound(err) {
+			return "", "", err
+		}
+	}
+	names, err := list()
+	if err != nil {
+		return "", "", err
+	}
+	switch len(names) {
+	case 0:
+		return "", "", fmt.Errorf("none of %v exists, and nothing is labeled %s", candidates, coreDNSLabelSelector)
+	case 1:
+		return names[0], "label " + coreDNSLabelSelector, nil
+	default:
+		return "", "", fmt.Errorf("none of %v exists, and %v are all labeled %s, choose one with --coredns-name", candidates, names, coreDNSLabelSelector)
+	}
+}
+
+// discoverDeployment finds the CoreDNS Deployment independently of the Service
+func (s *Server) discoverDeployment() (string, error) {
+	deployments := s.clientset.AppsV1().Deployments(s.args.CoreDNSNamespace)
+	name, by, err := discoverName(candidateNames(s.args.CoreDNSName), func(name string) error {
+		_, err := deployments.Get(context.TODO(), name, metav1.GetOptions{})
+		return err
+	}, func() ([]string, error) {
+		list, err := deployments.List(context.TODO(), metav1.ListOptions{LabelSelector: coreDNSLabelSelector})
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(list.Items))
+		for _, item := range list.Items {
+			names = append(names, item.Name)
+		}
+		return names, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to find the CoreDNS Deployment: %v", err)
+	}
+	klog.InfoS("Found the CoreDNS Deployment", "deployment", klog.KRef(s.args.CoreDNSNamespace, name), "by", by)
+	return name, nil
+}
+
+// discoverService finds the CoreDNS Service independently of the Deployment
+func (s *Server) discoverService() (string, error) {
+	services := s.clientset.CoreV1().Services(s.args.CoreDNSNamespace)
+	name, by, err := discoverName(candidateNames(s.args.CoreDNSName), func(name string) error {
+		_, err := services.Get(context.TODO(), name, metav1.GetOptions{})
+		return err
+	}, func() ([]string, error) {
+		list, err := services.List(context.TODO(), metav1.ListOptions{LabelSelector: coreDNSLabelSelector})
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(list.Items))
+		for _, item := range list.Items {
+			names = append(names, item.Name)
+		}
+		return names, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to find the CoreDNS Service: %v", err)
+	}
+	klog.InfoS("Found the CoreDNS Service", "service", klog.KRef(s.args.CoreDNSNamespace, name), "by", by)
+	return name, nil
+}
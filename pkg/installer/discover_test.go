@@ -0,0 +1,86 @@
+package installer
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// renamedCoreDNSObjects returns coreDNSObjects with the Deployment and the Service renamed and unlabeled
+// unless labeled, together with the extra Deployments labeled as CoreDNS.
+func renamedCoreDNSObjects(deployment, service string, labeled bool, extra ...string) []runtime.Object {
+	objects := coreDNSObjects()
+	d := objects[0].(*appsv1.Deployment)
+	d.Name = deployment
+	svc := objects[1].(*corev1.Service)
+	svc.Name = service
+	if !labeled {
+		d.Labels, svc.Labels = nil, nil
+	}
+	for _, name := range extra {
+		objects = append(objects, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "kube-system", Labels: map[string]string{"k8s-app": "kube-dns"}}})
+	}
+	return objects
+}
+
+func TestDiscoverCoreDNS(t *testing.T) {
+	tests := []struct {
+		name           string
+		coreDNSName    string
+		objects        []runtime.Object
+		wantDeployment string
+		wantService    string
+		wantErr        bool
+	}{
+		{name: "kubeadm", coreDNSName: "coredns", objects: renamedCoreDNSObjects("coredns", "kube-dns", true), wantDeployment: "coredns", wantService: "kube-dns"},
+		{name: "the other way round", coreDNSName: "coredns", objects: renamedCoreDNSObjects("kube-dns", "coredns", true), wantDeployment: "kube-dns", wantService: "coredns"},
+		{name: "the given name first", coreDNSName: "dns", objects: renamedCoreDNSObjects("dns", "kube-dns", false, "coredns"), wantDeployment: "dns", wantService: "kube-dns"},
+		{name: "by the label", coreDNSName: "coredns", objects: renamedCoreDNSObjects("dns-server", "dns-service", true), wantDeployment: "dns-server", wantService: "dns-service"},
+		{name: "nothing found", coreDNSName: "coredns", objects: renamedCoreDNSObjects("dns-server", "dns-service", false), wantErr: true},
+		{name: "several labeled", coreDNSName: "coredns", objects: renamedCoreDNSObjects("dns-server", "kube-dns", true, "dns-server-2"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := newTestArgs()
+			args.CoreDNSName = tt.coreDNSName
+			s := &Server{args: args, clientset: fake.NewSimpleClientset(tt.objects...)}
+			deployment, err := s.discoverDeployment()
+			if (err != nil) != tt.wantErr || deployment != tt.wantDeployment {
+				t.Errorf("discoverDeployment = %q, %v, want %q", deployment, err, tt.wantDeployment)
+			}
+			if tt.wantErr {
+				return
+			}
+			if service, err := s.discoverService(); err != nil || service != tt.wantService {
+				t.Errorf("discoverService = %q, %v, want %q", service, err, tt.wantService)
+			}
+		})
+	}
+}
+
+func TestRunOnceWithDifferentNames(t *testing.T) {
+	args := newTestArgs()
+	s, clientset := newTestServer(t, args, renamedCoreDNSObjects("kube-dns", "coredns", true)...)
+	if err := s.RunOnce(); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	deployment, err := clientset.AppsV1().Deployments("kube-system").Get(context.TODO(), "kube-dns", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostsServerContainerOf(deployment) == nil {
+		t.Error("the sidecar is not injected into the Deployment kube-dns")
+	}
+	service, err := clientset.CoreV1().Services("kube-system").Get(context.TODO(), "coredns", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ExistPortsByPort(args.ServerArgs.Port, service.Spec.Ports) {
+		t.Errorf("the ports of the Service coredns = %v, want %d", service.Spec.Ports, args.ServerArgs.Port)
+	}
+}
@@ -0,0 +1,84 @@
+package installer
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// updateOptions makes the apiserver validate the update without persisting it under --dry-run
+func (s *Server) updateOptions() metav1.UpdateOptions {
+	if s.args.DryRun {
+		return metav1.UpdateOptions{DryRun: []string{metav1.DryRunAll}}
+	}
+	return metav1.UpdateOptions{}
+}
+
+// patchOptions makes the apiserver validate the patch without persisting it under --dry-run
+func (s *Server) patchOptions() metav1.PatchOptions {
+	if s.args.DryRun {
+		return metav1.PatchOptions{DryRun: []string{metav1.DryRunAll}}
+	}
+	return metav1.PatchOptions{}
+}
+
+// printDryRun prints the changes which would be made to the resource under --dry-run, a change
+// starts with + for an addition and ~ for a modification.
+func (s *Server) printDryRun(kind string, meta metav1.Object, changes []string) {
+	if !s.args.DryRun || len(changes) == 0 {
+		return
+	}
+	name := meta.GetName()
+	if meta.GetNamespace() != "" {
+		name = meta.GetNamespace() + "/" + name
+	}
+	fmt.Fprintf(os.Stdout, "%s %s (dry run):\n", kind, name)
+	for _, change := range changes {
+		fmt.Fprintf(os.Stdout, "  %s\n", change)
+	}
+	if injected := meta.GetAnnotations()[InjectedAnnotation]; injected != "" {
+		fmt.Fprintf(os.Stdout, "  ~ annotation %s: %s\n", InjectedAnnotation, injected)
+	}
+}
+
+// lineDiff returns the lines of after with the ones removed from before prefixed by -, the added
+// ones by + and the unchanged ones by a space, following the longest common subsequence.
+func lineDiff(before, after string) []string {
+	a, b := strings.Split(before, "\n"), strings.Split(after, "\n")
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	diff := make([]string, 0, len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			diff = append(diff, "  "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "- "+a[i])
+			i++
+		default:
+			diff = append(diff, "+ "+b[j])
+			j++
+		}
+	}
+	return diff
+}
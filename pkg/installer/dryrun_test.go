@@ -0,0 +1,152 @@
+package installer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// dryRunAPIServer serves the objects of the tracker over http like the apiserver does under dry-run:
+// the gets are read from the tracker, and the updates and the patches are answered without being
+// persisted. The fake clientset drops the options of the requests, so it can't tell a dry run.
+type dryRunAPIServer struct {
+	tracker k8stesting.ObjectTracker
+	lock    sync.Mutex
+	// writes are the writes received, e.g. an event too, and wetWrites the ones without dryRun=All
+	writes, wetWrites []string
+}
+
+// parsePath parses /api/v1/... and /apis/<group>/<version>/... into the resource, the namespace and
+// the name, which is empty for a list
+func parsePath(path string) (schema.GroupVersionResource, string, string, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	var gvr schema.GroupVersionResource
+	switch {
+	case len(segments) >= 2 && segments[0] == "api":
+		gvr.Version, segments = segments[1], segments[2:]
+	case len(segments) >= 3 && segments[0] == "apis":
+		gvr.Group, gvr.Version, segments = segments[1], segments[2], segments[3:]
+	default:
+		return gvr, "", "", false
+	}
+	var namespace string
+	if len(segments) >= 2 && segments[0] == "namespaces" {
+		namespace, segments = segments[1], segments[2:]
+	}
+	switch len(segments) {
+	case 1:
+		gvr.Resource = segments[0]
+		return gvr, namespace, "", true
+	case 2:
+		gvr.Resource = segments[0]
+		return gvr, namespace, segments[1], true
+	}
+	return gvr, "", "", false
+}
+
+// kindOf returns the kind of the resource, which the tracker needs to list it
+func kindOf(gvr schema.GroupVersionResource) (schema.GroupVersionKind, bool) {
+	for gvk := range scheme.Scheme.AllKnownTypes() {
+		if plural, _ := meta.UnsafeGuessKindToResource(gvk); plural == gvr {
+			return gvk, true
+		}
+	}
+	return schema.GroupVersionKind{}, false
+}
+
+func (a *dryRunAPIServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		io.Copy(io.Discard, req.Body)
+		write := req.Method + " " + req.URL.Path
+		a.lock.Lock()
+		a.writes = append(a.writes, write)
+		if req.URL.Query().Get("dryRun") != metav1.DryRunAll {
+			a.wetWrites = append(a.wetWrites, write)
+		}
+		a.lock.Unlock()
+	}
+	gvr, namespace, name, ok := parsePath(req.URL.Path)
+	if !ok {
+		http.Error(w, "unsupported path "+req.URL.Path, http.StatusNotFound)
+		return
+	}
+	// The write is answered with the current object, since nothing is persisted
+	var obj runtime.Object
+	var err error
+	if name != "" {
+		obj, err = a.tracker.Get(gvr, namespace, name)
+	} else if gvk, ok := kindOf(gvr); ok {
+		obj, err = a.tracker.List(gvr, gvk, namespace)
+	} else {
+		err = fmt.Errorf("unknown resource %s", gvr)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	kinds, _, err := scheme.Scheme.ObjectKinds(obj)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	obj = obj.DeepCopyObject()
+	obj.GetObjectKind().SetGroupVersionKind(kinds[0])
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
+
+func TestRunOnceDryRun(t *testing.T) {
+	objects := coreDNSObjects()
+	clientset := fake.NewSimpleClientset(objects...)
+	apiserver := &dryRunAPIServer{tracker: clientset.Tracker()}
+	ts := httptest.NewServer(apiserver)
+	defer ts.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := newTestArgs()
+	args.DryRun = true
+	s := &Server{args: args, clientset: client}
+	s.initEventRecorder()
+	defer s.eventBroadcaster.Shutdown()
+	if err := s.initCorednsDeployment(args); err != nil {
+		t.Fatalf("initCorednsDeployment: %v", err)
+	}
+	if err := s.initCorednsService(); err != nil {
+		t.Fatalf("initCorednsService: %v", err)
+	}
+	if err := s.RunOnce(); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+
+	// Every change is sent as a dry run, and so is every resource of CoreDNS left as it was
+	if len(apiserver.writes) == 0 {
+		t.Error("no change is sent to the apiserver, want the dry runs")
+	}
+	if len(apiserver.wetWrites) > 0 {
+		t.Errorf("the writes %v are sent without dryRun=All", apiserver.wetWrites)
+	}
+	for i, got := range []runtime.Object{getDeployment(t, clientset), getService(t, clientset), getCoreDNSConfigmap(t, clientset), getClusterRole(t, clientset)} {
+		if !equality.Semantic.DeepEqual(got, objects[i]) {
+			t.Errorf("the object %d = %+v, want it unchanged %+v", i, got, objects[i])
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package installer
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// eventComponent is the source of the events recorded by the installer
+	eventComponent = "coredns-hosts-installer"
+	// eventFlushTimeout bounds how long Close waits for the events still being written
+	eventFlushTimeout = 10 * time.Second
+)
+
+// The reasons of the events recorded on the resources of CoreDNS, which `kubectl describe` shows
+const (
+	EventReasonPolicyRulesAdded       = "PolicyRulesAdded"
+	EventReasonSidecarInjected        = "SidecarInjected"
+	EventReasonSidecarUpgraded        = "SidecarUpgraded"
+	EventReasonServicePortAdded       = "ServicePortAdded"
+	EventReasonHostsDirectiveInjected = "HostsDirectiveInjected"
+	EventReasonInstallFailed          = "InstallFailed"
+)
+
+// initEventRecorder records the events of the installer into the apiserver. The events are written
+// by a watcher of the installer rather than StartRecordingToSink, so that Close can wait for them
+// before the process exits.
+func (s *Server) initEventRecorder() {
+	sink := &typedcorev1.EventSinkImpl{Interface: s.clientset.CoreV1().Events("")}
+	s.eventBroadcaster = record.NewBroadcaster()
+	s.eventBroadcaster.StartEventWatcher(func(event *corev1.Event) {
+		defer s.pendingEvents.Done()
+		if _, err := sink.Create(event); err != nil {
+			klog.ErrorS(err, "Failed to record the event", "reason", event.Reason,
+				"object", klog.KRef(event.InvolvedObject.Namespace, event.InvolvedObject.Name))
+		}
+	})
+	s.recorder = s.eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})
+}
+
+// recordEvent records an event on the object, which must be one of the resources of CoreDNS.
+// Nothing is recorded under --dry-run since nothing is changed.
+func (s *Server) recordEvent(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	if s.args.DryRun {
+		return
+	}
+	s.pendingEvents.Add(1)
+	s.recorder.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+// Close waits for the events recorded so far to be written and stops recording, it must be called
+// before the installer exits.
+func (s *Server) Close() {
+	done := make(chan struct{})
+	go func() {
+		s.pendingEvents.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(eventFlushTimeout):
+		klog.InfoS("Gave up waiting for the events to be written", "timeout", eventFlushTimeout)
+	}
+	s.eventBroadcaster.Shutdown()
+}
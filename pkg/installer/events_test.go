@@ -0,0 +1,82 @@
+package installer
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// waitEvents waits for the events of the fake clientset to be the want ones, which are
+// `<kind>/<name> <type> <reason>` in any order
+func waitEvents(t *testing.T, clientset *fake.Clientset, want []string) {
+	t.Helper()
+	sort.Strings(want)
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		events, err := clientset.CoreV1().Events("kube-system").List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = make([]string, 0, len(events.Items))
+		for _, event := range events.Items {
+			if event.Source.Component != eventComponent {
+				t.Errorf("the source of the event %s = %q, want %q", event.Reason, event.Source.Component, eventComponent)
+			}
+			got = append(got, event.InvolvedObject.Kind+"/"+event.InvolvedObject.Name+" "+event.Type+" "+event.Reason)
+		}
+		sort.Strings(got)
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+	}
+	t.Fatalf("the events = %v, want %v", got, want)
+}
+
+func TestRunOnceRecordsEvents(t *testing.T) {
+	s, clientset := newTestServer(t, newTestArgs(), coreDNSObjects()...)
+	if err := s.RunOnce(); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	waitEvents(t, clientset, []string{
+		"Deployment/coredns Normal " + EventReasonPolicyRulesAdded,
+		"Deployment/coredns Normal " + EventReasonSidecarInjected,
+		"Service/kube-dns Normal " + EventReasonServicePortAdded,
+		"ConfigMap/coredns Normal " + EventReasonHostsDirectiveInjected,
+	})
+	// Nothing changes the second time, and so nothing is recorded
+	if err := s.RunOnce(); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	waitEvents(t, clientset, []string{
+		"Deployment/coredns Normal " + EventReasonPolicyRulesAdded,
+		"Deployment/coredns Normal " + EventReasonSidecarInjected,
+		"Service/kube-dns Normal " + EventReasonServicePortAdded,
+		"ConfigMap/coredns Normal " + EventReasonHostsDirectiveInjected,
+	})
+}
+
+func TestRunOnceRecordsTheFailure(t *testing.T) {
+	s, clientset := newTestServer(t, newTestArgs(), coreDNSObjects()...)
+	// The Corefile can't be updated, so the install fails at the last step
+	clientset.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("the apiserver is down")
+	})
+	if err := s.RunOnce(); err == nil {
+		t.Fatal("RunOnce = nil, want an error")
+	}
+	waitEvents(t, clientset, []string{
+		"Deployment/coredns Normal " + EventReasonPolicyRulesAdded,
+		"Deployment/coredns Normal " + EventReasonSidecarInjected,
+		"Service/kube-dns Normal " + EventReasonServicePortAdded,
+		"Deployment/coredns Warning " + EventReasonInstallFailed,
+	})
+}
@@ -1,6 +1,29 @@
 package installer
 
-import "github.com/devincd/coredns-hosts-api/pkg/server"
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/devincd/coredns-hosts-api/pkg/common"
+	"github.com/devincd/coredns-hosts-api/pkg/server"
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// DefaultServerImageRepository is the public image of coredns-hosts-server
+	DefaultServerImageRepository = "docker.io/devincd/coredns-hosts-server"
+
+	// The default resources of the injected server container, which has no CPU limit
+	// so that it is never throttled while the hosts file is rendered.
+	DefaultServerCPURequest    = "10m"
+	DefaultServerMemoryRequest = "32Mi"
+	DefaultServerMemoryLimit   = "128Mi"
+)
 
 type Args struct {
 	// Kubeconfig  is absolute path to the kubeconfig file
@@ -8,11 +31,152 @@ type Args struct {
 	CoreDNSName               string
 	CoreDNSNamespace          string
 	CoreDNSHostsServerVersion string
-	ServerArgs                *server.Args
+	// HostsVolumeClaim is the name of the PersistentVolumeClaim which keeps the hosts file across
+	// restarts, the EmptyDir is used if it is empty.
+	HostsVolumeClaim string
+	// HostsDir is where the shared volume is mounted in every container, which drives the hosts
+	// directive of the Corefile and the --file-path of the server so that they never drift.
+	HostsDir string
+	// HostsFallthrough, HostsTTL and HostsNoReverse are the options of the injected hosts directive
+	HostsFallthrough bool
+	HostsTTL         int
+	HostsNoReverse   bool
+	// HostsZoneTTLs are the ttls of the server blocks of the zones, e.g. example.org, whose hosts
+	// directive reads a hosts file of its own, see HostsZonePath, written by the server as well.
+	HostsZoneTTLs map[string]int
+	// HostsRecordNoReverse serves the PTR records from the reverse hosts file, see HostsReversePath, which
+	// leaves out the records of noReverse, while the hosts directive of the root zone gets no_reverse.
+	HostsRecordNoReverse bool
+	// ServerImageRepository is the image of the injected server without the tag, which is
+	// CoreDNSHostsServerVersion, e.g. a private registry mirroring the image for air-gapped clusters.
+	ServerImageRepository string
+	// ServerImagePullPolicy is the pull policy of the injected server image
+	ServerImagePullPolicy string
+	// ServerImagePullSecret is added to the imagePullSecrets of the CoreDNS pod if not empty
+	ServerImagePullSecret string
+	// ServerCPURequest, ServerMemoryRequest, ServerCPULimit and ServerMemoryLimit are the resources
+	// of the injected server container, empty means unset.
+	ServerCPURequest    string
+	ServerMemoryRequest string
+	ServerCPULimit      string
+	ServerMemoryLimit   string
+	// ServerLivenessProbe and ServerReadinessProbe add the probes against /healthz and /readyz
+	// of the server to the injected container. The readiness of the sidecar gates the whole
+	// CoreDNS pod, so the readiness probe can be disabled apart.
+	ServerLivenessProbe  bool
+	ServerReadinessProbe bool
+	// Wait makes RunOnce wait for the rollout of CoreDNS after changing the Deployment, and fail if it
+	// doesn't complete within WaitTimeout, e.g. the sidecar never becomes ready.
+	Wait        bool
+	WaitTimeout time.Duration
+	// DryRun makes RunOnce send every change to the apiserver as a dry run, which validates it
+	// without persisting it, and print the changes instead.
+	DryRun bool
+	// Watch keeps the installer running and re-ensures the installation once the CoreDNS
+	// Deployment, Service or ConfigMap drifts, rather than installing once and exiting.
+	Watch bool
+	// WatchResyncPeriod is the interval of re-ensuring the installation in the watch mode regardless of events
+	WatchResyncPeriod time.Duration
+	ServerArgs        *server.Args
+}
+
+// ServerImage is the image of the injected server
+func (a *Args) ServerImage() string {
+	return fmt.Sprintf("%s:%s", a.ServerImageRepository, a.CoreDNSHostsServerVersion)
+}
+
+// HostsPath is the hosts file written by the server and read by CoreDNS
+func (a *Args) HostsPath() string {
+	return filepath.Join(a.HostsDir, "hosts")
 }
 
 func NewEmptyArgs() *Args {
 	return &Args{
-		ServerArgs: &server.Args{},
+		HostsDir:              common.CoreDNSHostsDir,
+		ServerImageRepository: DefaultServerImageRepository,
+		ServerImagePullPolicy: string(corev1.PullAlways),
+		ServerCPURequest:      DefaultServerCPURequest,
+		ServerMemoryRequest:   DefaultServerMemoryRequest,
+		ServerMemoryLimit:     DefaultServerMemoryLimit,
+		ServerLivenessProbe:   true,
+		ServerReadinessProbe:  true,
+		ServerArgs:            &server.Args{},
+	}
+}
+
+// zoneFileEscaper turns a zone into a part of a file name
+var zoneFileEscaper = strings.NewReplacer("/", "_", ":", "_")
+
+// HostsReversePath is the reverse hosts file of HostsPath written by the server, read by the server blocks of the reverse zones
+func (a *Args) HostsReversePath() string {
+	return controller.ReverseFilePath(a.HostsPath())
+}
+
+// HostsZonePath is the hosts file of the server blocks of the zone in HostsZoneTTLs
+func (a *Args) HostsZonePath(zone string) string {
+	return filepath.Join(a.HostsDir, "hosts-"+zoneFileEscaper.Replace(normalizeZone(zone)))
+}
+
+// HostsPaths are the hosts files written by the server, HostsPath first and then the ones of the zones in order
+func (a *Args) HostsPaths() []string {
+	paths := []string{a.HostsPath()}
+	for _, zone := range a.hostsZones() {
+		paths = append(paths, a.HostsZonePath(zone))
+	}
+	return paths
+}
+
+func (a *Args) hostsZones() []string {
+	zones := make([]string, 0, len(a.HostsZoneTTLs))
+	for zone := range a.HostsZoneTTLs {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// HostsOptions is the hosts directive injected into the Corefile
+func (a *Args) HostsOptions() HostsOptions {
+	opts := HostsOptions{
+		Path:        a.HostsPath(),
+		Fallthrough: a.HostsFallthrough,
+		TTL:         a.HostsTTL,
+		NoReverse:   a.HostsNoReverse,
+	}
+	for _, zone := range a.hostsZones() {
+		opts.Zones = append(opts.Zones, HostsZone{Zone: zone, Path: a.HostsZonePath(zone), TTL: a.HostsZoneTTLs[zone]})
+	}
+	if a.HostsRecordNoReverse {
+		opts.ReversePath = a.HostsReversePath()
+	}
+	return opts
+}
+
+// ServerResources is the resources of the injected server container
+func (a *Args) ServerResources() (corev1.ResourceRequirements, error) {
+	var resources corev1.ResourceRequirements
+	for _, item := range []struct {
+		flag  string
+		value string
+		name  corev1.ResourceName
+		list  *corev1.ResourceList
+	}{
+		{"--server-cpu-request", a.ServerCPURequest, corev1.ResourceCPU, &resources.Requests},
+		{"--server-memory-request", a.ServerMemoryRequest, corev1.ResourceMemory, &resources.Requests},
+		{"--server-cpu-limit", a.ServerCPULimit, corev1.ResourceCPU, &resources.Limits},
+		{"--server-memory-limit", a.ServerMemoryLimit, corev1.ResourceMemory, &resources.Limits},
+	} {
+		if item.value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(item.value)
+		if err != nil {
+			return corev1.ResourceRequirements{}, fmt.Errorf("invalid %s %q: %v", item.flag, item.value, err)
+		}
+		if *item.list == nil {
+			*item.list = corev1.ResourceList{}
+		}
+		(*item.list)[item.name] = quantity
 	}
+	return resources, nil
 }
@@ -0,0 +1,129 @@
+package installer
+
+import (
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ManagedByAnnotation marks the resources of CoreDNS touched by the installer
+	ManagedByAnnotation = "coredns-hosts-api/managed-by"
+	ManagedByValue      = "coredns-hosts-installer"
+	// InjectedAnnotation lists the elements the installer added to the resource, e.g. the sidecar
+	// container or a rule, which are exactly the ones Uninstall removes.
+	InjectedAnnotation = "coredns-hosts-api/injected"
+)
+
+// The kinds of the elements in InjectedAnnotation, an element is `<kind>:<name>`
+const (
+	injectedContainer       = "container"
+	injectedVolume          = "volume"
+	injectedImagePullSecret = "imagePullSecret"
+	injectedRule            = "rule"
+	injectedPort            = "port"
+	injectedHosts           = "hosts"
+	// injectedPodSpec names a field of the pod spec set by the installer, e.g. shareProcessNamespace
+	injectedPodSpec = "podSpec"
+)
+
+func injectedElement(kind, name string) string {
+	return kind + ":" + name
+}
+
+// injectedElements returns the elements in InjectedAnnotation, marked is false if the resource has
+// no marker, e.g. it was installed before the markers were introduced.
+func injectedElements(meta metav1.Object) ([]string, bool) {
+	annotations := meta.GetAnnotations()
+	if annotations[ManagedByAnnotation] != ManagedByValue {
+		return nil, false
+	}
+	elements := make([]string, 0)
+	for _, element := range strings.Split(annotations[InjectedAnnotation], ",") {
+		if element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return elements, true
+}
+
+// injectedNames returns the names of the elements of the kind
+func injectedNames(elements []string, kind string) []string {
+	names := make([]string, 0)
+	for _, element := range elements {
+		if name := strings.TrimPrefix(element, kind+":"); name != element {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// markedAnnotations returns the markers of the resource with the elements added, changed is false
+// if they are marked already. The elements are sorted so that the same ones are always stamped the same.
+func markedAnnotations(meta metav1.Object, elements ...string) (map[string]string, bool) {
+	current, _ := injectedElements(meta)
+	merged := append([]string{}, current...)
+	for _, element := range elements {
+		if !ExistStringSlice(element, merged) {
+			merged = append(merged, element)
+		}
+	}
+	sort.Strings(merged)
+	annotations := map[string]string{
+		ManagedByAnnotation: ManagedByValue,
+		InjectedAnnotation:  strings.Join(merged, ","),
+	}
+	old := meta.GetAnnotations()
+	changed := old[ManagedByAnnotation] != annotations[ManagedByAnnotation] || old[InjectedAnnotation] != annotations[InjectedAnnotation]
+	return annotations, changed
+}
+
+// markInjected stamps the markers with the elements added onto the resource and reports whether they changed
+func markInjected(meta metav1.Object, elements ...string) bool {
+	annotations, changed := markedAnnotations(meta, elements...)
+	if !changed {
+		return false
+	}
+	merged := meta.GetAnnotations()
+	if merged == nil {
+		merged = make(map[string]string)
+	}
+	for key, value := range annotations {
+		merged[key] = value
+	}
+	meta.SetAnnotations(merged)
+	return true
+}
+
+// unmarkInjectedElement removes the element from the markers of the resource, e.g. before it is
+// replaced by another one, the markers stay even if no element is left.
+func unmarkInjectedElement(meta metav1.Object, element string) {
+	elements, marked := injectedElements(meta)
+	if !marked {
+		return
+	}
+	kept := make([]string, 0, len(elements))
+	for _, e := range elements {
+		if e != element {
+			kept = append(kept, e)
+		}
+	}
+	annotations := meta.GetAnnotations()
+	annotations[InjectedAnnotation] = strings.Join(kept, ",")
+	meta.SetAnnotations(annotations)
+}
+
+// unmarkInjected removes the markers from the resource and reports whether there were any
+func unmarkInjected(meta metav1.Object) bool {
+	annotations := meta.GetAnnotations()
+	_, managed := annotations[ManagedByAnnotation]
+	_, injected := annotations[InjectedAnnotation]
+	if !managed && !injected {
+		return false
+	}
+	delete(annotations, ManagedByAnnotation)
+	delete(annotations, InjectedAnnotation)
+	meta.SetAnnotations(annotations)
+	return true
+}
@@ -0,0 +1,63 @@
+package installer
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRunOnceMarksTheInjectedElements(t *testing.T) {
+	args := newTestArgs()
+	args.ServerImagePullSecret = "registry-example"
+	s, clientset := newTestServer(t, args, coreDNSObjects()...)
+	// The markers are stamped once, however many times the installer runs
+	for i := 0; i < 2; i++ {
+		if err := s.RunOnce(); err != nil {
+			t.Fatalf("RunOnce: %v", err)
+		}
+	}
+	tests := []struct {
+		name string
+		meta metav1.Object
+		want []string
+	}{
+		{name: "Deployment", meta: getDeployment(t, clientset), want: []string{"container:coredns-hosts-server", "imagePullSecret:registry-example", "volume:shared-data"}},
+		{name: "Service", meta: getService(t, clientset), want: []string{"port:9080"}},
+		{name: "ClusterRole", meta: getClusterRole(t, clientset), want: []string{"rule:configmaps"}},
+		{name: "ConfigMap", meta: getCoreDNSConfigmap(t, clientset), want: []string{"hosts:/etc/coredns-dir/hosts"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.meta.GetAnnotations()[ManagedByAnnotation]; got != ManagedByValue {
+				t.Errorf("the annotation %s = %q, want %q", ManagedByAnnotation, got, ManagedByValue)
+			}
+			if got, _ := injectedElements(tt.meta); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("the injected elements = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarkInjected(t *testing.T) {
+	meta := &metav1.ObjectMeta{Annotations: map[string]string{"other": "kept"}}
+	if !markInjected(meta, "port:9080") {
+		t.Fatal("markInjected = false, want the markers stamped")
+	}
+	if markInjected(meta, "port:9080") {
+		t.Error("markInjected of the same element = true, want unchanged")
+	}
+	if !markInjected(meta, "container:a") {
+		t.Error("markInjected of another element = false, want it added")
+	}
+	if got, want := meta.Annotations[InjectedAnnotation], "container:a,port:9080"; got != want {
+		t.Errorf("the annotation %s = %q, want %q", InjectedAnnotation, got, want)
+	}
+	unmarkInjectedElement(meta, "port:9080")
+	if got, marked := injectedElements(meta); !marked || !reflect.DeepEqual(got, []string{"container:a"}) {
+		t.Errorf("the injected elements = %v, %v, want [container:a]", got, marked)
+	}
+	if !unmarkInjected(meta) || !reflect.DeepEqual(meta.Annotations, map[string]string{"other": "kept"}) {
+		t.Errorf("the annotations = %v, want the markers removed and the others kept", meta.Annotations)
+	}
+}
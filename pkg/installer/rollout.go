@@ -0,0 +1,69 @@
+package installer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// rolloutPollInterval is the interval of checking the rollout of CoreDNS
+const rolloutPollInterval = 2 * time.Second
+
+// DeploymentRolledOut reports whether the rollout of the Deployment has completed, i.e. every replica
+// runs the latest pod template and is available, which is what `kubectl rollout status` checks. The
+// message tells what the rollout is waiting for, and an error means the rollout will never complete.
+func DeploymentRolledOut(deployment *appsv1.Deployment) (bool, string, error) {
+	if deployment.Generation > deployment.Status.ObservedGeneration {
+		return false, "waiting for the rollout to be observed", nil
+	}
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Status == corev1.ConditionFalse && condition.Reason == "ProgressDeadlineExceeded" {
+			return false, "", fmt.Errorf("the rollout of the Deployment %s exceeded its progress deadline: %s", deployment.Name, condition.Message)
+		}
+	}
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	status := deployment.Status
+	switch {
+	case status.UpdatedReplicas < replicas:
+		return false, fmt.Sprintf("%d of %d replicas are updated", status.UpdatedReplicas, replicas), nil
+	case status.Replicas > status.UpdatedReplicas:
+		return false, fmt.Sprintf("%d old replicas are pending termination", status.Replicas-status.UpdatedReplicas), nil
+	case status.AvailableReplicas < status.UpdatedReplicas:
+		return false, fmt.Sprintf("%d of %d updated replicas are available", status.AvailableReplicas, status.UpdatedReplicas), nil
+	}
+	return true, "", nil
+}
+
+// waitForRollout waits until the rollout of the CoreDNS Deployment completes, so that a sidecar
+// which never becomes ready, e.g. crash-looping on a wrong flag, fails the install.
+func (s *Server) waitForRollout(timeout time.Duration) error {
+	namespace, name := s.corednsDeployment.Namespace, s.corednsDeployment.Name
+	var message string
+	err := wait.PollImmediate(rolloutPollInterval, timeout, func() (bool, error) {
+		deployment, err := s.clientset.AppsV1().Deployments(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			klog.ErrorS(err, "Failed to get the Deployment, retrying", "deployment", klog.KRef(namespace, name))
+			return false, nil
+		}
+		var done bool
+		done, message, err = DeploymentRolledOut(deployment)
+		if !done && err == nil {
+			klog.InfoS("Waiting for the rollout", "deployment", klog.KRef(namespace, name), "status", message)
+		}
+		return done, err
+	})
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("the rollout of the Deployment %s/%s did not complete within %s, %s, check the logs of the container %s",
+			namespace, name, timeout, message, coreDNSHostsServerName)
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package installer
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDeploymentRolledOut(t *testing.T) {
+	replicas := int32(2)
+	tests := []struct {
+		name    string
+		status  appsv1.DeploymentStatus
+		want    bool
+		wantErr bool
+	}{
+		{name: "not observed", status: appsv1.DeploymentStatus{ObservedGeneration: 1}, want: false},
+		{name: "not updated", status: appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 1, AvailableReplicas: 2}, want: false},
+		{name: "old replicas pending", status: appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 3, UpdatedReplicas: 2, AvailableReplicas: 2}, want: false},
+		{name: "not available", status: appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 1}, want: false},
+		{name: "rolled out", status: appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 2}, want: true},
+		{
+			name: "progress deadline exceeded",
+			status: appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 1, Conditions: []appsv1.DeploymentCondition{
+				{Type: appsv1.DeploymentProgressing, Status: corev1.ConditionFalse, Reason: "ProgressDeadlineExceeded"},
+			}},
+			want:    false,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "coredns", Generation: 2},
+				Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+				Status:     tt.status,
+			}
+			got, message, err := DeploymentRolledOut(deployment)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("DeploymentRolledOut = %v, %v, want %v with the error %v", got, err, tt.want, tt.wantErr)
+			}
+			if !got && !tt.wantErr && message == "" {
+				t.Error("the message is empty, want what the rollout is waiting for")
+			}
+		})
+	}
+}
+
+func TestRunOnceWaitsForARolloutNeverReady(t *testing.T) {
+	args := newTestArgs()
+	args.Wait = true
+	args.WaitTimeout = 100 * time.Millisecond
+	// Nothing runs the pods of the fake clientset, so the rollout never completes
+	s, clientset := newTestServer(t, args, coreDNSObjects()...)
+	start := time.Now()
+	err := s.RunOnce()
+	if err == nil || !strings.Contains(err.Error(), "did not complete within") {
+		t.Fatalf("RunOnce = %v, want the rollout timed out", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("RunOnce returned after %s, want it bounded by the wait timeout", elapsed)
+	}
+	// The Deployment is changed before the wait, which stops the install before the Service
+	if hostsServerContainerOf(getDeployment(t, clientset)) == nil {
+		t.Error("the sidecar is not injected")
+	}
+	for _, port := range getService(t, clientset).Spec.Ports {
+		if port.Port == args.ServerArgs.Port {
+			t.Errorf("the Service port %d is added, want the install stopped at the wait", port.Port)
+		}
+	}
+}
+
+func TestWaitForRolloutCompleted(t *testing.T) {
+	s, clientset := newTestServer(t, newTestArgs(), coreDNSObjects()...)
+	deployment := getDeployment(t, clientset)
+	deployment.Status = appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+	if _, err := clientset.AppsV1().Deployments("kube-system").UpdateStatus(context.TODO(), deployment, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.waitForRollout(time.Second); err != nil {
+		t.Errorf("waitForRollout = %v, want nil", err)
+	}
+}
@@ -1,43 +1,70 @@
 package installer
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
-	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/coredns/caddy/caddyfile"
+	"github.com/devincd/coredns-hosts-api/pkg/server"
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/homedir"
 	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
 )
 
 type Server struct {
-	clientset         *kubernetes.Clientset
+	clientset         kubernetes.Interface
 	corednsDeployment *appsv1.Deployment
-	args              *Args
+	// corednsService is the name of the CoreDNS Service, which may differ from the Deployment's
+	corednsService   string
+	eventBroadcaster record.EventBroadcaster
+	// recorder records the events of the installation on the resources of CoreDNS
+	recorder record.EventRecorder
+	// pendingEvents are the events recorded but not written yet
+	pendingEvents sync.WaitGroup
+	args          *Args
 }
 
 func NewServer(args *Args) (*Server, error) {
 	s := &Server{
 		args: args,
 	}
+	if err := validateImagePullPolicy(args.ServerImagePullPolicy); err != nil {
+		return nil, err
+	}
+	if _, err := args.ServerResources(); err != nil {
+		return nil, err
+	}
+	if args.DryRun && args.Watch {
+		return nil, fmt.Errorf("--dry-run can not be used with --watch")
+	}
 	if err := s.initKubeClient(args); err != nil {
 		return nil, fmt.Errorf("failed to initKubeClient: %v", err)
 	}
+	s.initEventRecorder()
 	if err := s.initCorednsDeployment(args); err != nil {
 		return nil, fmt.Errorf("failed to initCorednsDeployment: %v", err)
 	}
+	if err := s.initCorednsService(); err != nil {
+		return nil, fmt.Errorf("failed to initCorednsService: %v", err)
+	}
 	return s, nil
 }
 
@@ -52,6 +79,9 @@ func (s *Server) initKubeClient(args *Args) error {
 	}
 	kubeconfig, err := clientcmd.BuildConfigFromFlags("", kconfig)
 	if err != nil {
+		return fmt.Errorf("bad kubeconfig %q: %v", kconfig, err)
+	}
+	if err := server.CheckKubeConnectivity(kubeconfig); err != nil {
 		return err
 	}
 	clientset, err := kubernetes.NewForConfig(kubeconfig)
@@ -66,7 +96,11 @@ func (s *Server) initCorednsDeployment(args *Args) error {
 	if s.clientset == nil {
 		return fmt.Errorf("the k8s clientset can not be nil")
 	}
-	deploy, err := s.clientset.AppsV1().Deployments(args.CoreDNSNamespace).Get(context.TODO(), args.CoreDNSName, metav1.GetOptions{})
+	name, err := s.discoverDeployment()
+	if err != nil {
+		return err
+	}
+	deploy, err := s.clientset.AppsV1().Deployments(args.CoreDNSNamespace).Get(context.TODO(), name, metav1.GetOptions{})
 	if err != nil {
 		return err
 	}
@@ -74,18 +108,51 @@ func (s *Server) initCorednsDeployment(args *Args) error {
 	return nil
 }
 
+func (s *Server) initCorednsService() error {
+	name, err := s.discoverService()
+	if err != nil {
+		return err
+	}
+	s.corednsService = name
+	return nil
+}
+
+func validateImagePullPolicy(policy string) error {
+	switch corev1.PullPolicy(policy) {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+		return nil
+	}
+	return fmt.Errorf("invalid image pull policy %q, it must be Always, IfNotPresent or Never", policy)
+}
+
 func FileExist(name string) bool {
 	_, err := os.Stat(name)
 	return err == nil
 }
 
+// RunOnce ensures every part of the installation, a failure is also recorded as an event on the
+// CoreDNS Deployment, which is the resource the cluster admins describe first.
 func (s *Server) RunOnce() error {
+	err := s.runOnce()
+	if err != nil {
+		s.recordEvent(s.corednsDeployment, corev1.EventTypeWarning, EventReasonInstallFailed, "Failed to install coredns-hosts-server: %v", err)
+	}
+	return err
+}
+
+func (s *Server) runOnce() error {
 	if err := s.ensureClusterrole(); err != nil {
 		return fmt.Errorf("failed to ensureClusterrole:%v", err)
 	}
 	if err := s.ensureDeployment(); err != nil {
 		return fmt.Errorf("failed to ensureDeployment:%v", err)
 	}
+	// Nothing rolls out under --dry-run
+	if s.args.Wait && !s.args.DryRun {
+		if err := s.waitForRollout(s.args.WaitTimeout); err != nil {
+			return fmt.Errorf("failed to waitForRollout:%v", err)
+		}
+	}
 	if err := s.ensureService(); err != nil {
 		return fmt.Errorf("failed to ensureService:%v", err)
 	}
@@ -95,9 +162,60 @@ func (s *Server) RunOnce() error {
 	return nil
 }
 
-func (s *Server) ensureClusterrole() error {
+// configmapsPolicyRule is the rule added to the ClusterRole of CoreDNS for the server to manage the configmaps
+func configmapsPolicyRule() rbacv1.PolicyRule {
+	return rbacv1.PolicyRule{
+		APIGroups: []string{""},
+		Resources: []string{"configmaps"},
+		Verbs:     []string{"*"},
+	}
+}
+
+// leasesPolicyRule is the rule added to the ClusterRole of CoreDNS for the leader election of the server
+func leasesPolicyRule() rbacv1.PolicyRule {
+	return rbacv1.PolicyRule{
+		APIGroups: []string{"coordination.k8s.io"},
+		Resources: []string{"leases"},
+		Verbs:     []string{"get", "create", "update"},
+	}
+}
+
+// deploymentsPolicyRule is the rule added to the ClusterRole of CoreDNS for the server to annotate
+// the CoreDNS Deployment with the hosts checksum
+func deploymentsPolicyRule() rbacv1.PolicyRule {
+	return rbacv1.PolicyRule{
+		APIGroups: []string{"apps"},
+		Resources: []string{"deployments"},
+		Verbs:     []string{"get", "patch"},
+	}
+}
+
+// policyRuleName names the rule added by the installer in InjectedAnnotation
+func policyRuleName(rule rbacv1.PolicyRule) string {
+	return strings.Join(rule.Resources, "+")
+}
+
+// injectablePolicyRules are all the rules the installer may add, regardless of the flags
+func injectablePolicyRules() []rbacv1.PolicyRule {
+	return []rbacv1.PolicyRule{configmapsPolicyRule(), leasesPolicyRule(), deploymentsPolicyRule()}
+}
+
+// policyRules returns the rules the server needs in the ClusterRole of CoreDNS
+func (s *Server) policyRules() []rbacv1.PolicyRule {
+	rules := []rbacv1.PolicyRule{configmapsPolicyRule()}
+	if s.args.ServerArgs.EnableLeaderElection {
+		rules = append(rules, leasesPolicyRule())
+	}
+	if s.args.ServerArgs.RestartCoreDNSOnChange {
+		rules = append(rules, deploymentsPolicyRule())
+	}
+	return rules
+}
+
+// findClusterRoleName finds the ClusterRole bound to the ServiceAccount of the CoreDNS Deployment
+func (s *Server) findClusterRoleName() (string, error) {
 	if s.corednsDeployment == nil {
-		return fmt.Errorf("the coredns deployment can not be nil")
+		return "", fmt.Errorf("the coredns deployment can not be nil")
 	}
 	// search ServiceAccount from Deployment
 	var serviceAccountName string
@@ -106,12 +224,12 @@ func (s *Server) ensureClusterrole() error {
 		serviceAccountName = s.corednsDeployment.Spec.Template.Spec.DeprecatedServiceAccount
 	}
 	if serviceAccountName == "" {
-		return fmt.Errorf("the serviceAccountName can not be empty")
+		return "", fmt.Errorf("the serviceAccountName can not be empty")
 	}
 	serviceAccountNamespace := s.corednsDeployment.Namespace
 	clusterRoleBindingList, err := s.clientset.RbacV1().ClusterRoleBindings().List(context.TODO(), metav1.ListOptions{})
 	if err != nil {
-		return err
+		return "", err
 	}
 	var clusterRoleName string
 	for _, item := range clusterRoleBindingList.Items {
@@ -124,36 +242,67 @@ func (s *Server) ensureClusterrole() error {
 		}
 	}
 	if clusterRoleName == "" {
-		return fmt.Errorf("the clusterRoleName can not be empty")
+		return "", fmt.Errorf("the clusterRoleName can not be empty")
+	}
+	return clusterRoleName, nil
+}
+
+func (s *Server) ensureClusterrole() error {
+	clusterRoleName, err := s.findClusterRoleName()
+	if err != nil {
+		return err
 	}
 	// update
+	var added []string
 	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		added = added[:0]
 		result, getErr := s.clientset.RbacV1().ClusterRoles().Get(context.TODO(), clusterRoleName, metav1.GetOptions{})
 		if getErr != nil {
 			return fmt.Errorf("failed to get latest version of Cluster: %v", getErr)
 		}
-		addRule := rbacv1.PolicyRule{
-			APIGroups: []string{""},
-			Resources: []string{"configmaps"},
-			Verbs:     []string{"*"},
+		var changes []string
+		for _, addRule := range s.policyRules() {
+			if !ExistPolicyRule(addRule, result.Rules) {
+				result.Rules = append(result.Rules, addRule)
+				markInjected(result, injectedElement(injectedRule, policyRuleName(addRule)))
+				added = append(added, policyRuleName(addRule))
+				changes = append(changes, fmt.Sprintf("+ rule %s: %s", policyRuleName(addRule), strings.Join(addRule.Verbs, ",")))
+			}
+		}
+		if len(added) == 0 {
+			return nil
 		}
-		if !ExistPolicyRule(addRule, result.Rules) {
-			result.Rules = append(result.Rules, addRule)
-			_, updateErr := s.clientset.RbacV1().ClusterRoles().Update(context.TODO(), result, metav1.UpdateOptions{})
-			return updateErr
+		_, updateErr := s.clientset.RbacV1().ClusterRoles().Update(context.TODO(), result, s.updateOptions())
+		if updateErr == nil {
+			s.printDryRun("ClusterRole", result, changes)
 		}
-		return nil
+		return updateErr
 	})
+	if retryErr == nil && len(added) > 0 {
+		s.recordEvent(s.corednsDeployment, corev1.EventTypeNormal, EventReasonPolicyRulesAdded, "Added the rules of %s to the ClusterRole %s", strings.Join(added, ", "), clusterRoleName)
+	}
 	return retryErr
 }
 
+const (
+	// sharedVolumeName is the volume shared by CoreDNS and the coredns-hosts-server container
+	sharedVolumeName = "shared-data"
+	// coreDNSHostsServerName is the name of the injected sidecar container
+	coreDNSHostsServerName = "coredns-hosts-server"
+	// shareProcessNamespaceField is the field of the pod spec set for --server-reload-coredns
+	shareProcessNamespaceField = "shareProcessNamespace"
+)
+
 func (s *Server) ensureDeployment() error {
-	volumeName := "shared-data"
 	volumeMountItem := corev1.VolumeMount{
-		Name:      volumeName,
-		MountPath: "/etc/coredns-dir",
+		Name:      sharedVolumeName,
+		MountPath: s.args.HostsDir,
 	}
+	// injected and upgraded tell which event to record once the update succeeds
+	var injected, upgraded bool
+	var updated *appsv1.Deployment
 	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		injected, upgraded, updated = false, false, nil
 		// Retrieve the latest version of Deployment before attempting update
 		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
 		result, getErr := s.clientset.AppsV1().Deployments(s.corednsDeployment.Namespace).Get(context.TODO(), s.corednsDeployment.Name, metav1.GetOptions{})
@@ -161,49 +310,226 @@ func (s *Server) ensureDeployment() error {
 			return fmt.Errorf("failed to get latest version of Deployment: %v", getErr)
 		}
 		var needUpdate bool
+		var changes []string
+		desired := s.hostsServerContainer()
+		// A port already taken makes a pod that never starts, so fail before touching the Deployment
+		if err := ValidateServerPort(result.Spec.Template.Spec.Containers, s.args.ServerArgs.Port); err != nil {
+			return err
+		}
 		// add Container
-		coreDNSHostsServerName := "coredns-hosts-server"
 		if !ExistContainerByName(coreDNSHostsServerName, result.Spec.Template.Spec.Containers) {
 			needUpdate = true
-			result.Spec.Template.Spec.Containers = append(result.Spec.Template.Spec.Containers, corev1.Container{
-				Name:            coreDNSHostsServerName,
-				Image:           fmt.Sprintf("docker.io/devincd/coredns-hosts-server:%s", s.args.CoreDNSHostsServerVersion),
-				ImagePullPolicy: corev1.PullAlways,
-				Args: []string{
-					"--kubeconfig", s.args.ServerArgs.Kubeconfig,
-					"--port", fmt.Sprintf("%d", s.args.ServerArgs.Port),
-				},
-				Ports: []corev1.ContainerPort{
-					{
-						ContainerPort: s.args.ServerArgs.Port,
-					},
-				},
-			})
+			injected = true
+			result.Spec.Template.Spec.Containers = append(result.Spec.Template.Spec.Containers, desired)
+			changes = append(changes, fmt.Sprintf("+ container %s: %s %s", coreDNSHostsServerName, desired.Image, strings.Join(desired.Args, " ")))
+		}
+		// upgrade the existing Container
+		for index, container := range result.Spec.Template.Spec.Containers {
+			if container.Name != coreDNSHostsServerName {
+				continue
+			}
+			if container.Image != desired.Image || container.ImagePullPolicy != desired.ImagePullPolicy || !stringSlicesEqual(container.Args, desired.Args) ||
+				!apiequality.Semantic.DeepEqual(container.Resources, desired.Resources) ||
+				!apiequality.Semantic.DeepEqual(container.LivenessProbe, desired.LivenessProbe) ||
+				!apiequality.Semantic.DeepEqual(container.ReadinessProbe, desired.ReadinessProbe) {
+				klog.InfoS("Upgrade the container", "container", coreDNSHostsServerName, "oldImage", container.Image, "newImage", desired.Image)
+				needUpdate = true
+				upgraded = true
+				changes = append(changes, fmt.Sprintf("~ container %s: %s %s -> %s %s", coreDNSHostsServerName,
+					container.Image, strings.Join(container.Args, " "), desired.Image, strings.Join(desired.Args, " ")))
+				result.Spec.Template.Spec.Containers[index].Image = desired.Image
+				result.Spec.Template.Spec.Containers[index].ImagePullPolicy = desired.ImagePullPolicy
+				result.Spec.Template.Spec.Containers[index].Args = desired.Args
+				result.Spec.Template.Spec.Containers[index].Resources = desired.Resources
+				result.Spec.Template.Spec.Containers[index].LivenessProbe = desired.LivenessProbe
+				result.Spec.Template.Spec.Containers[index].ReadinessProbe = desired.ReadinessProbe
+			}
+		}
+		// add imagePullSecret, which is marked only if added here since it may be used by CoreDNS too
+		if secret := s.args.ServerImagePullSecret; secret != "" && !ExistPullSecretByName(secret, result.Spec.Template.Spec.ImagePullSecrets) {
+			needUpdate = true
+			result.Spec.Template.Spec.ImagePullSecrets = append(result.Spec.Template.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: secret})
+			changes = append(changes, "+ imagePullSecret "+secret)
+			markInjected(result, injectedElement(injectedImagePullSecret, secret))
+		}
+		// The server signals the coredns process to reload, which it only sees with the process namespace shared.
+		// It is marked only if set here, since CoreDNS may need it too.
+		if s.args.ServerArgs.ControllerArgs.ReloadCoreDNS {
+			if share := result.Spec.Template.Spec.ShareProcessNamespace; share == nil || !*share {
+				needUpdate = true
+				share := true
+				result.Spec.Template.Spec.ShareProcessNamespace = &share
+				changes = append(changes, "+ shareProcessNamespace")
+				markInjected(result, injectedElement(injectedPodSpec, shareProcessNamespaceField))
+			}
 		}
 		// add container volumeMount
 		for index, container := range result.Spec.Template.Spec.Containers {
-			if !ExistVolumeMountsByName(volumeName, container.VolumeMounts) {
+			if !ExistVolumeMountsByName(sharedVolumeName, container.VolumeMounts) {
 				needUpdate = true
 				result.Spec.Template.Spec.Containers[index].VolumeMounts = append(result.Spec.Template.Spec.Containers[index].VolumeMounts, volumeMountItem)
+				changes = append(changes, fmt.Sprintf("+ volumeMount %s at %s in the container %s", sharedVolumeName, s.args.HostsDir, container.Name))
 			}
 		}
+		// The server only works if CoreDNS reads the hosts file from the same volume and path
+		if err := ValidateSharedVolumeMounts(result.Spec.Template.Spec.Containers, s.args.HostsDir); err != nil {
+			return err
+		}
 		// add volume
-		if !ExistVolumeMsByName(volumeName, result.Spec.Template.Spec.Volumes) {
+		if !ExistVolumeMsByName(sharedVolumeName, result.Spec.Template.Spec.Volumes) {
 			needUpdate = true
 			result.Spec.Template.Spec.Volumes = append(result.Spec.Template.Spec.Volumes, corev1.Volume{
-				Name: volumeName,
-				VolumeSource: corev1.VolumeSource{
-					EmptyDir: &corev1.EmptyDirVolumeSource{},
-				},
+				Name:         sharedVolumeName,
+				VolumeSource: s.hostsVolumeSource(),
 			})
+			changes = append(changes, "+ volume "+sharedVolumeName)
+		}
+		// The container and the volume are named after the server, so they are always the installer's.
+		// The markers are on the Deployment rather than the pod template, which would restart CoreDNS.
+		if markInjected(result, injectedElement(injectedContainer, coreDNSHostsServerName), injectedElement(injectedVolume, sharedVolumeName)) {
+			needUpdate = true
 		}
 		if needUpdate {
-			_, updateErr := s.clientset.AppsV1().Deployments(s.corednsDeployment.Namespace).Update(context.TODO(), result, metav1.UpdateOptions{})
+			var updateErr error
+			updated, updateErr = s.clientset.AppsV1().Deployments(s.corednsDeployment.Namespace).Update(context.TODO(), result, s.updateOptions())
+			if updateErr == nil {
+				s.printDryRun("Deployment", result, changes)
+			}
 			return updateErr
 		}
 		return nil
 	})
-	return retryErr
+	if retryErr != nil {
+		return retryErr
+	}
+	switch {
+	case injected:
+		s.recordEvent(updated, corev1.EventTypeNormal, EventReasonSidecarInjected, "Injected the container %s with the image %s", coreDNSHostsServerName, s.args.ServerImage())
+	case upgraded:
+		s.recordEvent(updated, corev1.EventTypeNormal, EventReasonSidecarUpgraded, "Upgraded the container %s to the image %s", coreDNSHostsServerName, s.args.ServerImage())
+	}
+	return nil
+}
+
+// hostsServerContainer returns the desired coredns-hosts-server container, the shared volumeMount
+// is added by ensureDeployment together with the ones of the other containers.
+func (s *Server) hostsServerContainer() corev1.Container {
+	// The resources are validated by NewServer
+	resources, _ := s.args.ServerResources()
+	container := corev1.Container{
+		Name:            coreDNSHostsServerName,
+		Image:           s.args.ServerImage(),
+		ImagePullPolicy: corev1.PullPolicy(s.args.ServerImagePullPolicy),
+		Args: []string{
+			"--kubeconfig", s.args.ServerArgs.Kubeconfig,
+			"--port", fmt.Sprintf("%d", s.args.ServerArgs.Port),
+			"--file-path", s.args.HostsPath(),
+		},
+		Ports: []corev1.ContainerPort{
+			{
+				ContainerPort: s.args.ServerArgs.Port,
+			},
+		},
+		Resources: resources,
+	}
+	// The default configmap is left out, so that the existing sidecars are not restarted for nothing
+	controllerArgs := s.args.ServerArgs.ControllerArgs
+	if name := controllerArgs.Name(); name != controller.DefaultConfigmapName {
+		container.Args = append(container.Args, "--record-configmap-name", name)
+	}
+	if namespace := controllerArgs.Namespace(); namespace != controller.DefaultConfigmapNamespace {
+		container.Args = append(container.Args, "--record-configmap-namespace", namespace)
+	}
+	for _, path := range s.args.HostsPaths()[1:] {
+		container.Args = append(container.Args, "--file-path", path)
+	}
+	if s.args.HostsRecordNoReverse {
+		container.Args = append(container.Args, "--reverse-file")
+	}
+	if controllerArgs.CompressRecords {
+		container.Args = append(container.Args, "--compress-records")
+	}
+	if controllerArgs.ReloadCoreDNS {
+		container.Args = append(container.Args, "--reload-coredns")
+	}
+	if s.args.ServerArgs.EnableLeaderElection {
+		container.Args = append(container.Args, "--enable-leader-election")
+	}
+	if s.args.ServerArgs.RestartCoreDNSOnChange {
+		container.Args = append(container.Args, "--restart-coredns-on-change", "--coredns-deployment", s.corednsDeployment.Name)
+	}
+	if s.args.ServerLivenessProbe {
+		container.LivenessProbe = s.hostsServerProbe("/healthz")
+	}
+	if s.args.ServerReadinessProbe {
+		container.ReadinessProbe = s.hostsServerProbe("/readyz")
+	}
+	return container
+}
+
+// hostsServerProbe returns the probe against the path of the server, every field defaulted by
+// the apiserver is set so that the probe of an existing container compares equal.
+func (s *Server) hostsServerProbe(path string) *corev1.Probe {
+	return &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path:   path,
+				Port:   intstr.FromInt(int(s.args.ServerArgs.Port)),
+				Scheme: corev1.URISchemeHTTP,
+			},
+		},
+		InitialDelaySeconds: 10,
+		TimeoutSeconds:      5,
+		PeriodSeconds:       10,
+		SuccessThreshold:    1,
+		FailureThreshold:    3,
+	}
+}
+
+// ValidateServerPort checks the port of the server is not used by any other container of the pod,
+// which share the network namespace.
+func ValidateServerPort(containers []corev1.Container, port int32) error {
+	for _, container := range containers {
+		if container.Name == coreDNSHostsServerName {
+			continue
+		}
+		for _, containerPort := range container.Ports {
+			if containerPort.ContainerPort == port {
+				return fmt.Errorf("the port %d is already used by the container %s, choose another one with --server-port", port, container.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateSharedVolumeMounts checks every container mounts the shared volume at the hosts directory,
+// and no other volume is mounted there, otherwise the server writes a file CoreDNS never reads.
+func ValidateSharedVolumeMounts(containers []corev1.Container, hostsDir string) error {
+	for _, container := range containers {
+		for _, mount := range container.VolumeMounts {
+			if mount.Name == sharedVolumeName && mount.MountPath != hostsDir {
+				return fmt.Errorf("the container %s mounts the volume %s at %s, but it must be %s", container.Name, sharedVolumeName, mount.MountPath, hostsDir)
+			}
+			if mount.Name != sharedVolumeName && mount.MountPath == hostsDir {
+				return fmt.Errorf("the container %s mounts the volume %s at %s, but it must be the volume %s", container.Name, mount.Name, mount.MountPath, sharedVolumeName)
+			}
+		}
+	}
+	return nil
+}
+
+// hostsVolumeSource returns the PersistentVolumeClaim source if configured, otherwise the EmptyDir
+func (s *Server) hostsVolumeSource() corev1.VolumeSource {
+	if s.args.HostsVolumeClaim != "" {
+		return corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: s.args.HostsVolumeClaim,
+			},
+		}
+	}
+	return corev1.VolumeSource{
+		EmptyDir: &corev1.EmptyDirVolumeSource{},
+	}
 }
 
 func ExistPolicyRule(rule rbacv1.PolicyRule, rules []rbacv1.PolicyRule) bool {
@@ -236,6 +562,15 @@ func ExistContainerByName(name string, containers []corev1.Container) bool {
 	return false
 }
 
+func ExistPullSecretByName(name string, secrets []corev1.LocalObjectReference) bool {
+	for _, secret := range secrets {
+		if secret.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func ExistVolumeMountsByName(name string, volumeMounts []corev1.VolumeMount) bool {
 	for _, val := range volumeMounts {
 		if val.Name == name {
@@ -263,30 +598,85 @@ func ExistPortsByPort(port int32, ports []corev1.ServicePort) bool {
 	return false
 }
 
+// getService gets the Service of CoreDNS found by NewServer
+func (s *Server) getService() (*corev1.Service, error) {
+	return s.clientset.CoreV1().Services(s.args.CoreDNSNamespace).Get(context.TODO(), s.corednsService, metav1.GetOptions{})
+}
+
+// ensureService adds the port of the server to the CoreDNS Service by a strategic merge patch of the
+// ports and the markers only rather than an update, so that the fields defaulted or changed by others,
+// e.g. the ipFamilies and ipFamilyPolicy of a dual-stack Service, are never reset. If the installer
+// added the port named apis with another number, the same patch deletes it and adds --server-port,
+// since the apiserver rejects a second port of the same name, while a port of that name added by
+// someone else fails the install.
 func (s *Server) ensureService() error {
+	port := s.args.ServerArgs.Port
+	var patched *corev1.Service
+	var changes []string
 	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		// Retrieve the latest version of Deployment before attempting update
-		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
-		var result *corev1.Service
-		var getErr error
-		result, getErr = s.clientset.CoreV1().Services(s.args.CoreDNSNamespace).Get(context.TODO(), s.args.CoreDNSName, metav1.GetOptions{})
+		patched, changes = nil, nil
+		result, getErr := s.getService()
 		if getErr != nil {
-			result, getErr = s.clientset.CoreV1().Services(s.args.CoreDNSNamespace).Get(context.TODO(), "kube-dns", metav1.GetOptions{})
-			if getErr != nil {
-				return fmt.Errorf("failed to get latest version of Service: %v", getErr)
+			return fmt.Errorf("failed to get latest version of Service: %v", getErr)
+		}
+		if ExistPortsByPort(port, result.Spec.Ports) {
+			return nil
+		}
+		ports := []map[string]interface{}{
+			{
+				"name":       servicePortName,
+				"protocol":   corev1.ProtocolTCP,
+				"port":       port,
+				"targetPort": intstr.FromInt(int(port)),
+			},
+		}
+		if stale, ok := ServicePortByName(servicePortName, result.Spec.Ports); ok {
+			elements, _ := injectedElements(result)
+			staleElement := injectedElement(injectedPort, strconv.Itoa(int(stale.Port)))
+			if !ExistStringSlice(staleElement, elements) {
+				return fmt.Errorf("the Service %s already has the port %s (%d) which was not added by the installer, rename it or choose it with --server-port",
+					result.Name, servicePortName, stale.Port)
 			}
+			unmarkInjectedElement(result, staleElement)
+			ports = append([]map[string]interface{}{{"port": stale.Port, "$patch": "delete"}}, ports...)
+			changes = append(changes, fmt.Sprintf("- port %s: %d/%s", servicePortName, stale.Port, stale.Protocol))
 		}
-		if !ExistPortsByPort(s.args.ServerArgs.Port, result.Spec.Ports) {
-			result.Spec.Ports = append(result.Spec.Ports, corev1.ServicePort{
-				Name: "apis",
-				Port: s.args.ServerArgs.Port,
-			})
-			_, updateErr := s.clientset.CoreV1().Services(s.args.CoreDNSNamespace).Update(context.TODO(), result, metav1.UpdateOptions{})
-			return updateErr
+		changes = append(changes, fmt.Sprintf("+ port %s: %d/TCP", servicePortName, port))
+		annotations, _ := markedAnnotations(result, injectedElement(injectedPort, strconv.Itoa(int(port))))
+		// Only the ports and the markers are sent, the ports are merged by port, and a Service port serves
+		// every ip family of the Service. The resourceVersion makes a concurrent change of the markers,
+		// which are computed from the read, a conflict rather than being overwritten.
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"resourceVersion": result.ResourceVersion,
+				"annotations":     annotations,
+			},
+			"spec": map[string]interface{}{
+				"ports": ports,
+			},
+		})
+		if err != nil {
+			return err
 		}
-		return nil
+		patched, err = s.clientset.CoreV1().Services(result.Namespace).Patch(context.TODO(), result.Name, types.StrategicMergePatchType, patch, s.patchOptions())
+		return err
 	})
-	return retryErr
+	if retryErr != nil || patched == nil {
+		return retryErr
+	}
+	s.printDryRun("Service", patched, changes)
+	s.recordEvent(patched, corev1.EventTypeNormal, EventReasonServicePortAdded, "Added the port %d of coredns-hosts-server", port)
+	return nil
+}
+
+// ServicePortByName returns the port of the name
+func ServicePortByName(name string, ports []corev1.ServicePort) (corev1.ServicePort, bool) {
+	for _, val := range ports {
+		if val.Name == name {
+			return val, true
+		}
+	}
+	return corev1.ServicePort{}, false
 }
 
 func (s *Server) ensureCoreDNSConfigmap() error {
@@ -294,12 +684,16 @@ func (s *Server) ensureCoreDNSConfigmap() error {
 	if err != nil {
 		return err
 	}
-	corefile, needUpdate, err := BuildNewCoreFile([]byte(cm.Data["Corefile"]))
+	corefile, needUpdate, err := BuildNewCoreFile([]byte(cm.Data["Corefile"]), s.args.HostsOptions())
 	if err != nil {
 		return err
 	}
 	klog.InfoS("The coreDNS config content", "corefile", string(corefile))
 	if needUpdate {
+		if err := ValidateCoreFile(corefile); err != nil {
+			return err
+		}
+		var updated *corev1.ConfigMap
 		retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
 			// Retrieve the latest version of Deployment before attempting update
 			// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
@@ -309,95 +703,347 @@ func (s *Server) ensureCoreDNSConfigmap() error {
 			if getErr != nil {
 				return fmt.Errorf("failed to get latest version of ConfigMap: %v", getErr)
 			}
+			// Keep the prior Corefile so an operator can restore it if CoreDNS rejects the new one
+			result.Data[corefileBackupKey] = result.Data["Corefile"]
 			result.Data["Corefile"] = string(corefile)
+			var elements []string
+			for _, path := range s.args.HostsPaths() {
+				elements = append(elements, injectedElement(injectedHosts, path))
+			}
+			if s.args.HostsRecordNoReverse {
+				elements = append(elements, injectedElement(injectedHosts, s.args.HostsReversePath()))
+			}
+			markInjected(result, elements...)
 			// update
-			_, updateErr := s.clientset.CoreV1().ConfigMaps(s.args.CoreDNSNamespace).Update(context.TODO(), result, metav1.UpdateOptions{})
+			var updateErr error
+			updated, updateErr = s.clientset.CoreV1().ConfigMaps(s.args.CoreDNSNamespace).Update(context.TODO(), result, s.updateOptions())
+			if updateErr == nil {
+				changes := []string{"+ " + corefileBackupKey, "~ Corefile:"}
+				for _, line := range lineDiff(result.Data[corefileBackupKey], result.Data["Corefile"]) {
+					changes = append(changes, "  "+line)
+				}
+				s.printDryRun("ConfigMap", result, changes)
+			}
 			return updateErr
 		})
-		return retryErr
+		if retryErr != nil {
+			return retryErr
+		}
+		s.recordEvent(updated, corev1.EventTypeNormal, EventReasonHostsDirectiveInjected, "Injected the hosts directive reading %s into the Corefile", s.args.HostsPath())
 	}
 	return nil
 }
 
-const (
-	filename  = "Caddyfile"
-	hostsPath = "/etc/coredns-dir/hosts"
-)
+const filename = "Caddyfile"
 
-func BuildNewCoreFile(corefile []byte) ([]byte, bool, error) {
-	var j caddyfile.EncodedCaddyfile
-	var needUpdate bool
-	serverBlocks, err := caddyfile.Parse(filename, bytes.NewReader(corefile), nil)
+// corefileBackupKey is the key of the CoreDNS ConfigMap holding the Corefile before the last update
+const corefileBackupKey = "Corefile.bak"
+
+// ValidateCoreFile parses the generated Corefile again before it is pushed, since a Corefile
+// CoreDNS can not parse breaks the DNS of the whole cluster.
+func ValidateCoreFile(corefile []byte) error {
+	lines := strings.Split(string(corefile), "\n")
+	blocks, err := scanCorefile(lines)
 	if err != nil {
-		return nil, needUpdate, err
+		return fmt.Errorf("the generated Corefile is invalid: %v", err)
+	}
+	// The imported files only exist in the CoreDNS pod
+	lines = withoutFileImports(lines, blocks)
+	serverBlocks, err := caddyfile.Parse(filename, strings.NewReader(strings.Join(lines, "\n")), nil)
+	if err != nil {
+		return fmt.Errorf("the generated Corefile is invalid: %v", err)
+	}
+	if len(serverBlocks) == 0 {
+		return fmt.Errorf("the generated Corefile has no server block")
 	}
+	return nil
+}
 
-	for _, sb := range serverBlocks {
-		block := caddyfile.EncodedServerBlock{
-			Keys: sb.Keys,
-			Body: [][]interface{}{},
+// HostsOptions is the hosts directive injected into the Corefile
+type HostsOptions struct {
+	// Path is the hosts file read by the directive
+	Path string
+	// Fallthrough passes the queries not found in the hosts file to the next plugin
+	Fallthrough bool
+	// TTL is the ttl of the answers in seconds, 0 means the default of the plugin
+	TTL int
+	// NoReverse disables the PTR records generated from the hosts file
+	NoReverse bool
+	// Zones are the server blocks reading a hosts file of their own with another ttl
+	Zones []HostsZone
+	// ReversePath is the reverse hosts file without the records of noReverse, empty means there is none.
+	// The server blocks of the reverse zones read it while the ones of the root zone get no_reverse, and
+	// the reverse server block is added next to a root one lacking it, see reverseBlock.
+	ReversePath string
+}
+
+// HostsZone is the hosts file and the ttl of the server blocks of a zone
+type HostsZone struct {
+	// Zone matches a key of a server block regardless of its scheme and port, e.g. example.org
+	// matches example.org:53 and dns://example.org.
+	Zone string
+	Path string
+	TTL  int
+}
+
+// forBlock returns the options of the server block of the keys, i.e. the ones of the first zone
+// matching a key of the block, or else opts. With ReversePath the block of the root zone gets
+// no_reverse and the block of a reverse zone reads ReversePath.
+func (opts HostsOptions) forBlock(keys []string) HostsOptions {
+	if opts.ReversePath != "" {
+		var root, reverse bool
+		for _, key := range keys {
+			root = root || normalizeZone(key) == "."
+			reverse = reverse || isReverseZone(normalizeZone(key))
+		}
+		switch {
+		case root:
+			opts.NoReverse = true
+		case reverse:
+			opts.Path, opts.NoReverse = opts.ReversePath, false
+			return opts
+		}
+	}
+	for _, zone := range opts.Zones {
+		for _, key := range keys {
+			if normalizeZone(key) == normalizeZone(zone.Zone) {
+				opts.Path, opts.TTL = zone.Path, zone.TTL
+				return opts
+			}
 		}
-		// Extract directives deterministically by sorting them
-		var hostsItem []interface{}
-		hostsItem = append(hostsItem, "hosts")
-		hostsItem = append(hostsItem, hostsPath)
+	}
+	return opts
+}
+
+// normalizeZone returns the zone of a key of a server block without its scheme, port and trailing dot
+func normalizeZone(key string) string {
+	_, zone, _ := splitKey(key)
+	if zone != "." {
+		zone = strings.TrimSuffix(zone, ".")
+	}
+	return strings.ToLower(zone)
+}
 
-		var directives = make([]string, len(sb.Tokens))
-		for dir := range sb.Tokens {
-			directives = append(directives, dir)
+// splitKey splits a key of a server block into its scheme, zone and port, e.g. dns://.:53 into
+// dns://, . and :53, the scheme and the port are empty if absent
+func splitKey(key string) (string, string, string) {
+	var scheme, port string
+	if i := strings.Index(key, "://"); i >= 0 {
+		scheme, key = key[:i+3], key[i+3:]
+	}
+	if i := strings.LastIndex(key, ":"); i >= 0 {
+		key, port = key[:i], key[i:]
+	}
+	return scheme, key, port
+}
+
+// keyPort returns the port of a key of a server block, which is 53 unless set
+func keyPort(key string) string {
+	if _, _, port := splitKey(key); port != "" {
+		return port
+	}
+	return ":53"
+}
+
+// reverseZones are the zones of the PTR records
+var reverseZones = []string{"in-addr.arpa", "ip6.arpa"}
+
+// isReverseZone reports whether the zone is one of reverseZones or below one
+func isReverseZone(zone string) bool {
+	for _, reverse := range reverseZones {
+		if zone == reverse || strings.HasSuffix(zone, "."+reverse) {
+			return true
 		}
-		if !ExistStringSlice("hosts", directives) {
-			directives = append(directives, "hosts")
+	}
+	return false
+}
+
+// generatedBlockComment marks the server blocks added by the installer, which are removed as a whole
+var generatedBlockComment = fmt.Sprintf("# %s: %s", ManagedByAnnotation, ManagedByValue)
+
+// reverseBlock returns the lines of the server block of the reverse zones missing for the root zone
+// server block, nil if it is not a root one or has them all. The PTR queries go to the most specific
+// zone, so the block reads opts.ReversePath and otherwise copies the directives of the root block
+// besides hosts, health and ready, the last two of which listen once per CoreDNS.
+func reverseBlock(lines []string, blocks []corefileBlock, block corefileBlock, opts HostsOptions, hostsSnippets []string, indent string) []string {
+	if opts.ReversePath == "" {
+		return nil
+	}
+	var keys []string
+	for _, key := range block.keys {
+		if normalizeZone(key) != "." {
+			continue
+		}
+		scheme, _, port := splitKey(key)
+		for _, zone := range reverseZones {
+			if !hasServerBlock(blocks, zone, keyPort(key)) {
+				keys = append(keys, scheme+zone+port)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	hostsItem, _ := applyHostsOptions([]interface{}{"hosts", opts.ReversePath}, opts.forBlock(keys))
+	ret := []string{"", strings.Join(keys, " ") + " { " + generatedBlockComment}
+	ret = append(ret, formatDirective(hostsItem, indent, indent)...)
+	for _, directive := range block.directives {
+		switch directive.name {
+		case "hosts", "health", "ready":
+			continue
+		case "import":
+			// The snippet with the hosts directive would be a second one
+			tokens := strings.Fields(stripComment(lines[directive.start]))
+			if len(tokens) == 2 && ExistStringSlice(tokens[1], hostsSnippets) {
+				continue
+			}
 		}
-		sort.Strings(directives)
+		ret = append(ret, lines[directive.start:directive.end+1]...)
+	}
+	return append(ret, "}")
+}
 
-		// Convert each directive's tokens into our JSON structure
-		for _, dir := range directives {
-			// hosts 插件单独处理
-			if dir == "hosts" {
+// hasServerBlock reports whether a server block of the Corefile serves the zone on the port
+func hasServerBlock(blocks []corefileBlock, zone, port string) bool {
+	for _, block := range blocks {
+		if block.snippet {
+			continue
+		}
+		for _, key := range block.keys {
+			if normalizeZone(key) == zone && keyPort(key) == port {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// BuildNewCoreFile adds the hosts directive reading opts.Path with the options to every server block,
+// or points the existing one at opts.Path and adds the missing options while keeping the present ones.
+// The server blocks of opts.Zones read the path of their zone with its ttl instead, and the ones
+// of the reverse zones read opts.ReversePath if set.
+// needUpdate is false if the Corefile is unchanged.
+func BuildNewCoreFile(corefile []byte, opts HostsOptions) ([]byte, bool, error) {
+	var needUpdate bool
+	lines := strings.Split(string(corefile), "\n")
+	blocks, err := scanCorefile(lines)
+	if err != nil {
+		return nil, needUpdate, err
+	}
+	hostsSnippets := snippetsWithHosts(blocks)
+	// Edit from the bottom so that the line numbers of the blocks above stay valid, and only
+	// the hosts directive is touched so that imports, snippets and comments survive verbatim.
+	for i := len(blocks) - 1; i >= 0; i-- {
+		block := blocks[i]
+		if block.snippet {
+			continue
+		}
+		blockOpts := opts.forBlock(block.keys)
+		indent := defaultIndent
+		if len(block.directives) > 0 && leadingIndent(lines[block.directives[0].start]) != "" {
+			indent = leadingIndent(lines[block.directives[0].start])
+		}
+		// The reverse block goes below the block before the lines of the block move
+		if reverse := reverseBlock(lines, blocks, block, opts, hostsSnippets, indent); reverse != nil {
+			needUpdate = true
+			lines = append(lines[:block.end+1], append(reverse, lines[block.end+1:]...)...)
+		}
+		// hosts 插件单独处理
+		var found bool
+		for j := len(block.directives) - 1; j >= 0; j-- {
+			directive := block.directives[j]
+			if directive.name != "hosts" {
+				continue
+			}
+			found = true
+			item := parseDirective(lines[directive.start : directive.end+1])
+			var changed bool
+			if !ExistInterfaceSlice(blockOpts.Path, item) {
+				changed = true
 				switch {
-				case len(sb.Tokens[dir]) == 0:
-					needUpdate = true
-					block.Body = append(block.Body, hostsItem)
+				case len(item) == 1:
+					item = append(item, blockOpts.Path)
+				case isBlock(item[1]):
+					// `hosts {` has no path, which is inserted before the block
+					item = append(item[:1], append([]interface{}{blockOpts.Path}, item[1:]...)...)
 				default:
-					disp := caddyfile.NewDispenserTokens(filename, sb.Tokens[dir])
-					for disp.Next() {
-						item := constructLine(&disp)
-						// first floor
-						if item[0] == "hosts" {
-							if !ExistInterfaceSlice(hostsPath, item) {
-								needUpdate = true
-								if len(item) == 1 {
-									item = append(item, hostsPath)
-								} else {
-									item[1] = hostsPath
-								}
-							}
-						}
-						block.Body = append(block.Body, item)
-					}
-				}
-			} else {
-				disp := caddyfile.NewDispenserTokens(filename, sb.Tokens[dir])
-				for disp.Next() {
-					item := constructLine(&disp)
-					block.Body = append(block.Body, item)
+					item[1] = blockOpts.Path
 				}
 			}
+			var optionsChanged bool
+			item, optionsChanged = applyHostsOptions(item, blockOpts)
+			if changed || optionsChanged {
+				needUpdate = true
+				formatted := formatDirective(item, leadingIndent(lines[directive.start]), indent)
+				lines = append(lines[:directive.start], append(formatted, lines[directive.end+1:]...)...)
+			}
+		}
+		// The hosts directive may come from an imported snippet, a second one breaks CoreDNS
+		for _, name := range importedSnippets(lines, block) {
+			if ExistStringSlice(name, hostsSnippets) {
+				found = true
+			}
 		}
-		// tack this block onto the end of the list
-		j = append(j, block)
+		if found {
+			continue
+		}
+		needUpdate = true
+		hostsItem, _ := applyHostsOptions([]interface{}{"hosts", blockOpts.Path}, blockOpts)
+		formatted := formatDirective(hostsItem, indent, indent)
+		lines = append(lines[:block.end], append(formatted, lines[block.end:]...)...)
 	}
-	result, err := json.Marshal(j)
-	if err != nil {
-		return nil, needUpdate, err
+	return []byte(strings.Join(lines, "\n")), needUpdate, nil
+}
+
+// applyHostsOptions adds the options missing in the block of the hosts directive line, the block
+// is created if needed, and the options already present are kept as they are.
+func applyHostsOptions(item []interface{}, opts HostsOptions) ([]interface{}, bool) {
+	var wanted [][]interface{}
+	if opts.TTL > 0 {
+		wanted = append(wanted, []interface{}{"ttl", strconv.Itoa(opts.TTL)})
 	}
-	// encode
-	newResult, err := caddyfile.FromJSON(result)
-	if err != nil {
-		return nil, needUpdate, err
+	if opts.NoReverse {
+		wanted = append(wanted, []interface{}{"no_reverse"})
+	}
+	if opts.Fallthrough {
+		wanted = append(wanted, []interface{}{"fallthrough"})
+	}
+	if len(wanted) == 0 {
+		return item, false
+	}
+	blockIndex := -1
+	for i, v := range item {
+		if isBlock(v) {
+			blockIndex = i
+		}
 	}
-	return newResult, needUpdate, nil
+	if blockIndex == -1 {
+		item = append(item, [][]interface{}{})
+		blockIndex = len(item) - 1
+	}
+	block := item[blockIndex].([][]interface{})
+	var changed bool
+	for _, option := range wanted {
+		var present bool
+		for _, line := range block {
+			if len(line) > 0 && line[0] == option[0] {
+				present = true
+				break
+			}
+		}
+		if !present {
+			changed = true
+			block = append(block, option)
+		}
+	}
+	item[blockIndex] = block
+	return item, changed
+}
+
+// isBlock tells whether the value of a line built by constructLine is a block
+func isBlock(v interface{}) bool {
+	_, ok := v.([][]interface{})
+	return ok
 }
 
 func ExistInterfaceSlice(val string, item []interface{}) bool {
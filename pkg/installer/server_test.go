@@ -0,0 +1,633 @@
+package installer
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testCorefile = `.:53 {
+    errors
+    health {
+       lameduck 5s
+    }
+    ready
+    kubernetes cluster.local in-addr.arpa ip6.arpa {
+       pods insecure
+       fallthrough in-addr.arpa ip6.arpa
+    }
+    prometheus :9153
+    forward . /etc/resolv.conf
+    cache 30
+    loop
+    reload
+    loadbalance
+}
+`
+
+// newTestArgs returns the args of the installer as defaulted by its flags
+func newTestArgs() *Args {
+	args := NewEmptyArgs()
+	args.CoreDNSName = "coredns"
+	args.CoreDNSNamespace = "kube-system"
+	args.CoreDNSHostsServerVersion = "v1.0.0"
+	args.ServerArgs.Port = 9080
+	return args
+}
+
+// coreDNSObjects returns the resources of CoreDNS as installed by kubeadm
+func coreDNSObjects() []runtime.Object {
+	labels := map[string]string{"k8s-app": "kube-dns"}
+	return []runtime.Object{
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "coredns", Namespace: "kube-system", Labels: labels},
+			Spec: appsv1.DeploymentSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						ServiceAccountName: "coredns",
+						Containers: []corev1.Container{{
+							Name:         "coredns",
+							Image:        "registry.k8s.io/coredns/coredns:v1.9.3",
+							Ports:        []corev1.ContainerPort{{Name: "dns", ContainerPort: 53}, {Name: "metrics", ContainerPort: 9153}},
+							VolumeMounts: []corev1.VolumeMount{{Name: "config-volume", MountPath: "/etc/coredns"}},
+						}},
+						Volumes: []corev1.Volume{{Name: "config-volume"}},
+					},
+				},
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "kube-dns", Namespace: "kube-system", Labels: labels},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Name: "dns", Protocol: corev1.ProtocolUDP, Port: 53}},
+			},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "coredns", Namespace: "kube-system"},
+			Data:       map[string]string{"Corefile": testCorefile},
+		},
+		&rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "system:coredns"},
+			Rules: []rbacv1.PolicyRule{{
+				APIGroups: []string{""},
+				Resources: []string{"endpoints", "services", "pods", "namespaces"},
+				Verbs:     []string{"list", "watch"},
+			}},
+		},
+		&rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "system:coredns"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "system:coredns"},
+			Subjects:   []rbacv1.Subject{{Kind: "ServiceAccount", Name: "coredns", Namespace: "kube-system"}},
+		},
+	}
+}
+
+// newTestServer returns the installer of the args working on a fake clientset holding the objects
+func newTestServer(t *testing.T, args *Args, objects ...runtime.Object) (*Server, *fake.Clientset) {
+	t.Helper()
+	clientset := fake.NewSimpleClientset(objects...)
+	s := &Server{
+		args:      args,
+		clientset: clientset,
+	}
+	s.initEventRecorder()
+	t.Cleanup(s.eventBroadcaster.Shutdown)
+	if err := s.initCorednsDeployment(args); err != nil {
+		t.Fatalf("initCorednsDeployment: %v", err)
+	}
+	if err := s.initCorednsService(); err != nil {
+		t.Fatalf("initCorednsService: %v", err)
+	}
+	return s, clientset
+}
+
+func getDeployment(t *testing.T, clientset *fake.Clientset) *appsv1.Deployment {
+	t.Helper()
+	deployment, err := clientset.AppsV1().Deployments("kube-system").Get(context.TODO(), "coredns", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deployment
+}
+
+func getService(t *testing.T, clientset *fake.Clientset) *corev1.Service {
+	t.Helper()
+	service, err := clientset.CoreV1().Services("kube-system").Get(context.TODO(), "kube-dns", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+func getCoreDNSConfigmap(t *testing.T, clientset *fake.Clientset) *corev1.ConfigMap {
+	t.Helper()
+	cm, err := clientset.CoreV1().ConfigMaps("kube-system").Get(context.TODO(), "coredns", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cm
+}
+
+func getClusterRole(t *testing.T, clientset *fake.Clientset) *rbacv1.ClusterRole {
+	t.Helper()
+	role, err := clientset.RbacV1().ClusterRoles().Get(context.TODO(), "system:coredns", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return role
+}
+
+// hostsServerContainerOf returns the injected container of the Deployment, nil if there is none
+func hostsServerContainerOf(deployment *appsv1.Deployment) *corev1.Container {
+	for i, container := range deployment.Spec.Template.Spec.Containers {
+		if container.Name == coreDNSHostsServerName {
+			return &deployment.Spec.Template.Spec.Containers[i]
+		}
+	}
+	return nil
+}
+
+func TestValidateSharedVolumeMounts(t *testing.T) {
+	const dir = "/etc/coredns-dir"
+	container := func(name string, mounts ...corev1.VolumeMount) corev1.Container {
+		return corev1.Container{Name: name, VolumeMounts: mounts}
+	}
+	tests := []struct {
+		name       string
+		containers []corev1.Container
+		wantErr    bool
+	}{
+		{
+			name: "same volume and path",
+			containers: []corev1.Container{
+				container("coredns", corev1.VolumeMount{Name: "config-volume", MountPath: "/etc/coredns"}, corev1.VolumeMount{Name: sharedVolumeName, MountPath: dir}),
+				container(coreDNSHostsServerName, corev1.VolumeMount{Name: sharedVolumeName, MountPath: dir}),
+			},
+		},
+		{
+			name: "shared volume at another path",
+			containers: []corev1.Container{
+				container("coredns", corev1.VolumeMount{Name: sharedVolumeName, MountPath: "/etc/hosts-dir"}),
+				container(coreDNSHostsServerName, corev1.VolumeMount{Name: sharedVolumeName, MountPath: dir}),
+			},
+			wantErr: true,
+		},
+		{
+			name: "another volume at the path",
+			containers: []corev1.Container{
+				container("coredns", corev1.VolumeMount{Name: "custom", MountPath: dir}),
+				container(coreDNSHostsServerName, corev1.VolumeMount{Name: sharedVolumeName, MountPath: dir}),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateSharedVolumeMounts(tt.containers, dir); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateSharedVolumeMounts = %v, want an error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunOnceUpgradesTheImage(t *testing.T) {
+	args := newTestArgs()
+	s, clientset := newTestServer(t, args, coreDNSObjects()...)
+	if err := s.RunOnce(); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	args.CoreDNSHostsServerVersion = "v1.1.0"
+	if err := s.RunOnce(); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	deployment := getDeployment(t, clientset)
+	count := 0
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		if container.Name == coreDNSHostsServerName {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Fatalf("the Deployment has %d containers %s, want 1", count, coreDNSHostsServerName)
+	}
+	if got, want := hostsServerContainerOf(deployment).Image, DefaultServerImageRepository+":v1.1.0"; got != want {
+		t.Errorf("the image = %v, want %v", got, want)
+	}
+}
+
+func TestEnsureCoreDNSConfigmapBacksUpTheCorefile(t *testing.T) {
+	s, clientset := newTestServer(t, newTestArgs(), coreDNSObjects()...)
+	// The second run needs no update, so the backup still holds the original Corefile
+	for i := 0; i < 2; i++ {
+		if err := s.ensureCoreDNSConfigmap(); err != nil {
+			t.Fatalf("ensureCoreDNSConfigmap: %v", err)
+		}
+		cm := getCoreDNSConfigmap(t, clientset)
+		if got := cm.Data[corefileBackupKey]; got != testCorefile {
+			t.Errorf("the %s = %q, want %q", corefileBackupKey, got, testCorefile)
+		}
+		if cm.Data["Corefile"] == testCorefile {
+			t.Errorf("the Corefile is unchanged")
+		}
+	}
+}
+
+func TestEnsureCoreDNSConfigmapWithoutUpdate(t *testing.T) {
+	objects := coreDNSObjects()
+	corefile, _, err := BuildNewCoreFile([]byte(testCorefile), newTestArgs().HostsOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects[2].(*corev1.ConfigMap).Data["Corefile"] = string(corefile)
+	s, clientset := newTestServer(t, newTestArgs(), objects...)
+	if err := s.ensureCoreDNSConfigmap(); err != nil {
+		t.Fatalf("ensureCoreDNSConfigmap: %v", err)
+	}
+	if cm := getCoreDNSConfigmap(t, clientset); len(cm.Data) != 1 {
+		t.Errorf("the data = %v, want no %s", cm.Data, corefileBackupKey)
+	}
+}
+
+func TestEnsureDeploymentWithAPrivateRegistry(t *testing.T) {
+	args := newTestArgs()
+	args.ServerImageRepository = "registry.example.com/mirror/coredns-hosts-server"
+	args.ServerImagePullPolicy = string(corev1.PullIfNotPresent)
+	args.ServerImagePullSecret = "registry-example"
+	s, clientset := newTestServer(t, args, coreDNSObjects()...)
+	if err := s.ensureDeployment(); err != nil {
+		t.Fatalf("ensureDeployment: %v", err)
+	}
+	deployment := getDeployment(t, clientset)
+	container := hostsServerContainerOf(deployment)
+	if got, want := container.Image, "registry.example.com/mirror/coredns-hosts-server:v1.0.0"; got != want {
+		t.Errorf("the image = %v, want %v", got, want)
+	}
+	if got, want := container.ImagePullPolicy, corev1.PullIfNotPresent; got != want {
+		t.Errorf("the image pull policy = %v, want %v", got, want)
+	}
+	if secrets := deployment.Spec.Template.Spec.ImagePullSecrets; !ExistPullSecretByName("registry-example", secrets) {
+		t.Errorf("the imagePullSecrets = %v, want registry-example", secrets)
+	}
+}
+
+func TestEnsureDeploymentWithARecordConfigmap(t *testing.T) {
+	tests := []struct {
+		name      string
+		configmap string
+		namespace string
+		want      []string
+	}{
+		{name: "default", want: nil},
+		{name: "custom", configmap: "hosts-records", namespace: "dns", want: []string{"--record-configmap-name", "hosts-records", "--record-configmap-namespace", "dns"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := newTestArgs()
+			args.ServerArgs.ControllerArgs.ConfigmapName = tt.configmap
+			args.ServerArgs.ControllerArgs.ConfigmapNamespace = tt.namespace
+			s, clientset := newTestServer(t, args, coreDNSObjects()...)
+			if err := s.ensureDeployment(); err != nil {
+				t.Fatalf("ensureDeployment: %v", err)
+			}
+			var got []string
+			containerArgs := hostsServerContainerOf(getDeployment(t, clientset)).Args
+			for i, arg := range containerArgs {
+				if strings.HasPrefix(arg, "--record-configmap-") && i+1 < len(containerArgs) {
+					got = append(got, arg, containerArgs[i+1])
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("the configmap args = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnsureDeploymentCompressRecords(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		args := newTestArgs()
+		args.ServerArgs.ControllerArgs.CompressRecords = compress
+		s, clientset := newTestServer(t, args, coreDNSObjects()...)
+		if err := s.ensureDeployment(); err != nil {
+			t.Fatalf("ensureDeployment: %v", err)
+		}
+		containerArgs := hostsServerContainerOf(getDeployment(t, clientset)).Args
+		if got := ExistStringSlice("--compress-records", containerArgs); got != compress {
+			t.Errorf("compress %v: the args %v have --compress-records %v", compress, containerArgs, got)
+		}
+	}
+}
+
+func TestEnsureDeploymentReloadCoreDNS(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		objects := coreDNSObjects()
+		if shared {
+			objects[0].(*appsv1.Deployment).Spec.Template.Spec.ShareProcessNamespace = &shared
+		}
+		args := newTestArgs()
+		args.ServerArgs.ControllerArgs.ReloadCoreDNS = true
+		s, clientset := newTestServer(t, args, objects...)
+		if err := s.ensureDeployment(); err != nil {
+			t.Fatalf("ensureDeployment: %v", err)
+		}
+		deployment := getDeployment(t, clientset)
+		if share := deployment.Spec.Template.Spec.ShareProcessNamespace; share == nil || !*share {
+			t.Errorf("shared %v: shareProcessNamespace = %v, want true for the signal to reach coredns", shared, share)
+		}
+		if containerArgs := hostsServerContainerOf(deployment).Args; !ExistStringSlice("--reload-coredns", containerArgs) {
+			t.Errorf("shared %v: the args %v have no --reload-coredns", shared, containerArgs)
+		}
+
+		// The uninstall unsets it only if the installer set it
+		if err := s.removeDeploymentSidecar(); err != nil {
+			t.Fatalf("removeDeploymentSidecar: %v", err)
+		}
+		if share := getDeployment(t, clientset).Spec.Template.Spec.ShareProcessNamespace; (share != nil) != shared {
+			t.Errorf("shared %v: shareProcessNamespace after the uninstall = %v", shared, share)
+		}
+	}
+}
+
+func TestEnsureDeploymentRecordNoReverse(t *testing.T) {
+	args := newTestArgs()
+	args.HostsRecordNoReverse = true
+	s, clientset := newTestServer(t, args, coreDNSObjects()...)
+	if err := s.ensureDeployment(); err != nil {
+		t.Fatalf("ensureDeployment: %v", err)
+	}
+	if containerArgs := hostsServerContainerOf(getDeployment(t, clientset)).Args; !ExistStringSlice("--reverse-file", containerArgs) {
+		t.Errorf("the args %v have no --reverse-file", containerArgs)
+	}
+}
+
+func TestEnsureDeploymentResources(t *testing.T) {
+	tests := []struct {
+		name       string
+		cpuLimit   string
+		wantLimits corev1.ResourceList
+	}{
+		{
+			name:       "defaults",
+			wantLimits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse(DefaultServerMemoryLimit)},
+		},
+		{
+			name:     "cpu limit",
+			cpuLimit: "100m",
+			wantLimits: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("100m"),
+				corev1.ResourceMemory: resource.MustParse(DefaultServerMemoryLimit),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := newTestArgs()
+			args.ServerCPULimit = tt.cpuLimit
+			s, clientset := newTestServer(t, args, coreDNSObjects()...)
+			if err := s.ensureDeployment(); err != nil {
+				t.Fatalf("ensureDeployment: %v", err)
+			}
+			resources := hostsServerContainerOf(getDeployment(t, clientset)).Resources
+			wantRequests := corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse(DefaultServerCPURequest),
+				corev1.ResourceMemory: resource.MustParse(DefaultServerMemoryRequest),
+			}
+			if !equality.Semantic.DeepEqual(resources.Requests, wantRequests) {
+				t.Errorf("the requests = %v, want %v", resources.Requests, wantRequests)
+			}
+			if !equality.Semantic.DeepEqual(resources.Limits, tt.wantLimits) {
+				t.Errorf("the limits = %v, want %v", resources.Limits, tt.wantLimits)
+			}
+		})
+	}
+}
+
+func TestServerResourcesInvalid(t *testing.T) {
+	args := newTestArgs()
+	args.ServerMemoryLimit = "a lot"
+	if _, err := args.ServerResources(); err == nil {
+		t.Error("ServerResources() error = nil, want the invalid --server-memory-limit")
+	}
+}
+
+func TestEnsureDeploymentProbes(t *testing.T) {
+	tests := []struct {
+		name      string
+		liveness  bool
+		readiness bool
+	}{
+		{name: "both", liveness: true, readiness: true},
+		{name: "liveness only", liveness: true},
+		{name: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := newTestArgs()
+			args.ServerArgs.Port = 9099
+			args.ServerLivenessProbe = tt.liveness
+			args.ServerReadinessProbe = tt.readiness
+			s, clientset := newTestServer(t, args, coreDNSObjects()...)
+			if err := s.ensureDeployment(); err != nil {
+				t.Fatalf("ensureDeployment: %v", err)
+			}
+			container := hostsServerContainerOf(getDeployment(t, clientset))
+			for _, probe := range []struct {
+				name  string
+				probe *corev1.Probe
+				want  bool
+				path  string
+			}{
+				{"liveness", container.LivenessProbe, tt.liveness, "/healthz"},
+				{"readiness", container.ReadinessProbe, tt.readiness, "/readyz"},
+			} {
+				if !probe.want {
+					if probe.probe != nil {
+						t.Errorf("the %s probe = %+v, want none", probe.name, probe.probe)
+					}
+					continue
+				}
+				if probe.probe == nil || probe.probe.HTTPGet == nil {
+					t.Errorf("the %s probe = %+v, want a HTTP GET", probe.name, probe.probe)
+					continue
+				}
+				if got := probe.probe.HTTPGet.Path; got != probe.path {
+					t.Errorf("the path of the %s probe = %v, want %v", probe.name, got, probe.path)
+				}
+				if got := probe.probe.HTTPGet.Port.IntValue(); got != 9099 {
+					t.Errorf("the port of the %s probe = %v, want %v", probe.name, got, 9099)
+				}
+			}
+		})
+	}
+}
+
+func TestEnsureDeploymentWithThePortInUse(t *testing.T) {
+	objects := coreDNSObjects()
+	deployment := objects[0].(*appsv1.Deployment)
+	deployment.Spec.Template.Spec.Containers = append(deployment.Spec.Template.Spec.Containers, corev1.Container{
+		Name:  "sidecar",
+		Ports: []corev1.ContainerPort{{ContainerPort: 9080}},
+	})
+	s, clientset := newTestServer(t, newTestArgs(), objects...)
+	err := s.ensureDeployment()
+	if err == nil || !strings.Contains(err.Error(), "sidecar") {
+		t.Fatalf("ensureDeployment() error = %v, want the port used by the sidecar", err)
+	}
+	if container := hostsServerContainerOf(getDeployment(t, clientset)); container != nil {
+		t.Errorf("the container %s is injected", container.Name)
+	}
+}
+
+func TestValidateServerPort(t *testing.T) {
+	containers := []corev1.Container{
+		{Name: "coredns", Ports: []corev1.ContainerPort{{ContainerPort: 53}, {ContainerPort: 9153}}},
+		{Name: coreDNSHostsServerName, Ports: []corev1.ContainerPort{{ContainerPort: 9080}}},
+	}
+	tests := []struct {
+		port    int32
+		wantErr bool
+	}{
+		{port: 9080},
+		{port: 9081},
+		{port: 9153, wantErr: true},
+		{port: 53, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := ValidateServerPort(containers, tt.port); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateServerPort(%d) error = %v, wantErr %v", tt.port, err, tt.wantErr)
+		}
+	}
+}
+
+func TestEnsureServiceKeepsTheIPFamilies(t *testing.T) {
+	objects := coreDNSObjects()
+	service := objects[1].(*corev1.Service)
+	policy := corev1.IPFamilyPolicyRequireDualStack
+	service.Spec.IPFamilyPolicy = &policy
+	service.Spec.IPFamilies = []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol}
+	service.Spec.ClusterIP = "10.96.0.10"
+	service.Spec.ClusterIPs = []string{"10.96.0.10", "fd00:10:96::a"}
+	s, clientset := newTestServer(t, newTestArgs(), objects...)
+	if err := s.ensureService(); err != nil {
+		t.Fatalf("ensureService: %v", err)
+	}
+	got := getService(t, clientset)
+	if port, ok := ServicePortByName(servicePortName, got.Spec.Ports); !ok || port.Port != 9080 {
+		t.Errorf("the ports = %+v, want %s at 9080", got.Spec.Ports, servicePortName)
+	}
+	if !ExistPortsByPort(53, got.Spec.Ports) {
+		t.Errorf("the ports = %+v, want the port 53 kept", got.Spec.Ports)
+	}
+	if got.Spec.IPFamilyPolicy == nil || *got.Spec.IPFamilyPolicy != policy {
+		t.Errorf("the ipFamilyPolicy = %v, want %v", got.Spec.IPFamilyPolicy, policy)
+	}
+	if !reflect.DeepEqual(got.Spec.IPFamilies, service.Spec.IPFamilies) || !reflect.DeepEqual(got.Spec.ClusterIPs, service.Spec.ClusterIPs) {
+		t.Errorf("the ipFamilies = %v and clusterIPs = %v, want %v and %v", got.Spec.IPFamilies, got.Spec.ClusterIPs, service.Spec.IPFamilies, service.Spec.ClusterIPs)
+	}
+}
+
+func TestEnsureServiceWithADuplicateName(t *testing.T) {
+	tests := []struct {
+		name string
+		// injected is the marker of the port named apis already in the Service, empty if someone else added it
+		injected string
+		wantErr  bool
+	}{
+		{name: "added by the installer", injected: "port:8080"},
+		{name: "added by someone else", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := coreDNSObjects()
+			service := objects[1].(*corev1.Service)
+			service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Name: servicePortName, Protocol: corev1.ProtocolTCP, Port: 8080})
+			if tt.injected != "" {
+				markInjected(service, tt.injected)
+			}
+			s, clientset := newTestServer(t, newTestArgs(), objects...)
+			err := s.ensureService()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ensureService = %v, want the error %v", err, tt.wantErr)
+			}
+			got := getService(t, clientset)
+			var names []string
+			for _, port := range got.Spec.Ports {
+				if port.Name == servicePortName {
+					names = append(names, strconv.Itoa(int(port.Port)))
+				}
+			}
+			want, wantElements := []string{"9080"}, []string{"port:9080"}
+			if tt.wantErr {
+				want, wantElements = []string{"8080"}, nil
+			}
+			if !reflect.DeepEqual(names, want) {
+				t.Errorf("the ports named %s = %v, want %v", servicePortName, names, want)
+			}
+			if !ExistPortsByPort(53, got.Spec.Ports) {
+				t.Errorf("the ports = %+v, want the port 53 kept", got.Spec.Ports)
+			}
+			if elements, _ := injectedElements(got); !reflect.DeepEqual(elements, wantElements) {
+				t.Errorf("the injected elements = %v, want %v", elements, wantElements)
+			}
+		})
+	}
+}
+
+func TestEnsureServiceWithAConcurrentModification(t *testing.T) {
+	s, clientset := newTestServer(t, newTestArgs(), coreDNSObjects()...)
+	patches := 0
+	clientset.PrependReactor("patch", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches++
+		if patches > 1 {
+			return false, nil, nil
+		}
+		// Someone else changes the Service after it is read, which makes the first patch conflict. The
+		// tracker is used directly since the clientset is locked while its reactors run.
+		gvr := corev1.SchemeGroupVersion.WithResource("services")
+		obj, err := clientset.Tracker().Get(gvr, "kube-system", "kube-dns")
+		if err != nil {
+			return true, nil, err
+		}
+		service := obj.(*corev1.Service).DeepCopy()
+		service.Labels["owner"] = "someone-else"
+		service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Name: "dns-tcp", Protocol: corev1.ProtocolTCP, Port: 53})
+		service.Spec.SessionAffinity = corev1.ServiceAffinityClientIP
+		if err := clientset.Tracker().Update(gvr, service, "kube-system"); err != nil {
+			return true, nil, err
+		}
+		return true, nil, apierrors.NewConflict(gvr.GroupResource(), service.Name, fmt.Errorf("the object has been modified"))
+	})
+	if err := s.ensureService(); err != nil {
+		t.Fatalf("ensureService: %v", err)
+	}
+	if patches != 2 {
+		t.Errorf("got %d patches, want the conflict retried once", patches)
+	}
+	got := getService(t, clientset)
+	var ports []string
+	for _, port := range got.Spec.Ports {
+		ports = append(ports, fmt.Sprintf("%s/%d/%s", port.Name, port.Port, port.Protocol))
+	}
+	sort.Strings(ports)
+	if want := []string{servicePortName + "/9080/TCP", "dns-tcp/53/TCP", "dns/53/UDP"}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("the ports = %v, want %v", ports, want)
+	}
+	if got.Labels["owner"] != "someone-else" || got.Spec.SessionAffinity != corev1.ServiceAffinityClientIP {
+		t.Errorf("the labels = %v and the session affinity = %v, want the concurrent change kept", got.Labels, got.Spec.SessionAffinity)
+	}
+}
@@ -0,0 +1,279 @@
+package installer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+// servicePortName is the name of the port added to the Service of CoreDNS
+const servicePortName = "apis"
+
+// Uninstall reverts every mutation made by RunOnce in the reverse order, the ones already
+// reverted are skipped so that it can be run again after a failure.
+func (s *Server) Uninstall() error {
+	if err := s.removeCoreDNSConfigmapHosts(); err != nil {
+		return fmt.Errorf("failed to removeCoreDNSConfigmapHosts:%v", err)
+	}
+	if err := s.removeServicePort(); err != nil {
+		return fmt.Errorf("failed to removeServicePort:%v", err)
+	}
+	if err := s.removeDeploymentSidecar(); err != nil {
+		return fmt.Errorf("failed to removeDeploymentSidecar:%v", err)
+	}
+	if err := s.removeClusterroleRule(); err != nil {
+		return fmt.Errorf("failed to removeClusterroleRule:%v", err)
+	}
+	return nil
+}
+
+func (s *Server) removeClusterroleRule() error {
+	clusterRoleName, err := s.findClusterRoleName()
+	if err != nil {
+		return err
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		result, getErr := s.clientset.RbacV1().ClusterRoles().Get(context.TODO(), clusterRoleName, metav1.GetOptions{})
+		if getErr != nil {
+			return fmt.Errorf("failed to get latest version of ClusterRole: %v", getErr)
+		}
+		// The rules marked are the ones added, and without the markers the optional rules are removed
+		// regardless of the flags, which may be set by an earlier install
+		addedRules := injectablePolicyRules()
+		if elements, marked := injectedElements(result); marked {
+			names := injectedNames(elements, injectedRule)
+			addedRules = addedRules[:0]
+			for _, rule := range injectablePolicyRules() {
+				if ExistStringSlice(policyRuleName(rule), names) {
+					addedRules = append(addedRules, rule)
+				}
+			}
+		}
+		rules := make([]rbacv1.PolicyRule, 0, len(result.Rules))
+		for _, rule := range result.Rules {
+			if !ExistPolicyRule(rule, addedRules) {
+				rules = append(rules, rule)
+			}
+		}
+		unmarked := unmarkInjected(result)
+		if len(rules) == len(result.Rules) && !unmarked {
+			return nil
+		}
+		result.Rules = rules
+		_, updateErr := s.clientset.RbacV1().ClusterRoles().Update(context.TODO(), result, metav1.UpdateOptions{})
+		return updateErr
+	})
+}
+
+func (s *Server) removeDeploymentSidecar() error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		// Retrieve the latest version of Deployment before attempting update
+		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
+		result, getErr := s.clientset.AppsV1().Deployments(s.corednsDeployment.Namespace).Get(context.TODO(), s.corednsDeployment.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return fmt.Errorf("failed to get latest version of Deployment: %v", getErr)
+		}
+		var needUpdate bool
+		podSpec := &result.Spec.Template.Spec
+		// remove Container
+		containers := make([]corev1.Container, 0, len(podSpec.Containers))
+		for _, container := range podSpec.Containers {
+			if container.Name == coreDNSHostsServerName {
+				needUpdate = true
+				continue
+			}
+			// remove container volumeMount
+			if ExistVolumeMountsByName(sharedVolumeName, container.VolumeMounts) {
+				needUpdate = true
+				mounts := make([]corev1.VolumeMount, 0, len(container.VolumeMounts))
+				for _, mount := range container.VolumeMounts {
+					if mount.Name != sharedVolumeName {
+						mounts = append(mounts, mount)
+					}
+				}
+				container.VolumeMounts = mounts
+			}
+			containers = append(containers, container)
+		}
+		podSpec.Containers = containers
+		// remove volume
+		if ExistVolumeMsByName(sharedVolumeName, podSpec.Volumes) {
+			needUpdate = true
+			volumes := make([]corev1.Volume, 0, len(podSpec.Volumes))
+			for _, volume := range podSpec.Volumes {
+				if volume.Name != sharedVolumeName {
+					volumes = append(volumes, volume)
+				}
+			}
+			podSpec.Volumes = volumes
+		}
+		// remove imagePullSecret, the marked ones are the ones added and otherwise the one of the flag
+		var pullSecrets []string
+		if elements, marked := injectedElements(result); marked {
+			pullSecrets = injectedNames(elements, injectedImagePullSecret)
+		} else if s.args.ServerImagePullSecret != "" {
+			pullSecrets = []string{s.args.ServerImagePullSecret}
+		}
+		for _, secret := range pullSecrets {
+			if !ExistPullSecretByName(secret, podSpec.ImagePullSecrets) {
+				continue
+			}
+			needUpdate = true
+			secrets := make([]corev1.LocalObjectReference, 0, len(podSpec.ImagePullSecrets))
+			for _, ref := range podSpec.ImagePullSecrets {
+				if ref.Name != secret {
+					secrets = append(secrets, ref)
+				}
+			}
+			podSpec.ImagePullSecrets = secrets
+		}
+		// unset shareProcessNamespace, which is marked only if set by the installer
+		if elements, _ := injectedElements(result); ExistStringSlice(shareProcessNamespaceField, injectedNames(elements, injectedPodSpec)) &&
+			podSpec.ShareProcessNamespace != nil {
+			needUpdate = true
+			podSpec.ShareProcessNamespace = nil
+		}
+		if unmarkInjected(result) {
+			needUpdate = true
+		}
+		if needUpdate {
+			_, updateErr := s.clientset.AppsV1().Deployments(s.corednsDeployment.Namespace).Update(context.TODO(), result, metav1.UpdateOptions{})
+			return updateErr
+		}
+		return nil
+	})
+}
+
+// removeServicePort removes the port added by ensureService with a strategic merge patch, which
+// leaves the other fields of the Service as they are.
+func (s *Server) removeServicePort() error {
+	result, getErr := s.getService()
+	if getErr != nil {
+		return fmt.Errorf("failed to get latest version of Service: %v", getErr)
+	}
+	// Only the port added by RunOnce is removed, which is the marked one even if --server-port differs
+	addedPort := s.args.ServerArgs.Port
+	elements, marked := injectedElements(result)
+	if ports := injectedNames(elements, injectedPort); len(ports) > 0 {
+		port, err := strconv.ParseInt(ports[0], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid port %q in the annotation %s: %v", ports[0], InjectedAnnotation, err)
+		}
+		addedPort = int32(port)
+	}
+	var found bool
+	for _, port := range result.Spec.Ports {
+		if port.Name == servicePortName && port.Port == addedPort {
+			found = true
+		}
+	}
+	if !found && !marked {
+		return nil
+	}
+	patch := map[string]interface{}{
+		// A null removes the annotation
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{ManagedByAnnotation: nil, InjectedAnnotation: nil},
+		},
+	}
+	if found {
+		patch["spec"] = map[string]interface{}{
+			"ports": []map[string]interface{}{
+				{"port": addedPort, "$patch": "delete"},
+			},
+		}
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = s.clientset.CoreV1().Services(result.Namespace).Patch(context.TODO(), result.Name, types.StrategicMergePatchType, data, metav1.PatchOptions{})
+	return err
+}
+
+func (s *Server) removeCoreDNSConfigmapHosts() error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		result, getErr := s.clientset.CoreV1().ConfigMaps(s.args.CoreDNSNamespace).Get(context.TODO(), s.args.CoreDNSName, metav1.GetOptions{})
+		if getErr != nil {
+			return fmt.Errorf("failed to get latest version of ConfigMap: %v", getErr)
+		}
+		// The marked hosts files are the ones added, even if --hosts-dir differs
+		hostsPaths := []string{s.args.HostsPath()}
+		if elements, marked := injectedElements(result); marked {
+			hostsPaths = injectedNames(elements, injectedHosts)
+		}
+		corefile := []byte(result.Data["Corefile"])
+		var needUpdate bool
+		for _, hostsPath := range hostsPaths {
+			var removed bool
+			var err error
+			corefile, removed, err = RemoveHostsFromCoreFile(corefile, hostsPath)
+			if err != nil {
+				return err
+			}
+			needUpdate = needUpdate || removed
+		}
+		if needUpdate {
+			if err := ValidateCoreFile(corefile); err != nil {
+				return err
+			}
+			result.Data["Corefile"] = string(corefile)
+		}
+		if unmarkInjected(result) {
+			needUpdate = true
+		}
+		if !needUpdate {
+			return nil
+		}
+		_, updateErr := s.clientset.CoreV1().ConfigMaps(s.args.CoreDNSNamespace).Update(context.TODO(), result, metav1.UpdateOptions{})
+		return updateErr
+	})
+}
+
+// RemoveHostsFromCoreFile drops the hosts directives pointing at the hosts file of the server together
+// with the server blocks added for them, the hosts directives reading other files and the rest of the
+// Corefile are kept verbatim.
+func RemoveHostsFromCoreFile(corefile []byte, hostsPath string) ([]byte, bool, error) {
+	var needUpdate bool
+	lines := strings.Split(string(corefile), "\n")
+	blocks, err := scanCorefile(lines)
+	if err != nil {
+		return nil, needUpdate, err
+	}
+	// Remove from the bottom so that the line numbers above stay valid
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if blocks[i].snippet {
+			continue
+		}
+		for j := len(blocks[i].directives) - 1; j >= 0; j-- {
+			directive := blocks[i].directives[j]
+			if directive.name != "hosts" {
+				continue
+			}
+			item := parseDirective(lines[directive.start : directive.end+1])
+			if len(item) <= 1 || item[1] != hostsPath {
+				continue
+			}
+			needUpdate = true
+			if strings.Contains(lines[blocks[i].start], generatedBlockComment) {
+				// The blank line separating the block added by reverseBlock goes along
+				start := blocks[i].start
+				if start > 0 && strings.TrimSpace(lines[start-1]) == "" {
+					start--
+				}
+				lines = append(lines[:start], lines[blocks[i].end+1:]...)
+				break
+			}
+			lines = append(lines[:directive.start], lines[directive.end+1:]...)
+		}
+	}
+	return []byte(strings.Join(lines, "\n")), needUpdate, nil
+}
@@ -0,0 +1,78 @@
+package installer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+func TestUninstall(t *testing.T) {
+	objects := coreDNSObjects()
+	s, clientset := newTestServer(t, newTestArgs(), objects...)
+	original := struct {
+		deployment interface{}
+		service    interface{}
+		corefile   string
+		rules      interface{}
+	}{
+		deployment: getDeployment(t, clientset).Spec.Template.Spec,
+		service:    getService(t, clientset).Spec.Ports,
+		corefile:   getCoreDNSConfigmap(t, clientset).Data["Corefile"],
+		rules:      getClusterRole(t, clientset).Rules,
+	}
+	if err := s.RunOnce(); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	if hostsServerContainerOf(getDeployment(t, clientset)) == nil || !strings.Contains(getCoreDNSConfigmap(t, clientset).Data["Corefile"], "hosts ") {
+		t.Fatal("RunOnce didn't install the server")
+	}
+
+	// Uninstalling twice is the same as once
+	for i := 0; i < 2; i++ {
+		if err := s.Uninstall(); err != nil {
+			t.Fatalf("Uninstall: %v", err)
+		}
+		if spec := getDeployment(t, clientset).Spec.Template.Spec; !equality.Semantic.DeepEqual(spec, original.deployment) {
+			t.Errorf("the pod spec = %+v, want the original %+v", spec, original.deployment)
+		}
+		if ports := getService(t, clientset).Spec.Ports; !reflect.DeepEqual(ports, original.service) {
+			t.Errorf("the Service ports = %+v, want the original %+v", ports, original.service)
+		}
+		if corefile := getCoreDNSConfigmap(t, clientset).Data["Corefile"]; corefile != original.corefile {
+			t.Errorf("the Corefile = %q, want the original %q", corefile, original.corefile)
+		}
+		if rules := getClusterRole(t, clientset).Rules; !reflect.DeepEqual(rules, original.rules) {
+			t.Errorf("the ClusterRole rules = %+v, want the original %+v", rules, original.rules)
+		}
+	}
+}
+
+func TestUninstallTheHostsFilesOfTheZones(t *testing.T) {
+	objects := coreDNSObjects()
+	original := testCorefile + "\nexample.org:53 {\n    forward . 8.8.8.8\n}\n"
+	objects[2].(*corev1.ConfigMap).Data["Corefile"] = original
+	args := newTestArgs()
+	args.HostsZoneTTLs = map[string]int{"example.org": 10}
+	s, clientset := newTestServer(t, args, objects...)
+	if err := s.RunOnce(); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	// The server writes the file of the zone the hosts directive of its server block reads
+	zonePath := args.HostsZonePath("example.org")
+	if containerArgs := hostsServerContainerOf(getDeployment(t, clientset)).Args; !ExistStringSlice(zonePath, containerArgs) {
+		t.Errorf("the args = %v, want --file-path %s", containerArgs, zonePath)
+	}
+	if corefile := getCoreDNSConfigmap(t, clientset).Data["Corefile"]; !strings.Contains(corefile, "hosts "+zonePath+" {\n        ttl 10\n    }") {
+		t.Errorf("the Corefile = %q, want the hosts directive of %s with ttl 10", corefile, zonePath)
+	}
+
+	if err := s.Uninstall(); err != nil {
+		t.Fatalf("Uninstall: %v", err)
+	}
+	if corefile := getCoreDNSConfigmap(t, clientset).Data["Corefile"]; corefile != original {
+		t.Errorf("the Corefile = %q, want the original %q", corefile, original)
+	}
+}
@@ -0,0 +1,119 @@
+package installer
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CheckResult is the result of checking one mutation made by RunOnce
+type CheckResult struct {
+	Name    string
+	Passed  bool
+	Message string
+}
+
+func newCheckResult(name string, err error) CheckResult {
+	if err != nil {
+		return CheckResult{Name: name, Passed: false, Message: err.Error()}
+	}
+	return CheckResult{Name: name, Passed: true}
+}
+
+// Verify checks every mutation made by RunOnce is still in place without changing anything
+func (s *Server) Verify() []CheckResult {
+	var results []CheckResult
+	results = append(results, s.verifyClusterrole())
+	results = append(results, s.verifyDeployment()...)
+	results = append(results, s.verifyService())
+	results = append(results, s.verifyCoreDNSConfigmap())
+	return results
+}
+
+func (s *Server) verifyClusterrole() CheckResult {
+	name := "configmaps rule in the ClusterRole"
+	clusterRoleName, err := s.findClusterRoleName()
+	if err != nil {
+		return newCheckResult(name, err)
+	}
+	result, err := s.clientset.RbacV1().ClusterRoles().Get(context.TODO(), clusterRoleName, metav1.GetOptions{})
+	if err != nil {
+		return newCheckResult(name, err)
+	}
+	if !ExistPolicyRule(configmapsPolicyRule(), result.Rules) {
+		return newCheckResult(name, fmt.Errorf("the ClusterRole %s has no configmaps rule", clusterRoleName))
+	}
+	if s.args.ServerArgs.EnableLeaderElection && !ExistPolicyRule(leasesPolicyRule(), result.Rules) {
+		return newCheckResult(name, fmt.Errorf("the ClusterRole %s has no leases rule for the leader election", clusterRoleName))
+	}
+	if s.args.ServerArgs.RestartCoreDNSOnChange && !ExistPolicyRule(deploymentsPolicyRule(), result.Rules) {
+		return newCheckResult(name, fmt.Errorf("the ClusterRole %s has no deployments rule for the hosts checksum", clusterRoleName))
+	}
+	return newCheckResult(name, nil)
+}
+
+func (s *Server) verifyDeployment() []CheckResult {
+	containerCheck := fmt.Sprintf("%s container in the Deployment", coreDNSHostsServerName)
+	volumeMountCheck := fmt.Sprintf("%s volumeMount in every container", sharedVolumeName)
+	volumeCheck := fmt.Sprintf("%s volume in the Deployment", sharedVolumeName)
+	result, err := s.clientset.AppsV1().Deployments(s.corednsDeployment.Namespace).Get(context.TODO(), s.corednsDeployment.Name, metav1.GetOptions{})
+	if err != nil {
+		return []CheckResult{newCheckResult(containerCheck, err), newCheckResult(volumeMountCheck, err), newCheckResult(volumeCheck, err)}
+	}
+	podSpec := result.Spec.Template.Spec
+
+	var containerErr, volumeMountErr, volumeErr error
+	if !ExistContainerByName(coreDNSHostsServerName, podSpec.Containers) {
+		containerErr = fmt.Errorf("the container %s is missing", coreDNSHostsServerName)
+	}
+	// The server must write the files the hosts directives read
+	for _, container := range podSpec.Containers {
+		for _, path := range s.args.HostsPaths() {
+			if container.Name == coreDNSHostsServerName && !ExistStringSlice(path, container.Args) {
+				containerErr = fmt.Errorf("the container %s does not write the hosts file %s", coreDNSHostsServerName, path)
+			}
+		}
+	}
+	for _, container := range podSpec.Containers {
+		if !ExistVolumeMountsByName(sharedVolumeName, container.VolumeMounts) {
+			volumeMountErr = fmt.Errorf("the container %s has no volumeMount %s", container.Name, sharedVolumeName)
+			break
+		}
+	}
+	if volumeMountErr == nil {
+		volumeMountErr = ValidateSharedVolumeMounts(podSpec.Containers, s.args.HostsDir)
+	}
+	if !ExistVolumeMsByName(sharedVolumeName, podSpec.Volumes) {
+		volumeErr = fmt.Errorf("the volume %s is missing", sharedVolumeName)
+	}
+	return []CheckResult{newCheckResult(containerCheck, containerErr), newCheckResult(volumeMountCheck, volumeMountErr), newCheckResult(volumeCheck, volumeErr)}
+}
+
+func (s *Server) verifyService() CheckResult {
+	name := fmt.Sprintf("port %d in the Service", s.args.ServerArgs.Port)
+	result, err := s.getService()
+	if err != nil {
+		return newCheckResult(name, err)
+	}
+	if !ExistPortsByPort(s.args.ServerArgs.Port, result.Spec.Ports) {
+		return newCheckResult(name, fmt.Errorf("the Service %s has no port %d", result.Name, s.args.ServerArgs.Port))
+	}
+	return newCheckResult(name, nil)
+}
+
+func (s *Server) verifyCoreDNSConfigmap() CheckResult {
+	name := fmt.Sprintf("hosts %s directive in the Corefile", s.args.HostsPath())
+	cm, err := s.clientset.CoreV1().ConfigMaps(s.args.CoreDNSNamespace).Get(context.TODO(), s.args.CoreDNSName, metav1.GetOptions{})
+	if err != nil {
+		return newCheckResult(name, err)
+	}
+	_, needUpdate, err := BuildNewCoreFile([]byte(cm.Data["Corefile"]), s.args.HostsOptions())
+	if err != nil {
+		return newCheckResult(name, err)
+	}
+	if needUpdate {
+		return newCheckResult(name, fmt.Errorf("the Corefile has no hosts directive pointing at %s with the configured options", s.args.HostsPath()))
+	}
+	return newCheckResult(name, nil)
+}
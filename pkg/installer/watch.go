@@ -0,0 +1,118 @@
+package installer
+
+import (
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+// reconcileKey is the only key of the workqueue, since every event re-ensures the whole installation
+const reconcileKey = "installation"
+
+// Watch turns the installer into a controller which watches the CoreDNS Deployment, Service and
+// ConfigMap and runs the install again once any of them drifts, until stopCh is closed.
+// The installation is also re-ensured every resyncPeriod even without events, 0 means never.
+func (s *Server) Watch(stopCh <-chan struct{}, resyncPeriod time.Duration) error {
+	defer utilruntime.HandleCrash()
+
+	queue := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Installation")
+	defer queue.ShutDown()
+
+	informerFactory := informers.NewSharedInformerFactoryWithOptions(s.clientset, resyncPeriod, informers.WithNamespace(s.args.CoreDNSNamespace))
+	deploymentInformer := informerFactory.Apps().V1().Deployments().Informer()
+	serviceInformer := informerFactory.Core().V1().Services().Informer()
+	configmapInformer := informerFactory.Core().V1().ConfigMaps().Informer()
+
+	deploymentInformer.AddEventHandler(s.eventHandler(queue, func(obj interface{}) bool {
+		deploy, ok := obj.(*appsv1.Deployment)
+		return ok && deploy.Name == s.corednsDeployment.Name
+	}))
+	serviceInformer.AddEventHandler(s.eventHandler(queue, func(obj interface{}) bool {
+		svc, ok := obj.(*corev1.Service)
+		return ok && svc.Name == s.corednsService
+	}))
+	configmapInformer.AddEventHandler(s.eventHandler(queue, func(obj interface{}) bool {
+		cm, ok := obj.(*corev1.ConfigMap)
+		return ok && cm.Name == s.args.CoreDNSName
+	}))
+
+	klog.Info("Starting the installer in the watch mode")
+	informerFactory.Start(stopCh)
+	if ok := cache.WaitForCacheSync(stopCh, deploymentInformer.HasSynced, serviceInformer.HasSynced, configmapInformer.HasSynced); !ok {
+		return fmt.Errorf("failed to wait for caches to sync")
+	}
+	// Ensure the installation once even if nothing changes
+	queue.Add(reconcileKey)
+	go wait.Until(func() {
+		for s.processNextItem(queue) {
+		}
+	}, time.Second, stopCh)
+
+	<-stopCh
+	klog.Info("Shutting down the installer")
+	return nil
+}
+
+// eventHandler enqueues the reconcile once an object matching the filter is added, updated or deleted
+func (s *Server) eventHandler(queue workqueue.RateLimitingInterface, filter func(obj interface{}) bool) cache.ResourceEventHandler {
+	return cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			return filter(obj)
+		},
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				queue.Add(reconcileKey)
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldMeta, ok := oldObj.(metav1.Object)
+				newMeta, ok1 := newObj.(metav1.Object)
+				if !ok || !ok1 {
+					return
+				}
+				// The status of the Deployment changes on every rollout, only the spec matters.
+				// The periodic resync delivers the same ResourceVersion, which is kept to
+				// re-ensure the installation on the resync period.
+				if _, isDeploy := newObj.(*appsv1.Deployment); isDeploy && oldMeta.GetResourceVersion() != newMeta.GetResourceVersion() &&
+					oldMeta.GetGeneration() == newMeta.GetGeneration() {
+					return
+				}
+				klog.InfoS("Update Event", "object", klog.KObj(newMeta))
+				queue.Add(reconcileKey)
+			},
+			DeleteFunc: func(obj interface{}) {
+				queue.Add(reconcileKey)
+			},
+		},
+	}
+}
+
+// processNextItem runs the install for the next key of the queue, which is retried with
+// backoff on error, and returns false once the queue is shut down.
+func (s *Server) processNextItem(queue workqueue.RateLimitingInterface) bool {
+	key, quit := queue.Get()
+	if quit {
+		return false
+	}
+	defer queue.Done(key)
+	startTime := time.Now()
+	if err := s.RunOnce(); err != nil {
+		klog.ErrorS(err, "Error ensuring the installation and retry...")
+		queue.AddRateLimited(key)
+		return true
+	}
+	queue.Forget(key)
+	klog.Infof("Finished ensuring the installation, and cost %s", time.Since(startTime))
+	return true
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "coredns_hosts_api"
+
+var (
+	// HTTPRequests counts the api requests by route and status code
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "The number of the api requests by method, route and status code.",
+	}, []string{"method", "route", "code"})
+	// HTTPRequestDuration observes the latency of the api requests by route
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "The latency of the api requests by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+	// ConfigmapUpdateRetries counts the retries of the configmap updates on conflict by operation
+	ConfigmapUpdateRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "configmap_update_retries_total",
+		Help:      "The number of the retries of the configmap updates on conflict by operation.",
+	}, []string{"operation"})
+	// Syncs counts the renderings of the hosts file by result, success or error
+	Syncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "syncs_total",
+		Help:      "The number of the renderings of the hosts file by result.",
+	}, []string{"result"})
+	// SyncDuration observes the latency of the renderings of the hosts file
+	SyncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sync_duration_seconds",
+		Help:      "The latency of the renderings of the hosts file.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	// HostsFileDrifts counts the out of band changes of the hosts files found before writing them
+	HostsFileDrifts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hosts_file_drifts_total",
+		Help:      "The number of the out of band changes of the hosts file by path.",
+	}, []string{"path"})
+	// WatchFailures counts the failures of the configmap watch
+	WatchFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watch_failures_total",
+		Help:      "The number of the failures of the configmap watch.",
+	})
+	// Conflicts is the number of the domains mapped to different values across the record namespaces
+	Conflicts = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "conflicts",
+		Help:      "The number of the domains mapped to different values across the record namespaces.",
+	})
+)
+
+var registerOnce sync.Once
+
+// Register registers all the collectors to the default registry, it is safe to call more than once
+func Register() {
+	registerOnce.Do(func() {
+		prometheus.MustRegister(
+			HTTPRequests,
+			HTTPRequestDuration,
+			ConfigmapUpdateRetries,
+			Syncs,
+			SyncDuration,
+			HostsFileDrifts,
+			WatchFailures,
+			Conflicts,
+		)
+	})
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog/v2"
+)
+
+// writeRequest is the client writing the records and the version of the records the write is based on
+type writeRequest struct {
+	// Version guards the write unless it is empty, see ifMatch
+	Version string
+	// Caller identifies the client in the audit log, see callerIdentity
+	Caller string
+}
+
+func newWriteRequest(c *gin.Context) writeRequest {
+	return writeRequest{
+		Version: ifMatch(c),
+		Caller:  callerIdentity(c),
+	}
+}
+
+// callerIdentity identifies the client by the hash of its bearer token, which is never logged
+// itself, or by its ip without the token.
+func callerIdentity(c *gin.Context) string {
+	if header := c.GetHeader("Authorization"); header != "" {
+		sum := sha256.Sum256([]byte(strings.TrimPrefix(header, bearerPrefix)))
+		return "token:" + hex.EncodeToString(sum[:])[:12]
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// AuditEntry is a change of a record, the values are the ones stored in the configmap
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Caller    string    `json:"caller"`
+	Namespace string    `json:"namespace"`
+	Domain    string    `json:"domain"`
+	Action    string    `json:"action"`
+	OldValue  string    `json:"oldValue"`
+	NewValue  string    `json:"newValue"`
+}
+
+// auditLogger logs every change of the records as a klog entry, and as a JSON line of the
+// audit log file if it is set. The reads are not audited.
+type auditLogger struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// newAuditLogger opens the audit log file for appending, only klog is written if the path is empty
+func newAuditLogger(path string) (*auditLogger, error) {
+	a := &auditLogger{}
+	if path == "" {
+		return a, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the audit log file: %v", err)
+	}
+	a.file = file
+	return a, nil
+}
+
+func (a *auditLogger) log(entry AuditEntry) {
+	klog.InfoS("Audit", "caller", entry.Caller, "namespace", entry.Namespace, "domain", entry.Domain,
+		"action", entry.Action, "oldValue", entry.OldValue, "newValue", entry.NewValue)
+	if a.file == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		klog.ErrorS(err, "Failed to marshal the audit entry")
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		klog.ErrorS(err, "Failed to write the audit log file", "path", a.file.Name())
+	}
+}
+
+// recordChange keeps the change of the record made by the request in the history and the audit log,
+// and posts it to the change webhook if any
+func (r *recordController) recordChange(namespace string, req writeRequest, domain, action, oldValue, newValue string) {
+	r.history.add(namespace, domain, action, oldValue, newValue)
+	r.audit.log(AuditEntry{
+		Time:      time.Now(),
+		Caller:    req.Caller,
+		Namespace: namespace,
+		Domain:    domain,
+		Action:    action,
+		OldValue:  oldValue,
+		NewValue:  newValue,
+	})
+	if r.webhook != nil {
+		r.webhook.notify(newWebhookEvent(namespace, domain, action, oldValue, newValue))
+	}
+}
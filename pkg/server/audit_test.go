@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s := newSyncedTestServer(t, Args{AuditLogPath: path})
+	h := s.webServer.Handler
+	for _, req := range []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodPost, "/api/v1/records", `{"domain": "a.com", "ip": "10.0.0.1"}`},
+		{http.MethodGet, "/api/v1/record/a.com", ""},
+		{http.MethodPut, "/api/v1/records/a.com", `{"ip": "10.0.0.2"}`},
+		{http.MethodGet, "/api/v1/records", ""},
+		{http.MethodDelete, "/api/v1/record/a.com", ""},
+	} {
+		if w := serve(h, req.method, req.path, req.body, "Authorization", "Bearer secret"); w.Code != http.StatusOK {
+			t.Fatalf("%s %s = %d %s", req.method, req.path, w.Code, w.Body)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("failed to decode the audit entry %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	// The reads are not audited
+	want := []struct{ oldValue, newValue string }{
+		{"", "10.0.0.1"},
+		{"10.0.0.1", "10.0.0.2"},
+		{"10.0.0.2", ""},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d audit entries %+v, want %d", len(entries), entries, len(want))
+	}
+	for i, entry := range entries {
+		if entry.OldValue != want[i].oldValue || entry.NewValue != want[i].newValue {
+			t.Errorf("the entry %d changed %q to %q, want %q to %q", i, entry.OldValue, entry.NewValue, want[i].oldValue, want[i].newValue)
+		}
+		if entry.Domain != "a.com" || entry.Namespace != controller.DefaultConfigmapNamespace || entry.Time.IsZero() {
+			t.Errorf("the entry %d = %+v, want a.com of %s", i, entry, controller.DefaultConfigmapNamespace)
+		}
+		// The caller is the hash of the token, which is never logged itself
+		if !strings.HasPrefix(entry.Caller, "token:") || strings.Contains(entry.Caller, "secret") {
+			t.Errorf("the caller of the entry %d = %q, want the hash of the token", i, entry.Caller)
+		}
+	}
+}
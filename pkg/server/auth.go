@@ -0,0 +1,51 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog/v2"
+)
+
+// bearerPrefix is the scheme of the Authorization header carrying the token
+const bearerPrefix = "Bearer "
+
+// loadAuthToken returns the token of --auth-token, or else the content of --auth-token-file
+// which is typically a key of a Secret mounted into the pod. Empty means the api is open.
+func loadAuthToken(token, tokenFile string) (string, error) {
+	if token != "" && tokenFile != "" {
+		return "", fmt.Errorf("--auth-token and --auth-token-file can not be set together")
+	}
+	if tokenFile == "" {
+		return token, nil
+	}
+	content, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the auth token file: %v", err)
+	}
+	token = strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("the auth token file %s is empty", tokenFile)
+	}
+	return token, nil
+}
+
+// bearerTokenMiddleware rejects with 401 the request without the `Authorization: Bearer <token>` header
+func bearerTokenMiddleware(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if !strings.HasPrefix(header, bearerPrefix) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, bearerPrefix)), []byte(token)) != 1 {
+			err := fmt.Errorf("missing or invalid bearer token")
+			klog.ErrorS(err, "Response with a error", "httpCode", http.StatusUnauthorized, "requestUri", c.Request.RequestURI)
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse(CodeUnauthorized, err))
+			return
+		}
+		c.Next()
+	}
+}
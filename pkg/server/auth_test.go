@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		status int
+	}{
+		{name: "authorized", token: "secret", header: "Bearer secret", status: http.StatusOK},
+		{name: "wrong token", token: "secret", header: "Bearer other", status: http.StatusUnauthorized},
+		{name: "missing token", token: "secret", status: http.StatusUnauthorized},
+		{name: "not a bearer", token: "secret", header: "Basic secret", status: http.StatusUnauthorized},
+		{name: "disabled", token: "", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSyncedTestServer(t, Args{AuthToken: tt.token})
+			var header []string
+			if tt.header != "" {
+				header = []string{"Authorization", tt.header}
+			}
+			w := serve(s.webServer.Handler, http.MethodGet, "/api/v1/records", "", header...)
+			if w.Code != tt.status {
+				t.Fatalf("GET = %d %s, want %d", w.Code, w.Body, tt.status)
+			}
+			if tt.status == http.StatusUnauthorized {
+				if resp := decodeResponse(t, w, nil); resp.Code != CodeUnauthorized || w.Header().Get("WWW-Authenticate") != "Bearer" {
+					t.Errorf("response = %+v %v, want the bearer challenge", resp, w.Header())
+				}
+			}
+			// The probes stay open
+			if w := serve(s.webServer.Handler, http.MethodGet, "/healthz", ""); w.Code != http.StatusOK {
+				t.Errorf("GET /healthz = %d, want 200 without the token", w.Code)
+			}
+		})
+	}
+}
+
+func TestLoadAuthToken(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "token")
+	if err := os.WriteFile(file, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty")
+	if err := os.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		token     string
+		tokenFile string
+		want      string
+		wantErr   bool
+	}{
+		{name: "flag", token: "secret", want: "secret"},
+		{name: "file", tokenFile: file, want: "secret"},
+		{name: "both", token: "secret", tokenFile: file, wantErr: true},
+		{name: "empty file", tokenFile: empty, wantErr: true},
+		{name: "missing file", tokenFile: filepath.Join(dir, "missing"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadAuthToken(tt.token, tt.tokenFile)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("loadAuthToken = %q, %v, want %q with an error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog/v2"
+)
+
+// AuthzRequest is posted to the external authorization service for every api request
+type AuthzRequest struct {
+	// Identity is the credential presented by the client, the Authorization header or the remote address without it
+	Identity string `json:"identity"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	// Namespace is empty for the global records
+	Namespace string `json:"namespace,omitempty"`
+	// Domain is empty for the requests not targeting a single domain
+	Domain string `json:"domain,omitempty"`
+}
+
+// AuthzResponse is answered by the external authorization service
+type AuthzResponse struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+type authzDecision struct {
+	response AuthzResponse
+	expire   time.Time
+}
+
+// authorizer delegates the authorization of the api requests to an external service,
+// it fails closed, i.e. any error of the service denies the request.
+type authorizer struct {
+	url      string
+	client   *http.Client
+	cacheTTL time.Duration
+
+	lock  sync.Mutex
+	cache map[AuthzRequest]authzDecision
+}
+
+func newAuthorizer(url string, timeout, cacheTTL time.Duration) *authorizer {
+	return &authorizer{
+		url:      url,
+		client:   &http.Client{Timeout: timeout},
+		cacheTTL: cacheTTL,
+		cache:    make(map[AuthzRequest]authzDecision),
+	}
+}
+
+// Middleware denies the request with 403 unless the external service allows it
+func (a *authorizer) Middleware(c *gin.Context) {
+	req := authzRequestFromContext(c)
+	resp, err := a.authorize(c.Request.Context(), req)
+	if err != nil {
+		err = fmt.Errorf("authorization failed: %v", err)
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusForbidden, "requestUri", c.Request.RequestURI)
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse(CodeForbidden, err))
+		return
+	}
+	if !resp.Allowed {
+		err := fmt.Errorf("%s %s is denied: %s", req.Method, req.Path, resp.Reason)
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusForbidden, "requestUri", c.Request.RequestURI)
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse(CodeForbidden, err))
+		return
+	}
+	c.Next()
+}
+
+func (a *authorizer) authorize(ctx context.Context, req AuthzRequest) (AuthzResponse, error) {
+	if resp, ok := a.cached(req); ok {
+		return resp, nil
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return AuthzResponse{}, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return AuthzResponse{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpResp, err := a.client.Do(httpReq)
+	if err != nil {
+		return AuthzResponse{}, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return AuthzResponse{}, fmt.Errorf("the authorization service answered %s", httpResp.Status)
+	}
+	var resp AuthzResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return AuthzResponse{}, fmt.Errorf("failed to decode the authorization response: %v", err)
+	}
+	a.store(req, resp)
+	return resp, nil
+}
+
+func (a *authorizer) cached(req AuthzRequest) (AuthzResponse, bool) {
+	if a.cacheTTL <= 0 {
+		return AuthzResponse{}, false
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	decision, ok := a.cache[req]
+	if !ok {
+		return AuthzResponse{}, false
+	}
+	if time.Now().After(decision.expire) {
+		delete(a.cache, req)
+		return AuthzResponse{}, false
+	}
+	return decision.response, true
+}
+
+func (a *authorizer) store(req AuthzRequest, resp AuthzResponse) {
+	if a.cacheTTL <= 0 {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	// Drop the expired decisions so the cache doesn't grow with the identities
+	for key, decision := range a.cache {
+		if now.After(decision.expire) {
+			delete(a.cache, key)
+		}
+	}
+	a.cache[req] = authzDecision{response: resp, expire: now.Add(a.cacheTTL)}
+}
+
+// authzRequestFromContext collects the identity and the target of the request, the domain
+// is taken from the path or else from a single record in the body, which is restored for the handler.
+func authzRequestFromContext(c *gin.Context) AuthzRequest {
+	identity := c.GetHeader("Authorization")
+	if identity == "" {
+		identity = c.ClientIP()
+	}
+	req := AuthzRequest{
+		Identity:  identity,
+		Method:    c.Request.Method,
+		Path:      c.FullPath(),
+		Namespace: c.Param("ns"),
+		Domain:    NormalizeDomain(c.Param("domain")),
+	}
+	if req.Domain == "" && c.Request.Body != nil {
+		body, err := io.ReadAll(c.Request.Body)
+		if err == nil {
+			var record struct {
+				Domain string `json:"domain"`
+			}
+			if json.Unmarshal(body, &record) == nil {
+				req.Domain = NormalizeDomain(record.Domain)
+			}
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	return req
+}
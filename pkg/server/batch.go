@@ -0,0 +1,215 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog/v2"
+)
+
+// BatchItemResult tells whether a record of a batch is accepted
+type BatchItemResult struct {
+	Domain   string `json:"domain"`
+	Accepted bool   `json:"accepted"`
+	Message  string `json:"message,omitempty"`
+}
+
+// SetDatas stores the values of several domains in one update of the configmap, so either
+// all of them are written or none. With merge the ips of a value are added to the ones stored
+// for the domain, see mergeValue, instead of replacing them. The number of the domains which
+// didn't exist before is returned.
+func (r *recordController) SetDatas(namespace string, req writeRequest, values map[string]string, merge bool) (int, error) {
+	for domain, value := range values {
+		if err := ValidateRecord(*recordFromValue(domain, value)); err != nil {
+			return 0, err
+		}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	oldValues := make(map[string]string, len(values))
+	newValues := make(map[string]string, len(values))
+	created := 0
+	err := r.update(namespace, req.Version, func(data map[string]string) error {
+		created = 0
+		for domain, value := range values {
+			old, ok := data[domain]
+			if !ok {
+				created++
+			}
+			if merge {
+				value = mergeValue(old, value)
+			}
+			oldValues[domain], newValues[domain] = old, value
+			data[domain] = value
+		}
+		// The CNAME chains must end with an ip after all the records are applied
+		for domain, value := range newValues {
+			if bare := controller.DecodeValue(value).Value; strings.HasPrefix(bare, controller.CNAMEPrefix) {
+				if _, err := controller.ResolveCNAME(data, domain); err != nil {
+					return &ValidationError{Field: "cname", Value: strings.TrimPrefix(bare, controller.CNAMEPrefix), Reason: err.Error()}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for domain, value := range newValues {
+		if oldValues[domain] != value {
+			r.recordChange(namespace, req, domain, HistoryActionSet, oldValues[domain], value)
+		}
+	}
+	return created, nil
+}
+
+// mergeValue adds the ips of the value missing from the stored one, whose labels, weights and
+// expiry are kept. A stored value not resolved to ips (empty, pending or a CNAME) is replaced.
+func mergeValue(stored, value string) string {
+	v := controller.DecodeValue(stored)
+	if stored == "" || v.Value == controller.PendingValue || strings.HasPrefix(v.Value, controller.CNAMEPrefix) {
+		return value
+	}
+	ips := controller.SplitIPs(v.Value)
+	for _, ip := range controller.SplitIPs(controller.DecodeValue(value).Value) {
+		if !ExistString(ip, ips) {
+			ips = append(ips, ip)
+		}
+	}
+	v.Value = controller.JoinIPs(ips)
+	return v.Encode()
+}
+
+// PostRecordsBatch creates or updates several records in one update of the configmap. The records
+// failing the validation are rejected and reported, while the accepted ones are written atomically.
+func (r *recordController) PostRecordsBatch(c *gin.Context) {
+	namespace, ok := r.recordNamespace(c)
+	if !ok {
+		return
+	}
+	var records []Record
+	if err := c.ShouldBindJSON(&records); err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	}
+	results := make([]BatchItemResult, 0, len(records))
+	values := make(map[string]string, len(records))
+	for _, record := range records {
+		record.normalize()
+		if len(record.ips()) == 0 && record.CNAME == "" && !record.Pending && r.args.DefaultIP != "" {
+			record.IP = r.args.DefaultIP
+		}
+		if err := ValidateRecord(record); err != nil {
+			results = append(results, BatchItemResult{Domain: record.Domain, Message: err.Error()})
+			continue
+		}
+		if err := r.domains.check(record.Domain); err != nil {
+			results = append(results, BatchItemResult{Domain: record.Domain, Message: err.Error()})
+			continue
+		}
+		if _, ok := values[record.Domain]; ok {
+			results = append(results, BatchItemResult{Domain: record.Domain, Message: "duplicate domain in the batch"})
+			continue
+		}
+		values[record.Domain] = record.storedValue()
+		results = append(results, BatchItemResult{Domain: record.Domain, Accepted: true})
+	}
+	if len(values) > 0 {
+		_, err := r.SetDatas(namespace, newWriteRequest(c), values, false)
+		if errors.Is(err, ErrRecordConflict) {
+			klog.ErrorS(err, "Response with a error", "httpCode", http.StatusConflict, "requestUri", c.Request.RequestURI)
+			c.JSON(http.StatusConflict, ErrorResponse(CodeConflict, err))
+			return
+		}
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+			c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+			return
+		}
+		if err != nil {
+			klog.ErrorS(err, "Response with a error", "httpCode", http.StatusInternalServerError, "requestUri", c.Request.RequestURI)
+			c.JSON(http.StatusInternalServerError, ErrorResponse(CodeBackendError, err))
+			return
+		}
+	}
+	c.JSON(http.StatusOK, SuccessResponse(results, fmt.Sprintf("PostRecordsBatch is successful. Accepted is %d, rejected is %d", len(values), len(records)-len(values))))
+}
+
+// BatchDeleteResult reports how many of the requested domains were actually removed
+type BatchDeleteResult struct {
+	Requested int      `json:"requested"`
+	Removed   int      `json:"removed"`
+	Domains   []string `json:"domains"`
+}
+
+// DeleteDatas deletes several domains in one update of the configmap and returns the removed ones,
+// the domains not existing are ignored.
+func (r *recordController) DeleteDatas(namespace string, req writeRequest, domains []string) ([]string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	removed := make([]string, 0)
+	oldValues := make(map[string]string, len(domains))
+	err := r.update(namespace, req.Version, func(data map[string]string) error {
+		removed = removed[:0]
+		for _, domain := range domains {
+			val, ok := data[domain]
+			if !ok {
+				continue
+			}
+			oldValues[domain] = val
+			delete(data, domain)
+			removed = append(removed, domain)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, domain := range removed {
+		r.recordChange(namespace, req, domain, HistoryActionDelete, oldValues[domain], "")
+	}
+	return removed, nil
+}
+
+// DeleteRecordsBatch deletes several records in one update of the configmap
+func (r *recordController) DeleteRecordsBatch(c *gin.Context) {
+	namespace, ok := r.recordNamespace(c)
+	if !ok {
+		return
+	}
+	var records []DeleteRecord
+	if err := c.ShouldBindJSON(&records); err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	}
+	domains := make([]string, 0, len(records))
+	for _, record := range records {
+		domain := NormalizeDomain(record.Domain)
+		if !r.domainPermitted(c, domain) {
+			return
+		}
+		if !ExistString(domain, domains) {
+			domains = append(domains, domain)
+		}
+	}
+	removed, err := r.DeleteDatas(namespace, newWriteRequest(c), domains)
+	if errors.Is(err, ErrRecordConflict) {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusConflict, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusConflict, ErrorResponse(CodeConflict, err))
+		return
+	}
+	if err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusInternalServerError, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusInternalServerError, ErrorResponse(CodeBackendError, err))
+		return
+	}
+	result := BatchDeleteResult{Requested: len(domains), Removed: len(removed), Domains: removed}
+	c.JSON(http.StatusOK, SuccessResponse(result, fmt.Sprintf("DeleteRecordsBatch is successful. Removed is %d, requested is %d", result.Removed, result.Requested)))
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// countingStore is a MemoryStore counting its writes
+type countingStore struct {
+	*controller.MemoryStore
+	writes int32
+}
+
+func (s *countingStore) Update(namespace string, mutate func(data map[string]string) error) error {
+	atomic.AddInt32(&s.writes, 1)
+	return s.MemoryStore.Update(namespace, mutate)
+}
+
+func (s *countingStore) UpdateIfVersion(namespace, version string, mutate func(data map[string]string) error) error {
+	atomic.AddInt32(&s.writes, 1)
+	return s.MemoryStore.UpdateIfVersion(namespace, version, mutate)
+}
+
+func newCountingTestServer(t *testing.T, args Args) (*Server, *countingStore) {
+	t.Helper()
+	store := &countingStore{MemoryStore: controller.NewMemoryStore()}
+	s := newTestServerWithStore(t, args, fake.NewSimpleClientset(), store)
+	startInformers(t, s)
+	return s, store
+}
+
+func TestPostRecordsBatch(t *testing.T) {
+	s, store := newCountingTestServer(t, Args{})
+	w := serve(s.webServer.Handler, http.MethodPost, "/api/v1/records/batch", `[
+		{"domain": "a.com", "ip": "10.0.0.1"},
+		{"domain": "b.com", "ips": ["10.0.0.2", "10.0.0.3"]},
+		{"domain": "c.com", "ip": "10.0.0.300"},
+		{"domain": "A.com.", "ip": "10.0.0.4"}
+	]`)
+	var results []BatchItemResult
+	decodeResponse(t, w, &results)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST = %d %s", w.Code, w.Body)
+	}
+	accepted := make([]bool, 0, len(results))
+	for _, result := range results {
+		accepted = append(accepted, result.Accepted)
+	}
+	if want := []bool{true, true, false, false}; !reflect.DeepEqual(accepted, want) {
+		t.Errorf("accepted = %v, want %v", accepted, want)
+	}
+	if store.writes != 1 {
+		t.Errorf("writes = %d, want the batch written at once", store.writes)
+	}
+	want := map[string]string{"a.com": "10.0.0.1", "b.com": "10.0.0.2,10.0.0.3"}
+	if data, _ := store.List(s.args.ControllerArgs.Namespace()); !reflect.DeepEqual(data, want) {
+		t.Errorf("the records = %v, want %v", data, want)
+	}
+}
+
+func TestDeleteRecordsBatch(t *testing.T) {
+	s, store := newCountingTestServer(t, Args{})
+	ns := s.args.ControllerArgs.Namespace()
+	for _, domain := range []string{"a.com", "b.com", "c.com"} {
+		if err := store.MemoryStore.Set(ns, domain, "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := serve(s.webServer.Handler, http.MethodDelete, "/api/v1/records/batch",
+		`[{"domain": "a.com"}, {"domain": "B.com."}, {"domain": "missing.com"}, {"domain": "a.com"}]`)
+	var result BatchDeleteResult
+	decodeResponse(t, w, &result)
+	if w.Code != http.StatusOK || result.Requested != 3 || result.Removed != 2 {
+		t.Fatalf("DELETE = %d %+v, want 2 of the 3 domains removed", w.Code, result)
+	}
+	if store.writes != 1 {
+		t.Errorf("writes = %d, want the batch written at once", store.writes)
+	}
+	if data, _ := store.List(ns); !reflect.DeepEqual(data, map[string]string{"c.com": "10.0.0.1"}) {
+		t.Errorf("the records = %v, want only c.com left", data)
+	}
+}
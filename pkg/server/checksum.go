@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// HostsChecksumAnnotation is the annotation of the pod template of CoreDNS holding the checksum of
+// the hosts content, changing it makes a rolling restart of CoreDNS.
+const HostsChecksumAnnotation = "coredns-hosts/checksum"
+
+// hostsChecksum returns the checksum of the hosts content, the same content always has the same one
+func hostsChecksum(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// runChecksumAnnotator annotates the CoreDNS Deployment with the checksum of the hosts content once
+// and then after every change of the records until stop is closed.
+func (s *Server) runChecksumAnnotator(stop <-chan struct{}) {
+	// The records are incomplete before the sync, and their checksum would restart CoreDNS for nothing
+	if !cache.WaitForCacheSync(stop, s.configmapController.HasSynced) {
+		return
+	}
+	for {
+		events, cancel := s.configmapController.Watch()
+		s.annotateChecksum()
+		for open := true; open; {
+			select {
+			case <-stop:
+				cancel()
+				return
+			case _, open = <-events:
+				// The changes of a sync come together and make a single patch
+				for drained := false; open && !drained; {
+					select {
+					case _, open = <-events:
+					default:
+						drained = true
+					}
+				}
+				if open {
+					s.annotateChecksum()
+				}
+			}
+		}
+		// The watcher falling behind is dropped, and the annotation is checked again on watching again
+		cancel()
+	}
+}
+
+func (s *Server) annotateChecksum() {
+	ref := klog.KRef(s.args.CoreDNSNamespace, s.args.CoreDNSDeployment)
+	if err := s.patchChecksum(); err != nil {
+		klog.ErrorS(err, "Failed to annotate the hosts checksum", "deployment", ref)
+	}
+}
+
+// patchChecksum patches the checksum onto the pod template only if it differs, so that the same
+// content never restarts CoreDNS.
+func (s *Server) patchChecksum() error {
+	content, err := s.configmapController.RenderHosts()
+	if err != nil {
+		return err
+	}
+	checksum := hostsChecksum(content)
+	deployments := s.clientset.AppsV1().Deployments(s.args.CoreDNSNamespace)
+	deployment, err := deployments.Get(context.TODO(), s.args.CoreDNSDeployment, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if deployment.Spec.Template.Annotations[HostsChecksumAnnotation] == checksum {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{HostsChecksumAnnotation: checksum},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := deployments.Patch(context.TODO(), s.args.CoreDNSDeployment, types.StrategicMergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return err
+	}
+	klog.InfoS("Annotated the hosts checksum, and CoreDNS is restarting", "deployment", klog.KRef(s.args.CoreDNSNamespace, s.args.CoreDNSDeployment), "checksum", checksum)
+	return nil
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newChecksumTestServer returns the server annotating the Deployment kube-system/coredns of its clientset
+func newChecksumTestServer(t *testing.T) (*Server, *fake.Clientset) {
+	t.Helper()
+	clientset := fake.NewSimpleClientset(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "coredns", Namespace: "kube-system"},
+	})
+	args := Args{RestartCoreDNSOnChange: true, CoreDNSDeployment: "coredns", CoreDNSNamespace: "kube-system"}
+	s := newTestServerWithStore(t, args, clientset, controller.NewMemoryStore())
+	startInformers(t, s)
+	return s, clientset
+}
+
+func templateChecksum(t *testing.T, clientset *fake.Clientset) string {
+	t.Helper()
+	deployment, err := clientset.AppsV1().Deployments("kube-system").Get(context.TODO(), "coredns", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deployment.Spec.Template.Annotations[HostsChecksumAnnotation]
+}
+
+func TestPatchChecksumAfterAWrite(t *testing.T) {
+	s, clientset := newChecksumTestServer(t)
+	if err := s.patchChecksum(); err != nil {
+		t.Fatalf("patchChecksum: %v", err)
+	}
+	if got := templateChecksum(t, clientset); got != hostsChecksum("") {
+		t.Fatalf("checksum = %q, want the one of the empty hosts", got)
+	}
+
+	if err := s.store.Set(s.args.ControllerArgs.Namespace(), "a.com", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.patchChecksum(); err != nil {
+		t.Fatalf("patchChecksum: %v", err)
+	}
+	if got := templateChecksum(t, clientset); got != hostsChecksum("10.0.0.1 a.com\n") {
+		t.Errorf("checksum = %q, want the one of the written record", got)
+	}
+}
+
+func TestPatchChecksumOnlyOnChange(t *testing.T) {
+	s, clientset := newChecksumTestServer(t)
+	s.store.Set(s.args.ControllerArgs.Namespace(), "a.com", "10.0.0.1")
+	if err := s.patchChecksum(); err != nil {
+		t.Fatalf("patchChecksum: %v", err)
+	}
+	patches := func() int {
+		count := 0
+		for _, action := range clientset.Actions() {
+			if action.GetVerb() == "patch" && action.GetResource().Resource == "deployments" {
+				count++
+			}
+		}
+		return count
+	}
+	if got := patches(); got != 1 {
+		t.Fatalf("patches = %d, want 1", got)
+	}
+	// The same content, even rewritten, never restarts CoreDNS
+	s.store.Set(s.args.ControllerArgs.Namespace(), "a.com", "10.0.0.1")
+	for i := 0; i < 2; i++ {
+		if err := s.patchChecksum(); err != nil {
+			t.Fatalf("patchChecksum: %v", err)
+		}
+	}
+	if got := patches(); got != 1 {
+		t.Errorf("patches = %d after no change, want 1", got)
+	}
+	// A record left out of the hosts file doesn't change the content either
+	s.store.Set(s.args.ControllerArgs.Namespace(), "b.com", controller.PendingValue)
+	if err := s.patchChecksum(); err != nil {
+		t.Fatalf("patchChecksum: %v", err)
+	}
+	if got := patches(); got != 1 {
+		t.Errorf("patches = %d after a pending record, want 1", got)
+	}
+	s.store.Set(s.args.ControllerArgs.Namespace(), "a.com", "10.0.0.2")
+	if err := s.patchChecksum(); err != nil {
+		t.Fatalf("patchChecksum: %v", err)
+	}
+	if got := patches(); got != 2 {
+		t.Errorf("patches = %d after a change, want 2", got)
+	}
+}
@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// CompactResult reports the configmap data before and after the compaction
+type CompactResult struct {
+	Namespace   string `json:"namespace"`
+	KeysBefore  int    `json:"keysBefore"`
+	KeysAfter   int    `json:"keysAfter"`
+	BytesBefore int    `json:"bytesBefore"`
+	BytesAfter  int    `json:"bytesAfter"`
+	// Dropped are the keys removed because another key normalizes to the same domain or the record has expired
+	Dropped []string `json:"dropped"`
+}
+
+// NormalizeDomain lowercases the domain and trims a single trailing dot, since the domains
+// are case-insensitive and `example.com.` is the fully qualified form of `example.com`.
+func NormalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// CompactData rewrites the configmap data into the canonical form: the domains of NormalizeDomain,
+// trimmed values without blanks between the ips and normalized CNAME targets. When several keys
+// normalize to the same domain, the one already in the canonical form wins, otherwise the first
+// in sorted order. The records expired at now are dropped.
+func CompactData(data map[string]string, now time.Time) (map[string]string, []string) {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	compacted := make(map[string]string, len(data))
+	owners := make(map[string]string, len(data))
+	dropped := make([]string, 0)
+	for _, key := range keys {
+		if DecodeValue(data[key]).Expired(now) {
+			dropped = append(dropped, key)
+			continue
+		}
+		domain := NormalizeDomain(key)
+		if owner, ok := owners[domain]; ok {
+			if owner == domain || key != domain {
+				dropped = append(dropped, key)
+				continue
+			}
+			// The canonical key replaces the one seen earlier
+			dropped = append(dropped, owner)
+		}
+		owners[domain] = key
+		compacted[domain] = normalizeValue(data[key])
+	}
+	return compacted, dropped
+}
+
+// normalizeValue trims the value and normalizes the target of a CNAME, the metadata is kept as is
+func normalizeValue(stored string) string {
+	v := DecodeValue(strings.TrimSpace(stored))
+	v.Value = normalizeBareValue(v.Value)
+	return v.Encode()
+}
+
+func normalizeBareValue(val string) string {
+	val = strings.TrimSpace(val)
+	if strings.HasPrefix(strings.ToLower(val), CNAMEPrefix) {
+		return CNAMEPrefix + NormalizeDomain(val[len(CNAMEPrefix):])
+	}
+	if val == PendingValue {
+		return val
+	}
+	return JoinIPs(SplitIPs(val))
+}
+
+// dataSize is the total bytes of the keys and values of the configmap data
+func dataSize(data map[string]string) int {
+	var size int
+	for key, val := range data {
+		size += len(key) + len(val)
+	}
+	return size
+}
+
+// Compact rewrites the records of the namespace into the canonical form in one update,
+// which is retried on conflict so no concurrent write is lost.
+func Compact(store RecordStore, namespace string) (*CompactResult, error) {
+	result := &CompactResult{Namespace: namespace}
+	err := store.Update(namespace, func(data map[string]string) error {
+		compacted, dropped := CompactData(data, time.Now())
+		result.KeysBefore = len(data)
+		result.BytesBefore = dataSize(data)
+		result.KeysAfter = len(compacted)
+		result.BytesAfter = dataSize(compacted)
+		result.Dropped = dropped
+		for key := range data {
+			delete(data, key)
+		}
+		for key, val := range compacted {
+			data[key] = val
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	klog.InfoS("Compacted the configmap", "namespace", namespace, "keysBefore", result.KeysBefore, "keysAfter", result.KeysAfter,
+		"bytesBefore", result.BytesBefore, "bytesAfter", result.BytesAfter)
+	return result, nil
+}
+
+func equalData(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, val := range a {
+		if other, ok := b[key]; !ok || other != val {
+			return false
+		}
+	}
+	return true
+}
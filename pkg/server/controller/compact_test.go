@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCompactData(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        map[string]string
+		want        map[string]string
+		wantDropped []string
+	}{
+		{
+			name:        "the canonical key wins",
+			data:        map[string]string{"A.com.": "10.0.0.2", "a.com": "10.0.0.1"},
+			want:        map[string]string{"a.com": "10.0.0.1"},
+			wantDropped: []string{"A.com."},
+		},
+		{
+			name:        "the first in sorted order wins",
+			data:        map[string]string{"A.com.": "10.0.0.2", "a.com.": "10.0.0.1"},
+			want:        map[string]string{"a.com": "10.0.0.2"},
+			wantDropped: []string{"a.com."},
+		},
+		{
+			name:        "the values",
+			data:        map[string]string{" B.com ": " 10.0.0.1 , 10.0.0.2 ", "c.com": "CNAME:B.com."},
+			want:        map[string]string{"b.com": "10.0.0.1,10.0.0.2", "c.com": "cname:b.com"},
+			wantDropped: []string{},
+		},
+		{
+			name: "the expired records",
+			data: map[string]string{
+				"a.com": `{"value":"10.0.0.1","expiresAt":"2026-01-01T00:00:00Z"}`,
+				"b.com": `{"value":"10.0.0.2","expiresAt":"2026-01-01T00:00:02Z"}`,
+			},
+			want:        map[string]string{"b.com": `{"value":"10.0.0.2","expiresAt":"2026-01-01T00:00:02Z"}`},
+			wantDropped: []string{"a.com"},
+		},
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 1, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, dropped := CompactData(tt.data, now)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CompactData = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(dropped, tt.wantDropped) {
+				t.Errorf("dropped = %v, want %v", dropped, tt.wantDropped)
+			}
+		})
+	}
+}
@@ -1,20 +1,24 @@
 package controller
 
 import (
-	"context"
+	"bytes"
 	"fmt"
 	"github.com/devincd/coredns-hosts-api/pkg/common"
+	"github.com/devincd/coredns-hosts-api/pkg/metrics"
 	"k8s.io/klog/v2"
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	coreinformers "k8s.io/client-go/informers/core/v1"
-	"k8s.io/client-go/kubernetes"
 	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
@@ -23,15 +27,68 @@ import (
 const (
 	ConcurrentConfigmapSyncs = 1
 
-	ConfigmapName      = "coredns-hosts-api"
-	ConfigmapNamespace = "kube-system"
+	// DefaultConfigmapName and DefaultConfigmapNamespace are the configmap of the global records
+	// unless Args says otherwise
+	DefaultConfigmapName      = "coredns-hosts-api"
+	DefaultConfigmapNamespace = "kube-system"
+
+	// watchFailureGap is the max gap between two watch failures of the same outage,
+	// which is longer than the max backoff of the reflector.
+	watchFailureGap = time.Minute
 )
 
+// SyncStatus is the result of the syncs of the hosts file
+type SyncStatus struct {
+	RecordCount  int
+	LastSyncTime time.Time
+	LastError    error
+	// FileErrors is the write error of every hosts file path, nil if the write succeeded
+	FileErrors map[string]error
+	// WatchFailures is the total number of the failures of the configmap watch
+	WatchFailures int
+	// WatchFailingSince is the start of the ongoing watch failures, zero if the watch is fine
+	WatchFailingSince time.Time
+	// WatchUnhealthy means the watch has been failing longer than the threshold
+	WatchUnhealthy bool
+	// Conflicts are the domains mapped to different values in several namespaces by the last sync
+	Conflicts []Conflict
+}
+
+// Conflict is a domain mapped to different values in several record namespaces, the value
+// of the earliest namespace is written into the hosts file.
+type Conflict struct {
+	Domain         string `json:"domain"`
+	Namespace      string `json:"namespace"`
+	Value          string `json:"value"`
+	LoserNamespace string `json:"loserNamespace"`
+	LoserValue     string `json:"loserValue"`
+}
+
+// Healthy reports whether the last sync of the hosts file succeeded and the watch is working
+func (s SyncStatus) Healthy() bool {
+	return s.LastError == nil && !s.WatchUnhealthy
+}
+
 type ConfigmapController struct {
-	clientset       *kubernetes.Clientset
+	store           RecordStore
 	configmapLister corelisters.ConfigMapLister
 	configmapSynced cache.InformerSynced
-	filePath        string
+	filePaths       []string
+	args            Args
+	// reload makes CoreDNS re-read the hosts file with ReloadCoreDNS, i.e. reloadCoreDNS
+	reload func() error
+
+	// lastWritten is the content of every hosts file written by the last sync,
+	// used to detect the drift of the file on disk.
+	lastWritten map[string][]byte
+
+	statusLock sync.RWMutex
+	status     SyncStatus
+	// lastWatchFailure is the time of the latest watch failure
+	lastWatchFailure time.Time
+
+	// events notifies the watchers of the changes of the records found by the syncs
+	events *recordEvents
 
 	// workqueue is a rate limited work queue. This is used to queue work to be
 	// processed instead of performing it as soon as a change happens. This
@@ -41,16 +98,28 @@ type ConfigmapController struct {
 	workqueue workqueue.RateLimitingInterface
 }
 
-func NewConfigmapController(clientset *kubernetes.Clientset, configmapInformer coreinformers.ConfigMapInformer) *ConfigmapController {
+// NewConfigmapController returns the controller writing the records of the store into the hosts file,
+// which is triggered by the events of the configmaps.
+func NewConfigmapController(configmapInformer coreinformers.ConfigMapInformer, store RecordStore, args Args) *ConfigmapController {
 	c := &ConfigmapController{
-		clientset:       clientset,
+		store:           store,
 		configmapLister: configmapInformer.Lister(),
 		configmapSynced: configmapInformer.Informer().HasSynced,
-		filePath:        common.CoreDNSHostsPath,
+		filePaths:       args.FilePaths,
+		args:            args,
+		lastWritten:     make(map[string][]byte),
+		events:          newRecordEvents(),
+		reload:          reloadCoreDNS,
 
 		workqueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Configmap"),
 	}
+	if len(c.filePaths) == 0 {
+		c.filePaths = []string{common.CoreDNSHostsPath}
+	}
 
+	if err := configmapInformer.Informer().SetWatchErrorHandler(c.watchErrorHandler); err != nil {
+		klog.ErrorS(err, "Failed to set the watch error handler")
+	}
 	configmapInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			cm := obj.(*corev1.ConfigMap)
@@ -70,7 +139,23 @@ func NewConfigmapController(clientset *kubernetes.Clientset, configmapInformer c
 			}
 		},
 		DeleteFunc: func(obj interface{}) {
-			// 处理下
+			cm, ok := obj.(*corev1.ConfigMap)
+			if !ok {
+				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+				if !ok {
+					utilruntime.HandleError(fmt.Errorf("couldn't get object from tombstone %#v", obj))
+					return
+				}
+				cm, ok = tombstone.Obj.(*corev1.ConfigMap)
+				if !ok {
+					utilruntime.HandleError(fmt.Errorf("tombstone contained object that is not a configmap %#v", obj))
+					return
+				}
+			}
+			if c.FilterConfigmap(cm) {
+				klog.InfoS("Delete Event", "configmap", klog.KObj(cm))
+				c.enqueue(cm)
+			}
 		},
 	})
 
@@ -89,12 +174,25 @@ func (c *ConfigmapController) Run(stopCh <-chan struct{}) error {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
+	for _, file := range c.hostsFiles("", "") {
+		c.loadExistingFile(file.path)
+	}
+
 	klog.Info("Starting workers")
 	// Launch once workers to process ConfigMap resources
 	for i := 1; i <= ConcurrentConfigmapSyncs; i++ {
 		go wait.Until(c.worker, time.Second, stopCh)
 	}
 
+	// Launch the full reconcile independent of the informer events
+	if c.args.FullResyncPeriod > 0 {
+		go wait.Until(c.enqueueFullResync, c.args.FullResyncPeriod, stopCh)
+	}
+	// Rotate the weighted order of the ips, which is seeded by the period the sync falls in
+	if c.args.IPOrder == IPOrderWeighted && c.args.IPRotationPeriod > 0 {
+		go wait.Until(c.enqueueFullResync, c.args.IPRotationPeriod, stopCh)
+	}
+
 	klog.Info("Started workers")
 	<-stopCh
 	klog.Info("Shutting down workers")
@@ -103,8 +201,13 @@ func (c *ConfigmapController) Run(stopCh <-chan struct{}) error {
 }
 
 func (c *ConfigmapController) FilterConfigmap(cm *corev1.ConfigMap) bool {
-	if cm.Name == ConfigmapName && cm.Namespace == ConfigmapNamespace {
-		return true
+	if !IsShardName(c.args.Name(), cm.Name) {
+		return false
+	}
+	for _, ns := range c.recordNamespaces() {
+		if cm.Namespace == ns {
+			return true
+		}
 	}
 	return false
 }
@@ -116,6 +219,20 @@ func (c *ConfigmapController) enqueue(cm *corev1.ConfigMap) {
 		return
 	}
 
+	// The key waiting in the queue is not added again, so a burst of events within the
+	// debounce is synced once, and the sync always reads the latest configmaps.
+	if c.args.SyncDebounce > 0 {
+		c.workqueue.AddAfter(key, c.args.SyncDebounce)
+		return
+	}
+	c.workqueue.Add(key)
+}
+
+// enqueueFullResync enqueues the managed configmap so that the hosts file
+// is re-rendered from the authoritative configmap even if events are missed.
+func (c *ConfigmapController) enqueueFullResync() {
+	key := fmt.Sprintf("%s/%s", c.args.Namespace(), c.args.Name())
+	klog.V(4).InfoS("Full resync", "configmap", key)
 	c.workqueue.Add(key)
 }
 
@@ -129,10 +246,14 @@ func (c *ConfigmapController) worker() {
 			defer c.workqueue.Done(key)
 			startTime := time.Now()
 			err := c.syncConfigmap(key.(string))
+			c.setLastError(err)
+			metrics.SyncDuration.Observe(time.Since(startTime).Seconds())
 			if err != nil {
+				metrics.Syncs.WithLabelValues("error").Inc()
 				klog.ErrorS(err, "Error syncing configmap and retry...", "node", key)
 				c.workqueue.AddRateLimited(key)
 			} else {
+				metrics.Syncs.WithLabelValues("success").Inc()
 				c.workqueue.Forget(key)
 				klog.Infof("Finished syncing configmap(%s), and cost %s", key, time.Now().Sub(startTime))
 			}
@@ -140,23 +261,313 @@ func (c *ConfigmapController) worker() {
 	}
 }
 
+// syncConfigmap renders the hosts file from the configmaps of all the record namespaces,
+// whichever of them the key refers to, since they are merged into the same file.
 func (c *ConfigmapController) syncConfigmap(key string) error {
-	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if _, _, err := cache.SplitMetaNamespaceKey(key); err != nil {
+		return err
+	}
+	content, reverse, data, conflicts, records, err := c.render()
 	if err != nil {
 		return err
 	}
-	cm, err := c.clientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
-	switch {
-	case errors.IsNotFound(err):
+	// The events reflect the records whether or not the hosts file is written
+	c.events.publish(records)
+	// The hosts file is truncated rather than kept stale once no record is left
+	if len(data) == 0 {
+		klog.InfoS("No record is left and clear the hosts file", "paths", c.filePaths)
+	}
+	if err := c.checkLimits(strings.Count(content, "\n"), len(content)); err != nil {
+		klog.ErrorS(err, "Refuse to write the hosts file and keep the last good one", "paths", c.filePaths)
+		return err
+	}
+	// Write every path so that all the CoreDNS instances stay in sync
+	var errs []error
+	var changed bool
+	files := c.hostsFiles(content, reverse)
+	fileErrors := make(map[string]error, len(files))
+	for _, file := range files {
+		c.checkDrift(file.path)
+		if !bytes.Equal(c.lastWritten[file.path], []byte(file.content)) {
+			changed = true
+		}
+		err := writeFileAtomic(file.path, []byte(file.content))
+		fileErrors[file.path] = err
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to write the hosts file %s: %v", file.path, err))
+			continue
+		}
+		c.lastWritten[file.path] = []byte(file.content)
+	}
+	if changed && c.args.ReloadCoreDNS {
+		if err := c.reload(); err != nil {
+			// The hosts plugin still picks up the file on its own reload interval
+			klog.ErrorS(err, "Failed to signal CoreDNS to reload")
+		}
+	}
+	c.statusLock.Lock()
+	c.status.FileErrors = fileErrors
+	c.status.Conflicts = conflicts
+	metrics.Conflicts.Set(float64(len(conflicts)))
+	if len(errs) == 0 {
+		c.status.RecordCount = len(data)
+		c.status.LastSyncTime = time.Now()
+	}
+	c.statusLock.Unlock()
+	return utilerrors.NewAggregate(errs)
+}
+
+// hostsFile is the content of a hosts file to write
+type hostsFile struct {
+	path    string
+	content string
+}
+
+// hostsFiles returns every hosts file to write, i.e. the file paths with the content and, if
+// Args.ReverseFile is set, their reverse files with the reverse content
+func (c *ConfigmapController) hostsFiles(content, reverse string) []hostsFile {
+	files := make([]hostsFile, 0, 2*len(c.filePaths))
+	for _, path := range c.filePaths {
+		files = append(files, hostsFile{path: path, content: content})
+	}
+	if c.args.ReverseFile {
+		for _, path := range c.filePaths {
+			files = append(files, hostsFile{path: ReverseFilePath(path), content: reverse})
+		}
+	}
+	return files
+}
+
+// recordNamespaces returns the namespaces holding the records, the global one first
+func (c *ConfigmapController) recordNamespaces() []string {
+	return c.args.Namespaces()
+}
+
+// RenderHosts returns the hosts file content rendered from the current records, which is
+// exactly what the next sync writes.
+func (c *ConfigmapController) RenderHosts() (string, error) {
+	content, _, _, _, _, err := c.render()
+	return content, err
+}
+
+// render merges the records of all the record namespaces and renders them into the hosts file
+// content and the reverse one without the records of NoReverse, which is empty unless Args.ReverseFile
+// is set. The records of every namespace are returned as well. The line ending is applied before
+// any comparison, so that the drift detection and the written content agree and switching it
+// rewrites the file only once.
+func (c *ConfigmapController) render() (string, string, map[string]string, []Conflict, map[string]map[string]string, error) {
+	records := make(map[string]map[string]string)
+	// weights are the weights of the ips of the namespace winning the domain, i.e. the earliest one,
+	// and so is noReverse
+	weights := make(map[string]map[string]int)
+	noReverse := make(map[string]bool)
+	now := time.Now()
+	for _, namespace := range c.recordNamespaces() {
+		data, err := c.store.List(namespace)
+		if err != nil {
+			return "", "", nil, nil, nil, err
+		}
+		// The metadata and the expired records never reach the hosts file
+		records[namespace] = LiveValues(data, now)
+		for domain, stored := range data {
+			if _, ok := weights[domain]; !ok {
+				if v := DecodeValue(stored); !v.Expired(now) {
+					weights[domain] = v.Weights
+					noReverse[domain] = v.NoReverse
+				}
+			}
+		}
+	}
+	data, conflicts := c.mergeRecords(records)
+	content := renderHosts(data, c.ipOrder(weights, now))
+	var reverse string
+	if c.args.ReverseFile {
+		reverse = applyLineEnding(withoutDomains(content, noReverse), c.args.LineEnding)
+	}
+	return applyLineEnding(content, c.args.LineEnding), reverse, data, conflicts, records, nil
+}
+
+// ipOrder returns the ips of a domain in the hosts file in their order, nil means all of them sorted
+func (c *ConfigmapController) ipOrder(weights map[string]map[string]int, now time.Time) func(domain string, ips []string) []string {
+	if c.args.IPOrder != IPOrderWeighted && c.args.MaxIPsPerDomain <= 0 {
 		return nil
-	case err != nil:
+	}
+	var seed int64
+	if c.args.IPRotationPeriod > 0 {
+		seed = now.UnixNano() / int64(c.args.IPRotationPeriod)
+	}
+	return func(domain string, ips []string) []string {
+		ips = topIPs(ips, weights[domain], c.args.MaxIPsPerDomain)
+		if c.args.IPOrder != IPOrderWeighted {
+			return ips
+		}
+		return weightedOrder(domain, ips, weights[domain], seed)
+	}
+}
+
+// mergeRecords merges the records of all the record namespaces. The same value of a domain
+// in several namespaces is deduped silently, while different values are reported as conflicts
+// and the earlier namespace wins.
+func (c *ConfigmapController) mergeRecords(records map[string]map[string]string) (map[string]string, []Conflict) {
+	data := make(map[string]string)
+	owners := make(map[string]string)
+	conflicts := make([]Conflict, 0)
+	for _, namespace := range c.recordNamespaces() {
+		for domain, val := range records[namespace] {
+			existing, ok := data[domain]
+			if !ok {
+				data[domain] = val
+				owners[domain] = namespace
+				continue
+			}
+			if existing != val {
+				conflicts = append(conflicts, Conflict{
+					Domain:         domain,
+					Namespace:      owners[domain],
+					Value:          existing,
+					LoserNamespace: namespace,
+					LoserValue:     val,
+				})
+			}
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Domain != conflicts[j].Domain {
+			return conflicts[i].Domain < conflicts[j].Domain
+		}
+		return conflicts[i].LoserNamespace < conflicts[j].LoserNamespace
+	})
+	if len(conflicts) > 0 {
+		klog.InfoS("Found conflicting domains across the record namespaces", "count", len(conflicts))
+	}
+	return data, conflicts
+}
+
+// writeFileAtomic writes the file via a temporary file and a rename, so that
+// CoreDNS never reads a partially written file.
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
 		return err
-	default:
-		var content string
-		for key, val := range cm.Data {
-			item := fmt.Sprintf("%s %s\n", val, key)
-			content += item
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// checkLimits checks the rendered hosts file is within --max-hosts-lines and --max-hosts-bytes,
+// which protects CoreDNS from parsing a pathological file.
+func (c *ConfigmapController) checkLimits(lines, size int) error {
+	if c.args.MaxHostsLines > 0 && lines > c.args.MaxHostsLines {
+		return fmt.Errorf("the hosts file has %d lines which exceeds the limit %d", lines, c.args.MaxHostsLines)
+	}
+	if c.args.MaxHostsBytes > 0 && size > c.args.MaxHostsBytes {
+		return fmt.Errorf("the hosts file has %d bytes which exceeds the limit %d", size, c.args.MaxHostsBytes)
+	}
+	return nil
+}
+
+// HasSynced tells whether the informer cache of the configmaps has synced
+func (c *ConfigmapController) HasSynced() bool {
+	return c.configmapSynced()
+}
+
+// Status returns the result of the syncs of the hosts file
+func (c *ConfigmapController) Status() SyncStatus {
+	c.statusLock.RLock()
+	defer c.statusLock.RUnlock()
+	status := c.status
+	// The reflector retries within watchFailureGap while the apiserver is down
+	if !status.WatchFailingSince.IsZero() && time.Since(c.lastWatchFailure) > watchFailureGap {
+		status.WatchFailingSince = time.Time{}
+	}
+	status.WatchUnhealthy = c.args.WatchFailureThreshold > 0 && !status.WatchFailingSince.IsZero() &&
+		time.Since(status.WatchFailingSince) > c.args.WatchFailureThreshold
+	return status
+}
+
+// watchErrorHandler is called by the reflector when the list or watch of the configmaps fails,
+// client-go keeps retrying with backoff and this makes the failures observable.
+func (c *ConfigmapController) watchErrorHandler(r *cache.Reflector, err error) {
+	cache.DefaultWatchErrorHandler(r, err)
+	klog.ErrorS(err, "Failed to watch the configmaps")
+
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	now := time.Now()
+	if c.status.WatchFailingSince.IsZero() || now.Sub(c.lastWatchFailure) > watchFailureGap {
+		c.status.WatchFailingSince = now
+	}
+	c.lastWatchFailure = now
+	c.status.WatchFailures++
+	metrics.WatchFailures.Inc()
+}
+
+func (c *ConfigmapController) setLastError(err error) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	c.status.LastError = err
+}
+
+// loadExistingFile trusts a valid hosts file left on disk by the previous run (e.g. on a
+// persistent volume) so CoreDNS keeps serving it while reconciling, and truncates an invalid one.
+func (c *ConfigmapController) loadExistingFile(path string) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.ErrorS(err, "Failed to read the existing hosts file", "path", path)
+		}
+		return
+	}
+	if err := validateHostsContent(content); err != nil {
+		klog.ErrorS(err, "The existing hosts file is invalid and truncate it", "path", path)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			klog.ErrorS(err, "Failed to truncate the existing hosts file", "path", path)
+		}
+		return
+	}
+	klog.InfoS("Serving the existing hosts file while reconciling", "path", path)
+	c.lastWritten[path] = content
+}
+
+// validateHostsContent checks every line of the hosts file is in the `IP hostname` form
+func validateHostsContent(content []byte) error {
+	for i, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
 		}
-		return os.WriteFile(c.filePath, []byte(content), 0644)
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			return fmt.Errorf("the line %d %q is not in the `IP hostname` form", i+1, line)
+		}
+	}
+	return nil
+}
+
+// checkDrift compares the hosts file on disk with the content written by the
+// last sync, and logs if the file has been changed or removed out of band.
+func (c *ConfigmapController) checkDrift(path string) {
+	lastWritten, ok := c.lastWritten[path]
+	if !ok {
+		return
+	}
+	current, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		klog.ErrorS(err, "Failed to read the hosts file for drift detection", "path", path)
+		return
+	}
+	if !bytes.Equal(current, lastWritten) {
+		klog.InfoS("Detected drift of the hosts file and correct it", "path", path)
+		metrics.HostsFileDrifts.WithLabelValues(path).Inc()
 	}
 }
@@ -0,0 +1,355 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+// newTestController returns the controller writing the records of the store, its informer is never started
+func newTestController(store RecordStore, args Args) *ConfigmapController {
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	return NewConfigmapController(factory.Core().V1().ConfigMaps(), store, args)
+}
+
+// syncKey is the key of the configmap of the global records of the default Args
+const syncKey = DefaultConfigmapNamespace + "/" + DefaultConfigmapName
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return string(content)
+}
+
+func TestSyncKeepsTheLastGoodFileBeyondTheLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		args Args
+	}{
+		{name: "lines", args: Args{MaxHostsLines: 2}},
+		{name: "bytes", args: Args{MaxHostsBytes: len("10.0.0.1 a.com\n10.0.0.2 b.com\n")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hosts")
+			tt.args.FilePaths = []string{path}
+			store := NewMemoryStore()
+			c := newTestController(store, tt.args)
+
+			store.Set(DefaultConfigmapNamespace, "a.com", "10.0.0.1")
+			store.Set(DefaultConfigmapNamespace, "b.com", "10.0.0.2")
+			if err := c.syncConfigmap(syncKey); err != nil {
+				t.Fatalf("sync within the limits: %v", err)
+			}
+			good := readFile(t, path)
+
+			store.Set(DefaultConfigmapNamespace, "c.com", "10.0.0.3")
+			err := c.syncConfigmap(syncKey)
+			if err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+				t.Fatalf("sync beyond the limits = %v, want the limit exceeded", err)
+			}
+			if got := readFile(t, path); got != good {
+				t.Errorf("the hosts file = %q, want the last good one %q", got, good)
+			}
+		})
+	}
+}
+
+func TestSyncWritesEveryPath(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "blue"), filepath.Join(dir, "green")}
+	store := NewMemoryStore()
+	c := newTestController(store, Args{FilePaths: paths})
+	store.Set(DefaultConfigmapNamespace, "a.com", "10.0.0.1")
+	if err := c.syncConfigmap(syncKey); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	for _, path := range paths {
+		if got := readFile(t, path); got != "10.0.0.1 a.com\n" {
+			t.Errorf("%s = %q, want the record", path, got)
+		}
+	}
+
+	// A path failing doesn't keep the others from being written
+	paths = append(paths, filepath.Join(dir, "missing", "hosts"))
+	c = newTestController(store, Args{FilePaths: paths})
+	store.Set(DefaultConfigmapNamespace, "b.com", "10.0.0.2")
+	if err := c.syncConfigmap(syncKey); err == nil {
+		t.Fatal("sync to a missing directory succeeded")
+	}
+	for _, path := range paths[:2] {
+		if got := readFile(t, path); got != "10.0.0.1 a.com\n10.0.0.2 b.com\n" {
+			t.Errorf("%s = %q, want both records", path, got)
+		}
+	}
+	if status := c.Status(); status.FileErrors[paths[2]] == nil || status.FileErrors[paths[0]] != nil {
+		t.Errorf("file errors = %v, want only %s failing", status.FileErrors, paths[2])
+	}
+}
+
+func TestSyncReverseFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	store := NewMemoryStore()
+	store.Set(DefaultConfigmapNamespace, "a.com", "10.0.0.1")
+	store.Set(DefaultConfigmapNamespace, "b.com", RecordValue{Value: "10.0.0.2", NoReverse: true}.Encode())
+	// The CNAME to b.com is flattened to its ip and has the PTR record unless it opts out as well
+	store.Set(DefaultConfigmapNamespace, "c.com", CNAMEPrefix+"b.com")
+
+	c := newTestController(store, Args{FilePaths: []string{path}, ReverseFile: true})
+	if err := c.syncConfigmap(syncKey); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if got, want := readFile(t, path), "10.0.0.1 a.com\n10.0.0.2 b.com\n10.0.0.2 c.com\n"; got != want {
+		t.Errorf("the hosts file = %q, want every record %q", got, want)
+	}
+	if got, want := readFile(t, ReverseFilePath(path)), "10.0.0.1 a.com\n10.0.0.2 c.com\n"; got != want {
+		t.Errorf("the reverse hosts file = %q, want the records without noReverse %q", got, want)
+	}
+	if status := c.Status(); len(status.FileErrors) != 2 {
+		t.Errorf("file errors = %v, want both files written", status.FileErrors)
+	}
+
+	// Without the flag there is no reverse file
+	other := filepath.Join(t.TempDir(), "hosts")
+	if err := newTestController(store, Args{FilePaths: []string{other}}).syncConfigmap(syncKey); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if _, err := os.Stat(ReverseFilePath(other)); !os.IsNotExist(err) {
+		t.Errorf("the reverse hosts file exists without the flag: %v", err)
+	}
+}
+
+func TestWatchErrors(t *testing.T) {
+	c := newTestController(NewMemoryStore(), Args{WatchFailureThreshold: time.Minute})
+	reflector := cache.NewReflector(&cache.ListWatch{}, &corev1.ConfigMap{}, nil, 0)
+	for i := 0; i < 3; i++ {
+		c.watchErrorHandler(reflector, errors.New("connection refused"))
+	}
+	status := c.Status()
+	if status.WatchFailures != 3 || status.WatchFailingSince.IsZero() {
+		t.Fatalf("status = %+v, want 3 failures of an ongoing outage", status)
+	}
+	if !status.Healthy() {
+		t.Errorf("the status is unhealthy within the threshold")
+	}
+
+	// The outage lasting beyond the threshold turns the status unhealthy
+	c.statusLock.Lock()
+	c.status.WatchFailingSince = time.Now().Add(-2 * time.Minute)
+	c.statusLock.Unlock()
+	if status := c.Status(); !status.WatchUnhealthy || status.Healthy() {
+		t.Errorf("status = %+v, want unhealthy beyond the threshold", status)
+	}
+
+	// No failure within watchFailureGap means the watch has recovered
+	c.statusLock.Lock()
+	c.lastWatchFailure = time.Now().Add(-2 * watchFailureGap)
+	c.statusLock.Unlock()
+	if status := c.Status(); status.WatchUnhealthy || !status.Healthy() {
+		t.Errorf("status = %+v, want healthy after the recovery", status)
+	}
+}
+
+func TestMergeRecords(t *testing.T) {
+	c := newTestController(NewMemoryStore(), Args{RecordNamespaces: []string{"team-a", "team-b"}})
+	tests := []struct {
+		name          string
+		records       map[string]map[string]string
+		want          map[string]string
+		wantConflicts []Conflict
+	}{
+		{
+			name: "the same value is deduplicated",
+			records: map[string]map[string]string{
+				"team-a": {"a.com": "10.0.0.1"},
+				"team-b": {"a.com": "10.0.0.1"},
+			},
+			want:          map[string]string{"a.com": "10.0.0.1"},
+			wantConflicts: []Conflict{},
+		},
+		{
+			name: "the earlier namespace wins a conflict",
+			records: map[string]map[string]string{
+				DefaultConfigmapNamespace: {"b.com": "10.0.0.9"},
+				"team-a":                  {"a.com": "10.0.0.1", "b.com": "10.0.0.3"},
+				"team-b":                  {"a.com": "10.0.0.2"},
+			},
+			want: map[string]string{"a.com": "10.0.0.1", "b.com": "10.0.0.9"},
+			wantConflicts: []Conflict{
+				{Domain: "a.com", Namespace: "team-a", Value: "10.0.0.1", LoserNamespace: "team-b", LoserValue: "10.0.0.2"},
+				{Domain: "b.com", Namespace: DefaultConfigmapNamespace, Value: "10.0.0.9", LoserNamespace: "team-a", LoserValue: "10.0.0.3"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, conflicts := c.mergeRecords(tt.records)
+			if !reflect.DeepEqual(data, tt.want) {
+				t.Errorf("data = %v, want %v", data, tt.want)
+			}
+			if !reflect.DeepEqual(conflicts, tt.wantConflicts) {
+				t.Errorf("conflicts = %+v, want %+v", conflicts, tt.wantConflicts)
+			}
+		})
+	}
+}
+
+func TestSyncLineEnding(t *testing.T) {
+	tests := []struct {
+		lineEnding string
+		want       string
+	}{
+		{lineEnding: "", want: "10.0.0.1 a.com\n10.0.0.2 b.com\n"},
+		{lineEnding: LineEndingLF, want: "10.0.0.1 a.com\n10.0.0.2 b.com\n"},
+		{lineEnding: LineEndingCRLF, want: "10.0.0.1 a.com\r\n10.0.0.2 b.com\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.lineEnding, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hosts")
+			store := NewMemoryStore()
+			store.Set(DefaultConfigmapNamespace, "a.com", "10.0.0.1")
+			store.Set(DefaultConfigmapNamespace, "b.com", "10.0.0.2")
+			c := newTestController(store, Args{FilePaths: []string{path}, LineEnding: tt.lineEnding})
+			// Syncing again leaves the file in the same line ending
+			for i := 0; i < 2; i++ {
+				if err := c.syncConfigmap(syncKey); err != nil {
+					t.Fatalf("sync: %v", err)
+				}
+				if got := readFile(t, path); got != tt.want {
+					t.Fatalf("the hosts file = %q, want %q", got, tt.want)
+				}
+			}
+			if content, err := c.RenderHosts(); err != nil || content != tt.want {
+				t.Errorf("RenderHosts = %q, %v, want %q", content, err, tt.want)
+			}
+		})
+	}
+	if err := ValidateLineEnding("cr"); err == nil {
+		t.Error("ValidateLineEnding(cr) succeeded")
+	}
+}
+
+// waitFile waits for the content of the file to be want
+func waitFile(t *testing.T, path, want string) {
+	t.Helper()
+	var got string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		content, err := os.ReadFile(path)
+		if got = string(content); err == nil && got == want {
+			return
+		}
+	}
+	t.Fatalf("the hosts file = %q, want %q", got, want)
+}
+
+func TestDeletedConfigmapClearsTheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	args := Args{FilePaths: []string{path}}
+	clientset := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(clientset, 0)
+	configmapInformer := factory.Core().V1().ConfigMaps()
+	store := NewConfigmapStore(clientset, configmapInformer, args, true, 0)
+	c := NewConfigmapController(configmapInformer, store, args)
+	if err := store.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	go func() {
+		if err := c.Run(stop); err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	}()
+
+	if err := store.Set(DefaultConfigmapNamespace, "a.com", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	waitFile(t, path, "10.0.0.1 a.com\n")
+
+	if err := clientset.CoreV1().ConfigMaps(DefaultConfigmapNamespace).Delete(context.TODO(), DefaultConfigmapName, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFile(t, path, "")
+}
+
+func TestSyncDebounce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	args := Args{FilePaths: []string{path}, SyncDebounce: 200 * time.Millisecond, ReloadCoreDNS: true}
+	clientset := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(clientset, 0)
+	configmapInformer := factory.Core().V1().ConfigMaps()
+	store := NewConfigmapStore(clientset, configmapInformer, args, true, 0)
+	c := NewConfigmapController(configmapInformer, store, args)
+	// CoreDNS is signaled once per write of a new content of the hosts file
+	var writes int32
+	c.reload = func() error {
+		atomic.AddInt32(&writes, 1)
+		return nil
+	}
+	if err := store.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	go func() {
+		if err := c.Run(stop); err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	}()
+	if !cache.WaitForCacheSync(stop, c.HasSynced) {
+		t.Fatal("the cache never synced")
+	}
+
+	const updates = 50
+	for i := 1; i <= updates; i++ {
+		if err := store.Set(DefaultConfigmapNamespace, "a.com", fmt.Sprintf("10.0.0.%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The file always ends up with the latest records
+	waitFile(t, path, fmt.Sprintf("10.0.0.%d a.com\n", updates))
+	if got := atomic.LoadInt32(&writes); got == 0 || got > updates/10 {
+		t.Errorf("the hosts file is written %d times for %d updates, want far fewer", got, updates)
+	}
+}
+
+func TestSyncIsByteIdentical(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	c := newTestController(NewMemoryStore(), Args{FilePaths: []string{path}})
+	var want strings.Builder
+	for i := 0; i < 50; i++ {
+		want.WriteString(fmt.Sprintf("10.0.1.%d d%02d.com\n", i, i))
+	}
+	// The same data in new maps, whose iteration order differs every time
+	for i := 0; i < 3; i++ {
+		store := NewMemoryStore()
+		for j := 49; j >= 0; j-- {
+			store.Set(DefaultConfigmapNamespace, fmt.Sprintf("d%02d.com", j), fmt.Sprintf("10.0.1.%d", j))
+		}
+		c.store = store
+		if err := c.syncConfigmap(syncKey); err != nil {
+			t.Fatalf("sync: %v", err)
+		}
+		if got := readFile(t, path); got != want.String() {
+			t.Fatalf("the sync %d wrote %q, want %q", i, got, want.String())
+		}
+	}
+}
@@ -0,0 +1,556 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/devincd/coredns-hosts-api/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+// waitConfigmapInterval is the interval of checking the configmap exists when it is not created by the server
+var waitConfigmapInterval = 5 * time.Second
+
+// updateBackoff is the backoff of retrying the write of the shards on conflict. A new domain is written
+// by the update guarded by the resourceVersion, which conflicts with any concurrent write of the shard,
+// so it retries longer than retry.DefaultRetry with more jitter to spread the concurrent writers.
+var updateBackoff = wait.Backoff{
+	Steps:    10,
+	Duration: 10 * time.Millisecond,
+	Factor:   1.5,
+	Jitter:   1,
+}
+
+const (
+	// DefaultShardBytes is the size of the data of a configmap beyond which the records spill into
+	// the next shard, which leaves room below the 1MiB limit of the object for the metadata.
+	DefaultShardBytes = 700 * 1024
+
+	// pendingWriteTimeout bounds how long a read waits for the informer cache to catch up with a
+	// write before trusting the cache again, e.g. if a relist of the informer skipped the version.
+	pendingWriteTimeout = 10 * time.Second
+)
+
+type pendingWrite struct {
+	resourceVersion string
+	time            time.Time
+}
+
+// ConfigmapStore is the RecordStore keeping the records of every namespace in its configmap named
+// e.g. coredns-hosts-api. Once the data of it reaches the shard size, the new records spill into the
+// shards coredns-hosts-api-1, coredns-hosts-api-2 and so on, and every domain lives in one of them.
+// The write of several domains is atomic only if they live in the same shard.
+// The reads are served from the informer cache, falling back to the apiserver until the cache has
+// synced, and after a write until the cache holds the written version, so that a client reads its
+// own writes. The writes always go to the apiserver.
+// With Args.CompressRecords the records of a shard are stored compressed in its BinaryData instead,
+// see CompressedRecordsKey. Both encodings are read, and a shard in the other one is migrated by its
+// next write, or by Init for the global records.
+type ConfigmapStore struct {
+	clientset kubernetes.Interface
+	lister    corelisters.ConfigMapLister
+	synced    cache.InformerSynced
+	// name is the configmap of the records in every namespace, namespace is the one of the global records
+	name      string
+	namespace string
+	// createConfigmap creates the configmap of a namespace other than the global one on its first write
+	createConfigmap bool
+	// shardBytes is the size of the data of a shard beyond which the records spill into the next one,
+	// which is the size of the records before they are compressed
+	shardBytes int
+	compress   bool
+
+	lock sync.Mutex
+	// pending is the version of the last write per shard not yet seen in the cache
+	pending map[string]pendingWrite
+	// patchUnsupported is set once the apiserver rejects the JSON patch, the writes update the whole configmap then
+	patchUnsupported atomic.Bool
+}
+
+// NewConfigmapStore returns the ConfigmapStore of the configmap of args, every read goes to the apiserver
+// if configmapInformer is nil and the shard size is DefaultShardBytes if shardBytes is not positive.
+func NewConfigmapStore(clientset kubernetes.Interface, configmapInformer coreinformers.ConfigMapInformer, args Args, createConfigmap bool, shardBytes int) *ConfigmapStore {
+	if shardBytes <= 0 {
+		shardBytes = DefaultShardBytes
+	}
+	s := &ConfigmapStore{
+		clientset:       clientset,
+		name:            args.Name(),
+		namespace:       args.Namespace(),
+		createConfigmap: createConfigmap,
+		shardBytes:      shardBytes,
+		compress:        args.CompressRecords,
+		pending:         make(map[string]pendingWrite),
+	}
+	if configmapInformer != nil {
+		s.lister = configmapInformer.Lister()
+		s.synced = configmapInformer.Informer().HasSynced
+	}
+	return s
+}
+
+// Init creates the configmap of the global records if it doesn't exist, or waits for it to be
+// created by others (e.g. GitOps) if the store doesn't create the configmaps. The shards of the
+// global records are migrated to the encoding of the store then.
+func (s *ConfigmapStore) Init() error {
+	if !s.createConfigmap {
+		if err := s.waitConfigmap(); err != nil {
+			return err
+		}
+		return s.Migrate(s.namespace)
+	}
+	_, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(context.TODO(), s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = s.clientset.CoreV1().ConfigMaps(s.namespace).Create(context.TODO(), s.newShard(s.namespace, s.name, nil), metav1.CreateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	return s.Migrate(s.namespace)
+}
+
+// Migrate rewrites the shards of the namespace stored in the other encoding than the one of the store,
+// which is retried on conflict.
+func (s *ConfigmapStore) Migrate(namespace string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		shards, err := s.getShards(namespace, s.getLive)
+		if err != nil {
+			return err
+		}
+		for _, cm := range shards {
+			if compressed(cm) == s.compress {
+				continue
+			}
+			klog.InfoS("Migrate the encoding of the records", "configmap", klog.KObj(cm), "compressed", s.compress)
+			newCm := cm.DeepCopy()
+			if err := encodeShard(newCm, cm.Data, s.compress); err != nil {
+				return err
+			}
+			newCm, err = s.clientset.CoreV1().ConfigMaps(namespace).Update(context.TODO(), newCm, metav1.UpdateOptions{})
+			if err != nil {
+				return err
+			}
+			s.written(newCm)
+		}
+		return nil
+	})
+}
+
+func (s *ConfigmapStore) waitConfigmap() error {
+	return wait.PollImmediateInfinite(waitConfigmapInterval, func() (bool, error) {
+		_, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(context.TODO(), s.name, metav1.GetOptions{})
+		switch {
+		case errors.IsNotFound(err):
+			klog.InfoS("Waiting for the configmap to be created", "configmap", klog.KRef(s.namespace, s.name))
+			return false, nil
+		case err != nil:
+			klog.ErrorS(err, "Failed to get the configmap and retry", "configmap", klog.KRef(s.namespace, s.name))
+			return false, nil
+		}
+		return true, nil
+	})
+}
+
+func newConfigmap(namespace, name string, data map[string]string) *corev1.ConfigMap {
+	if data == nil {
+		data = make(map[string]string)
+	}
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Data: data,
+	}
+}
+
+// newShard returns the configmap of a shard with the records in the encoding of the store
+func (s *ConfigmapStore) newShard(namespace, name string, data map[string]string) *corev1.ConfigMap {
+	cm := newConfigmap(namespace, name, nil)
+	// The encoding never fails on a map of strings
+	_ = encodeShard(cm, copyData(data), s.compress)
+	return cm
+}
+
+// ShardName returns the name of the configmap of the shard of the records in the configmap base,
+// the first one is base itself
+func ShardName(base string, index int) string {
+	if index == 0 {
+		return base
+	}
+	return fmt.Sprintf("%s-%d", base, index)
+}
+
+// IsShardName reports whether the configmap is a shard of the records in the configmap base
+func IsShardName(base, name string) bool {
+	if name == base {
+		return true
+	}
+	suffix := strings.TrimPrefix(name, base+"-")
+	index, err := strconv.Atoi(suffix)
+	return suffix != name && err == nil && index > 0 && ShardName(base, index) == name
+}
+
+func (s *ConfigmapStore) Get(namespace, domain string) (string, bool, error) {
+	shards, err := s.getShards(namespace, s.getConfigmap)
+	if err != nil {
+		return "", false, err
+	}
+	data, _ := mergeShards(shards)
+	value, ok := data[domain]
+	return value, ok, nil
+}
+
+func (s *ConfigmapStore) List(namespace string) (map[string]string, error) {
+	shards, err := s.getShards(namespace, s.getConfigmap)
+	if err != nil {
+		return nil, err
+	}
+	data, _ := mergeShards(shards)
+	return data, nil
+}
+
+// Count counts the domains of the shards, a domain left in several shards by an interrupted move counts once
+func (s *ConfigmapStore) Count(namespace string) (int, error) {
+	shards, err := s.getShards(namespace, s.getConfigmap)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	for index, cm := range shards {
+		for key := range cm.Data {
+			if !inShards(key, shards[:index]) {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+func inShards(key string, shards []*corev1.ConfigMap) bool {
+	for _, cm := range shards {
+		if _, ok := cm.Data[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ConfigmapStore) Set(namespace, domain, value string) error {
+	return s.update("set", namespace, "", func(data map[string]string) error {
+		data[domain] = value
+		return nil
+	})
+}
+
+func (s *ConfigmapStore) Delete(namespace, domain string) error {
+	return s.update("delete", namespace, "", func(data map[string]string) error {
+		delete(data, domain)
+		return nil
+	})
+}
+
+func (s *ConfigmapStore) Update(namespace string, mutate func(data map[string]string) error) error {
+	return s.update("update", namespace, "", mutate)
+}
+
+// Version returns the resourceVersions of the shards of the namespace joined by ".",
+// the write of any shard changes it.
+func (s *ConfigmapStore) Version(namespace string) (string, error) {
+	shards, err := s.getShards(namespace, s.getConfigmap)
+	if err != nil {
+		return "", err
+	}
+	return shardsVersion(shards), nil
+}
+
+// UpdateIfVersion is Update guarded by the version of the shards, the shards are updated as a whole
+// rather than patched then, so that a write of the shard by others in between conflicts and the
+// retry sees the new version.
+func (s *ConfigmapStore) UpdateIfVersion(namespace, version string, mutate func(data map[string]string) error) error {
+	return s.update("update", namespace, version, mutate)
+}
+
+// update runs the read-modify-write of the shards, which is retried on conflict with the
+// retries counted by the operation. The shards must be at the version unless it is empty.
+func (s *ConfigmapStore) update(operation, namespace, version string, mutate func(data map[string]string) error) error {
+	var attempts int
+	retryErr := retry.RetryOnConflict(updateBackoff, func() error {
+		attempts++
+		// Retrieve the latest version of Configmap before attempting update
+		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
+		shards, getErr := s.getShards(namespace, s.getLive)
+		if getErr != nil {
+			return fmt.Errorf("failed to get latest version of Configmap: %v", getErr)
+		}
+		if version != "" && version != shardsVersion(shards) {
+			return ErrVersionMismatch
+		}
+		oldData, owners := mergeShards(shards)
+		data := copyData(oldData)
+		if err := mutate(data); err != nil {
+			return err
+		}
+		if equalData(oldData, data) {
+			return nil
+		}
+		if len(shards) == 0 && (namespace == s.namespace || !s.createConfigmap) {
+			return fmt.Errorf("failed to get latest version of Configmap: the configmap %s/%s is not found", namespace, s.name)
+		}
+		shardData, dirty := s.placeChanges(shards, owners, oldData, data)
+		// The shards in the other encoding are migrated along
+		for index, cm := range shards {
+			if compressed(cm) != s.compress {
+				dirty[index] = true
+			}
+		}
+		for index := range shardData {
+			if !dirty[index] {
+				continue
+			}
+			var newCm *corev1.ConfigMap
+			var writeErr error
+			if index < len(shards) {
+				newCm, writeErr = s.writeData(shards[index], shardData[index], version != "")
+			} else {
+				klog.InfoS("Spill the records into a new shard", "configmap", klog.KRef(namespace, ShardName(s.name, index)))
+				newCm, writeErr = s.clientset.CoreV1().ConfigMaps(namespace).Create(context.TODO(), s.newShard(namespace, ShardName(s.name, index), shardData[index]), metav1.CreateOptions{})
+			}
+			if writeErr != nil {
+				return writeErr
+			}
+			s.written(newCm)
+		}
+		return nil
+	})
+	metrics.ConfigmapUpdateRetries.WithLabelValues(operation).Add(float64(attempts - 1))
+	return retryErr
+}
+
+// placeChanges applies the changes from oldData to data to the data of the shards and returns it with
+// the changed shards. A changed domain stays in its shard unless the shard grows beyond the shard size,
+// and a new one goes into the first shard with room, or else into a new shard appended to the end.
+func (s *ConfigmapStore) placeChanges(shards []*corev1.ConfigMap, owners map[string]int, oldData, data map[string]string) ([]map[string]string, map[int]bool) {
+	shardData := make([]map[string]string, len(shards), len(shards)+1)
+	sizes := make([]int, len(shards), len(shards)+1)
+	for index, cm := range shards {
+		shardData[index] = copyData(cm.Data)
+		sizes[index] = dataSize(cm.Data)
+	}
+	if len(shards) == 0 {
+		shardData = append(shardData, make(map[string]string))
+		sizes = append(sizes, 0)
+	}
+	dirty := make(map[int]bool)
+	keys := changedKeys(oldData, data)
+	sort.Strings(keys)
+	for _, key := range keys {
+		// Remove the domain from every shard, including the leftover of an interrupted move
+		for index := range shardData {
+			if oldValue, ok := shardData[index][key]; ok {
+				delete(shardData[index], key)
+				sizes[index] -= len(key) + len(oldValue)
+				dirty[index] = true
+			}
+		}
+		value, ok := data[key]
+		if !ok {
+			continue
+		}
+		index, owned := owners[key]
+		if !owned || sizes[index]+len(key)+len(value) > s.shardBytes {
+			index = 0
+			for index < len(shardData) && sizes[index]+len(key)+len(value) > s.shardBytes {
+				index++
+			}
+		}
+		if index == len(shardData) {
+			shardData = append(shardData, make(map[string]string))
+			sizes = append(sizes, 0)
+		}
+		shardData[index][key] = value
+		sizes[index] += len(key) + len(value)
+		dirty[index] = true
+	}
+	return shardData, dirty
+}
+
+// getShards returns the existing shards of the namespace in order, by the getter of a configmap,
+// with the records of every shard decoded into its Data
+func (s *ConfigmapStore) getShards(namespace string, get func(namespace, name string) (*corev1.ConfigMap, error)) ([]*corev1.ConfigMap, error) {
+	var shards []*corev1.ConfigMap
+	for index := 0; ; index++ {
+		cm, err := get(namespace, ShardName(s.name, index))
+		if errors.IsNotFound(err) {
+			return shards, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cm, err = decodeShard(cm); err != nil {
+			return nil, err
+		}
+		shards = append(shards, cm)
+	}
+}
+
+// shardsVersion returns the version of the data of the shards, which is empty without any shard
+func shardsVersion(shards []*corev1.ConfigMap) string {
+	versions := make([]string, 0, len(shards))
+	for _, cm := range shards {
+		versions = append(versions, cm.ResourceVersion)
+	}
+	return strings.Join(versions, ".")
+}
+
+// mergeShards merges the data of the shards and returns the shard of every domain,
+// the earlier shard wins if a domain is left in several of them by an interrupted move.
+func mergeShards(shards []*corev1.ConfigMap) (map[string]string, map[string]int) {
+	data := make(map[string]string)
+	owners := make(map[string]int)
+	for index, cm := range shards {
+		for key, val := range cm.Data {
+			if _, ok := data[key]; !ok {
+				data[key] = val
+				owners[key] = index
+			}
+		}
+	}
+	return data, owners
+}
+
+// getConfigmap returns the configmap, which is shared with the cache and must not be modified
+func (s *ConfigmapStore) getConfigmap(namespace, name string) (*corev1.ConfigMap, error) {
+	if s.lister == nil || !s.synced() {
+		return s.getLive(namespace, name)
+	}
+	cm, err := s.lister.ConfigMaps(namespace).Get(name)
+	if s.fresh(namespace+"/"+name, cm) {
+		return cm, err
+	}
+	return s.getLive(namespace, name)
+}
+
+func (s *ConfigmapStore) getLive(namespace, name string) (*corev1.ConfigMap, error) {
+	return s.clientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+}
+
+// fresh reports whether the cached configmap includes the last write of it
+func (s *ConfigmapStore) fresh(key string, cached *corev1.ConfigMap) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	write, ok := s.pending[key]
+	if !ok {
+		return true
+	}
+	if (cached != nil && cached.ResourceVersion == write.resourceVersion) || time.Since(write.time) > pendingWriteTimeout {
+		delete(s.pending, key)
+		return true
+	}
+	return false
+}
+
+// written records the configmap returned by a write, the reads of it go to the apiserver
+// until the cache holds it.
+func (s *ConfigmapStore) written(cm *corev1.ConfigMap) {
+	if cm == nil || s.lister == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pending[cm.Namespace+"/"+cm.Name] = pendingWrite{resourceVersion: cm.ResourceVersion, time: time.Now()}
+}
+
+// jsonPatchOperation is an operation of a JSON patch (RFC 6902)
+type jsonPatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value string `json:"value"`
+}
+
+// jsonPointerEscaper escapes a key of the configmap data into a JSON pointer token (RFC 6901)
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// writeData writes the new data of the configmap. A change of a single existing key is sent as a JSON
+// patch of the key guarded by a test of its old value, so that it neither ships the whole data nor conflicts
+// with the writes of the other keys. Otherwise, or if the apiserver doesn't accept the patch or the test
+// fails, or the write is guarded, or either the shard or the store is compressed, the whole cm is
+// updated, which is guarded by the resourceVersion. A new key is never patched, since a JSON patch can't
+// test the absence of the key, and two concurrent adds of it would both succeed.
+func (s *ConfigmapStore) writeData(cm *corev1.ConfigMap, data map[string]string, guarded bool) (*corev1.ConfigMap, error) {
+	patchable := !guarded && !s.compress && !compressed(cm) && !s.patchUnsupported.Load()
+	if keys := changedKeys(cm.Data, data); len(keys) == 1 && hasKey(cm.Data, keys[0]) && patchable {
+		newCm, err := s.patchKey(cm, keys[0], data)
+		switch {
+		case err == nil:
+			return newCm, nil
+		case errors.IsUnsupportedMediaType(err) || errors.IsMethodNotSupported(err):
+			klog.InfoS("The apiserver doesn't support the JSON patch of configmaps and fall back to the update", "err", err)
+			s.patchUnsupported.Store(true)
+		case errors.IsInvalid(err):
+			// The key has changed since it was read, the update either succeeds or conflicts and is retried
+			klog.V(4).InfoS("Failed to patch the configmap and fall back to the update", "configmap", klog.KObj(cm), "key", keys[0], "err", err)
+		default:
+			return nil, err
+		}
+	}
+	cm = cm.DeepCopy()
+	if err := encodeShard(cm, data, s.compress); err != nil {
+		return nil, err
+	}
+	return s.clientset.CoreV1().ConfigMaps(cm.Namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+}
+
+// patchKey replaces or removes the existing key of the configmap if it still has the old value
+func (s *ConfigmapStore) patchKey(cm *corev1.ConfigMap, key string, data map[string]string) (*corev1.ConfigMap, error) {
+	path := "/data/" + jsonPointerEscaper.Replace(key)
+	ops := []jsonPatchOperation{{Op: "test", Path: path, Value: cm.Data[key]}}
+	if newValue, ok := data[key]; ok {
+		ops = append(ops, jsonPatchOperation{Op: "replace", Path: path, Value: newValue})
+	} else {
+		ops = append(ops, jsonPatchOperation{Op: "remove", Path: path})
+	}
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+	return s.clientset.CoreV1().ConfigMaps(cm.Namespace).Patch(context.TODO(), cm.Name, types.JSONPatchType, patch, metav1.PatchOptions{})
+}
+
+func hasKey(data map[string]string, key string) bool {
+	_, ok := data[key]
+	return ok
+}
+
+// changedKeys returns the keys whose values differ between a and b
+func changedKeys(a, b map[string]string) []string {
+	var keys []string
+	for key, val := range a {
+		if other, ok := b[key]; !ok || other != val {
+			keys = append(keys, key)
+		}
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,308 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func getConfigmap(t *testing.T, clientset *fake.Clientset, namespace, name string) *corev1.ConfigMap {
+	t.Helper()
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get the configmap %s/%s: %v", namespace, name, err)
+	}
+	return cm
+}
+
+func TestInitCreatesTheConfigmap(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	store := NewConfigmapStore(clientset, nil, Args{}, true, 0)
+	if err := store.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	getConfigmap(t, clientset, DefaultConfigmapNamespace, DefaultConfigmapName)
+}
+
+func TestInitWaitsForTheConfigmap(t *testing.T) {
+	interval := waitConfigmapInterval
+	waitConfigmapInterval = 10 * time.Millisecond
+	defer func() { waitConfigmapInterval = interval }()
+
+	clientset := fake.NewSimpleClientset()
+	store := NewConfigmapStore(clientset, nil, Args{}, false, 0)
+	done := make(chan error, 1)
+	go func() { done <- store.Init() }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Init returned %v before the configmap exists", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := clientset.CoreV1().ConfigMaps(DefaultConfigmapNamespace).Create(context.TODO(),
+		newConfigmap(DefaultConfigmapNamespace, DefaultConfigmapName, map[string]string{"a.com": "10.0.0.1"}), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Init is still waiting after the configmap is created")
+	}
+	// The configmap of the others is left as is
+	if cm := getConfigmap(t, clientset, DefaultConfigmapNamespace, DefaultConfigmapName); cm.Data["a.com"] != "10.0.0.1" {
+		t.Errorf("the data = %v, want it untouched", cm.Data)
+	}
+}
+
+// withResourceVersions makes the writes of the configmaps bump their resourceVersion and the updates of
+// a stale resourceVersion conflict like the apiserver, the tracker of the fake clientset does neither.
+// The writes are serialized, since the tracker patches by a get and an update.
+func withResourceVersions(clientset *fake.Clientset) {
+	var lock sync.Mutex
+	var version int64
+	gvr := corev1.SchemeGroupVersion.WithResource("configmaps")
+	react := k8stesting.ObjectReaction(clientset.Tracker())
+	clientset.PrependReactor("*", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		switch action.GetVerb() {
+		case "create", "update", "patch":
+		default:
+			return false, nil, nil
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if update, ok := action.(k8stesting.UpdateAction); ok {
+			cm := update.GetObject().(*corev1.ConfigMap)
+			if current, err := clientset.Tracker().Get(gvr, cm.Namespace, cm.Name); err == nil && current.(*corev1.ConfigMap).ResourceVersion != cm.ResourceVersion {
+				return true, nil, apierrors.NewConflict(gvr.GroupResource(), cm.Name, fmt.Errorf("the object has been modified"))
+			}
+		}
+		handled, obj, err := react(action)
+		cm, ok := obj.(*corev1.ConfigMap)
+		if err != nil || !ok {
+			return handled, obj, err
+		}
+		version++
+		cm.ResourceVersion = strconv.FormatInt(version, 10)
+		return true, cm, clientset.Tracker().Update(gvr, cm, cm.Namespace)
+	})
+}
+
+// newCachedStore returns the ConfigmapStore reading from the synced informer cache
+func newCachedStore(t testing.TB, clientset *fake.Clientset) *ConfigmapStore {
+	t.Helper()
+	factory := informers.NewSharedInformerFactory(clientset, 0)
+	store := NewConfigmapStore(clientset, factory.Core().V1().ConfigMaps(), Args{}, true, 0)
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	factory.Start(stop)
+	factory.WaitForCacheSync(stop)
+	return store
+}
+
+func TestCachedReadsMatchTheLiveOnes(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	withResourceVersions(clientset)
+	cached := newCachedStore(t, clientset)
+	live := NewConfigmapStore(clientset, nil, Args{}, true, 0)
+	if err := cached.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	writes := []func() error{
+		func() error { return cached.Set(DefaultConfigmapNamespace, "a.com", "10.0.0.1") },
+		func() error { return cached.Set(DefaultConfigmapNamespace, "b.com", "10.0.0.2") },
+		func() error { return cached.Set(DefaultConfigmapNamespace, "a.com", "10.0.0.3") },
+		func() error { return cached.Delete(DefaultConfigmapNamespace, "b.com") },
+	}
+	for i, write := range writes {
+		if err := write(); err != nil {
+			t.Fatalf("the write %d: %v", i, err)
+		}
+		// The write is read back right away, whether the cache has caught up or not
+		want, err := live.List(DefaultConfigmapNamespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := cached.List(DefaultConfigmapNamespace); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("after the write %d the cached data = %v, %v, want the live %v", i, got, err, want)
+		}
+	}
+}
+
+func BenchmarkConfigmapStoreGet(b *testing.B) {
+	clientset := fake.NewSimpleClientset(newConfigmap(DefaultConfigmapNamespace, DefaultConfigmapName, map[string]string{"a.com": "10.0.0.1"}))
+	for _, bm := range []struct {
+		name  string
+		store *ConfigmapStore
+	}{
+		{name: "cached", store: newCachedStore(b, clientset)},
+		{name: "live", store: NewConfigmapStore(clientset, nil, Args{}, true, 0)},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, ok, err := bm.store.Get(DefaultConfigmapNamespace, "a.com"); err != nil || !ok {
+					b.Fatalf("Get = %v, %v", ok, err)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentWritesLoseNoUpdate(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	withResourceVersions(clientset)
+	store := NewConfigmapStore(clientset, nil, Args{}, true, 0)
+	if err := store.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	const writers, domains = 10, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*domains)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for d := 0; d < domains; d++ {
+				domain := fmt.Sprintf("%d-%d.com", w, d)
+				if err := store.Set(DefaultConfigmapNamespace, domain, "10.0.0.1"); err != nil {
+					errs <- fmt.Errorf("Set %s: %v", domain, err)
+				}
+				// Every other domain is changed again, which patches an existing key
+				if d%2 == 0 {
+					if err := store.Set(DefaultConfigmapNamespace, domain, "10.0.0.2"); err != nil {
+						errs <- fmt.Errorf("Set %s: %v", domain, err)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	data, err := store.List(DefaultConfigmapNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != writers*domains {
+		t.Errorf("got %d domains, want %d", len(data), writers*domains)
+	}
+	for w := 0; w < writers; w++ {
+		for d := 0; d < domains; d++ {
+			want := "10.0.0.1"
+			if d%2 == 0 {
+				want = "10.0.0.2"
+			}
+			if domain := fmt.Sprintf("%d-%d.com", w, d); data[domain] != want {
+				t.Errorf("%s = %q, want %q", domain, data[domain], want)
+			}
+		}
+	}
+}
+
+func TestConcurrentCreatesOfTheSameDomainConflict(t *testing.T) {
+	clientset := fake.NewSimpleClientset(newConfigmap(DefaultConfigmapNamespace, DefaultConfigmapName, map[string]string{"b.com": "10.0.0.9"}))
+	withResourceVersions(clientset)
+	store := NewConfigmapStore(clientset, nil, Args{}, true, 0)
+	errExists := errors.New("already exists")
+	// Both creates read the configmap without the domain before either writes it
+	var read sync.WaitGroup
+	read.Add(2)
+	create := func(ip string) error {
+		var once sync.Once
+		return store.Update(DefaultConfigmapNamespace, func(data map[string]string) error {
+			once.Do(func() {
+				read.Done()
+				read.Wait()
+			})
+			if _, ok := data["a.com"]; ok {
+				return errExists
+			}
+			data["a.com"] = ip
+			return nil
+		})
+	}
+	ips := []string{"10.0.0.1", "10.0.0.2"}
+	errs := make([]error, len(ips))
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		wg.Add(1)
+		go func(i int, ip string) {
+			defer wg.Done()
+			errs[i] = create(ip)
+		}(i, ip)
+	}
+	wg.Wait()
+
+	// The later create conflicts and its retry sees the domain rather than overwriting it
+	winner := -1
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			winner = i
+		case !errors.Is(err, errExists):
+			t.Errorf("the create of %s = %v, want it to succeed or find the domain", ips[i], err)
+		}
+	}
+	if winner == -1 || errs[1-winner] == nil {
+		t.Fatalf("the creates = %v, want exactly one to succeed", errs)
+	}
+	if value, ok, err := store.Get(DefaultConfigmapNamespace, "a.com"); err != nil || !ok || value != ips[winner] {
+		t.Errorf("Get = %q, %v, %v, want the value of the successful create %s", value, ok, err, ips[winner])
+	}
+}
+
+func TestRecordsSpillIntoShards(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	withResourceVersions(clientset)
+	store := NewConfigmapStore(clientset, nil, Args{}, true, 256)
+	if err := store.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	const records = 50
+	var want strings.Builder
+	for i := 0; i < records; i++ {
+		if err := store.Set(DefaultConfigmapNamespace, fmt.Sprintf("d%02d.com", i), fmt.Sprintf("10.0.0.%d", i)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		want.WriteString(fmt.Sprintf("10.0.0.%d d%02d.com\n", i, i))
+	}
+	first := getConfigmap(t, clientset, DefaultConfigmapNamespace, DefaultConfigmapName)
+	second := getConfigmap(t, clientset, DefaultConfigmapNamespace, ShardName(DefaultConfigmapName, 1))
+	if len(first.Data) == 0 || len(second.Data) == 0 {
+		t.Fatalf("the shards have %d and %d records, want both used", len(first.Data), len(second.Data))
+	}
+	if data, err := store.List(DefaultConfigmapNamespace); err != nil || len(data) != records {
+		t.Errorf("List = %d records, %v, want %d", len(data), err, records)
+	}
+	if value, ok, err := store.Get(DefaultConfigmapNamespace, "d49.com"); err != nil || !ok || value != "10.0.0.49" {
+		t.Errorf("Get = %q, %v, %v, want 10.0.0.49", value, ok, err)
+	}
+	// The hosts file has the records of every shard
+	path := filepath.Join(t.TempDir(), "hosts")
+	c := newTestController(store, Args{FilePaths: []string{path}})
+	if err := c.syncConfigmap(syncKey); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if got := readFile(t, path); got != want.String() {
+		t.Errorf("the hosts file = %q, want %q", got, want.String())
+	}
+}
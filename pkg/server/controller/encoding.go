@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// CompressedRecordsKey is the key of the BinaryData of a shard holding its records as the gzip-compressed
+// JSON object of the domains and their values, see Args.CompressRecords. The Data of the shard is empty then.
+const CompressedRecordsKey = "records.json.gz"
+
+// compressed reports whether the records of the shard are stored compressed
+func compressed(cm *corev1.ConfigMap) bool {
+	_, ok := cm.BinaryData[CompressedRecordsKey]
+	return ok
+}
+
+// decodeShard returns the shard with its records in Data whatever their encoding. A compressed shard is
+// decoded into a copy, since the cached one must not be modified, and the plain records written beside the
+// compressed ones by others (e.g. kubectl edit) are kept unless the compressed ones have the same domains.
+func decodeShard(cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	blob, ok := cm.BinaryData[CompressedRecordsKey]
+	if !ok {
+		return cm, nil
+	}
+	data, err := decompressRecords(blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the records of the configmap %s/%s: %v", cm.Namespace, cm.Name, err)
+	}
+	for key, val := range cm.Data {
+		if _, ok := data[key]; !ok {
+			data[key] = val
+		}
+	}
+	cm = cm.DeepCopy()
+	cm.Data = data
+	return cm, nil
+}
+
+// encodeShard sets the records of the shard in the plain or the compressed encoding, which migrates
+// the shard stored in the other one
+func encodeShard(cm *corev1.ConfigMap, data map[string]string, compress bool) error {
+	if !compress {
+		cm.Data = data
+		delete(cm.BinaryData, CompressedRecordsKey)
+		if len(cm.BinaryData) == 0 {
+			cm.BinaryData = nil
+		}
+		return nil
+	}
+	blob, err := compressRecords(data)
+	if err != nil {
+		return err
+	}
+	if cm.BinaryData == nil {
+		cm.BinaryData = make(map[string][]byte)
+	}
+	cm.BinaryData[CompressedRecordsKey] = blob
+	cm.Data = nil
+	return nil
+}
+
+// compressRecords returns the gzip-compressed JSON of the records, the keys are marshaled in order
+// and the header has no time, so the same records are always compressed the same
+func compressRecords(data map[string]string) ([]byte, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressRecords(blob []byte) (map[string]string, error) {
+	r, err := gzip.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]string
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, err
+	}
+	if data == nil {
+		data = make(map[string]string)
+	}
+	return data, nil
+}
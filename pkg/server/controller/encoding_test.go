@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCompressedRecordsRoundTrip(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	withResourceVersions(clientset)
+	store := NewConfigmapStore(clientset, nil, Args{CompressRecords: true}, true, 256)
+	if err := store.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	const records = 50
+	want := make(map[string]string, records)
+	var hosts strings.Builder
+	for i := 0; i < records; i++ {
+		domain, ip := fmt.Sprintf("d%02d.com", i), fmt.Sprintf("10.0.0.%d", i)
+		if err := store.Set(DefaultConfigmapNamespace, domain, ip); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		want[domain] = ip
+		hosts.WriteString(ip + " " + domain + "\n")
+	}
+	for _, name := range []string{DefaultConfigmapName, ShardName(DefaultConfigmapName, 1)} {
+		cm := getConfigmap(t, clientset, DefaultConfigmapNamespace, name)
+		if len(cm.Data) != 0 || len(cm.BinaryData[CompressedRecordsKey]) == 0 {
+			t.Errorf("the shard %s = %d plain records and %d compressed bytes, want only the compressed ones",
+				name, len(cm.Data), len(cm.BinaryData[CompressedRecordsKey]))
+		}
+	}
+	if data, err := store.List(DefaultConfigmapNamespace); err != nil || !reflect.DeepEqual(data, want) {
+		t.Errorf("List = %v, %v, want %v", data, err, want)
+	}
+	if count, err := store.Count(DefaultConfigmapNamespace); err != nil || count != records {
+		t.Errorf("Count = %d, %v, want %d", count, err, records)
+	}
+	// The store without the flag reads the compressed records as well
+	plain := NewConfigmapStore(clientset, nil, Args{}, true, 256)
+	if value, ok, err := plain.Get(DefaultConfigmapNamespace, "d49.com"); err != nil || !ok || value != "10.0.0.49" {
+		t.Errorf("Get = %q, %v, %v, want 10.0.0.49", value, ok, err)
+	}
+	// So does the controller rendering the hosts file
+	path := filepath.Join(t.TempDir(), "hosts")
+	c := newTestController(store, Args{FilePaths: []string{path}})
+	if err := c.syncConfigmap(syncKey); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if got := readFile(t, path); got != hosts.String() {
+		t.Errorf("the hosts file = %q, want %q", got, hosts.String())
+	}
+}
+
+func TestMigrateTheEncoding(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	withResourceVersions(clientset)
+	want := map[string]string{"a.com": "10.0.0.1", "b.com": "10.0.0.2"}
+	// The configmaps written before the flag existed
+	for _, namespace := range []string{DefaultConfigmapNamespace, "team"} {
+		if _, err := clientset.CoreV1().ConfigMaps(namespace).Create(context.TODO(),
+			newConfigmap(namespace, DefaultConfigmapName, copyData(want)), metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Init migrates the global records
+	store := NewConfigmapStore(clientset, nil, Args{CompressRecords: true}, true, 0)
+	if err := store.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	cm := getConfigmap(t, clientset, DefaultConfigmapNamespace, DefaultConfigmapName)
+	if !compressed(cm) || len(cm.Data) != 0 {
+		t.Errorf("the global configmap = %v, want it compressed", cm.Data)
+	}
+	if data, err := store.List(DefaultConfigmapNamespace); err != nil || !reflect.DeepEqual(data, want) {
+		t.Errorf("List = %v, %v, want %v", data, err, want)
+	}
+
+	// The plain records of another namespace are read as they are until a write migrates them along
+	if data, err := store.List("team"); err != nil || !reflect.DeepEqual(data, want) {
+		t.Errorf("List of team = %v, %v, want %v", data, err, want)
+	}
+	if err := store.Set("team", "c.com", "10.0.0.3"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if cm := getConfigmap(t, clientset, "team", DefaultConfigmapName); !compressed(cm) || len(cm.Data) != 0 {
+		t.Errorf("the configmap of team = %v, want it compressed by the write", cm.Data)
+	}
+	if value, ok, err := store.Get("team", "a.com"); err != nil || !ok || value != "10.0.0.1" {
+		t.Errorf("Get = %q, %v, %v, want the record written before the migration", value, ok, err)
+	}
+
+	// Without the flag the records are migrated back into the plain data
+	plain := NewConfigmapStore(clientset, nil, Args{}, true, 0)
+	if err := plain.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	cm = getConfigmap(t, clientset, DefaultConfigmapNamespace, DefaultConfigmapName)
+	if compressed(cm) || !reflect.DeepEqual(cm.Data, want) {
+		t.Errorf("the global configmap = %v with the binary data %v, want the plain records %v", cm.Data, cm.BinaryData, want)
+	}
+}
+
+func TestDecodeShardKeepsThePlainRecordsBeside(t *testing.T) {
+	cm := newConfigmap(DefaultConfigmapNamespace, DefaultConfigmapName, nil)
+	if err := encodeShard(cm, map[string]string{"a.com": "10.0.0.1"}, true); err != nil {
+		t.Fatal(err)
+	}
+	// e.g. added by kubectl edit
+	cm.Data = map[string]string{"a.com": "10.0.0.9", "b.com": "10.0.0.2"}
+	decoded, err := decodeShard(cm)
+	if err != nil {
+		t.Fatalf("decodeShard: %v", err)
+	}
+	if want := map[string]string{"a.com": "10.0.0.1", "b.com": "10.0.0.2"}; !reflect.DeepEqual(decoded.Data, want) {
+		t.Errorf("the records = %v, want %v", decoded.Data, want)
+	}
+	if cm.Data["a.com"] != "10.0.0.9" {
+		t.Errorf("the shard is modified, want the decoded copy only")
+	}
+
+	cm.BinaryData[CompressedRecordsKey] = []byte("not gzip")
+	if _, err := decodeShard(cm); err == nil {
+		t.Error("decodeShard of a corrupted blob = nil, want an error")
+	}
+}
@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"sort"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	RecordEventAdded   = "added"
+	RecordEventUpdated = "updated"
+	RecordEventDeleted = "deleted"
+
+	// watchBufferSize is the number of the events kept for a watcher not keeping up,
+	// beyond which the watcher is dropped and has to watch again.
+	watchBufferSize = 256
+)
+
+// RecordEvent is a change of a record found by the sync of the hosts file. The changes in between
+// two syncs are coalesced, e.g. a domain added and deleted again before the sync has no event.
+type RecordEvent struct {
+	Type      string `json:"type"`
+	Namespace string `json:"namespace"`
+	Domain    string `json:"domain"`
+	Value     string `json:"value,omitempty"`
+	OldValue  string `json:"oldValue,omitempty"`
+}
+
+// recordEvents finds the changes between the records of two syncs and fans them out to the watchers
+type recordEvents struct {
+	lock     sync.Mutex
+	last     map[string]map[string]string
+	watchers map[chan RecordEvent]struct{}
+}
+
+func newRecordEvents() *recordEvents {
+	return &recordEvents{
+		watchers: make(map[chan RecordEvent]struct{}),
+	}
+}
+
+// Watch returns the events of the records since now and the function to stop watching. The channel
+// is closed once stopped, or if the watcher falls too far behind, and the events are lost then.
+func (c *ConfigmapController) Watch() (<-chan RecordEvent, func()) {
+	return c.events.watch()
+}
+
+func (e *recordEvents) watch() (<-chan RecordEvent, func()) {
+	ch := make(chan RecordEvent, watchBufferSize)
+	e.lock.Lock()
+	e.watchers[ch] = struct{}{}
+	e.lock.Unlock()
+	return ch, func() {
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		e.remove(ch)
+	}
+}
+
+func (e *recordEvents) remove(ch chan RecordEvent) {
+	if _, ok := e.watchers[ch]; ok {
+		delete(e.watchers, ch)
+		close(ch)
+	}
+}
+
+// publish sends the changes from the records of the last sync to the given ones, by namespace.
+// The first sync has nothing to compare with and only keeps the records.
+func (e *recordEvents) publish(records map[string]map[string]string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	last := e.last
+	e.last = records
+	if last == nil || len(e.watchers) == 0 {
+		return
+	}
+	for _, event := range diffRecordEvents(last, records) {
+		for ch := range e.watchers {
+			select {
+			case ch <- event:
+			default:
+				klog.InfoS("Drop the watcher falling behind the record events")
+				e.remove(ch)
+			}
+		}
+	}
+}
+
+// diffRecordEvents returns the events changing the old records into the new ones, sorted by
+// namespace and domain.
+func diffRecordEvents(oldRecords, newRecords map[string]map[string]string) []RecordEvent {
+	var namespaces []string
+	for namespace := range oldRecords {
+		namespaces = append(namespaces, namespace)
+	}
+	for namespace := range newRecords {
+		if _, ok := oldRecords[namespace]; !ok {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	sort.Strings(namespaces)
+
+	var events []RecordEvent
+	for _, namespace := range namespaces {
+		oldData, newData := oldRecords[namespace], newRecords[namespace]
+		keys := changedKeys(oldData, newData)
+		sort.Strings(keys)
+		for _, domain := range keys {
+			oldValue, existed := oldData[domain]
+			value, exists := newData[domain]
+			event := RecordEvent{Namespace: namespace, Domain: domain, Value: value, OldValue: oldValue}
+			switch {
+			case !existed:
+				event.Type = RecordEventAdded
+			case !exists:
+				event.Type = RecordEventDeleted
+			default:
+				event.Type = RecordEventUpdated
+			}
+			events = append(events, event)
+		}
+	}
+	return events
+}
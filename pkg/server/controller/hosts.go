@@ -0,0 +1,226 @@
+package controller
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// LineEndingLF and LineEndingCRLF are the supported line endings of the hosts file
+	LineEndingLF   = "lf"
+	LineEndingCRLF = "crlf"
+
+	// IPSeparator separates the ips of a domain resolving to several addresses
+	IPSeparator = ","
+
+	// CNAMEPrefix marks a configmap value as a CNAME to another domain rather than an ip
+	CNAMEPrefix = "cname:"
+	// PendingValue marks a domain registered without an ip yet, which is excluded from the hosts file
+	PendingValue = "pending"
+	// maxCNAMEDepth is the max length of a CNAME chain
+	maxCNAMEDepth = 8
+	// WildcardPrefix marks a domain matching all the subdomains of the rest of it
+	WildcardPrefix = "*."
+
+	// IPOrderSorted and IPOrderWeighted are the supported orders of the ips of a domain in the hosts file
+	IPOrderSorted   = "sorted"
+	IPOrderWeighted = "weighted"
+)
+
+// IsWildcard reports whether the domain is a wildcard like *.dev.example.com, which the hosts plugin
+// can't serve, so it is stored but left out of the hosts file and has to be served by CoreDNS otherwise.
+func IsWildcard(domain string) bool {
+	return strings.HasPrefix(domain, WildcardPrefix)
+}
+
+// ResolveCNAME follows the CNAME chain of the domain in the configmap data and returns the final ip.
+// The hosts plugin can't serve a real CNAME, so it is flattened to the target's current ip.
+func ResolveCNAME(data map[string]string, domain string) (string, error) {
+	visited := []string{domain}
+	current := domain
+	for i := 0; i <= maxCNAMEDepth; i++ {
+		stored, ok := data[current]
+		if !ok {
+			return "", fmt.Errorf("the CNAME target %s of the domain %s does not exist", current, domain)
+		}
+		val := DecodeValue(stored).Value
+		if val == PendingValue {
+			return "", fmt.Errorf("the CNAME target %s of the domain %s is pending", current, domain)
+		}
+		if !strings.HasPrefix(val, CNAMEPrefix) {
+			return val, nil
+		}
+		current = strings.TrimPrefix(val, CNAMEPrefix)
+		for _, v := range visited {
+			if v == current {
+				return "", fmt.Errorf("the CNAME chain of the domain %s has a cycle: %s -> %s", domain, strings.Join(visited, " -> "), current)
+			}
+		}
+		visited = append(visited, current)
+	}
+	return "", fmt.Errorf("the CNAME chain of the domain %s is longer than %d", domain, maxCNAMEDepth)
+}
+
+// renderHosts renders the configmap data into the hosts file content, one `ip domain` per line.
+// The lines are sorted by domain and the ips of a domain are in the order of order, or sorted if
+// it is nil, so the same data always renders the same file.
+func renderHosts(data map[string]string, order func(domain string, ips []string) []string) string {
+	domains := make([]string, 0, len(data))
+	size := 0
+	for domain, val := range data {
+		domains = append(domains, domain)
+		size += len(domain) + len(val) + 2
+	}
+	sort.Strings(domains)
+
+	// The content is built in one pass, and sized upfront so that a big sync doesn't regrow it
+	var content strings.Builder
+	content.Grow(size)
+	for _, domain := range domains {
+		val := data[domain]
+		if val == PendingValue || IsWildcard(domain) {
+			continue
+		}
+		ip := val
+		if strings.HasPrefix(val, CNAMEPrefix) {
+			var err error
+			ip, err = ResolveCNAME(data, domain)
+			if err != nil {
+				klog.ErrorS(err, "Skip the unresolvable CNAME", "domain", domain)
+				continue
+			}
+		}
+		addrs := SplitIPs(ip)
+		sort.Strings(addrs)
+		if order != nil {
+			addrs = order(domain, addrs)
+		}
+		for _, addr := range addrs {
+			content.WriteString(addr)
+			content.WriteByte(' ')
+			content.WriteString(domain)
+			content.WriteByte('\n')
+		}
+	}
+	return content.String()
+}
+
+// withoutDomains drops the lines of the domains in the rendered hosts content, which keeps
+// the CNAMEs flattened to the ips of the dropped domains
+func withoutDomains(content string, domains map[string]bool) string {
+	var ret strings.Builder
+	ret.Grow(len(content))
+	for _, line := range strings.SplitAfter(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && domains[fields[1]] {
+			continue
+		}
+		ret.WriteString(line)
+	}
+	return ret.String()
+}
+
+// ReverseFilePath is the reverse hosts file written next to the hosts file of the path if
+// Args.ReverseFile is set
+func ReverseFilePath(path string) string {
+	return path + "-reverse"
+}
+
+// weightedOrder returns the sorted ips shuffled by their weights, an ip comes first in proportion to
+// its weight across the seeds while the same seed always gives the same order. The domain is mixed
+// into the seed so that the domains don't rotate in lockstep.
+func weightedOrder(domain string, ips []string, weights map[string]int, seed int64) []string {
+	hash := fnv.New64a()
+	hash.Write([]byte(domain))
+	rng := rand.New(rand.NewSource(seed ^ int64(hash.Sum64())))
+
+	left := append([]string(nil), ips...)
+	total := 0
+	for _, ip := range left {
+		total += ipWeight(weights, ip)
+	}
+	ret := make([]string, 0, len(ips))
+	for len(left) > 0 {
+		n := rng.Intn(total)
+		i := 0
+		for ; n >= ipWeight(weights, left[i]); i++ {
+			n -= ipWeight(weights, left[i])
+		}
+		ret = append(ret, left[i])
+		total -= ipWeight(weights, left[i])
+		left = append(left[:i], left[i+1:]...)
+	}
+	return ret
+}
+
+// topIPs returns the max sorted ips of the highest weights, the sorted order breaks the ties,
+// and all of them if max is 0.
+func topIPs(ips []string, weights map[string]int, max int) []string {
+	if max <= 0 || len(ips) <= max {
+		return ips
+	}
+	ret := append([]string(nil), ips...)
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ipWeight(weights, ret[i]) > ipWeight(weights, ret[j])
+	})
+	ret = ret[:max]
+	sort.Strings(ret)
+	return ret
+}
+
+// ipWeight returns the weight of the ip, which is 1 unless set
+func ipWeight(weights map[string]int, ip string) int {
+	if weight := weights[ip]; weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// SplitIPs splits the stored value of a domain into its ips, each of which is a line of the hosts file
+func SplitIPs(value string) []string {
+	ips := make([]string, 0)
+	for _, ip := range strings.Split(value, IPSeparator) {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// JoinIPs is the inverse of SplitIPs
+func JoinIPs(ips []string) string {
+	return strings.Join(ips, IPSeparator)
+}
+
+// applyLineEnding converts the LF rendered hosts content to the given line ending
+func applyLineEnding(content, lineEnding string) string {
+	if lineEnding == LineEndingCRLF {
+		return strings.ReplaceAll(content, "\n", "\r\n")
+	}
+	return content
+}
+
+// ValidateIPOrder checks the order of the ips is one of the supported ones
+func ValidateIPOrder(order string) error {
+	switch order {
+	case "", IPOrderSorted, IPOrderWeighted:
+		return nil
+	default:
+		return fmt.Errorf("unsupported ip order %q, must be %s or %s", order, IPOrderSorted, IPOrderWeighted)
+	}
+}
+
+// ValidateLineEnding checks the line ending is one of the supported ones
+func ValidateLineEnding(lineEnding string) error {
+	switch lineEnding {
+	case "", LineEndingLF, LineEndingCRLF:
+		return nil
+	default:
+		return fmt.Errorf("unsupported line ending %q, must be %s or %s", lineEnding, LineEndingLF, LineEndingCRLF)
+	}
+}
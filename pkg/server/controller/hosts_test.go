@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderHostsSorted(t *testing.T) {
+	data := map[string]string{
+		"b.com": "10.0.0.2,10.0.0.1",
+		"a.com": "10.0.0.3",
+	}
+	want := "10.0.0.3 a.com\n10.0.0.1 b.com\n10.0.0.2 b.com\n"
+	for i := 0; i < 2; i++ {
+		if got := renderHosts(data, nil); got != want {
+			t.Fatalf("renderHosts = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestWeightedOrderIsDeterministic(t *testing.T) {
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	weights := map[string]int{"10.0.0.1": 5}
+	for seed := int64(0); seed < 100; seed++ {
+		first := weightedOrder("a.com", ips, weights, seed)
+		if second := weightedOrder("a.com", ips, weights, seed); !reflect.DeepEqual(first, second) {
+			t.Fatalf("the seed %d ordered %v and then %v", seed, first, second)
+		}
+		if len(first) != len(ips) {
+			t.Fatalf("the seed %d ordered %v, want a permutation of %v", seed, first, ips)
+		}
+	}
+}
+
+func TestWeightedOrderDistribution(t *testing.T) {
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	tests := []struct {
+		name    string
+		weights map[string]int
+		// want is the share of each ip coming first
+		want map[string]float64
+	}{
+		{name: "no weights", weights: nil, want: map[string]float64{"10.0.0.1": 1.0 / 3, "10.0.0.2": 1.0 / 3, "10.0.0.3": 1.0 / 3}},
+		{name: "weighted", weights: map[string]int{"10.0.0.1": 6, "10.0.0.2": 3}, want: map[string]float64{"10.0.0.1": 0.6, "10.0.0.2": 0.3, "10.0.0.3": 0.1}},
+	}
+	const rounds = 20000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			firsts := make(map[string]int)
+			for seed := int64(0); seed < rounds; seed++ {
+				firsts[weightedOrder("a.com", ips, tt.weights, seed)[0]]++
+			}
+			for ip, want := range tt.want {
+				if got := float64(firsts[ip]) / rounds; got < want-0.02 || got > want+0.02 {
+					t.Errorf("%s came first %.3f of the time, want %.3f", ip, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderHostsWeighted(t *testing.T) {
+	c := &ConfigmapController{args: Args{IPOrder: IPOrderWeighted}}
+	data := map[string]string{"a.com": "10.0.0.1,10.0.0.2"}
+	weights := map[string]map[string]int{"a.com": {"10.0.0.2": 1000000}}
+	want := "10.0.0.2 a.com\n10.0.0.1 a.com\n"
+	if got := renderHosts(data, c.ipOrder(weights, time.Now())); got != want {
+		t.Errorf("renderHosts = %q, want %q", got, want)
+	}
+}
+
+func TestTopIPs(t *testing.T) {
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+	tests := []struct {
+		name    string
+		weights map[string]int
+		max     int
+		want    []string
+	}{
+		{name: "unlimited", max: 0, want: ips},
+		{name: "within the cap", max: 4, want: ips},
+		{name: "no weights", max: 2, want: []string{"10.0.0.1", "10.0.0.2"}},
+		{name: "by weight", weights: map[string]int{"10.0.0.4": 5, "10.0.0.2": 3}, max: 2, want: []string{"10.0.0.2", "10.0.0.4"}},
+		{name: "ties in order", weights: map[string]int{"10.0.0.3": 2}, max: 2, want: []string{"10.0.0.1", "10.0.0.3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := topIPs(ips, tt.weights, tt.max); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("topIPs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderHostsCapped(t *testing.T) {
+	data := map[string]string{"a.com": "10.0.0.1,10.0.0.2,10.0.0.3"}
+	weights := map[string]map[string]int{"a.com": {"10.0.0.3": 2}}
+	tests := []struct {
+		name string
+		args Args
+		want string
+	}{
+		{name: "sorted", args: Args{MaxIPsPerDomain: 2}, want: "10.0.0.1 a.com\n10.0.0.3 a.com\n"},
+		{name: "weighted", args: Args{MaxIPsPerDomain: 1, IPOrder: IPOrderWeighted}, want: "10.0.0.3 a.com\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ConfigmapController{args: tt.args}
+			if got := renderHosts(data, c.ipOrder(weights, time.Now())); got != tt.want {
+				t.Errorf("renderHosts = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderHostsSkipsWildcards(t *testing.T) {
+	data := map[string]string{
+		"*.dev.example.com": "10.0.0.1",
+		"dev.example.com":   "10.0.0.2",
+		"a.com":             CNAMEPrefix + "dev.example.com",
+	}
+	want := "10.0.0.2 a.com\n10.0.0.2 dev.example.com\n"
+	if got := renderHosts(data, nil); got != want {
+		t.Errorf("renderHosts = %q, want %q", got, want)
+	}
+}
+
+// The hosts plugin answers the PTR query of an ip with its domains in the order of the hosts file
+func TestRenderHostsReverseOrder(t *testing.T) {
+	data := map[string]string{
+		"c.com": "10.0.0.1",
+		"a.com": "10.0.0.1,10.0.0.2",
+		"b.com": CNAMEPrefix + "c.com",
+	}
+	var domains []string
+	for _, line := range strings.Split(strings.TrimSuffix(renderHosts(data, nil), "\n"), "\n") {
+		if fields := strings.Fields(line); fields[0] == "10.0.0.1" {
+			domains = append(domains, fields[1])
+		}
+	}
+	if want := []string{"a.com", "b.com", "c.com"}; !reflect.DeepEqual(domains, want) {
+		t.Errorf("the domains of 10.0.0.1 = %v, want %v", domains, want)
+	}
+}
@@ -0,0 +1,76 @@
+package controller
+
+import "time"
+
+type Args struct {
+	// ConfigmapName is the configmap holding the records in every record namespace, and the prefix
+	// of the names of its shards, DefaultConfigmapName if empty.
+	ConfigmapName string
+	// ConfigmapNamespace is the namespace of the global records, DefaultConfigmapNamespace if empty.
+	ConfigmapNamespace string
+	// FilePaths are the hosts files to write, e.g. one per CoreDNS deployment in blue/green rollouts
+	FilePaths []string
+	// RecordNamespaces are the namespaces besides ConfigmapNamespace whose ConfigmapName configmap
+	// is merged into the hosts file, the earlier namespace wins on a conflicting domain.
+	RecordNamespaces []string
+	// FullResyncPeriod is the interval of re-rendering the hosts file from the configmap
+	// regardless of events, 0 means disabled.
+	FullResyncPeriod time.Duration
+	// WatchFailureThreshold is how long the configmap watch may keep failing before
+	// the status turns unhealthy, 0 means never.
+	WatchFailureThreshold time.Duration
+	// MaxHostsLines is the max number of lines of the hosts file, 0 means unlimited.
+	MaxHostsLines int
+	// MaxHostsBytes is the max size in bytes of the hosts file, 0 means unlimited.
+	MaxHostsBytes int
+	// LineEnding is the line ending of the hosts file, LineEndingLF or LineEndingCRLF.
+	LineEnding string
+	// ReloadCoreDNS signals the CoreDNS process to reload once the hosts file changes, which
+	// requires the pod to share the process namespace. The reload interval of the hosts plugin
+	// applies otherwise.
+	ReloadCoreDNS bool
+	// SyncDebounce delays the sync after an event of the configmaps, so that the events within it
+	// coalesce into one write of the hosts file, 0 means the sync starts immediately.
+	SyncDebounce time.Duration
+	// IPOrder is the order of the ips of a domain in the hosts file, IPOrderSorted or IPOrderWeighted
+	// which shuffles them by their weights. IPRotationPeriod is how often the weighted order changes,
+	// 0 means it never does.
+	IPOrder          string
+	IPRotationPeriod time.Duration
+	// MaxIPsPerDomain is the max number of the ips of a domain in the hosts file, the ones of the highest
+	// weights are rendered while all of them are kept in the store, 0 means unlimited.
+	MaxIPsPerDomain int
+	// CompressRecords stores the records of every shard of the configmaps gzip-compressed in its BinaryData,
+	// see CompressedRecordsKey, which is about half the size. Both encodings are read either way.
+	CompressRecords bool
+	// ReverseFile writes the reverse hosts file of every file path, see ReverseFilePath, which has the records
+	// without NoReverse. CoreDNS serves the PTR records from it while the hosts file has no_reverse.
+	ReverseFile bool
+}
+
+// Name returns ConfigmapName, or DefaultConfigmapName if it is empty
+func (a Args) Name() string {
+	if a.ConfigmapName == "" {
+		return DefaultConfigmapName
+	}
+	return a.ConfigmapName
+}
+
+// Namespace returns ConfigmapNamespace, or DefaultConfigmapNamespace if it is empty
+func (a Args) Namespace() string {
+	if a.ConfigmapNamespace == "" {
+		return DefaultConfigmapNamespace
+	}
+	return a.ConfigmapNamespace
+}
+
+// Namespaces returns the namespaces holding the records, the global one first
+func (a Args) Namespaces() []string {
+	namespaces := []string{a.Namespace()}
+	for _, ns := range a.RecordNamespaces {
+		if ns != a.Namespace() {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return namespaces
+}
@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"k8s.io/klog/v2"
+)
+
+// coreDNSProcessName is the command name of the CoreDNS process in /proc/<pid>/comm
+const coreDNSProcessName = "coredns"
+
+// reloadCoreDNS sends SIGUSR1 to the CoreDNS processes, which makes them reload the Corefile and
+// so re-read the hosts file at once instead of waiting for the reload interval of the hosts plugin.
+// It only finds the processes if the pod shares the process namespace (shareProcessNamespace: true).
+func reloadCoreDNS() error {
+	pids, err := findProcesses(coreDNSProcessName)
+	if err != nil {
+		return err
+	}
+	if len(pids) == 0 {
+		return fmt.Errorf("no %s process is found, is shareProcessNamespace enabled in the pod", coreDNSProcessName)
+	}
+	for _, pid := range pids {
+		if err := syscall.Kill(pid, syscall.SIGUSR1); err != nil {
+			return fmt.Errorf("failed to signal the %s process %d: %v", coreDNSProcessName, pid, err)
+		}
+		klog.InfoS("Signaled CoreDNS to reload", "pid", pid)
+	}
+	return nil
+}
+
+// findProcesses returns the pids of the processes with the command name
+func findProcesses(name string) ([]int, error) {
+	comms, err := filepath.Glob("/proc/[0-9]*/comm")
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, comm := range comms {
+		content, err := os.ReadFile(comm)
+		if err != nil {
+			// The process may have exited meanwhile
+			continue
+		}
+		if strings.TrimSpace(string(content)) != name {
+			continue
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(comm)))
+		if err != nil {
+			continue
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
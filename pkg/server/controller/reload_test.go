@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindProcesses(t *testing.T) {
+	content, err := os.ReadFile("/proc/self/comm")
+	if err != nil {
+		t.Skipf("no procfs: %v", err)
+	}
+	pids, err := findProcesses(string(content[:len(content)-1]))
+	if err != nil {
+		t.Fatalf("findProcesses: %v", err)
+	}
+	found := false
+	for _, pid := range pids {
+		found = found || pid == os.Getpid()
+	}
+	if !found {
+		t.Errorf("pids = %v, want the test process %d", pids, os.Getpid())
+	}
+}
+
+func TestSyncReloadsOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	store := NewMemoryStore()
+	c := newTestController(store, Args{FilePaths: []string{path}, ReloadCoreDNS: true})
+	reloads := 0
+	c.reload = func() error {
+		reloads++
+		return nil
+	}
+	sync := func(want int) {
+		t.Helper()
+		if err := c.syncConfigmap(syncKey); err != nil {
+			t.Fatalf("sync: %v", err)
+		}
+		if reloads != want {
+			t.Fatalf("reloads = %d, want %d", reloads, want)
+		}
+	}
+	store.Set(DefaultConfigmapNamespace, "a.com", "10.0.0.1")
+	sync(1)
+	// The same content is not worth a reload
+	sync(1)
+	store.Set(DefaultConfigmapNamespace, "b.com", "10.0.0.2")
+	sync(2)
+}
@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// ErrVersionMismatch is returned by UpdateIfVersion when the data has changed since the version
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// RecordStore keeps the records of every record namespace. The value of a domain is in the
+// stored form, i.e. the ips joined by IPSeparator, CNAMEPrefix with the target or PendingValue,
+// or the JSON of RecordValue if the record has any metadata.
+// Both the record api and the controller writing the hosts file work on it, so the records
+// can be kept elsewhere than in the configmaps without touching either of them.
+type RecordStore interface {
+	// Get returns the value of the domain, ok is false if it doesn't exist
+	Get(namespace, domain string) (value string, ok bool, err error)
+	// List returns all the values of the namespace by domain, which is empty if there is none
+	List(namespace string) (map[string]string, error)
+	// Count returns the number of the domains of the namespace without copying their values
+	Count(namespace string) (int, error)
+	// Set stores the value of the domain unconditionally
+	Set(namespace, domain, value string) error
+	// Delete deletes the domain unconditionally, nothing happens if it doesn't exist
+	Delete(namespace, domain string) error
+	// Update applies mutate to a copy of the data of the namespace and stores the result in one
+	// atomic write. Nothing is written if mutate fails or leaves the data unchanged, and mutate
+	// may be called again if the write conflicts with another one.
+	Update(namespace string, mutate func(data map[string]string) error) error
+	// Version returns an opaque version of the data of the namespace, which changes on every write
+	// of it, or empty if the namespace has no data stored at all
+	Version(namespace string) (string, error)
+	// UpdateIfVersion is Update only if the data of the namespace is still at the version,
+	// otherwise it fails with ErrVersionMismatch without calling mutate.
+	UpdateIfVersion(namespace, version string, mutate func(data map[string]string) error) error
+}
+
+// MemoryStore is a RecordStore in memory, which is lost on restart and not shared between the
+// replicas, e.g. for tests.
+type MemoryStore struct {
+	lock     sync.RWMutex
+	data     map[string]map[string]string
+	versions map[string]int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		data:     make(map[string]map[string]string),
+		versions: make(map[string]int),
+	}
+}
+
+func (m *MemoryStore) Get(namespace, domain string) (string, bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	value, ok := m.data[namespace][domain]
+	return value, ok, nil
+}
+
+func (m *MemoryStore) List(namespace string) (map[string]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return copyData(m.data[namespace]), nil
+}
+
+func (m *MemoryStore) Count(namespace string) (int, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return len(m.data[namespace]), nil
+}
+
+func (m *MemoryStore) Set(namespace, domain, value string) error {
+	return m.Update(namespace, func(data map[string]string) error {
+		data[domain] = value
+		return nil
+	})
+}
+
+func (m *MemoryStore) Delete(namespace, domain string) error {
+	return m.Update(namespace, func(data map[string]string) error {
+		delete(data, domain)
+		return nil
+	})
+}
+
+func (m *MemoryStore) Update(namespace string, mutate func(data map[string]string) error) error {
+	return m.UpdateIfVersion(namespace, "", mutate)
+}
+
+func (m *MemoryStore) Version(namespace string) (string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.version(namespace), nil
+}
+
+// UpdateIfVersion is Update without the check of the version if it is empty
+func (m *MemoryStore) UpdateIfVersion(namespace, version string, mutate func(data map[string]string) error) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if version != "" && version != m.version(namespace) {
+		return ErrVersionMismatch
+	}
+	data := copyData(m.data[namespace])
+	if err := mutate(data); err != nil {
+		return err
+	}
+	if !equalData(m.data[namespace], data) {
+		m.data[namespace] = data
+		m.versions[namespace]++
+	}
+	return nil
+}
+
+func (m *MemoryStore) version(namespace string) string {
+	if _, ok := m.data[namespace]; !ok {
+		return ""
+	}
+	return strconv.Itoa(m.versions[namespace])
+}
+
+// copyData returns a copy of the data, which is never nil
+func copyData(data map[string]string) map[string]string {
+	ret := make(map[string]string, len(data))
+	for key, val := range data {
+		ret[key] = val
+	}
+	return ret
+}
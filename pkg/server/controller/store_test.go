@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testRecordStore checks the behavior every RecordStore shares, the namespace must have no records yet
+func testRecordStore(t *testing.T, store RecordStore, namespace string) {
+	t.Helper()
+	if _, ok, err := store.Get(namespace, "a.com"); err != nil || ok {
+		t.Fatalf("Get of a missing domain = %v, %v, want not found", ok, err)
+	}
+	if err := store.Set(namespace, "a.com", "10.0.0.1"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := store.Set(namespace, "b.com", "10.0.0.2"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if value, ok, err := store.Get(namespace, "a.com"); err != nil || !ok || value != "10.0.0.1" {
+		t.Errorf("Get = %q, %v, %v, want 10.0.0.1", value, ok, err)
+	}
+	if count, err := store.Count(namespace); err != nil || count != 2 {
+		t.Errorf("Count = %d, %v, want 2", count, err)
+	}
+	if err := store.Delete(namespace, "b.com"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := store.Delete(namespace, "missing.com"); err != nil {
+		t.Errorf("Delete of a missing domain: %v", err)
+	}
+	want := map[string]string{"a.com": "10.0.0.1"}
+	if data, err := store.List(namespace); err != nil || !reflect.DeepEqual(data, want) {
+		t.Errorf("List = %v, %v, want %v", data, err, want)
+	}
+
+	// The version changes on every write and guards UpdateIfVersion
+	version, err := store.Version(namespace)
+	if err != nil || version == "" {
+		t.Fatalf("Version = %q, %v, want a version", version, err)
+	}
+	if err := store.Update(namespace, func(data map[string]string) error {
+		data["c.com"] = "10.0.0.3"
+		return nil
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if newVersion, err := store.Version(namespace); err != nil || newVersion == version {
+		t.Errorf("Version after a write = %q, %v, want other than %q", newVersion, err, version)
+	}
+	called := false
+	err = store.UpdateIfVersion(namespace, version, func(data map[string]string) error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, ErrVersionMismatch) || called {
+		t.Errorf("UpdateIfVersion of a stale version = %v with mutate called %v, want ErrVersionMismatch", err, called)
+	}
+
+	// A failed mutate writes nothing
+	version, _ = store.Version(namespace)
+	mutateErr := errors.New("mutate failed")
+	if err := store.UpdateIfVersion(namespace, version, func(data map[string]string) error {
+		data["d.com"] = "10.0.0.4"
+		return mutateErr
+	}); !errors.Is(err, mutateErr) {
+		t.Errorf("UpdateIfVersion = %v, want %v", err, mutateErr)
+	}
+	if _, ok, _ := store.Get(namespace, "d.com"); ok {
+		t.Error("the failed mutate is written")
+	}
+	if newVersion, _ := store.Version(namespace); newVersion != version {
+		t.Errorf("Version after a failed mutate = %q, want %q", newVersion, version)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	if version, err := store.Version(DefaultConfigmapNamespace); err != nil || version != "" {
+		t.Errorf("Version of no data = %q, %v, want empty", version, err)
+	}
+	testRecordStore(t, store, DefaultConfigmapNamespace)
+	// The namespaces don't share their records
+	if data, _ := store.List("other"); len(data) != 0 {
+		t.Errorf("List of another namespace = %v, want empty", data)
+	}
+}
+
+func TestConfigmapStore(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	withResourceVersions(clientset)
+	store := NewConfigmapStore(clientset, nil, Args{}, true, 0)
+	if err := store.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	testRecordStore(t, store, DefaultConfigmapNamespace)
+}
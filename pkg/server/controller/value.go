@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// RecordValue is the value of a record together with its metadata. It is stored in the configmap
+// as JSON if there is any metadata, and as the bare value otherwise, which is the only form written
+// before the metadata was supported.
+type RecordValue struct {
+	// Value is the bare value, i.e. the ips joined by IPSeparator, CNAMEPrefix with the target or PendingValue
+	Value string `json:"value"`
+	// Labels tag the record, e.g. with its owner, and are left out of the hosts file
+	Labels map[string]string `json:"labels,omitempty"`
+	// ExpiresAt is when the record expires, nil means never. The expired record is left out at
+	// once and deleted by the garbage collection later.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Weights are the weights of the ips, an ip without one weighs 1. They order the ips in the hosts
+	// file if Args.IPOrder is IPOrderWeighted.
+	Weights map[string]int `json:"weights,omitempty"`
+	// NoReverse leaves the ips out of the PTR records, i.e. out of the reverse hosts file of Args.ReverseFile
+	NoReverse bool `json:"noReverse,omitempty"`
+}
+
+// Expired reports whether the record has expired at now
+func (v RecordValue) Expired(now time.Time) bool {
+	return v.ExpiresAt != nil && !now.Before(*v.ExpiresAt)
+}
+
+// DecodeValue decodes the value stored in the configmap, a bare value is decoded as is without any metadata
+func DecodeValue(stored string) RecordValue {
+	if strings.HasPrefix(stored, "{") {
+		var v RecordValue
+		if err := json.Unmarshal([]byte(stored), &v); err == nil {
+			return v
+		}
+	}
+	return RecordValue{Value: stored}
+}
+
+// Encode returns the form of the value stored in the configmap, the bare value if there is no metadata
+func (v RecordValue) Encode() string {
+	if len(v.Labels) == 0 && v.ExpiresAt == nil && len(v.Weights) == 0 && !v.NoReverse {
+		return v.Value
+	}
+	// The keys of a map are marshaled in order, so the same value is always stored the same
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v.Value
+	}
+	return string(data)
+}
+
+// LiveValues returns the bare values of the records not expired at now, which is what the hosts file is rendered from
+func LiveValues(data map[string]string, now time.Time) map[string]string {
+	ret := make(map[string]string, len(data))
+	for domain, stored := range data {
+		if v := DecodeValue(stored); !v.Expired(now) {
+			ret[domain] = v.Value
+		}
+	}
+	return ret
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog/v2"
+)
+
+// corsMaxAge is how long the browser may cache the answer of a preflight request
+const corsMaxAge = 10 * time.Minute
+
+// corsAllowAny is the origin allowing every origin
+const corsAllowAny = "*"
+
+// corsMiddleware lets the browser pages of the allowed origins, e.g. a dashboard served from another
+// host, call the api. A preflight request of an origin, a method or a header not allowed is answered
+// with 403, and the other requests of an origin not allowed get no CORS headers, which makes the
+// browser hide the response from the page.
+func corsMiddleware(origins, methods, headers []string) gin.HandlerFunc {
+	for i := range methods {
+		methods[i] = strings.ToUpper(strings.TrimSpace(methods[i]))
+	}
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(headers, ", ")
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "Origin")
+		allowed := ExistString(corsAllowAny, origins) || ExistString(origin, origins)
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+		if !preflight {
+			if allowed {
+				c.Header("Access-Control-Allow-Origin", origin)
+				c.Header("Access-Control-Expose-Headers", "ETag, Retry-After")
+			}
+			c.Next()
+			return
+		}
+		if err := checkPreflight(c, allowed, methods, headers); err != nil {
+			klog.ErrorS(err, "Response with a error", "httpCode", http.StatusForbidden, "requestUri", c.Request.RequestURI)
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse(CodeForbidden, err))
+			return
+		}
+		c.Header("Access-Control-Allow-Origin", origin)
+		c.Header("Access-Control-Allow-Methods", allowMethods)
+		c.Header("Access-Control-Allow-Headers", allowHeaders)
+		c.Header("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
+
+// checkPreflight checks the origin, the method and the headers a preflight request asks for
+func checkPreflight(c *gin.Context, allowed bool, methods, headers []string) error {
+	origin := c.GetHeader("Origin")
+	if !allowed {
+		return fmt.Errorf("the origin %s is not allowed", origin)
+	}
+	method := c.GetHeader("Access-Control-Request-Method")
+	if !ExistString(method, methods) {
+		return fmt.Errorf("the method %s is not allowed for the origin %s", method, origin)
+	}
+	for _, header := range strings.Split(c.GetHeader("Access-Control-Request-Headers"), ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		permitted := false
+		for _, h := range headers {
+			if strings.EqualFold(h, header) {
+				permitted = true
+				break
+			}
+		}
+		if !permitted {
+			return fmt.Errorf("the header %s is not allowed for the origin %s", header, origin)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	s := newSyncedTestServer(t, Args{
+		CORSAllowedOrigins: []string{"https://dashboard.example.com"},
+		CORSAllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+		CORSAllowedHeaders: []string{"Authorization", "Content-Type", "If-Match"},
+	})
+	tests := []struct {
+		name   string
+		method string
+		header []string
+		status int
+		// want are the CORS headers of the response, an empty value means the header is missing
+		want map[string]string
+	}{
+		{
+			name:   "preflight of an allowed origin",
+			method: http.MethodOptions,
+			header: []string{"Origin", "https://dashboard.example.com", "Access-Control-Request-Method", "POST", "Access-Control-Request-Headers", "content-type, if-match"},
+			status: http.StatusNoContent,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":  "https://dashboard.example.com",
+				"Access-Control-Allow-Methods": "GET, POST, PUT, DELETE",
+				"Access-Control-Allow-Headers": "Authorization, Content-Type, If-Match",
+				"Access-Control-Max-Age":       "600",
+			},
+		},
+		{
+			name:   "request of an allowed origin",
+			method: http.MethodGet,
+			header: []string{"Origin", "https://dashboard.example.com"},
+			status: http.StatusOK,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":   "https://dashboard.example.com",
+				"Access-Control-Expose-Headers": "ETag, Retry-After",
+				"Access-Control-Allow-Methods":  "",
+			},
+		},
+		{
+			name:   "preflight of a disallowed origin",
+			method: http.MethodOptions,
+			header: []string{"Origin", "https://evil.example.com", "Access-Control-Request-Method", "POST"},
+			status: http.StatusForbidden,
+			want:   map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Methods": ""},
+		},
+		{
+			name:   "request of a disallowed origin",
+			method: http.MethodGet,
+			header: []string{"Origin", "https://evil.example.com"},
+			status: http.StatusOK,
+			want:   map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Expose-Headers": ""},
+		},
+		{
+			name:   "preflight of a disallowed method",
+			method: http.MethodOptions,
+			header: []string{"Origin", "https://dashboard.example.com", "Access-Control-Request-Method", "PATCH"},
+			status: http.StatusForbidden,
+			want:   map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:   "preflight of a disallowed header",
+			method: http.MethodOptions,
+			header: []string{"Origin", "https://dashboard.example.com", "Access-Control-Request-Method", "POST", "Access-Control-Request-Headers", "X-Custom"},
+			status: http.StatusForbidden,
+			want:   map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(s.webServer.Handler, tt.method, "/api/v1/records", "", tt.header...)
+			if w.Code != tt.status {
+				t.Errorf("got = %d, want %d", w.Code, tt.status)
+			}
+			for name, want := range tt.want {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("the header %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCORSDisabled(t *testing.T) {
+	s := newSyncedTestServer(t, Args{})
+	w := serve(s.webServer.Handler, http.MethodGet, "/api/v1/records", "", "Origin", "https://dashboard.example.com")
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("the header Access-Control-Allow-Origin = %q, want none", got)
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DiffRequest for DiffRecords function, the Base is the live records if it is nil
+type DiffRequest struct {
+	Base   []*Record `json:"base"`
+	Target []*Record `json:"target" binding:"required"`
+}
+
+// ChangedRecord is a domain whose ip is different between two record sets,
+// a CNAME is shown as "cname:<target>"
+type ChangedRecord struct {
+	Domain string `json:"domain"`
+	OldIP  string `json:"oldIp"`
+	NewIP  string `json:"newIp"`
+}
+
+// RecordsDiff is the delta from the base record set to the target record set
+type RecordsDiff struct {
+	Added   []*Record        `json:"added"`
+	Removed []*Record        `json:"removed"`
+	Changed []*ChangedRecord `json:"changed"`
+}
+
+// diffRecords computes the delta from base to target, sorted by domain
+func diffRecords(base, target []*Record) *RecordsDiff {
+	diff := &RecordsDiff{
+		Added:   make([]*Record, 0),
+		Removed: make([]*Record, 0),
+		Changed: make([]*ChangedRecord, 0),
+	}
+	baseMap := recordsToMap(base)
+	targetMap := recordsToMap(target)
+	for domain, value := range targetMap {
+		oldValue, ok := baseMap[domain]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, recordFromValue(domain, value))
+		case oldValue != value:
+			diff.Changed = append(diff.Changed, &ChangedRecord{Domain: domain, OldIP: oldValue, NewIP: value})
+		}
+	}
+	for domain, value := range baseMap {
+		if _, ok := targetMap[domain]; !ok {
+			diff.Removed = append(diff.Removed, recordFromValue(domain, value))
+		}
+	}
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].Domain < diff.Added[j].Domain })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].Domain < diff.Removed[j].Domain })
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Domain < diff.Changed[j].Domain })
+	return diff
+}
+
+// recordsToMap converts the records to a map from the domain to the bare value, the labels are left out
+func recordsToMap(records []*Record) map[string]string {
+	ret := make(map[string]string, len(records))
+	for _, record := range records {
+		if record == nil {
+			continue
+		}
+		ret[record.Domain] = record.value()
+	}
+	return ret
+}
+
+// String renders the diff in a human readable form, one change per line
+func (d *RecordsDiff) String() string {
+	var b strings.Builder
+	for _, record := range d.Added {
+		fmt.Fprintf(&b, "+ %s %s\n", record.Domain, record.value())
+	}
+	for _, record := range d.Removed {
+		fmt.Fprintf(&b, "- %s %s\n", record.Domain, record.value())
+	}
+	for _, record := range d.Changed {
+		fmt.Fprintf(&b, "~ %s %s -> %s\n", record.Domain, record.OldIP, record.NewIP)
+	}
+	return b.String()
+}
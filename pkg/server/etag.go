@@ -0,0 +1,46 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+	"github.com/gin-gonic/gin"
+)
+
+// ifMatch returns the version of the records the request is based on from the If-Match header,
+// which is the ETag of a previous read. It is empty without the header or with "*".
+func ifMatch(c *gin.Context) string {
+	etag := strings.TrimSpace(c.GetHeader("If-Match"))
+	if etag == "*" {
+		return ""
+	}
+	return strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+}
+
+// setETag sets the version of the records of the namespace as the ETag of the response, it is read
+// before the records so that a write based on them fails rather than overwriting a newer change.
+func (r *recordController) setETag(c *gin.Context, namespace string) error {
+	version, err := r.store.Version(namespace)
+	if err != nil {
+		return err
+	}
+	if version != "" {
+		c.Header("ETag", fmt.Sprintf("%q", version))
+	}
+	return nil
+}
+
+// update applies mutate to the records of the namespace in one write of the store, which fails
+// with ErrRecordConflict if the version is not empty and the records have changed since then.
+func (r *recordController) update(namespace, version string, mutate func(data map[string]string) error) error {
+	if version == "" {
+		return r.store.Update(namespace, mutate)
+	}
+	err := r.store.UpdateIfVersion(namespace, version, mutate)
+	if errors.Is(err, controller.ErrVersionMismatch) {
+		return fmt.Errorf("the records of the namespace %s have changed since the version %s: %w", namespace, version, ErrRecordConflict)
+	}
+	return err
+}
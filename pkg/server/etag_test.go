@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIfMatch(t *testing.T) {
+	s := newSyncedTestServer(t, Args{})
+	h := s.webServer.Handler
+	if w := serve(h, http.MethodPost, "/api/v1/records", `{"domain": "a.com", "ip": "10.0.0.1"}`); w.Code != http.StatusOK {
+		t.Fatalf("POST = %d %s", w.Code, w.Body)
+	}
+	stale := serve(h, http.MethodGet, "/api/v1/record/a.com", "").Header().Get("ETag")
+	if stale == "" {
+		t.Fatal("GET has no ETag")
+	}
+	// A write based on the latest read succeeds and changes the ETag
+	if w := serve(h, http.MethodPost, "/api/v1/records", `{"domain": "a.com", "ip": "10.0.0.2"}`, "If-Match", stale); w.Code != http.StatusOK {
+		t.Fatalf("POST with the matching ETag = %d %s", w.Code, w.Body)
+	}
+	etag := serve(h, http.MethodGet, "/api/v1/record/a.com", "").Header().Get("ETag")
+	if etag == stale {
+		t.Fatalf("the ETag %s is unchanged after a write", etag)
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		ifMatch string
+		status  int
+	}{
+		{name: "stale POST", method: http.MethodPost, path: "/api/v1/records", body: `{"domain": "a.com", "ip": "10.0.0.3"}`, ifMatch: stale, status: http.StatusConflict},
+		{name: "stale PUT", method: http.MethodPut, path: "/api/v1/records/a.com", body: `{"ip": "10.0.0.3"}`, ifMatch: stale, status: http.StatusConflict},
+		{name: "stale DELETE", method: http.MethodDelete, path: "/api/v1/record/a.com", ifMatch: stale, status: http.StatusConflict},
+		{name: "weak ETag", method: http.MethodPut, path: "/api/v1/records/a.com", body: `{"ip": "10.0.0.3"}`, ifMatch: "W/" + etag, status: http.StatusOK},
+		{name: "any", method: http.MethodDelete, path: "/api/v1/record/a.com", ifMatch: "*", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(h, tt.method, tt.path, tt.body, "If-Match", tt.ifMatch)
+			resp := decodeResponse(t, w, nil)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d %+v, want %d", w.Code, resp, tt.status)
+			}
+			if tt.status == http.StatusConflict && resp.Code != CodeConflict {
+				t.Errorf("code = %d, want %d", resp.Code, CodeConflict)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"time"
+
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// expiryCaller is the caller of the deletions of the expired records in the history and the audit log
+const expiryCaller = "expiry-gc"
+
+// runExpiryCollector deletes the expired records of every record namespace every period until stop
+// is closed. The expired records are left out of the api and the hosts file already, the deletion
+// keeps the configmap from growing and makes the hosts file resync.
+func (s *Server) runExpiryCollector(period time.Duration, stop <-chan struct{}) {
+	wait.Until(func() {
+		for _, namespace := range s.args.ControllerArgs.Namespaces() {
+			if err := s.record.collectExpired(namespace, time.Now()); err != nil {
+				klog.ErrorS(err, "Failed to delete the expired records", "namespace", namespace)
+			}
+		}
+	}, period, stop)
+}
+
+// collectExpired deletes the records of the namespace expired at now in one update
+func (r *recordController) collectExpired(namespace string, now time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var expired map[string]string
+	err := r.update(namespace, "", func(data map[string]string) error {
+		expired = make(map[string]string)
+		for domain, stored := range data {
+			if controller.DecodeValue(stored).Expired(now) {
+				expired[domain] = stored
+				delete(data, domain)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	req := writeRequest{Caller: expiryCaller}
+	for domain, oldValue := range expired {
+		r.recordChange(namespace, req, domain, HistoryActionExpire, oldValue, "")
+	}
+	if len(expired) > 0 {
+		klog.InfoS("Deleted the expired records", "namespace", namespace, "count", len(expired))
+	}
+	return nil
+}
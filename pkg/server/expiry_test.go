@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRecordExpires(t *testing.T) {
+	s := newSyncedTestServer(t, Args{})
+	namespace := s.args.ControllerArgs.Namespace()
+	if w := serve(s.webServer.Handler, http.MethodPost, "/api/v1/records", `{"domain": "a.com", "ip": "10.0.0.1", "ttlSeconds": 1}`); w.Code != http.StatusOK {
+		t.Fatalf("PostRecords = %d %s", w.Code, w.Body.String())
+	}
+	if w := serve(s.webServer.Handler, http.MethodGet, "/api/v1/record/a.com", ""); w.Code != http.StatusOK {
+		t.Fatalf("GetRecord before the expiry = %d, want %d", w.Code, http.StatusOK)
+	}
+	// The expiry is truncated to the second, so the record lives up to a second longer
+	deadline := time.Now().Add(3 * time.Second)
+	for serve(s.webServer.Handler, http.MethodGet, "/api/v1/record/a.com", "").Code != http.StatusNotFound {
+		if time.Now().After(deadline) {
+			t.Fatal("the record is still there after its ttlSeconds")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// It is left out before the garbage collection, which deletes it
+	if _, ok, err := s.store.Get(namespace, "a.com"); err != nil || !ok {
+		t.Fatalf("the store has the expired record = %v, %v, want it until the garbage collection", ok, err)
+	}
+	if err := s.record.collectExpired(namespace, time.Now()); err != nil {
+		t.Fatalf("collectExpired: %v", err)
+	}
+	if _, ok, err := s.store.Get(namespace, "a.com"); err != nil || ok {
+		t.Errorf("the store has the expired record = %v, %v, want it deleted", ok, err)
+	}
+}
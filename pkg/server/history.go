@@ -0,0 +1,95 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	HistoryActionSet    = "set"
+	HistoryActionDelete = "delete"
+	// HistoryActionExpire is the deletion of an expired record by the garbage collection
+	HistoryActionExpire = "expire"
+)
+
+// HistoryEntry is one change of a record, the values are the ones stored in the configmap
+type HistoryEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	OldValue string    `json:"oldValue"`
+	NewValue string    `json:"newValue"`
+}
+
+// recordHistory keeps the recent changes of every domain made through this server in memory,
+// at most size entries per domain of at most maxDomains domains. Beyond that the domain changed
+// least recently is forgotten, so that the deleted and the short-lived domains don't pile up.
+type recordHistory struct {
+	lock       sync.Mutex
+	size       int
+	maxDomains int
+	// domains are the elements of recent by the key of the domain
+	domains map[string]*list.Element
+	// recent holds the historyItem of every domain, the one changed latest at the front
+	recent *list.List
+}
+
+type historyItem struct {
+	key     string
+	entries []HistoryEntry
+}
+
+func newRecordHistory(size, maxDomains int) *recordHistory {
+	return &recordHistory{
+		size:       size,
+		maxDomains: maxDomains,
+		domains:    make(map[string]*list.Element),
+		recent:     list.New(),
+	}
+}
+
+func (h *recordHistory) add(namespace, domain, action, oldValue, newValue string) {
+	if h.size <= 0 {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	key := namespace + "/" + domain
+	elem, ok := h.domains[key]
+	if ok {
+		h.recent.MoveToFront(elem)
+	} else {
+		elem = h.recent.PushFront(&historyItem{key: key})
+		h.domains[key] = elem
+	}
+	item := elem.Value.(*historyItem)
+	item.entries = append(item.entries, HistoryEntry{
+		Time:     time.Now(),
+		Action:   action,
+		OldValue: oldValue,
+		NewValue: newValue,
+	})
+	if len(item.entries) > h.size {
+		item.entries = item.entries[len(item.entries)-h.size:]
+	}
+	for h.maxDomains > 0 && h.recent.Len() > h.maxDomains {
+		oldest := h.recent.Back()
+		h.recent.Remove(oldest)
+		delete(h.domains, oldest.Value.(*historyItem).key)
+	}
+}
+
+// get returns the changes of the domain, the latest first
+func (h *recordHistory) get(namespace, domain string) []HistoryEntry {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var entries []HistoryEntry
+	if elem, ok := h.domains[namespace+"/"+domain]; ok {
+		entries = elem.Value.(*historyItem).entries
+	}
+	ret := make([]HistoryEntry, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		ret = append(ret, entries[i])
+	}
+	return ret
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestRecordHistory(t *testing.T) {
+	h := newRecordHistory(2, 0)
+	for i := 1; i <= 3; i++ {
+		h.add("ns", "a.com", HistoryActionSet, fmt.Sprintf("10.0.0.%d", i-1), fmt.Sprintf("10.0.0.%d", i))
+	}
+	entries := h.get("ns", "a.com")
+	if len(entries) != 2 || entries[0].NewValue != "10.0.0.3" || entries[1].NewValue != "10.0.0.2" {
+		t.Errorf("entries = %+v, want the last 2 changes, the latest first", entries)
+	}
+	if entries := h.get("other", "a.com"); len(entries) != 0 {
+		t.Errorf("the entries of another namespace = %+v, want none", entries)
+	}
+}
+
+func TestRecordHistoryEvictsTheLeastRecentlyChangedDomain(t *testing.T) {
+	h := newRecordHistory(10, 2)
+	h.add("ns", "a.com", HistoryActionSet, "", "10.0.0.1")
+	h.add("ns", "b.com", HistoryActionSet, "", "10.0.0.2")
+	// a.com is changed again and b.com becomes the least recent
+	h.add("ns", "a.com", HistoryActionDelete, "10.0.0.1", "")
+	h.add("ns", "c.com", HistoryActionSet, "", "10.0.0.3")
+
+	if entries := h.get("ns", "b.com"); len(entries) != 0 {
+		t.Errorf("the entries of b.com = %+v, want it evicted", entries)
+	}
+	if entries := h.get("ns", "a.com"); len(entries) != 2 {
+		t.Errorf("the entries of a.com = %+v, want both changes kept", entries)
+	}
+	if entries := h.get("ns", "c.com"); len(entries) != 1 {
+		t.Errorf("the entries of c.com = %+v, want the change kept", entries)
+	}
+	if h.recent.Len() != 2 || len(h.domains) != 2 {
+		t.Errorf("%d domains are kept, want 2", len(h.domains))
+	}
+}
+
+func TestRecordHistoryEndpoint(t *testing.T) {
+	s := newSyncedTestServer(t, Args{HistorySize: 10})
+	h := s.webServer.Handler
+	serve(h, http.MethodPost, "/api/v1/records", `{"domain": "a.com", "ip": "10.0.0.1"}`)
+	serve(h, http.MethodPost, "/api/v1/records", `{"domain": "a.com", "ip": "10.0.0.2"}`)
+	serve(h, http.MethodDelete, "/api/v1/record/a.com", "")
+
+	var entries []HistoryEntry
+	decodeResponse(t, serve(h, http.MethodGet, "/api/v1/record/A.com./history", ""), &entries)
+	want := []HistoryEntry{
+		{Action: HistoryActionDelete, OldValue: "10.0.0.2"},
+		{Action: HistoryActionSet, OldValue: "10.0.0.1", NewValue: "10.0.0.2"},
+		{Action: HistoryActionSet, NewValue: "10.0.0.1"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("entries = %+v, want %+v", entries, want)
+	}
+	for i := range want {
+		if entries[i].Action != want[i].Action || entries[i].OldValue != want[i].OldValue || entries[i].NewValue != want[i].NewValue {
+			t.Errorf("entry %d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog/v2"
+)
+
+// hostsLine is a non-empty and non-comment line of a hosts file
+type hostsLine struct {
+	// Number is the line number starting from 1
+	Number  int
+	Content string
+	IP      string
+	Domains []string
+}
+
+// parseHostsFile parses the content in the /etc/hosts format, which is `IP hostname [hostname...]`
+// per line, skipping the comments and blank lines.
+func parseHostsFile(r io.Reader) ([]hostsLine, error) {
+	var lines []hostsLine
+	err := scanHostsFile(r, func(line hostsLine) error {
+		lines = append(lines, line)
+		return nil
+	})
+	return lines, err
+}
+
+// scanHostsFile calls fn with every line of the content in the /etc/hosts format as it is read,
+// the scan stops at the first error of fn.
+func scanHostsFile(r io.Reader, fn func(line hostsLine) error) error {
+	scanner := bufio.NewScanner(r)
+	number := 0
+	for scanner.Scan() {
+		number++
+		content := scanner.Text()
+		fields := strings.Fields(content)
+		if i := strings.Index(content, "#"); i >= 0 {
+			fields = strings.Fields(content[:i])
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if err := fn(hostsLine{
+			Number:  number,
+			Content: strings.TrimSpace(content),
+			IP:      fields[0],
+			Domains: fields[1:],
+		}); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+const (
+	HostsEntryValid     = "valid"
+	HostsEntryInvalid   = "invalid"
+	HostsEntryDuplicate = "duplicate"
+	HostsEntryConflict  = "conflict"
+)
+
+// HostsEntryReport is the validation result of one hostname mapping in a hosts file
+type HostsEntryReport struct {
+	Line    int    `json:"line"`
+	IP      string `json:"ip"`
+	Domain  string `json:"domain"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// HostsFileReport is the validation result of a whole hosts file
+type HostsFileReport struct {
+	Valid     int                 `json:"valid"`
+	Invalid   int                 `json:"invalid"`
+	Duplicate int                 `json:"duplicate"`
+	Conflict  int                 `json:"conflict"`
+	Entries   []*HostsEntryReport `json:"entries"`
+}
+
+// validateHostsLines reports every hostname mapping of the lines as valid, invalid,
+// duplicate (the same mapping appeared before) or conflict (the domain appeared before with another ip).
+func validateHostsLines(lines []hostsLine) *HostsFileReport {
+	report := &HostsFileReport{
+		Entries: make([]*HostsEntryReport, 0),
+	}
+	seen := make(map[string]string)
+	for _, line := range lines {
+		if len(line.Domains) == 0 {
+			report.Invalid++
+			report.Entries = append(report.Entries, &HostsEntryReport{
+				Line:    line.Number,
+				IP:      line.IP,
+				Status:  HostsEntryInvalid,
+				Message: fmt.Sprintf("the line %q has no hostname", line.Content),
+			})
+			continue
+		}
+		for _, domain := range line.Domains {
+			entry := &HostsEntryReport{
+				Line:   line.Number,
+				IP:     line.IP,
+				Domain: domain,
+				Status: HostsEntryValid,
+			}
+			if err := ValidateRecord(Record{IP: line.IP, Domain: domain}); err != nil {
+				entry.Status, entry.Message = HostsEntryInvalid, err.Error()
+			} else if ip, ok := seen[domain]; ok && ip == line.IP {
+				entry.Status, entry.Message = HostsEntryDuplicate, fmt.Sprintf("the domain %s is already mapped to %s", domain, ip)
+			} else if ok {
+				entry.Status, entry.Message = HostsEntryConflict, fmt.Sprintf("the domain %s is already mapped to %s", domain, ip)
+			} else {
+				seen[domain] = line.IP
+			}
+			switch entry.Status {
+			case HostsEntryValid:
+				report.Valid++
+			case HostsEntryInvalid:
+				report.Invalid++
+			case HostsEntryDuplicate:
+				report.Duplicate++
+			case HostsEntryConflict:
+				report.Conflict++
+			}
+			report.Entries = append(report.Entries, entry)
+		}
+	}
+	return report
+}
+
+// ImportResult is the result of importing a hosts file
+type ImportResult struct {
+	// Imported is the number of the domains created, a domain on several lines gets all their ips
+	Imported int `json:"imported"`
+	// Merged is the number of the existing domains the ips were added to, including the ones of a
+	// domain written by an earlier chunk of the same import
+	Merged int `json:"merged"`
+	// Skipped is the number of the mappings repeating an earlier one of the same chunk
+	Skipped int `json:"skipped"`
+	Invalid int `json:"invalid"`
+	// Entries are the first maxImportEntries skipped and invalid mappings, the rest are only counted
+	// in Skipped, Invalid and OmittedEntries
+	Entries        []*HostsEntryReport `json:"entries"`
+	OmittedEntries int                 `json:"omittedEntries,omitempty"`
+}
+
+const (
+	// importChunkSize is the max number of the domains written by one update of an import
+	importChunkSize = 1000
+	// maxImportEntries is the max number of the skipped and invalid mappings reported one by one
+	maxImportEntries = 1000
+)
+
+// hostsImporter collects the values of the domains from the lines of a hosts file, the ips of a
+// domain on several lines (e.g. its IPv4 and IPv6 addresses) are joined into one record. The
+// domains out of the domain policy are invalid. Only the domains of the current chunk are kept,
+// a domain appearing again in a later chunk is merged with the stored value when it is written,
+// so the memory is bounded by importChunkSize and maxImportEntries whatever the size of the file.
+type hostsImporter struct {
+	domains *domainPolicy
+	result  *ImportResult
+	// ips are the ips of the domains of the current chunk
+	ips map[string][]string
+}
+
+func newHostsImporter(domains *domainPolicy) *hostsImporter {
+	return &hostsImporter{
+		domains: domains,
+		result: &ImportResult{
+			Entries: make([]*HostsEntryReport, 0),
+		},
+		ips: make(map[string][]string),
+	}
+}
+
+// report adds the entry to the result unless maxImportEntries are reported already
+func (im *hostsImporter) report(entry *HostsEntryReport) {
+	if len(im.result.Entries) >= maxImportEntries {
+		im.result.OmittedEntries++
+		return
+	}
+	im.result.Entries = append(im.result.Entries, entry)
+}
+
+func (im *hostsImporter) add(line hostsLine) {
+	result := im.result
+	if len(line.Domains) == 0 {
+		result.Invalid++
+		im.report(&HostsEntryReport{
+			Line:    line.Number,
+			IP:      line.IP,
+			Status:  HostsEntryInvalid,
+			Message: fmt.Sprintf("the line %q has no hostname", line.Content),
+		})
+		return
+	}
+	for _, domain := range line.Domains {
+		domain = NormalizeDomain(domain)
+		if err := ValidateRecord(Record{IP: line.IP, Domain: domain}); err != nil {
+			result.Invalid++
+			im.report(&HostsEntryReport{Line: line.Number, IP: line.IP, Domain: domain, Status: HostsEntryInvalid, Message: err.Error()})
+			continue
+		}
+		if err := im.domains.check(domain); err != nil {
+			result.Invalid++
+			im.report(&HostsEntryReport{Line: line.Number, IP: line.IP, Domain: domain, Status: HostsEntryInvalid, Message: err.Error()})
+			continue
+		}
+		if ExistString(line.IP, im.ips[domain]) {
+			result.Skipped++
+			im.report(&HostsEntryReport{Line: line.Number, IP: line.IP, Domain: domain, Status: HostsEntryDuplicate,
+				Message: fmt.Sprintf("the domain %s is already mapped to %s", domain, line.IP)})
+			continue
+		}
+		im.ips[domain] = append(im.ips[domain], line.IP)
+	}
+}
+
+// flush returns the values of the domains of the current chunk and starts the next one
+func (im *hostsImporter) flush() map[string]string {
+	values := make(map[string]string, len(im.ips))
+	for domain, ips := range im.ips {
+		values[domain] = controller.JoinIPs(ips)
+	}
+	im.ips = make(map[string][]string)
+	return values
+}
+
+// ImportRecords adds the records of a hosts file in the /etc/hosts format, the ips of a domain are
+// merged with the stored ones. The invalid lines are reported and don't stop the others from being
+// imported. The body is parsed as it is read and the records are written every importChunkSize
+// domains, so a large file is spread over several updates (and the shards of the configmap) instead
+// of one. The chunks written before a failed one are kept.
+func (r *recordController) ImportRecords(c *gin.Context) {
+	namespace, ok := r.recordNamespace(c)
+	if !ok {
+		return
+	}
+	importer := newHostsImporter(r.domains)
+	req := newWriteRequest(c)
+	written := 0
+	var writeErr error
+	write := func() error {
+		values := importer.flush()
+		if len(values) == 0 {
+			return nil
+		}
+		created, err := r.SetDatas(namespace, req, values, true)
+		if err != nil {
+			writeErr = err
+			return writeErr
+		}
+		importer.result.Imported += created
+		importer.result.Merged += len(values) - created
+		// The version guards the first chunk only, the later ones follow our own writes
+		req.Version = ""
+		written += len(values)
+		klog.V(2).InfoS("Imported a chunk of the records", "namespace", namespace, "records", len(values), "written", written)
+		return nil
+	}
+	err := scanHostsFile(c.Request.Body, func(line hostsLine) error {
+		importer.add(line)
+		if len(importer.ips) >= importChunkSize {
+			return write()
+		}
+		return nil
+	})
+	if err == nil {
+		err = write()
+	}
+	if writeErr != nil {
+		writeErr = fmt.Errorf("failed to import the records after writing %d of them: %w", written, writeErr)
+		if errors.Is(writeErr, ErrRecordConflict) {
+			klog.ErrorS(writeErr, "Response with a error", "httpCode", http.StatusConflict, "requestUri", c.Request.RequestURI)
+			c.JSON(http.StatusConflict, ErrorResponse(CodeConflict, writeErr))
+			return
+		}
+		var validationErr *ValidationError
+		if errors.As(writeErr, &validationErr) {
+			klog.ErrorS(writeErr, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+			c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, writeErr))
+			return
+		}
+		klog.ErrorS(writeErr, "Response with a error", "httpCode", http.StatusInternalServerError, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusInternalServerError, ErrorResponse(CodeBackendError, writeErr))
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to read the hosts file after writing %d records: %w", written, err)
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	}
+	result := importer.result
+	c.JSON(http.StatusOK, SuccessResponse(result, fmt.Sprintf("ImportRecords is successful. Imported is %d, merged is %d, skipped is %d, invalid is %d",
+		result.Imported, result.Merged, result.Skipped, result.Invalid)))
+}
+
+// ExportRecords returns the records of all the record namespaces in the /etc/hosts format,
+// rendered the same way as the hosts file of CoreDNS. `?format=json` returns them as a list
+// of records instead, one per line of the hosts file.
+func (s *Server) ExportRecords(c *gin.Context) {
+	content, err := s.configmapController.RenderHosts()
+	if err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusInternalServerError, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusInternalServerError, ErrorResponse(CodeBackendError, err))
+		return
+	}
+	if c.Query("format") != "json" {
+		c.String(http.StatusOK, content)
+		return
+	}
+	lines, err := parseHostsFile(strings.NewReader(content))
+	if err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusInternalServerError, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusInternalServerError, ErrorResponse(CodeBackendError, err))
+		return
+	}
+	records := make([]*Record, 0, len(lines))
+	for _, line := range lines {
+		for _, domain := range line.Domains {
+			records = append(records, &Record{IP: line.IP, Domain: domain})
+		}
+	}
+	c.JSON(http.StatusOK, SuccessResponse(records, fmt.Sprintf("ExportRecords is successful. Record is %d", len(records))))
+}
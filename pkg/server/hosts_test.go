@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestImportRecordsInChunks(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	store := controller.NewConfigmapStore(clientset, nil, controller.Args{}, true, 8192)
+	if err := store.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	s := newTestServerWithStore(t, Args{}, clientset, store)
+	startInformers(t, s)
+
+	const domains = importChunkSize*2 + 500
+	var body strings.Builder
+	for i := 0; i < domains; i++ {
+		fmt.Fprintf(&body, "10.0.%d.%d d%d.example.com\n", i/250, i%250+1, i)
+	}
+	// The ips of a domain in different chunks are joined
+	body.WriteString("10.1.0.1 d0.example.com\n")
+
+	w := serve(s.webServer.Handler, http.MethodPost, "/api/v1/records/import", body.String())
+	var result ImportResult
+	decodeResponse(t, w, &result)
+	if w.Code != http.StatusOK || result.Imported != domains || result.Merged != 1 || result.Invalid != 0 {
+		t.Fatalf("import = %d %+v, want %d imported and d0.example.com merged", w.Code, result, domains)
+	}
+
+	data, err := store.List(controller.DefaultConfigmapNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != domains {
+		t.Errorf("the records = %d, want %d", len(data), domains)
+	}
+	if data["d0.example.com"] != "10.0.0.1,10.1.0.1" {
+		t.Errorf("d0.example.com = %q, want the ips of both chunks", data["d0.example.com"])
+	}
+	list, err := clientset.CoreV1().ConfigMaps(controller.DefaultConfigmapNamespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := 0
+	for _, cm := range list.Items {
+		if controller.IsShardName(controller.DefaultConfigmapName, cm.Name) {
+			shards++
+		}
+	}
+	if shards < 2 {
+		t.Errorf("the shards = %d, want the records spread over several", shards)
+	}
+}
+
+func TestHostsImporterMemoryIsBounded(t *testing.T) {
+	im := newHostsImporter(newDomainPolicy(nil, nil))
+	const lines = importChunkSize*3 + maxImportEntries
+	for i := 0; i < lines; i++ {
+		im.add(hostsLine{Number: i*2 + 1, IP: fmt.Sprintf("10.%d.%d.1", i/250, i%250), Domains: []string{fmt.Sprintf("d%d.example.com", i)}})
+		im.add(hostsLine{Number: i*2 + 2, IP: "10.0.0.256", Domains: []string{"bad.com"}})
+		// The same flush as ImportRecords, which forgets the domains of the chunk written
+		if len(im.ips) >= importChunkSize {
+			im.flush()
+		}
+		if len(im.ips) > importChunkSize || len(im.result.Entries) > maxImportEntries {
+			t.Fatalf("line %d: %d domains and %d entries kept, want at most %d and %d",
+				i, len(im.ips), len(im.result.Entries), importChunkSize, maxImportEntries)
+		}
+	}
+	result := im.result
+	if result.Invalid != lines || len(result.Entries) != maxImportEntries || result.OmittedEntries != lines-maxImportEntries {
+		t.Errorf("result = %d invalid, %d entries and %d omitted, want %d, %d and %d",
+			result.Invalid, len(result.Entries), result.OmittedEntries, lines, maxImportEntries, lines-maxImportEntries)
+	}
+}
+
+func TestImportRecordsMergesTheStoredRecords(t *testing.T) {
+	s := newSyncedTestServer(t, Args{})
+	h := s.webServer.Handler
+	for _, body := range []string{
+		`{"domain": "a.com", "ip": "10.0.0.1", "labels": {"team": "web"}}`,
+		`{"domain": "b.com", "cname": "a.com"}`,
+	} {
+		if w := serve(h, http.MethodPost, "/api/v1/records", body); w.Code != http.StatusOK {
+			t.Fatalf("POST %s = %d %s", body, w.Code, w.Body)
+		}
+	}
+	w := serve(h, http.MethodPost, "/api/v1/records/import", "10.0.0.2 a.com\n10.0.0.1 a.com\n10.0.0.3 b.com\n10.0.0.4 c.com\n")
+	var result ImportResult
+	decodeResponse(t, w, &result)
+	if w.Code != http.StatusOK || result.Imported != 1 || result.Merged != 2 {
+		t.Fatalf("import = %d %+v, want c.com imported, a.com and b.com merged", w.Code, result)
+	}
+	for domain, want := range map[string][]string{
+		"a.com": {"10.0.0.1", "10.0.0.2"},
+		// A CNAME is replaced by the imported ips
+		"b.com": {"10.0.0.3"},
+		"c.com": {"10.0.0.4"},
+	} {
+		var record Record
+		decodeResponse(t, serve(h, http.MethodGet, "/api/v1/record/"+domain, ""), &record)
+		if got := record.ips(); !reflect.DeepEqual(got, want) || record.CNAME != "" {
+			t.Errorf("%s = %+v, want %v", domain, record, want)
+		}
+		if domain == "a.com" && record.Labels["team"] != "web" {
+			t.Errorf("a.com labels = %v, want the stored ones kept", record.Labels)
+		}
+	}
+}
+
+func TestImportRecords(t *testing.T) {
+	s := newSyncedTestServer(t, Args{})
+	body := `# The hosts of the lab
+10.0.0.1 a.com b.com   # two names on a line
+
+2001:db8::1 a.com
+fe80::2 v6.com
+10.0.0.1 a.com
+10.0.0.3
+10.0.0.256 bad.com
+	10.0.0.4	tab.com
+`
+	w := serve(s.webServer.Handler, http.MethodPost, "/api/v1/records/import", body)
+	var result ImportResult
+	decodeResponse(t, w, &result)
+	if w.Code != http.StatusOK {
+		t.Fatalf("import = %d %s", w.Code, w.Body)
+	}
+	if result.Imported != 4 || result.Skipped != 1 || result.Invalid != 2 {
+		t.Errorf("result = %+v, want 4 imported, 1 skipped and 2 invalid", result)
+	}
+	want := map[string]string{
+		"a.com":   "10.0.0.1,2001:db8::1",
+		"b.com":   "10.0.0.1",
+		"v6.com":  "fe80::2",
+		"tab.com": "10.0.0.4",
+	}
+	data, err := s.store.List(controller.DefaultConfigmapNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("the records = %v, want %v", data, want)
+	}
+	lines := make(map[int]string)
+	for _, entry := range result.Entries {
+		lines[entry.Line] = entry.Status
+	}
+	wantLines := map[int]string{6: HostsEntryDuplicate, 7: HostsEntryInvalid, 8: HostsEntryInvalid}
+	if !reflect.DeepEqual(lines, wantLines) {
+		t.Errorf("the reported lines = %v, want %v", lines, wantLines)
+	}
+}
+
+func TestExportRecordsMatchesTheHostsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	s := newRunningTestServer(t, Args{ControllerArgs: controller.Args{FilePaths: []string{path}}})
+	h := s.webServer.Handler
+	for _, body := range []string{
+		`{"domain": "b.com", "ips": ["10.0.0.2", "10.0.0.1"]}`,
+		`{"domain": "a.com", "ip": "2001:db8::1"}`,
+		`{"domain": "c.com", "cname": "a.com"}`,
+	} {
+		if w := serve(h, http.MethodPost, "/api/v1/records", body); w.Code != http.StatusOK {
+			t.Fatalf("POST %s = %d %s", body, w.Code, w.Body)
+		}
+	}
+	w := serve(h, http.MethodGet, "/api/v1/records/export", "")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("export = %d %s, want the text/plain hosts file", w.Code, w.Header().Get("Content-Type"))
+	}
+	export := w.Body.String()
+	if strings.Count(export, "\n") != 4 {
+		t.Errorf("export = %q, want 4 lines", export)
+	}
+	waitFile(t, path, export)
+}
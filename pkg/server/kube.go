@@ -0,0 +1,34 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+// connectivityTimeout bounds the startup connectivity check
+const connectivityTimeout = 10 * time.Second
+
+// CheckKubeConnectivity calls the apiserver once to fail fast at startup, telling an
+// unreachable cluster apart from an authentication failure.
+func CheckKubeConnectivity(kubeconfig *rest.Config) error {
+	config := rest.CopyConfig(kubeconfig)
+	config.Timeout = connectivityTimeout
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("bad kubeconfig: %v", err)
+	}
+	version, err := clientset.Discovery().ServerVersion()
+	switch {
+	case apierrors.IsUnauthorized(err) || apierrors.IsForbidden(err):
+		return fmt.Errorf("auth failure against the cluster %s: %v", config.Host, err)
+	case err != nil:
+		return fmt.Errorf("cluster %s is unreachable: %v", config.Host, err)
+	}
+	klog.InfoS("Connected to the cluster", "host", config.Host, "version", version.GitVersion)
+	return nil
+}
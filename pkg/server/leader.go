@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+const (
+	leaderElectionLeaseDuration = 15 * time.Second
+	leaderElectionRenewDeadline = 10 * time.Second
+	leaderElectionRetryPeriod   = 2 * time.Second
+)
+
+// leaseName is the Lease held by the leader among the replicas of the server
+func (s *Server) leaseName() string {
+	return s.args.ControllerArgs.Name() + "-leader"
+}
+
+// runSingletons runs the write-side reconciliation which only one replica is supposed to do, the
+// reads and the sync of the local hosts file are done by every replica regardless. It blocks until
+// stop is closed.
+func (s *Server) runSingletons(stop <-chan struct{}) {
+	if s.args.StatusUpdatePeriod > 0 {
+		go s.runStatusReporter(s.args.StatusUpdatePeriod, stop)
+	}
+	if s.args.ExpiryGCPeriod > 0 {
+		go s.runExpiryCollector(s.args.ExpiryGCPeriod, stop)
+	}
+	if s.args.RestartCoreDNSOnChange {
+		go s.runChecksumAnnotator(stop)
+	}
+	<-stop
+}
+
+// runLeaderElection runs the singletons while this replica holds the Lease until stop is closed,
+// a replica losing the Lease stops them and campaigns again.
+func (s *Server) runLeaderElection(stop <-chan struct{}) error {
+	identity, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      s.leaseName(),
+			Namespace: s.args.ControllerArgs.Namespace(),
+		},
+		Client: s.clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   leaderElectionLeaseDuration,
+		RenewDeadline:   leaderElectionRenewDeadline,
+		RetryPeriod:     leaderElectionRetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            s.leaseName(),
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				klog.InfoS("Started leading", "identity", identity)
+				s.runSingletons(ctx.Done())
+			},
+			OnStoppedLeading: func() {
+				klog.InfoS("Stopped leading", "identity", identity)
+			},
+			OnNewLeader: func(leader string) {
+				klog.InfoS("The leader is elected", "leader", leader)
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	// Run returns once the Lease is lost, and the replica campaigns again unless stopped
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+	return nil
+}
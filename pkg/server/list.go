@@ -0,0 +1,196 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog/v2"
+)
+
+// RecordPage is a page of the records sorted by domain
+type RecordPage struct {
+	// Total is the number of all the records rather than the ones of the page
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Items  interface{} `json:"items"`
+}
+
+// pageParams parses ?offset and ?limit, paged is false if neither is set, limit 0 means unlimited
+func pageParams(c *gin.Context) (offset, limit int, paged bool, err error) {
+	offsetStr, hasOffset := c.GetQuery("offset")
+	limitStr, hasLimit := c.GetQuery("limit")
+	if hasOffset {
+		if offset, err = strconv.Atoi(offsetStr); err != nil || offset < 0 {
+			return 0, 0, false, fmt.Errorf("the offset %q must be a non-negative integer", offsetStr)
+		}
+	}
+	if hasLimit {
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit < 0 {
+			return 0, 0, false, fmt.Errorf("the limit %q must be a non-negative integer", limitStr)
+		}
+	}
+	return offset, limit, hasOffset || hasLimit, nil
+}
+
+// paginateRecords returns the records of the page, which are sorted by domain already
+func paginateRecords(records []*Record, offset, limit int) []*Record {
+	if offset >= len(records) {
+		return make([]*Record, 0)
+	}
+	end := len(records)
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return records[offset:end]
+}
+
+// filterRecords keeps the records matching all the filters, an empty filter matches all. The domain
+// filter is a glob if it contains any of `*?[`, or a substring otherwise. The ip filter is a prefix
+// if it ends with `*`, or an exact ip otherwise, and matches any ip of the record. The record must
+// have every label of the label filter.
+func filterRecords(records []*Record, domainFilter, ipFilter string, labelFilter map[string]string) ([]*Record, error) {
+	if domainFilter == "" && ipFilter == "" && len(labelFilter) == 0 {
+		return records, nil
+	}
+	if strings.ContainsAny(domainFilter, "*?[") {
+		if _, err := path.Match(domainFilter, ""); err != nil {
+			return nil, fmt.Errorf("the domain filter %q is malformed: %v", domainFilter, err)
+		}
+	}
+	ret := make([]*Record, 0)
+	for _, record := range records {
+		if matchDomain(record.Domain, domainFilter) && matchIP(record.ips(), ipFilter) && matchLabels(record.Labels, labelFilter) {
+			ret = append(ret, record)
+		}
+	}
+	return ret, nil
+}
+
+func matchDomain(domain, filter string) bool {
+	if filter == "" {
+		return true
+	}
+	if strings.ContainsAny(filter, "*?[") {
+		matched, _ := path.Match(filter, domain)
+		return matched
+	}
+	return strings.Contains(domain, filter)
+}
+
+func matchIP(ips []string, filter string) bool {
+	if filter == "" {
+		return true
+	}
+	prefix := strings.TrimSuffix(filter, "*")
+	for _, ip := range ips {
+		if (prefix != filter && strings.HasPrefix(ip, prefix)) || ip == filter {
+			return true
+		}
+	}
+	return false
+}
+
+func matchLabels(labels, filter map[string]string) bool {
+	for key, value := range filter {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// labelFilter parses the repeatable ?label=key=value into the labels a record must have
+func labelFilter(c *gin.Context) (map[string]string, error) {
+	ret := make(map[string]string)
+	for _, selector := range c.QueryArray("label") {
+		parts := strings.SplitN(selector, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("the label filter %q must be key=value", selector)
+		}
+		ret[parts[0]] = parts[1]
+	}
+	return ret, nil
+}
+
+// RecordCount is the number of the records of a namespace
+type RecordCount struct {
+	Count int `json:"count"`
+}
+
+// CountRecords returns the number of the records, which is cheaper than listing them
+func (r *recordController) CountRecords(c *gin.Context) {
+	namespace, ok := r.recordNamespace(c)
+	if !ok {
+		return
+	}
+	count, err := r.store.Count(namespace)
+	if err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusInternalServerError, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusInternalServerError, ErrorResponse(CodeBackendError, err))
+		return
+	}
+	c.JSON(http.StatusOK, SuccessResponse(RecordCount{Count: count}, fmt.Sprintf("CountRecords is successful. Count is %d", count)))
+}
+
+// recordsByIP returns the live records of the data resolving to the ip sorted by domain,
+// including the CNAMEs flattened to it.
+func recordsByIP(data map[string]string, ip net.IP) []*Record {
+	ret := make([]*Record, 0)
+	live := controller.LiveValues(data, time.Now())
+	for domain, val := range live {
+		if val == controller.PendingValue {
+			continue
+		}
+		resolved := val
+		if strings.HasPrefix(val, controller.CNAMEPrefix) {
+			var err error
+			if resolved, err = controller.ResolveCNAME(live, domain); err != nil {
+				continue
+			}
+		}
+		for _, addr := range controller.SplitIPs(resolved) {
+			if ip.Equal(net.ParseIP(addr)) {
+				ret = append(ret, recordFromValue(domain, data[domain]))
+				break
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Domain < ret[j].Domain
+	})
+	return ret
+}
+
+// GetRecordsByIP returns the records resolving to the ip of the path, which is the inverse of GetRecord.
+// The ip is compared by value, e.g. 2001:db8::1 matches 2001:0db8:0:0:0:0:0:1.
+func (r *recordController) GetRecordsByIP(c *gin.Context) {
+	namespace, ok := r.recordNamespace(c)
+	if !ok {
+		return
+	}
+	ip := strings.TrimSpace(c.Param("ip"))
+	if err := validateIP(ip); err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	}
+	r.lock.RLock()
+	data, err := r.store.List(namespace)
+	r.lock.RUnlock()
+	if err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusInternalServerError, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusInternalServerError, ErrorResponse(CodeBackendError, err))
+		return
+	}
+	ret := recordsByIP(data, net.ParseIP(ip))
+	c.JSON(http.StatusOK, SuccessResponse(ret, fmt.Sprintf("GetRecordsByIP is successful. IP is %s, and record is %d", ip, len(ret))))
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// newListTestServer returns the server holding the records of the domains with their ips
+func newListTestServer(t *testing.T, records map[string]string) *Server {
+	t.Helper()
+	s := newSyncedTestServer(t, Args{})
+	for domain, ip := range records {
+		if err := s.store.Set(s.args.ControllerArgs.Namespace(), domain, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func domainsOf(records []*Record) []string {
+	ret := make([]string, 0, len(records))
+	for _, record := range records {
+		ret = append(ret, record.Domain)
+	}
+	return ret
+}
+
+func TestListRecordsPages(t *testing.T) {
+	s := newListTestServer(t, map[string]string{
+		"e.com": "10.0.0.5", "a.com": "10.0.0.1", "d.com": "10.0.0.4", "c.com": "10.0.0.3", "b.com": "10.0.0.2",
+	})
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{query: "limit=2", want: []string{"a.com", "b.com"}},
+		{query: "offset=2&limit=2", want: []string{"c.com", "d.com"}},
+		{query: "offset=4&limit=2", want: []string{"e.com"}},
+		{query: "offset=5&limit=2", want: []string{}},
+		{query: "offset=3", want: []string{"d.com", "e.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			var items []*Record
+			page := RecordPage{Items: &items}
+			w := serve(s.webServer.Handler, http.MethodGet, "/api/v1/records?"+tt.query, "")
+			decodeResponse(t, w, &page)
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET = %d %s", w.Code, w.Body)
+			}
+			if got := domainsOf(items); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("the page = %v, want %v", got, tt.want)
+			}
+			if page.Total != 5 {
+				t.Errorf("total = %d, want all the 5 records", page.Total)
+			}
+		})
+	}
+
+	for _, query := range []string{"limit=-1", "offset=x"} {
+		if w := serve(s.webServer.Handler, http.MethodGet, "/api/v1/records?"+query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("GET ?%s = %d, want 400", query, w.Code)
+		}
+	}
+	// Without the page parameters the records are returned as a plain list
+	var items []*Record
+	decodeResponse(t, serve(s.webServer.Handler, http.MethodGet, "/api/v1/records", ""), &items)
+	if len(items) != 5 {
+		t.Errorf("the records = %v, want all of them", domainsOf(items))
+	}
+}
+
+func TestListRecordsFilters(t *testing.T) {
+	s := newListTestServer(t, map[string]string{
+		"api.example.com":  "10.0.0.1",
+		"web.example.com":  "10.0.1.1,10.0.0.2",
+		"api.example.org":  "10.0.1.2",
+		"mail.example.net": "192.168.0.1",
+	})
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{name: "domain substring", query: "domain=example.com", want: []string{"api.example.com", "web.example.com"}},
+		{name: "domain glob", query: "domain=api.*", want: []string{"api.example.com", "api.example.org"}},
+		{name: "exact ip", query: "ip=10.0.0.1", want: []string{"api.example.com"}},
+		{name: "ip prefix", query: "ip=10.0.1.*", want: []string{"api.example.org", "web.example.com"}},
+		{name: "both", query: "domain=example.com&ip=10.0.1.*", want: []string{"web.example.com"}},
+		{name: "nothing matching", query: "domain=example.com&ip=192.168.*", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var items []*Record
+			w := serve(s.webServer.Handler, http.MethodGet, "/api/v1/records?"+tt.query, "")
+			decodeResponse(t, w, &items)
+			if got := domainsOf(items); w.Code != http.StatusOK || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GET = %d %v, want %v", w.Code, got, tt.want)
+			}
+		})
+	}
+	if w := serve(s.webServer.Handler, http.MethodGet, "/api/v1/records?domain=[", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("GET a malformed glob = %d, want 400", w.Code)
+	}
+}
+
+func TestCountRecords(t *testing.T) {
+	s := newSyncedTestServer(t, Args{})
+	h := s.webServer.Handler
+	steps := []struct {
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{want: 0},
+		{method: http.MethodPost, path: "/api/v1/records", body: `{"domain": "a.com", "ip": "10.0.0.1"}`, want: 1},
+		{method: http.MethodPost, path: "/api/v1/records", body: `{"domain": "b.com", "ips": ["10.0.0.1", "10.0.0.2"]}`, want: 2},
+		{method: http.MethodPost, path: "/api/v1/records", body: `{"domain": "a.com", "ip": "10.0.0.3"}`, want: 2},
+		{method: http.MethodDelete, path: "/api/v1/record/a.com", want: 1},
+		{method: http.MethodDelete, path: "/api/v1/record/b.com", want: 0},
+	}
+	for i, step := range steps {
+		if step.method != "" {
+			if w := serve(h, step.method, step.path, step.body); w.Code != http.StatusOK {
+				t.Fatalf("%s %s = %d %s", step.method, step.path, w.Code, w.Body)
+			}
+		}
+		var count RecordCount
+		if w := serve(h, http.MethodGet, "/api/v1/records/count", ""); w.Code != http.StatusOK {
+			t.Fatalf("GET = %d %s", w.Code, w.Body)
+		} else if decodeResponse(t, w, &count); count.Count != step.want {
+			t.Errorf("the count after the step %d = %d, want %d", i, count.Count, step.want)
+		}
+	}
+}
+
+func TestGetRecordsByIP(t *testing.T) {
+	s := newListTestServer(t, map[string]string{
+		"a.com": "10.0.0.1",
+		"b.com": "10.0.0.2,10.0.0.1",
+		"c.com": "10.0.0.3",
+		"d.com": "cname:b.com",
+		"e.com": "fd00::1",
+	})
+	tests := []struct {
+		ip     string
+		status int
+		want   []string
+	}{
+		{ip: "10.0.0.1", status: http.StatusOK, want: []string{"a.com", "b.com", "d.com"}},
+		{ip: "10.0.0.3", status: http.StatusOK, want: []string{"c.com"}},
+		{ip: "10.0.0.9", status: http.StatusOK, want: []string{}},
+		{ip: "fd00:0::1", status: http.StatusOK, want: []string{"e.com"}},
+		{ip: "10.0.0.300", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			var records []*Record
+			w := serve(s.webServer.Handler, http.MethodGet, "/api/v1/records/by-ip/"+tt.ip, "")
+			resp := decodeResponse(t, w, &records)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d %+v, want %d", w.Code, resp, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if got := domainsOf(records); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("the domains = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/devincd/coredns-hosts-api/pkg/version"
+	"github.com/gin-gonic/gin"
+)
+
+// openAPIOperation documents a handler of the api, the routes sharing a handler, e.g. the global
+// and the namespace scoped ones, share the documentation.
+type openAPIOperation struct {
+	summary string
+	// query are the query parameters
+	query []string
+	// body is the schema of the JSON body, or textBody for a hosts file
+	body interface{}
+	// produces is the content type of the success response, empty means a JSON Response
+	produces string
+}
+
+const textBody = "text/plain"
+
+func schemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func arrayOf(item map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": item}
+}
+
+// openAPIOperations are keyed by the name of the handler, a route whose handler is missing here is
+// still listed in the spec with its path parameters only.
+var openAPIOperations = map[string]openAPIOperation{
+	"PostRecords":        {summary: "Add or update a record", query: []string{"allowEmptyIP"}, body: schemaRef("Record")},
+	"DeleteRecords":      {summary: "Delete the record of the domain in the body, only if it is stored with the ip when the ip is set", body: schemaRef("DeleteRecord")},
+	"ListRecords":        {summary: "List the records", query: []string{"format", "offset", "limit", "domain", "ip", "label"}},
+	"GetRecord":          {summary: "Get the record of a domain"},
+	"GetRecordHistory":   {summary: "Get the recent changes of a domain, the latest first"},
+	"DeleteRecord":       {summary: "Delete the record of a domain", query: []string{"force"}},
+	"UpdateRecord":       {summary: "Update the record of an existing domain", body: schemaRef("Record")},
+	"AddRecordIP":        {summary: "Add an ip to a domain", body: map[string]interface{}{"type": "object", "required": []string{"ip"}, "properties": map[string]interface{}{"ip": map[string]interface{}{"type": "string"}}}},
+	"RemoveRecordIP":     {summary: "Remove an ip from a domain"},
+	"ValidateRecords":    {summary: "Validate a hosts file without writing it", body: textBody},
+	"DiffRecords":        {summary: "Compare two record sets", query: []string{"output"}, body: schemaRef("DiffRequest")},
+	"PostRecordsBatch":   {summary: "Add or update several records in one update", body: arrayOf(schemaRef("Record"))},
+	"DeleteRecordsBatch": {summary: "Delete several records in one update", body: arrayOf(schemaRef("DeleteRecord"))},
+	"ImportRecords":      {summary: "Import the records of a hosts file", body: textBody},
+	"ExportRecords":      {summary: "Export the records of all the namespaces as a hosts file", query: []string{"format"}, produces: textBody},
+	"WatchRecords":       {summary: "Watch the changes of the records as Server-Sent Events", produces: "text/event-stream"},
+	"CountRecords":       {summary: "Count the records"},
+	"GetRecordsByIP":     {summary: "List the records resolving to an ip"},
+	"ListConflicts":      {summary: "List the domains mapped to different values in several namespaces"},
+	"Compact":            {summary: "Rewrite the records into the canonical form"},
+}
+
+// openAPISchemas are the schemas referenced by the operations
+var openAPISchemas = map[string]interface{}{
+	"Response": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"code":    map[string]interface{}{"type": "integer", "description": "0 on success, see the error codes otherwise"},
+			"message": map[string]interface{}{"type": "string"},
+			"data":    map[string]interface{}{},
+		},
+	},
+	"Record": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"domain"},
+		"properties": map[string]interface{}{
+			"domain":     map[string]interface{}{"type": "string"},
+			"ip":         map[string]interface{}{"type": "string"},
+			"ips":        arrayOf(map[string]interface{}{"type": "string"}),
+			"weights":    map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "integer"}},
+			"cname":      map[string]interface{}{"type": "string"},
+			"pending":    map[string]interface{}{"type": "boolean"},
+			"labels":     map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "string"}},
+			"ttlSeconds": map[string]interface{}{"type": "integer", "format": "int64"},
+			"expiresAt":  map[string]interface{}{"type": "string", "format": "date-time", "readOnly": true},
+		},
+	},
+	"DeleteRecord": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"domain"},
+		"properties": map[string]interface{}{
+			"domain": map[string]interface{}{"type": "string"},
+			"ip":     map[string]interface{}{"type": "string"},
+		},
+	},
+	"DiffRequest": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"target"},
+		"properties": map[string]interface{}{
+			"base":   arrayOf(schemaRef("Record")),
+			"target": arrayOf(schemaRef("Record")),
+		},
+	},
+}
+
+// handlerName returns the name of the method or the function of the handler reported by gin,
+// e.g. PostRecords of github.com/.../server.(*recordController).PostRecords-fm.
+func handlerName(handler string) string {
+	handler = strings.TrimSuffix(handler, "-fm")
+	return handler[strings.LastIndex(handler, ".")+1:]
+}
+
+// openAPIPath converts the gin path into the OpenAPI one and returns its path parameters,
+// e.g. /record/:domain into /record/{domain}.
+func openAPIPath(path string) (string, []string) {
+	segments := strings.Split(path, "/")
+	params := make([]string, 0)
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			params = append(params, segment[1:])
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+func openAPIContent(contentType string, schema interface{}) map[string]interface{} {
+	return map[string]interface{}{contentType: map[string]interface{}{"schema": schema}}
+}
+
+// buildOpenAPISpec builds the OpenAPI 3 spec of the routes under /api/v1 from the routes registered
+// in gin, so that the spec never lists a route which isn't served or misses one. Secured means
+// the api requires the bearer token.
+func buildOpenAPISpec(routes gin.RoutesInfo, secured bool) map[string]interface{} {
+	paths := make(map[string]interface{})
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Path, "/api/v1/") {
+			continue
+		}
+		path, pathParams := openAPIPath(route.Path)
+		name := handlerName(route.Handler)
+		doc := openAPIOperations[name]
+		// The namespace scoped routes share the handler with the global ones
+		operationID := name
+		if ExistString("ns", pathParams) {
+			operationID += "InNamespace"
+		}
+		parameters := make([]interface{}, 0, len(pathParams)+len(doc.query))
+		for _, param := range pathParams {
+			parameters = append(parameters, map[string]interface{}{"name": param, "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"}})
+		}
+		for _, param := range doc.query {
+			parameters = append(parameters, map[string]interface{}{"name": param, "in": "query", "schema": map[string]interface{}{"type": "string"}})
+		}
+		success := map[string]interface{}{"description": "Success"}
+		if doc.produces != "" {
+			success["content"] = openAPIContent(doc.produces, map[string]interface{}{"type": "string"})
+		} else {
+			success["content"] = openAPIContent("application/json", schemaRef("Response"))
+		}
+		operation := map[string]interface{}{
+			"operationId": operationID,
+			"tags":        []string{"records"},
+			"parameters":  parameters,
+			"responses": map[string]interface{}{
+				"200":     success,
+				"default": map[string]interface{}{"description": "Failure, see the code", "content": openAPIContent("application/json", schemaRef("Response"))},
+			},
+		}
+		if doc.summary != "" {
+			operation["summary"] = doc.summary
+		}
+		switch body := doc.body.(type) {
+		case nil:
+		case string:
+			operation["requestBody"] = map[string]interface{}{"required": true, "content": openAPIContent(body, map[string]interface{}{"type": "string"})}
+		default:
+			operation["requestBody"] = map[string]interface{}{"required": true, "content": openAPIContent("application/json", body)}
+		}
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = operation
+	}
+	spec := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "coredns-hosts-api",
+			"version": version.Get().Version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": openAPISchemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerToken": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+	if secured {
+		spec["security"] = []interface{}{map[string]interface{}{"bearerToken": []string{}}}
+	}
+	return spec
+}
+
+// registerOpenAPI serves the spec of the routes registered so far at /openapi.json, so it must be
+// called after all the api routes are registered.
+func registerOpenAPI(route *gin.Engine, secured bool) {
+	spec := buildOpenAPISpec(route.Routes(), secured)
+	route.GET("/openapi.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, spec)
+	})
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestOpenAPISpecListsEveryRoute(t *testing.T) {
+	s := newSyncedTestServer(t, Args{})
+	w := serve(s.webServer.Handler, http.MethodGet, "/openapi.json", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /openapi.json = %d, want %d", w.Code, http.StatusOK)
+	}
+	var spec struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]map[string]struct {
+			OperationID string `json:"operationId"`
+			Summary     string `json:"summary"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("failed to parse the spec: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("the openapi version = %q, want 3.x", spec.OpenAPI)
+	}
+	routes := 0
+	for _, route := range s.webServer.Handler.(*gin.Engine).Routes() {
+		if !strings.HasPrefix(route.Path, "/api/v1/") {
+			continue
+		}
+		routes++
+		path, _ := openAPIPath(route.Path)
+		operation, ok := spec.Paths[path][strings.ToLower(route.Method)]
+		if !ok {
+			t.Errorf("the route %s %s is missing from the spec", route.Method, route.Path)
+			continue
+		}
+		if operation.OperationID == "" || operation.Summary == "" {
+			t.Errorf("the route %s %s = %+v, want an operationId and a summary", route.Method, route.Path, operation)
+		}
+	}
+	operations := 0
+	for _, item := range spec.Paths {
+		operations += len(item)
+	}
+	if operations != routes {
+		t.Errorf("the spec has %d operations, want the %d routes", operations, routes)
+	}
+	if w := serve(s.webServer.Handler, http.MethodGet, "/docs", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /docs = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
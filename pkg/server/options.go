@@ -1,7 +1,94 @@
 package server
 
+import (
+	"time"
+
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+)
+
 type Args struct {
 	Port int32
+	// MetricsAddr is the address (e.g. :9154) the metrics are served on by a listener of their own,
+	// empty means they are served on Port with the api.
+	MetricsAddr string
+	// MetricsPath is the path of the metrics, DefaultMetricsPath if empty.
+	MetricsPath string
 	// Kubeconfig  is absolute path to the kubeconfig file
 	Kubeconfig string
+	// ControllerArgs is the args of the configmap controller writing the hosts file
+	ControllerArgs controller.Args
+	// NoCreateConfigmap makes the server wait for the configmap to exist rather than creating it,
+	// which respects the ownership of GitOps.
+	NoCreateConfigmap bool
+	// ConfigmapShardBytes is the size of the data of a configmap beyond which the records spill into
+	// the next shard coredns-hosts-api-<n>, 0 means controller.DefaultShardBytes.
+	ConfigmapShardBytes int
+	// DefaultIP is assigned to the record posted without an ip, empty means the ip is required
+	// unless the request allows a pending record with ?allowEmptyIP=true.
+	DefaultIP string
+	// VerifyResolver is the DNS server address (e.g. 127.0.0.1:53 of the CoreDNS in the same pod) queried
+	// after a write until the record resolves, empty means disabled.
+	VerifyResolver string
+	// VerifyTimeout bounds the verification of VerifyResolver
+	VerifyTimeout time.Duration
+	// AllowedDomains and DeniedDomains are the patterns of the domains the api may manage, a pattern
+	// starting with `.` matches the subdomains. The denied ones win, and empty AllowedDomains allows all.
+	AllowedDomains []string
+	DeniedDomains  []string
+	// ChangeWebhookURL is posted a WebhookEvent for every change of a record, empty means disabled.
+	// The delivery is retried ChangeWebhookRetries times and each post is bounded by ChangeWebhookTimeout.
+	ChangeWebhookURL     string
+	ChangeWebhookTimeout time.Duration
+	ChangeWebhookRetries int
+	// HistorySize is the max number of changes kept in memory per domain, 0 means disabled.
+	HistorySize int
+	// HistoryMaxDomains is the max number of domains whose changes are kept in memory, the domain changed
+	// least recently is forgotten beyond it, 0 means unlimited.
+	HistoryMaxDomains int
+	// AuditLogPath is the file every change of the records is appended to as a JSON line,
+	// empty means the changes are audited in the klog output only.
+	AuditLogPath string
+	// StatusUpdatePeriod is the interval of updating the status configmap, 0 means disabled.
+	StatusUpdatePeriod time.Duration
+	// ExpiryGCPeriod is the interval of deleting the records expired by their ttlSeconds, 0 means the
+	// expired records are only left out but never deleted.
+	ExpiryGCPeriod time.Duration
+	// EnableLeaderElection makes only the replica holding the Lease coredns-hosts-api-leader run the
+	// write-side reconciliation, i.e. the status configmap, the expiry gc and the hosts checksum, while
+	// every replica keeps serving the api and writing its hosts file.
+	EnableLeaderElection bool
+	// RestartCoreDNSOnChange annotates the pod template of the Deployment CoreDNSDeployment with the
+	// checksum of the hosts content, which makes a rolling restart of CoreDNS once the content changes.
+	RestartCoreDNSOnChange bool
+	CoreDNSDeployment      string
+	CoreDNSNamespace       string
+	// AuthToken is the bearer token required by the api, empty means the api is open.
+	AuthToken string
+	// AuthTokenFile is the file holding AuthToken, e.g. a key of a Secret mounted into the pod.
+	AuthTokenFile string
+	// WriteRateLimit is the writes per second allowed to a client, identified by its token or else by
+	// its ip, with the bursts of WriteRateBurst, 0 means unlimited. ReadRateLimit and ReadRateBurst
+	// are the same for the reads.
+	WriteRateLimit float64
+	WriteRateBurst int
+	ReadRateLimit  float64
+	ReadRateBurst  int
+	// AuthzURL is the external authorization service every api request is checked against,
+	// empty means disabled.
+	AuthzURL string
+	// AuthzTimeout bounds a call of the authorization service, which denies the request on timeout.
+	AuthzTimeout time.Duration
+	// AuthzCacheTTL is how long a decision of the authorization service is cached, 0 means disabled.
+	AuthzCacheTTL time.Duration
+	// CORSAllowedOrigins are the origins of the browser pages allowed to call the api, `*` allows
+	// every origin and empty means CORS is disabled. CORSAllowedMethods and CORSAllowedHeaders are
+	// what their preflight requests may ask for.
+	CORSAllowedOrigins []string
+	CORSAllowedMethods []string
+	CORSAllowedHeaders []string
+	// TLSCertFile and TLSKeyFile make the web service serve HTTPS, plaintext is served if both are empty.
+	TLSCertFile string
+	TLSKeyFile  string
+	// ShutdownTimeout bounds the drain of the in-flight requests on termination.
+	ShutdownTimeout time.Duration
 }
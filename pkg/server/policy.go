@@ -0,0 +1,86 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog/v2"
+)
+
+// ErrDomainDenied is returned when the domain is out of the domains the api may manage
+var ErrDomainDenied = errors.New("domain denied")
+
+// domainPolicy is the allowlist and the denylist of the domains the api may manage. A pattern
+// starting with `.` matches the subdomains of the rest of it, e.g. `.svc.cluster.local` matches
+// `db.ns.svc.cluster.local` but neither `svc.cluster.local` nor `xsvc.cluster.local`, and any other
+// pattern matches the domain exactly. The denylist wins over the allowlist, and an empty allowlist
+// allows every domain not denied.
+type domainPolicy struct {
+	allowed []string
+	denied  []string
+}
+
+func newDomainPolicy(allowed, denied []string) *domainPolicy {
+	return &domainPolicy{
+		allowed: normalizeDomainPatterns(allowed),
+		denied:  normalizeDomainPatterns(denied),
+	}
+}
+
+func normalizeDomainPatterns(patterns []string) []string {
+	ret := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		ret = append(ret, NormalizeDomain(pattern))
+	}
+	return ret
+}
+
+// validateDomainPatterns checks every pattern is a hostname, optionally led by a `.`
+func validateDomainPatterns(patterns []string) error {
+	for _, pattern := range normalizeDomainPatterns(patterns) {
+		if err := validateDomain(strings.TrimPrefix(pattern, ".")); err != nil {
+			return fmt.Errorf("invalid domain pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+func matchDomainPattern(domain, pattern string) bool {
+	if strings.HasPrefix(pattern, ".") {
+		return strings.HasSuffix(domain, pattern)
+	}
+	return domain == pattern
+}
+
+// check returns ErrDomainDenied unless the domain may be managed. A wildcard is checked as
+// the subdomain it stands for, so `*.dev.example.com` is allowed by `.example.com`.
+func (p *domainPolicy) check(domain string) error {
+	for _, pattern := range p.denied {
+		if matchDomainPattern(domain, pattern) {
+			return fmt.Errorf("the domain %s matches the denied pattern %s: %w", domain, pattern, ErrDomainDenied)
+		}
+	}
+	if len(p.allowed) == 0 {
+		return nil
+	}
+	for _, pattern := range p.allowed {
+		if matchDomainPattern(domain, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the domain %s matches none of the allowed patterns: %w", domain, ErrDomainDenied)
+}
+
+// domainPermitted answers 403 and returns false if the domain is out of the domains the api may manage
+func (r *recordController) domainPermitted(c *gin.Context, domain string) bool {
+	err := r.domains.check(domain)
+	if err == nil {
+		return true
+	}
+	klog.ErrorS(err, "Response with a error", "httpCode", http.StatusForbidden, "requestUri", c.Request.RequestURI)
+	c.JSON(http.StatusForbidden, ErrorResponse(CodeForbidden, err))
+	return false
+}
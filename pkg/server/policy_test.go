@@ -0,0 +1,75 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestDomainPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		denied  []string
+		domain  string
+		want    bool
+	}{
+		{name: "no patterns", domain: "a.com", want: true},
+		{name: "allowed exactly", allowed: []string{"a.com"}, domain: "a.com", want: true},
+		{name: "not allowed", allowed: []string{"a.com"}, domain: "b.com", want: false},
+		{name: "exact pattern leaves the subdomains out", allowed: []string{"a.com"}, domain: "x.a.com", want: false},
+		{name: "allowed subdomain", allowed: []string{".svc.cluster.local"}, domain: "db.ns.svc.cluster.local", want: true},
+		{name: "suffix pattern leaves the domain itself out", allowed: []string{".svc.cluster.local"}, domain: "svc.cluster.local", want: false},
+		{name: "suffix pattern on a label boundary", allowed: []string{".svc.cluster.local"}, domain: "xsvc.cluster.local", want: false},
+		{name: "allowed wildcard", allowed: []string{".example.com"}, domain: "*.dev.example.com", want: true},
+		{name: "denied exactly", denied: []string{"kubernetes.default"}, domain: "kubernetes.default", want: false},
+		{name: "denied subdomain", denied: []string{".cluster.local"}, domain: "kubernetes.default.svc.cluster.local", want: false},
+		{name: "not denied", denied: []string{".cluster.local"}, domain: "cluster.local.com", want: true},
+		{name: "denied wins", allowed: []string{".example.com"}, denied: []string{"api.example.com"}, domain: "api.example.com", want: false},
+		{name: "normalized patterns", allowed: []string{".Example.COM."}, domain: "a.example.com", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newDomainPolicy(tt.allowed, tt.denied).check(tt.domain)
+			if got := err == nil; got != tt.want {
+				t.Errorf("check(%s) = %v, want allowed %v", tt.domain, err, tt.want)
+			}
+			if err != nil && !errors.Is(err, ErrDomainDenied) {
+				t.Errorf("check(%s) = %v, want ErrDomainDenied", tt.domain, err)
+			}
+		})
+	}
+}
+
+func TestValidateDomainPatterns(t *testing.T) {
+	if err := validateDomainPatterns([]string{"a.com", ".svc.cluster.local"}); err != nil {
+		t.Errorf("validateDomainPatterns = %v, want nil", err)
+	}
+	if err := validateDomainPatterns([]string{"a..com"}); err == nil {
+		t.Error("validateDomainPatterns(a..com) = nil, want an error")
+	}
+}
+
+func TestDomainPolicyForbidden(t *testing.T) {
+	s := newSyncedTestServer(t, Args{AllowedDomains: []string{".example.com"}, DeniedDomains: []string{"api.example.com"}})
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		want   int
+	}{
+		{name: "post allowed", method: http.MethodPost, body: `{"domain": "a.example.com", "ip": "10.0.0.1"}`, want: http.StatusOK},
+		{name: "post denied", method: http.MethodPost, body: `{"domain": "api.example.com", "ip": "10.0.0.1"}`, want: http.StatusForbidden},
+		{name: "post not allowed", method: http.MethodPost, body: `{"domain": "example.com", "ip": "10.0.0.1"}`, want: http.StatusForbidden},
+		{name: "delete denied", method: http.MethodDelete, body: `{"domain": "api.example.com"}`, want: http.StatusForbidden},
+		{name: "delete allowed", method: http.MethodDelete, body: `{"domain": "a.example.com"}`, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(s.webServer.Handler, tt.method, "/api/v1/records", tt.body)
+			if resp := decodeResponse(t, w, nil); w.Code != tt.want || (tt.want == http.StatusForbidden && resp.Code != CodeForbidden) {
+				t.Errorf("%s %s = %d %+v, want %d", tt.method, tt.body, w.Code, resp, tt.want)
+			}
+		})
+	}
+}
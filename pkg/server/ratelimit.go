@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+	"k8s.io/klog/v2"
+)
+
+// rateLimiterSweepPeriod is the interval of forgetting the idle clients
+const rateLimiterSweepPeriod = time.Minute
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter is a token bucket per client, which is identified by callerIdentity, i.e. by its
+// token or else by its ip.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+	// idle is how long a bucket takes to refill, after which the client is forgotten since a
+	// new bucket is the same as its own
+	idle time.Duration
+
+	lock      sync.Mutex
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+func newRateLimiter(qps float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = int(math.Ceil(qps))
+	}
+	return &rateLimiter{
+		limit:   rate.Limit(qps),
+		burst:   burst,
+		idle:    time.Duration(float64(burst) / qps * float64(time.Second)),
+		clients: make(map[string]*clientLimiter),
+	}
+}
+
+// reserve takes a token of the client and returns how long it has to wait if there is none left
+func (l *rateLimiter) reserve(client string, now time.Time) (time.Duration, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now.Sub(l.lastSweep) >= rateLimiterSweepPeriod {
+		for key, c := range l.clients {
+			if now.Sub(c.lastSeen) >= l.idle {
+				delete(l.clients, key)
+			}
+		}
+		l.lastSweep = now
+	}
+	c, ok := l.clients[client]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[client] = c
+	}
+	c.lastSeen = now
+	reservation := c.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay == 0 {
+		return 0, true
+	}
+	// The request is rejected rather than delayed, so the token is given back
+	reservation.CancelAt(now)
+	return delay, false
+}
+
+// rateLimitMiddleware answers 429 with Retry-After once a client exceeds its limit, the writes
+// (POST, PUT and DELETE) and the reads have separate limits, and a nil limiter means unlimited.
+// The POSTs only reading the records are counted as the reads.
+func rateLimitMiddleware(writes, reads *rateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limiter := reads
+		switch c.Request.Method {
+		case http.MethodPost:
+			if !ExistString(c.FullPath(), readOnlyPosts) {
+				limiter = writes
+			}
+		case http.MethodPut, http.MethodDelete:
+			limiter = writes
+		}
+		if limiter == nil {
+			c.Next()
+			return
+		}
+		if delay, ok := limiter.reserve(callerIdentity(c), time.Now()); !ok {
+			err := fmt.Errorf("too many requests, retry after %s", delay.Round(time.Millisecond))
+			klog.ErrorS(err, "Response with a error", "httpCode", http.StatusTooManyRequests, "requestUri", c.Request.RequestURI)
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, ErrorResponse(CodeTooManyRequests, err))
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefills(t *testing.T) {
+	l := newRateLimiter(1, 2)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, ok := l.reserve("a", now); !ok {
+			t.Fatalf("the request %d within the burst is limited", i)
+		}
+	}
+	if delay, ok := l.reserve("a", now); ok || delay != time.Second {
+		t.Errorf("the request beyond the burst = %v, %v, want limited for 1s", delay, ok)
+	}
+	// The rejected request takes no token
+	if _, ok := l.reserve("a", now.Add(time.Second)); !ok {
+		t.Error("the request after the refill is limited")
+	}
+	if _, ok := l.reserve("b", now); !ok {
+		t.Error("the request of another client is limited")
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	const burst = 3
+	s := newSyncedTestServer(t, Args{WriteRateLimit: 0.001, WriteRateBurst: burst})
+	limited := 0
+	for i := 0; i < 10; i++ {
+		w := serve(s.webServer.Handler, http.MethodPost, "/api/v1/records", fmt.Sprintf(`{"domain": "d%d.com", "ip": "10.0.0.1"}`, i),
+			"Authorization", "Bearer a")
+		switch w.Code {
+		case http.StatusOK:
+			if limited > 0 {
+				t.Errorf("the write %d succeeded after a 429", i)
+			}
+		case http.StatusTooManyRequests:
+			limited++
+			if resp := decodeResponse(t, w, nil); resp.Code != CodeTooManyRequests || w.Header().Get("Retry-After") == "" {
+				t.Errorf("the write %d = %+v with the Retry-After %q, want the code %d and a Retry-After", i, resp, w.Header().Get("Retry-After"), CodeTooManyRequests)
+			}
+		default:
+			t.Fatalf("the write %d = %d %s", i, w.Code, w.Body.String())
+		}
+	}
+	if want := 10 - burst; limited != want {
+		t.Errorf("got %d writes answered 429, want %d", limited, want)
+	}
+	// The reads and the other clients are not limited by the writes of the client
+	if w := serve(s.webServer.Handler, http.MethodGet, "/api/v1/records", "", "Authorization", "Bearer a"); w.Code != http.StatusOK {
+		t.Errorf("the read of the limited client = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := serve(s.webServer.Handler, http.MethodPost, "/api/v1/records", `{"domain": "b.com", "ip": "10.0.0.1"}`, "Authorization", "Bearer b"); w.Code != http.StatusOK {
+		t.Errorf("the write of another client = %d, want %d", w.Code, http.StatusOK)
+	}
+}
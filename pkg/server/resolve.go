@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// resolveInterval is the interval of querying the resolver until the record is served
+const resolveInterval = 500 * time.Millisecond
+
+// waitForResolution queries the domain against the DNS server at resolverAddr until it
+// resolves to the ip (any address if the ip is empty), or the timeout elapses.
+func waitForResolution(resolverAddr, domain, ip string, timeout time.Duration) error {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, resolverAddr)
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var lastErr error
+	err := wait.PollImmediateUntilWithContext(ctx, resolveInterval, func(ctx context.Context) (bool, error) {
+		addrs, err := resolver.LookupHost(ctx, domain)
+		if err != nil {
+			lastErr = err
+			return false, nil
+		}
+		if ip == "" && len(addrs) > 0 {
+			return true, nil
+		}
+		for _, addr := range addrs {
+			if net.ParseIP(addr).Equal(net.ParseIP(ip)) {
+				return true, nil
+			}
+		}
+		lastErr = fmt.Errorf("resolved to %v", addrs)
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("the domain %s is not served by %s within %s, last result: %v", domain, resolverAddr, timeout, lastErr)
+	}
+	return nil
+}
@@ -2,44 +2,97 @@ package server
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/devincd/coredns-hosts-api/pkg/metrics"
 	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+	"github.com/devincd/coredns-hosts-api/pkg/version"
 	"github.com/gin-gonic/gin"
-	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
-	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
 )
 
+// readyzTimeout bounds the configmap check of the readiness probe
+const readyzTimeout = 3 * time.Second
+
+// ErrRecordNotFound is returned when the domain has no record
+var ErrRecordNotFound = errors.New("record not found")
+
+// ErrRecordConflict is returned when the stored value of the domain is not the expected one
+var ErrRecordConflict = errors.New("record conflict")
+
 type Server struct {
-	clientset           *kubernetes.Clientset
-	webServer           *http.Server
+	clientset kubernetes.Interface
+	webServer *http.Server
+	// metricsServer serves the metrics on Args.MetricsAddr, nil if they are served by webServer
+	metricsServer       *http.Server
 	configmapController *controller.ConfigmapController
 	informerFactory     informers.SharedInformerFactory
+	store               controller.RecordStore
+	record              *recordController
+	args                Args
 }
 
 func NewServer(args Args) (*Server, error) {
-	s := &Server{}
+	s := &Server{
+		args: args,
+	}
+	if args.DefaultIP != "" {
+		if err := validateIP(args.DefaultIP); err != nil {
+			return nil, fmt.Errorf("invalid default ip: %v", err)
+		}
+	}
+	if err := validateTLSFiles(args.TLSCertFile, args.TLSKeyFile); err != nil {
+		return nil, err
+	}
+	if err := controller.ValidateLineEnding(args.ControllerArgs.LineEnding); err != nil {
+		return nil, err
+	}
+	if args.MetricsPath != "" && !strings.HasPrefix(args.MetricsPath, "/") {
+		return nil, fmt.Errorf("invalid metrics path %q: must start with /", args.MetricsPath)
+	}
+	if err := controller.ValidateIPOrder(args.ControllerArgs.IPOrder); err != nil {
+		return nil, err
+	}
+	if err := validateConfigmap(args.ControllerArgs.Name(), args.ControllerArgs.Namespace()); err != nil {
+		return nil, err
+	}
+	if err := validateDomainPatterns(args.AllowedDomains); err != nil {
+		return nil, err
+	}
+	if err := validateDomainPatterns(args.DeniedDomains); err != nil {
+		return nil, err
+	}
+	metrics.Register()
 	if err := s.initKubeClient(args); err != nil {
 		return nil, err
 	}
-	s.initController()
+	if err := s.initController(args); err != nil {
+		return nil, err
+	}
 	if err := s.initWebService(args); err != nil {
 		return nil, err
 	}
 	return s, nil
 }
 
+// Run runs the components of the server until stop is closed, and then shuts down the http server
+// gracefully within ShutdownTimeout.
 func (s *Server) Run(stop chan struct{}) error {
 	klog.Info("start the service")
 
@@ -53,41 +106,306 @@ func (s *Server) Run(stop chan struct{}) error {
 			klog.Fatalf("Error running configmap controller: %v", err)
 		}
 	}()
+	// Deliver the changes to the webhook, by every replica since each posts the changes it makes
+	if s.record.webhook != nil {
+		go s.record.webhook.run(stop)
+	}
+	// Run the write-side reconciliation, by the leader only if the leader election is enabled
+	if s.args.EnableLeaderElection {
+		go func() {
+			if err := s.runLeaderElection(stop); err != nil {
+				klog.Fatalf("Error running leader election: %v", err)
+			}
+		}()
+	} else {
+		go s.runSingletons(stop)
+	}
 	// Run the http server component
+	serveErr := make(chan error, 1)
 	go func() {
-		err := s.webServer.ListenAndServe()
-		if err != nil {
-			klog.Fatalf("Error running http server: %v", err)
+		var err error
+		if s.args.TLSCertFile != "" && s.args.TLSKeyFile != "" {
+			err = s.webServer.ListenAndServeTLS(s.args.TLSCertFile, s.args.TLSKeyFile)
+		} else {
+			err = s.webServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			serveErr <- err
 		}
 	}()
+	metricsErr := make(chan error, 1)
+	if s.metricsServer != nil {
+		go func() {
+			if err := s.metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				metricsErr <- err
+			}
+		}()
+	}
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("error running http server: %v", err)
+	case err := <-metricsErr:
+		return fmt.Errorf("error running metrics server: %v", err)
+	case <-stop:
+	}
+
+	// Drain the in-flight requests before exiting, the watches are closed by the shutdown hook
+	klog.InfoS("Shutting down the http server", "timeout", s.args.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), s.args.ShutdownTimeout)
+	defer cancel()
+	if err := s.webServer.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to shut down the http server: %v", err)
+	}
+	// The metrics stay scrapable during the drain
+	if s.metricsServer != nil {
+		if err := s.metricsServer.Shutdown(ctx); err != nil {
+			return fmt.Errorf("failed to shut down the metrics server: %v", err)
+		}
+	}
 	return nil
 }
 
 func (s *Server) initWebService(args Args) error {
 	route := gin.Default()
-	route.Use()
+	// Answer the unsupported methods of a known path with 405 rather than 404
+	route.HandleMethodNotAllowed = true
+	route.NoMethod(func(c *gin.Context) {
+		c.Header("Allow", strings.Join(allowedMethods(route.Routes(), c.Request.URL.Path), ", "))
+		c.JSON(http.StatusMethodNotAllowed, ErrorResponse(CodeMethodNotAllowed, fmt.Errorf("method %s is not allowed on %s", c.Request.Method, c.Request.URL.Path)))
+	})
+	route.NoRoute(func(c *gin.Context) {
+		c.JSON(http.StatusNotFound, ErrorResponse(CodeNotFound, fmt.Errorf("the path %s is not found", c.Request.URL.Path)))
+	})
+
+	// The preflight requests are answered before the routing, which would answer OPTIONS with 405
+	if len(args.CORSAllowedOrigins) > 0 {
+		route.Use(corsMiddleware(args.CORSAllowedOrigins, args.CORSAllowedMethods, args.CORSAllowedHeaders))
+	}
+	route.Use(metricsMiddleware)
+	// The probes and the metrics are outside of /api/v1 so that no authorization applies
+	route.GET("/healthz", s.Healthz)
+	route.GET("/readyz", s.Readyz)
+	if args.MetricsAddr == "" {
+		route.GET(metricsPath(args), gin.WrapH(promhttp.Handler()))
+	} else {
+		s.metricsServer = newMetricsServer(args)
+	}
 
-	record, err := newRecordController(s.clientset)
+	audit, err := newAuditLogger(args.AuditLogPath)
 	if err != nil {
 		return err
 	}
+	record := newRecordController(s.store, s.configmapController, audit, args)
+	s.record = record
 	apiv1 := route.Group("/api/v1")
+	token, err := loadAuthToken(args.AuthToken, args.AuthTokenFile)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		apiv1.Use(bearerTokenMiddleware(token))
+	}
+	// The limits apply before the authorization so that a flood never reaches the authorization service
+	if args.WriteRateLimit > 0 || args.ReadRateLimit > 0 {
+		var writes, reads *rateLimiter
+		if args.WriteRateLimit > 0 {
+			writes = newRateLimiter(args.WriteRateLimit, args.WriteRateBurst)
+		}
+		if args.ReadRateLimit > 0 {
+			reads = newRateLimiter(args.ReadRateLimit, args.ReadRateBurst)
+		}
+		apiv1.Use(rateLimitMiddleware(writes, reads))
+	}
+	if args.AuthzURL != "" {
+		apiv1.Use(newAuthorizer(args.AuthzURL, args.AuthzTimeout, args.AuthzCacheTTL).Middleware)
+	}
+	apiv1.Use(s.writeGate)
 	{
 		apiv1.POST("/records", record.PostRecords)
 		apiv1.DELETE("/records", record.DeleteRecords)
 		apiv1.GET("/records", record.ListRecords)
 		apiv1.GET("record/:domain", record.GetRecord)
+		apiv1.GET("record/:domain/history", record.GetRecordHistory)
+		apiv1.DELETE("record/:domain", record.DeleteRecord)
+		apiv1.PUT("/records/:domain", record.UpdateRecord)
+		apiv1.POST("record/:domain/ips", record.AddRecordIP)
+		apiv1.DELETE("record/:domain/ips/:ip", record.RemoveRecordIP)
+		apiv1.POST("/records/validate", record.ValidateRecords)
+		apiv1.POST("/records/diff", record.DiffRecords)
+		apiv1.POST("/records/batch", record.PostRecordsBatch)
+		apiv1.DELETE("/records/batch", record.DeleteRecordsBatch)
+		apiv1.POST("/records/import", record.ImportRecords)
+		apiv1.GET("/records/export", s.ExportRecords)
+		apiv1.GET("/records/watch", record.WatchRecords)
+		apiv1.GET("/records/count", record.CountRecords)
+		apiv1.GET("/records/by-ip/:ip", record.GetRecordsByIP)
+		apiv1.GET("/conflicts", s.ListConflicts)
+		apiv1.POST("/maintenance/compact", record.Compact)
+
+		// The records scoped in a namespace are merged into the same hosts file
+		apiv1.POST("/namespaces/:ns/records", record.PostRecords)
+		apiv1.POST("/namespaces/:ns/records/batch", record.PostRecordsBatch)
+		apiv1.DELETE("/namespaces/:ns/records/batch", record.DeleteRecordsBatch)
+		apiv1.POST("/namespaces/:ns/records/import", record.ImportRecords)
+		apiv1.DELETE("/namespaces/:ns/records", record.DeleteRecords)
+		apiv1.GET("/namespaces/:ns/records", record.ListRecords)
+		apiv1.GET("/namespaces/:ns/records/watch", record.WatchRecords)
+		apiv1.GET("/namespaces/:ns/records/count", record.CountRecords)
+		apiv1.GET("/namespaces/:ns/records/by-ip/:ip", record.GetRecordsByIP)
+		apiv1.GET("/namespaces/:ns/record/:domain", record.GetRecord)
+		apiv1.GET("/namespaces/:ns/record/:domain/history", record.GetRecordHistory)
+		apiv1.DELETE("/namespaces/:ns/record/:domain", record.DeleteRecord)
+		apiv1.PUT("/namespaces/:ns/records/:domain", record.UpdateRecord)
+		apiv1.POST("/namespaces/:ns/record/:domain/ips", record.AddRecordIP)
+		apiv1.DELETE("/namespaces/:ns/record/:domain/ips/:ip", record.RemoveRecordIP)
+		apiv1.POST("/namespaces/:ns/maintenance/compact", record.Compact)
 	}
+	// The spec is built from the routes above, and is public like the probes
+	registerOpenAPI(route, token != "")
 
 	webServer := &http.Server{
 		Addr:    fmt.Sprintf("0.0.0.0:%d", args.Port),
 		Handler: route,
 	}
+	webServer.RegisterOnShutdown(record.shutdown)
 	s.webServer = webServer
 
 	return nil
 }
 
+// DefaultMetricsPath is the path of the metrics, the same as the prometheus plugin of CoreDNS
+const DefaultMetricsPath = "/metrics"
+
+func metricsPath(args Args) string {
+	if args.MetricsPath == "" {
+		return DefaultMetricsPath
+	}
+	return args.MetricsPath
+}
+
+// newMetricsServer returns the http server serving only the metrics on MetricsAddr, which keeps the
+// scrapes apart from the api like the prometheus plugin of CoreDNS listening on :9153.
+func newMetricsServer(args Args) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath(args), promhttp.Handler())
+	return &http.Server{
+		Addr:    args.MetricsAddr,
+		Handler: mux,
+	}
+}
+
+// validateTLSFiles checks the certificate and the key are set together and both exist
+func validateTLSFiles(certFile, keyFile string) error {
+	if certFile == "" && keyFile == "" {
+		return nil
+	}
+	if certFile == "" || keyFile == "" {
+		return fmt.Errorf("--tls-cert-file and --tls-key-file must be set together")
+	}
+	for _, file := range []string{certFile, keyFile} {
+		if !FileExist(file) {
+			return fmt.Errorf("the tls file %s does not exist", file)
+		}
+	}
+	return nil
+}
+
+// metricsMiddleware observes the count and the latency of the requests by route, the unmatched
+// paths share one label so that the cardinality stays bounded.
+func metricsMiddleware(c *gin.Context) {
+	startTime := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	metrics.HTTPRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+	metrics.HTTPRequestDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(startTime).Seconds())
+}
+
+// Healthz answers the liveness probe, the server is alive as long as it serves.
+// The data is the build information of the server.
+func (s *Server) Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, SuccessResponse(version.Get(), "ok"))
+}
+
+// Readyz answers the readiness probe, the server is ready once the informer cache has synced
+// and the configmap holding the records is reachable.
+func (s *Server) Readyz(c *gin.Context) {
+	if !s.configmapController.HasSynced() {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse(CodeUnavailable, fmt.Errorf("the configmap informer has not synced")))
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readyzTimeout)
+	defer cancel()
+	namespace, name := s.args.ControllerArgs.Namespace(), s.args.ControllerArgs.Name()
+	_, err := s.clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse(CodeUnavailable, fmt.Errorf("the configmap %s/%s is not reachable: %v", namespace, name, err)))
+		return
+	}
+	c.JSON(http.StatusOK, SuccessResponse(nil, "ok"))
+}
+
+// readOnlyPosts are the POST routes which only read the records, e.g. the body is the records to check
+var readOnlyPosts = []string{"/api/v1/records/validate", "/api/v1/records/diff"}
+
+// writeGate answers the writes with 503 until the configmap controller has synced, so that no write
+// races the startup and the creation of the configmap. The reads are served from the apiserver until then.
+func (s *Server) writeGate(c *gin.Context) {
+	switch {
+	case c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead:
+	case c.Request.Method == http.MethodPost && ExistString(c.FullPath(), readOnlyPosts):
+	case !s.configmapController.HasSynced():
+		err := fmt.Errorf("the server is starting and the configmap informer has not synced, retry later")
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusServiceUnavailable, "requestUri", c.Request.RequestURI)
+		c.Header("Retry-After", "1")
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, ErrorResponse(CodeUnavailable, err))
+		return
+	}
+	c.Next()
+}
+
+// ListConflicts returns the domains mapped to different values in several record namespaces
+func (s *Server) ListConflicts(c *gin.Context) {
+	conflicts := s.configmapController.Status().Conflicts
+	if conflicts == nil {
+		conflicts = make([]controller.Conflict, 0)
+	}
+	c.JSON(http.StatusOK, SuccessResponse(conflicts, fmt.Sprintf("ListConflicts is successful. Conflict is %d", len(conflicts))))
+}
+
+// allowedMethods returns the sorted methods registered for the routes matching the path.
+func allowedMethods(routes gin.RoutesInfo, path string) []string {
+	var methods []string
+	for _, r := range routes {
+		if matchRoutePath(r.Path, path) && !ExistString(r.Method, methods) {
+			methods = append(methods, r.Method)
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// matchRoutePath reports whether the path matches the gin route pattern,
+// where ":name" matches one segment and "*name" matches the rest.
+func matchRoutePath(pattern, path string) bool {
+	patternSegs := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathSegs := strings.Split(strings.Trim(path, "/"), "/")
+	for i, seg := range patternSegs {
+		if strings.HasPrefix(seg, "*") {
+			return true
+		}
+		if i >= len(pathSegs) {
+			return false
+		}
+		if !strings.HasPrefix(seg, ":") && seg != pathSegs[i] {
+			return false
+		}
+	}
+	return len(patternSegs) == len(pathSegs)
+}
+
 // initKubeClient creates the k8s client if running in a k8s environment.
 func (s *Server) initKubeClient(args Args) error {
 	kconfig := args.Kubeconfig
@@ -99,6 +417,9 @@ func (s *Server) initKubeClient(args Args) error {
 	}
 	kubeconfig, err := clientcmd.BuildConfigFromFlags("", kconfig)
 	if err != nil {
+		return fmt.Errorf("bad kubeconfig %q: %v", kconfig, err)
+	}
+	if err := CheckKubeConnectivity(kubeconfig); err != nil {
 		return err
 	}
 	clientset, err := kubernetes.NewForConfig(kubeconfig)
@@ -111,232 +432,795 @@ func (s *Server) initKubeClient(args Args) error {
 	return nil
 }
 
-func (s *Server) initController() {
+func (s *Server) initController(args Args) error {
 	informerFactory := informers.NewSharedInformerFactory(s.clientset, 0)
 	s.informerFactory = informerFactory
 
-	s.configmapController = controller.NewConfigmapController(s.clientset, s.informerFactory.Core().V1().ConfigMaps())
+	configmapInformer := s.informerFactory.Core().V1().ConfigMaps()
+	store := controller.NewConfigmapStore(s.clientset, configmapInformer, args.ControllerArgs, !args.NoCreateConfigmap, args.ConfigmapShardBytes)
+	if err := store.Init(); err != nil {
+		return err
+	}
+	s.store = store
+	s.configmapController = controller.NewConfigmapController(configmapInformer, s.store, args.ControllerArgs)
+	return nil
 }
 
 type recordController struct {
 	// 自定义记录的数据存放地
 	// key = 域名
 	// value = IP
-	lock      *sync.RWMutex
-	clientset *kubernetes.Clientset
+	lock    *sync.RWMutex
+	store   controller.RecordStore
+	watcher recordWatcher
+	args    Args
+	history *recordHistory
+	audit   *auditLogger
+	domains *domainPolicy
+	// webhook is nil unless Args.ChangeWebhookURL is set
+	webhook *webhookNotifier
+	// done is closed once the server shuts down
+	done chan struct{}
 }
 
-func newRecordController(clientset *kubernetes.Clientset) (*recordController, error) {
-	rc := &recordController{
-		lock:      &sync.RWMutex{},
-		clientset: clientset,
+func newRecordController(store controller.RecordStore, watcher recordWatcher, audit *auditLogger, args Args) *recordController {
+	r := &recordController{
+		lock:    &sync.RWMutex{},
+		store:   store,
+		watcher: watcher,
+		args:    args,
+		history: newRecordHistory(args.HistorySize, args.HistoryMaxDomains),
+		audit:   audit,
+		domains: newDomainPolicy(args.AllowedDomains, args.DeniedDomains),
+		done:    make(chan struct{}),
 	}
-	err := rc.initConfigmap()
-	if err != nil {
-		return rc, err
+	if args.ChangeWebhookURL != "" {
+		r.webhook = newWebhookNotifier(args.ChangeWebhookURL, args.ChangeWebhookTimeout, args.ChangeWebhookRetries)
 	}
-	return rc, nil
+	return r
 }
 
-func (r *recordController) initConfigmap() error {
-	_, err := r.clientset.CoreV1().ConfigMaps(controller.ConfigmapNamespace).Get(context.TODO(), controller.ConfigmapName, metav1.GetOptions{})
-	if err != nil {
-		if errors.IsNotFound(err) {
-			newCm := &corev1.ConfigMap{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      controller.ConfigmapName,
-					Namespace: controller.ConfigmapNamespace,
-				},
-				Data: make(map[string]string),
-			}
-			_, err := r.clientset.CoreV1().ConfigMaps(controller.ConfigmapNamespace).Create(context.TODO(), newCm, metav1.CreateOptions{})
-			return err
-		}
-		return err
-	}
-	return nil
+// SetData stores the value of the domain, which is validated again here so that no write
+// path can put a line into the hosts file that breaks the parsing of CoreDNS.
+func (r *recordController) SetData(namespace string, req writeRequest, domain, value string) error {
+	return r.setData(namespace, req, domain, value, false)
+}
+
+// UpdateData is SetData with the update-only semantics, which fails with ErrRecordNotFound
+// rather than creating the domain.
+func (r *recordController) UpdateData(namespace string, req writeRequest, domain, value string) error {
+	return r.setData(namespace, req, domain, value, true)
 }
 
-func (r *recordController) SetData(domain, ip string) error {
+func (r *recordController) setData(namespace string, req writeRequest, domain, value string, mustExist bool) error {
+	if err := ValidateRecord(*recordFromValue(domain, value)); err != nil {
+		return err
+	}
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		// Retrieve the latest version of Deployment before attempting update
-		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
-		cm, getErr := r.clientset.CoreV1().ConfigMaps(controller.ConfigmapNamespace).Get(context.TODO(), controller.ConfigmapName, metav1.GetOptions{})
-		if getErr != nil {
-			return fmt.Errorf("failed to get latest version of Configmap: %v", getErr)
+	var oldValue string
+	var changed bool
+	err := r.update(namespace, req.Version, func(data map[string]string) error {
+		changed = false
+		// If the record is existed and ignore
+		val, ok := data[domain]
+		if ok && val == value {
+			return nil
 		}
-		if cm.Data == nil {
-			cm.Data = make(map[string]string)
+		if !ok && mustExist {
+			return fmt.Errorf("can't find the ip according to the domain %s: %w", domain, ErrRecordNotFound)
 		}
-		// If the record is existed and ignore
-		if val, ok := cm.Data[domain]; ok {
-			if val == ip {
-				return nil
+		oldValue = val
+		data[domain] = value
+		// The CNAME chain must end with an ip
+		if bare := controller.DecodeValue(value).Value; strings.HasPrefix(bare, controller.CNAMEPrefix) {
+			if _, err := controller.ResolveCNAME(data, domain); err != nil {
+				return &ValidationError{Field: "cname", Value: strings.TrimPrefix(bare, controller.CNAMEPrefix), Reason: err.Error()}
 			}
 		}
-		cm.Data[domain] = ip
-		newCm, updateErr := r.clientset.CoreV1().ConfigMaps(controller.ConfigmapNamespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
-		if updateErr != nil {
-			return updateErr
-		}
-		// Check again
-		if newCm.Data == nil {
-			return fmt.Errorf("failed to setData and updateCm's Data is nil, domainInfo is %s(%s)", domain, ip)
+		changed = true
+		return nil
+	})
+	if err == nil && changed {
+		r.recordChange(namespace, req, domain, HistoryActionSet, oldValue, value)
+	}
+	return err
+}
+
+// DeleteData deletes the domain, only if it is stored with the ip when the ip is not empty,
+// otherwise ErrRecordConflict is returned so a domain re-pointed by another client is kept.
+func (r *recordController) DeleteData(namespace string, req writeRequest, domain, ip string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var oldValue string
+	var changed bool
+	err := r.update(namespace, req.Version, func(data map[string]string) error {
+		changed = false
+		// If the record is not existed and ignore
+		val, ok := data[domain]
+		if !ok {
+			return nil
 		}
-		if newCm.Data[domain] != ip {
-			return fmt.Errorf("failed to setData and updateCm's value is not right, domainInfo is %s(%s)", domain, ip)
+		if bare := controller.DecodeValue(val).Value; ip != "" && bare != ip {
+			return fmt.Errorf("the domain %s is stored with %s rather than %s: %w", domain, bare, ip, ErrRecordConflict)
 		}
+		oldValue = val
+		delete(data, domain)
+		changed = true
 		return nil
 	})
-	return retryErr
+	if err == nil && changed {
+		r.recordChange(namespace, req, domain, HistoryActionDelete, oldValue, "")
+	}
+	return err
 }
 
-func (r *recordController) DeleteData(domain string) error {
+// ForceDeleteData deletes the key of the domain unconditionally without looking into the value,
+// which is the escape hatch for the corrupted entries left by manual edits.
+func (r *recordController) ForceDeleteData(namespace string, req writeRequest, domain string) error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		// Retrieve the latest version of Deployment before attempting update
-		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
-		cm, getErr := r.clientset.CoreV1().ConfigMaps(controller.ConfigmapNamespace).Get(context.TODO(), controller.ConfigmapName, metav1.GetOptions{})
-		if getErr != nil {
-			return fmt.Errorf("failed to get latest version of Configmap: %v", getErr)
-		}
-		if cm.Data == nil || len(cm.Data) == 0 {
-			return nil
+	var oldValue string
+	var ok bool
+	err := r.update(namespace, req.Version, func(data map[string]string) error {
+		oldValue, ok = data[domain]
+		delete(data, domain)
+		return nil
+	})
+	if err != nil || !ok {
+		return err
+	}
+	klog.InfoS("Force deleted the record", "namespace", namespace, "domain", domain, "rawValue", oldValue)
+	r.recordChange(namespace, req, domain, HistoryActionDelete, oldValue, "")
+	return nil
+}
+
+// AddIP adds the ip to the ips of the domain and keeps the others, the domain is created if absent
+func (r *recordController) AddIP(namespace string, req writeRequest, domain, ip string) error {
+	return r.updateIPs(namespace, req, domain, func(ips []string) []string {
+		if ExistString(ip, ips) {
+			return ips
 		}
-		// If the record is not existed and ignore
-		if _, ok := cm.Data[domain]; !ok {
-			return nil
+		return append(ips, ip)
+	})
+}
+
+// RemoveIP removes the ip from the ips of the domain and keeps the others,
+// the domain is deleted together with its last ip.
+func (r *recordController) RemoveIP(namespace string, req writeRequest, domain, ip string) error {
+	return r.updateIPs(namespace, req, domain, func(ips []string) []string {
+		ret := make([]string, 0, len(ips))
+		for _, v := range ips {
+			if v != ip {
+				ret = append(ret, v)
+			}
+		}
+		return ret
+	})
+}
+
+// updateIPs replaces the ips of the domain with the result of mutate, which fails with a
+// ValidationError if the domain is a CNAME or pending rather than a list of ips.
+func (r *recordController) updateIPs(namespace string, req writeRequest, domain string, mutate func([]string) []string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var oldValue, newValue string
+	var changed bool
+	err := r.update(namespace, req.Version, func(data map[string]string) error {
+		changed = false
+		oldValue = data[domain]
+		// The labels of the domain and the weights of the ips left are kept
+		v := controller.DecodeValue(oldValue)
+		if v.Value == controller.PendingValue || strings.HasPrefix(v.Value, controller.CNAMEPrefix) {
+			return &ValidationError{Field: "domain", Value: domain, Reason: "is not resolved to ips"}
+		}
+		oldIPs := controller.SplitIPs(v.Value)
+		ips := mutate(oldIPs)
+		for ip := range v.Weights {
+			if !ExistString(ip, ips) {
+				delete(v.Weights, ip)
+			}
 		}
-		delete(cm.Data, domain)
-		newCm, updateErr := r.clientset.CoreV1().ConfigMaps(controller.ConfigmapNamespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
-		if updateErr != nil {
-			return updateErr
+		v.Value = controller.JoinIPs(ips)
+		newValue = ""
+		if v.Value != "" {
+			newValue = v.Encode()
 		}
-		// Check again
-		if newCm.Data == nil || len(newCm.Data) == 0 {
+		if newValue == oldValue {
 			return nil
 		}
-		if val, ok := newCm.Data[domain]; ok {
-			return fmt.Errorf("failed to DeleteData and updateCm's val is exist, domainInfo is %s(%s)", domain, val)
+		if newValue == "" {
+			delete(data, domain)
+		} else {
+			data[domain] = newValue
 		}
+		changed = true
 		return nil
 	})
-	return retryErr
+	if err == nil && changed {
+		action := HistoryActionSet
+		if newValue == "" {
+			action = HistoryActionDelete
+		}
+		r.recordChange(namespace, req, domain, action, oldValue, newValue)
+	}
+	return err
 }
 
-func (r *recordController) GetDatas() ([]*Record, error) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
+func (r *recordController) GetDatas(namespace string) ([]*Record, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
 
 	ret := make([]*Record, 0)
-	cm, err := r.clientset.CoreV1().ConfigMaps(controller.ConfigmapNamespace).Get(context.TODO(), controller.ConfigmapName, metav1.GetOptions{})
+	data, err := r.store.List(namespace)
 	if err != nil {
 		return ret, err
 	}
-	for k, v := range cm.Data {
-		item := &Record{
-			Domain: k,
-			IP:     v,
+	now := time.Now()
+	for k, v := range data {
+		// The expired records are left out before the garbage collection deletes them
+		if controller.DecodeValue(v).Expired(now) {
+			continue
 		}
-		ret = append(ret, item)
+		ret = append(ret, recordFromValue(k, v))
 	}
+	// Sort by domain so the pages are stable across calls
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Domain < ret[j].Domain
+	})
 	return ret, nil
 }
 
-func (r *recordController) GetData(domain string) (*Record, error) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
+func (r *recordController) GetData(namespace, domain string) (*Record, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
 
 	ret := &Record{}
-	cm, err := r.clientset.CoreV1().ConfigMaps(controller.ConfigmapNamespace).Get(context.TODO(), controller.ConfigmapName, metav1.GetOptions{})
+	val, ok, err := r.store.Get(namespace, domain)
 	if err != nil {
 		return ret, err
 	}
-	if ip, ok := cm.Data[domain]; ok {
-		ret.Domain = domain
-		ret.IP = ip
-	} else {
-		return ret, fmt.Errorf("can't find the ip according to the domain %s", domain)
+	if !ok || controller.DecodeValue(val).Expired(time.Now()) {
+		return ret, fmt.Errorf("can't find the ip according to the domain %s: %w", domain, ErrRecordNotFound)
 	}
-	return ret, nil
+	return recordFromValue(domain, val), nil
 }
 
-// Record for PostRecords function
+// Record for PostRecords function, one of IP (or IPs), CNAME and Pending is set
 type Record struct {
-	IP     string `json:"ip" binding:"required"`
-	Domain string `json:"domain" binding:"required"`
+	IP string `json:"ip"`
+	// IPs are all the ips of a domain resolving to several addresses, IP is the first of them
+	IPs []string `json:"ips,omitempty"`
+	// Weights are the weights of the ips, see controller.IPOrderWeighted, an ip without one weighs 1
+	Weights map[string]int `json:"weights,omitempty"`
+	// CNAME is the target domain which is flattened to its ip in the hosts file
+	CNAME string `json:"cname,omitempty"`
+	// Pending means the domain is registered but the ip will be assigned later,
+	// it is excluded from the hosts file until then.
+	Pending bool   `json:"pending,omitempty"`
+	Domain  string `json:"domain" binding:"required"`
+	// Labels tag the record, e.g. with its owner, which are left out of the hosts file
+	Labels map[string]string `json:"labels,omitempty"`
+	// TTLSeconds makes the record expire the seconds after the write, 0 means never
+	TTLSeconds int64 `json:"ttlSeconds,omitempty"`
+	// ExpiresAt is when the record expires, which is set by the server from TTLSeconds
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// NoReverse leaves the ips of the record out of the PTR records, see controller.Args.ReverseFile
+	NoReverse bool `json:"noReverse,omitempty"`
 }
 
+// storedValue returns the value of the record stored in the configmap, the expiry is counted from now
+func (r Record) storedValue() string {
+	expiresAt := r.ExpiresAt
+	if r.TTLSeconds > 0 {
+		t := time.Now().Add(time.Duration(r.TTLSeconds) * time.Second).UTC().Truncate(time.Second)
+		expiresAt = &t
+	}
+	return controller.RecordValue{Value: r.value(), Labels: r.Labels, ExpiresAt: expiresAt, Weights: r.Weights,
+		NoReverse: r.NoReverse}.Encode()
+}
+
+// value returns the bare value of the record without the metadata
+func (r Record) value() string {
+	if r.Pending {
+		return controller.PendingValue
+	}
+	if r.CNAME != "" {
+		return controller.CNAMEPrefix + r.CNAME
+	}
+	return controller.JoinIPs(r.ips())
+}
+
+// ips returns the deduplicated ips of the record, either of IP and IPs may be set by the client
+func (r Record) ips() []string {
+	ret := make([]string, 0, len(r.IPs)+1)
+	if r.IP != "" {
+		ret = append(ret, r.IP)
+	}
+	for _, ip := range r.IPs {
+		if !ExistString(ip, ret) {
+			ret = append(ret, ip)
+		}
+	}
+	return ret
+}
+
+// recordFromValue builds the record from the value stored in the configmap
+func recordFromValue(domain, stored string) *Record {
+	v := controller.DecodeValue(stored)
+	ret := &Record{
+		Domain:    domain,
+		Labels:    v.Labels,
+		ExpiresAt: v.ExpiresAt,
+		Weights:   v.Weights,
+		NoReverse: v.NoReverse,
+	}
+	switch value := v.Value; {
+	case value == controller.PendingValue:
+		ret.Pending = true
+	case strings.HasPrefix(value, controller.CNAMEPrefix):
+		ret.CNAME = strings.TrimPrefix(value, controller.CNAMEPrefix)
+	default:
+		ret.IP = value
+		if ips := controller.SplitIPs(value); len(ips) > 1 {
+			ret.IP = ips[0]
+			ret.IPs = ips
+		}
+	}
+	return ret
+}
+
+const (
+	// ListFormatArray lists the records as an array of Record
+	ListFormatArray = "array"
+	// ListFormatMap lists the records as a map from the domain to the ip
+	ListFormatMap = "map"
+)
+
 // DeleteRecord for DeleteRecords function
 type DeleteRecord struct {
 	IP     string `json:"ip"`
 	Domain string `json:"domain" binding:"required"`
 }
 
+// recordNamespace returns the namespace of the configmap targeted by the request, which is the
+// global one unless the route is namespace scoped.
+func (r *recordController) recordNamespace(c *gin.Context) (string, bool) {
+	namespace := c.Param("ns")
+	if namespace == "" {
+		return r.args.ControllerArgs.Namespace(), true
+	}
+	if namespace == r.args.ControllerArgs.Namespace() || ExistString(namespace, r.args.ControllerArgs.RecordNamespaces) {
+		return namespace, true
+	}
+	err := fmt.Errorf("the namespace %s is not permitted to hold records", namespace)
+	klog.ErrorS(err, "Response with a error", "httpCode", http.StatusForbidden, "requestUri", c.Request.RequestURI)
+	c.JSON(http.StatusForbidden, ErrorResponse(CodeForbidden, err))
+	return "", false
+}
+
 func (r *recordController) PostRecords(c *gin.Context) {
+	namespace, ok := r.recordNamespace(c)
+	if !ok {
+		return
+	}
 	var record Record
 	if err := c.ShouldBindJSON(&record); err != nil {
 		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
-		c.JSON(http.StatusBadRequest, ErrorResponse(err))
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	}
+	record.normalize()
+	if !r.domainPermitted(c, record.Domain) {
+		return
+	}
+	// The record without an ip gets the default one, or is pending if allowed
+	if len(record.ips()) == 0 && record.CNAME == "" && !record.Pending {
+		if r.args.DefaultIP != "" {
+			record.IP = r.args.DefaultIP
+		} else if c.Query("allowEmptyIP") == "true" {
+			record.Pending = true
+		}
+	}
+	err := ValidateRecord(record)
+	if err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	}
+	err = r.SetData(namespace, newWriteRequest(c), record.Domain, record.storedValue())
+	if errors.Is(err, ErrRecordConflict) {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusConflict, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusConflict, ErrorResponse(CodeConflict, err))
+		return
+	}
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	}
+	if err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusInternalServerError, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusInternalServerError, ErrorResponse(CodeBackendError, err))
+		return
+	}
+	// Confirm CoreDNS has loaded the record for the read-your-writes guarantee
+	if r.args.VerifyResolver != "" && !record.Pending {
+		// Any of the ips shows the new hosts file is loaded, and a CNAME may resolve to any address
+		var ip string
+		if ips := record.ips(); len(ips) > 0 {
+			ip = ips[0]
+		}
+		if err := waitForResolution(r.args.VerifyResolver, record.Domain, ip, r.args.VerifyTimeout); err != nil {
+			klog.ErrorS(err, "Response with a error", "httpCode", http.StatusGatewayTimeout, "requestUri", c.Request.RequestURI)
+			c.JSON(http.StatusGatewayTimeout, ErrorResponse(CodeTimeout, err))
+			return
+		}
+	}
+	c.JSON(http.StatusOK, SuccessResponse(nil, fmt.Sprintf("PostRecords is successful. Domain is %s, and value is %s", record.Domain, record.value())))
+}
+
+// UpdateRecord changes the ip (or ips or CNAME) of an existing domain in place, unlike
+// PostRecords it never creates the domain and answers 404 if it is absent.
+func (r *recordController) UpdateRecord(c *gin.Context) {
+	namespace, ok := r.recordNamespace(c)
+	if !ok {
+		return
+	}
+	var record Record
+	if err := json.NewDecoder(c.Request.Body).Decode(&record); err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	}
+	// The domain of the path wins over the one of the body
+	record.Domain = c.Param("domain")
+	record.normalize()
+	if !r.domainPermitted(c, record.Domain) {
 		return
 	}
-	err := r.SetData(record.Domain, record.IP)
+	err := ValidateRecord(record)
 	if err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	}
+	err = r.UpdateData(namespace, newWriteRequest(c), record.Domain, record.storedValue())
+	var validationErr *ValidationError
+	switch {
+	case errors.Is(err, ErrRecordNotFound):
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusNotFound, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusNotFound, ErrorResponse(CodeNotFound, err))
+		return
+	case errors.Is(err, ErrRecordConflict):
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusConflict, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusConflict, ErrorResponse(CodeConflict, err))
+		return
+	case errors.As(err, &validationErr):
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	case err != nil:
 		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusInternalServerError, "requestUri", c.Request.RequestURI)
-		c.JSON(http.StatusInternalServerError, ErrorResponse(err))
+		c.JSON(http.StatusInternalServerError, ErrorResponse(CodeBackendError, err))
 		return
 	}
-	c.JSON(http.StatusOK, SuccessResponse(nil, fmt.Sprintf("PostRecords is successful. Domain is %s, and ip is %s", record.Domain, record.IP)))
+	c.JSON(http.StatusOK, SuccessResponse(nil, fmt.Sprintf("UpdateRecord is successful. Domain is %s, and value is %s", record.Domain, record.value())))
 }
 
 func (r *recordController) DeleteRecords(c *gin.Context) {
+	namespace, ok := r.recordNamespace(c)
+	if !ok {
+		return
+	}
 	var record DeleteRecord
 	if err := c.ShouldBindJSON(&record); err != nil {
 		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
-		c.JSON(http.StatusBadRequest, ErrorResponse(err))
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	}
+	record.Domain = NormalizeDomain(record.Domain)
+	if !r.domainPermitted(c, record.Domain) {
+		return
+	}
+	err := r.DeleteData(namespace, newWriteRequest(c), record.Domain, record.IP)
+	if errors.Is(err, ErrRecordConflict) {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusConflict, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusConflict, ErrorResponse(CodeConflict, err))
 		return
 	}
-	err := r.DeleteData(record.Domain)
 	if err != nil {
 		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusInternalServerError, "requestUri", c.Request.RequestURI)
-		c.JSON(http.StatusInternalServerError, ErrorResponse(err))
+		c.JSON(http.StatusInternalServerError, ErrorResponse(CodeBackendError, err))
 		return
 	}
 	c.JSON(http.StatusOK, SuccessResponse(nil, fmt.Sprintf("DeleteRecords is successful. Domain is %s, and ip is %s", record.Domain, record.IP)))
 }
 
+// DeleteRecord deletes the record of the domain in the path, ?force=true deletes the key
+// unconditionally even if the stored value is malformed.
+func (r *recordController) DeleteRecord(c *gin.Context) {
+	namespace, ok := r.recordNamespace(c)
+	if !ok {
+		return
+	}
+	domain := NormalizeDomain(c.Param("domain"))
+	if !r.domainPermitted(c, domain) {
+		return
+	}
+	var err error
+	if c.Query("force") == "true" {
+		// The key is taken verbatim, which may be a legacy one stored before the normalization
+		domain = c.Param("domain")
+		err = r.ForceDeleteData(namespace, newWriteRequest(c), domain)
+	} else {
+		err = r.DeleteData(namespace, newWriteRequest(c), domain, "")
+	}
+	if errors.Is(err, ErrRecordConflict) {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusConflict, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusConflict, ErrorResponse(CodeConflict, err))
+		return
+	}
+	if err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusInternalServerError, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusInternalServerError, ErrorResponse(CodeBackendError, err))
+		return
+	}
+	c.JSON(http.StatusOK, SuccessResponse(nil, fmt.Sprintf("DeleteRecord is successful. Domain is %s", domain)))
+}
+
+// Compact rewrites all the records of the namespace into the canonical form in one update
+func (r *recordController) Compact(c *gin.Context) {
+	namespace, ok := r.recordNamespace(c)
+	if !ok {
+		return
+	}
+	r.lock.Lock()
+	result, err := controller.Compact(r.store, namespace)
+	r.lock.Unlock()
+	if err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusInternalServerError, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusInternalServerError, ErrorResponse(CodeBackendError, err))
+		return
+	}
+	c.JSON(http.StatusOK, SuccessResponse(result, fmt.Sprintf("Compact is successful. Keys %d -> %d, bytes %d -> %d",
+		result.KeysBefore, result.KeysAfter, result.BytesBefore, result.BytesAfter)))
+}
+
+// AddRecordIP adds an ip to the domain and keeps its other ips
+func (r *recordController) AddRecordIP(c *gin.Context) {
+	namespace, ok := r.recordNamespace(c)
+	if !ok {
+		return
+	}
+	domain := NormalizeDomain(c.Param("domain"))
+	if !r.domainPermitted(c, domain) {
+		return
+	}
+	var body struct {
+		IP string `json:"ip" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	}
+	if err := ValidateRecord(Record{IP: body.IP, Domain: domain}); err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	}
+	r.respondIPUpdate(c, r.AddIP(namespace, newWriteRequest(c), domain, body.IP), fmt.Sprintf("AddRecordIP is successful. Domain is %s, and ip is %s", domain, body.IP))
+}
+
+// RemoveRecordIP removes an ip from the domain and keeps its other ips
+func (r *recordController) RemoveRecordIP(c *gin.Context) {
+	namespace, ok := r.recordNamespace(c)
+	if !ok {
+		return
+	}
+	domain, ip := NormalizeDomain(c.Param("domain")), c.Param("ip")
+	if !r.domainPermitted(c, domain) {
+		return
+	}
+	r.respondIPUpdate(c, r.RemoveIP(namespace, newWriteRequest(c), domain, ip), fmt.Sprintf("RemoveRecordIP is successful. Domain is %s, and ip is %s", domain, ip))
+}
+
+func (r *recordController) respondIPUpdate(c *gin.Context, err error, message string) {
+	if errors.Is(err, ErrRecordConflict) {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusConflict, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusConflict, ErrorResponse(CodeConflict, err))
+		return
+	}
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	}
+	if err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusInternalServerError, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusInternalServerError, ErrorResponse(CodeBackendError, err))
+		return
+	}
+	c.JSON(http.StatusOK, SuccessResponse(nil, message))
+}
+
 func (r *recordController) ListRecords(c *gin.Context) {
-	ret, err := r.GetDatas()
+	namespace, ok := r.recordNamespace(c)
+	if !ok {
+		return
+	}
+	format := c.DefaultQuery("format", ListFormatArray)
+	if format != ListFormatArray && format != ListFormatMap {
+		err := fmt.Errorf("the format %q is not supported, it must be %s or %s", format, ListFormatArray, ListFormatMap)
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	}
+	offset, limit, paged, err := pageParams(c)
+	if err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	}
+	if err := r.setETag(c, namespace); err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusInternalServerError, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusInternalServerError, ErrorResponse(CodeBackendError, err))
+		return
+	}
+	ret, err := r.GetDatas(namespace)
 	if err != nil {
 		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusInternalServerError, "requestUri", c.Request.RequestURI)
-		c.JSON(http.StatusInternalServerError, ErrorResponse(err))
+		c.JSON(http.StatusInternalServerError, ErrorResponse(CodeBackendError, err))
 		return
 	}
-	c.JSON(http.StatusOK, SuccessResponse(ret, "ListRecords is successful."))
+	// Filter before paginating so the total is the number of the matching records
+	labels, err := labelFilter(c)
+	if err == nil {
+		ret, err = filterRecords(ret, c.Query("domain"), c.Query("ip"), labels)
+	}
+	if err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	}
+	total := len(ret)
+	ret = paginateRecords(ret, offset, limit)
+	var items interface{} = ret
+	if format == ListFormatMap {
+		items = recordsToMap(ret)
+	}
+	// The response without ?offset and ?limit keeps the original shape for the old clients
+	if !paged {
+		c.JSON(http.StatusOK, SuccessResponse(items, "ListRecords is successful."))
+		return
+	}
+	page := RecordPage{Total: total, Offset: offset, Limit: limit, Items: items}
+	c.JSON(http.StatusOK, SuccessResponse(page, fmt.Sprintf("ListRecords is successful. Total is %d", total)))
 }
 
 func (r *recordController) GetRecord(c *gin.Context) {
-	domain := c.Param("domain")
+	namespace, ok := r.recordNamespace(c)
+	if !ok {
+		return
+	}
+	domain := NormalizeDomain(c.Param("domain"))
 
-	ret, err := r.GetData(domain)
+	if err := r.setETag(c, namespace); err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusInternalServerError, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusInternalServerError, ErrorResponse(CodeBackendError, err))
+		return
+	}
+	ret, err := r.GetData(namespace, domain)
+	if errors.Is(err, ErrRecordNotFound) {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusNotFound, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusNotFound, ErrorResponse(CodeNotFound, err))
+		return
+	}
 	if err != nil {
 		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusInternalServerError, "requestUri", c.Request.RequestURI)
-		c.JSON(http.StatusInternalServerError, ErrorResponse(err))
+		c.JSON(http.StatusInternalServerError, ErrorResponse(CodeBackendError, err))
 		return
 	}
 	c.JSON(http.StatusOK, SuccessResponse(ret, fmt.Sprintf("GetRecord is successful. Domain is %s", domain)))
 }
 
+// GetRecordHistory returns the recent changes of the domain made through this server, the latest first
+func (r *recordController) GetRecordHistory(c *gin.Context) {
+	namespace, ok := r.recordNamespace(c)
+	if !ok {
+		return
+	}
+	domain := NormalizeDomain(c.Param("domain"))
+	c.JSON(http.StatusOK, SuccessResponse(r.history.get(namespace, domain), fmt.Sprintf("GetRecordHistory is successful. Domain is %s", domain)))
+}
+
+// ValidateRecords checks a whole hosts file before importing it and reports
+// the problems of every line, nothing is persisted.
+func (r *recordController) ValidateRecords(c *gin.Context) {
+	lines, err := parseHostsFile(c.Request.Body)
+	if err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	}
+	report := validateHostsLines(lines)
+	c.JSON(http.StatusOK, SuccessResponse(report, fmt.Sprintf("ValidateRecords is successful. Valid is %d, invalid is %d, duplicate is %d, conflict is %d",
+		report.Valid, report.Invalid, report.Duplicate, report.Conflict)))
+}
+
+// DiffRecords compares two record sets, or a record set with the live records,
+// and returns the added, removed and changed domains.
+func (r *recordController) DiffRecords(c *gin.Context) {
+	var req DiffRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		klog.ErrorS(err, "Response with a error", "httpCode", http.StatusBadRequest, "requestUri", c.Request.RequestURI)
+		c.JSON(http.StatusBadRequest, ErrorResponse(CodeInvalidRequest, err))
+		return
+	}
+	base := req.Base
+	if base == nil {
+		ret, err := r.GetDatas(r.args.ControllerArgs.Namespace())
+		if err != nil {
+			klog.ErrorS(err, "Response with a error", "httpCode", http.StatusInternalServerError, "requestUri", c.Request.RequestURI)
+			c.JSON(http.StatusInternalServerError, ErrorResponse(CodeBackendError, err))
+			return
+		}
+		base = ret
+	}
+	diff := diffRecords(base, req.Target)
+	if c.Query("output") == "text" {
+		c.String(http.StatusOK, diff.String())
+		return
+	}
+	c.JSON(http.StatusOK, SuccessResponse(diff, fmt.Sprintf("DiffRecords is successful. Added is %d, removed is %d, changed is %d",
+		len(diff.Added), len(diff.Removed), len(diff.Changed))))
+}
+
 func FileExist(name string) bool {
 	_, err := os.Stat(name)
 	return err == nil
 }
 
+func ExistString(val string, items []string) bool {
+	for _, v := range items {
+		if val == v {
+			return true
+		}
+	}
+	return false
+}
+
+// The codes of Response, which are stable so that the clients can tell the failures apart. The
+// leading digits are the http status the code comes with.
+const (
+	CodeSuccess = 0
+	// CodeInvalidRequest is a malformed request or a record failing the validation
+	CodeInvalidRequest = 4000
+	// CodeUnauthorized is a request without the valid bearer token
+	CodeUnauthorized = 4010
+	// CodeForbidden is a request denied by the authorization, a namespace or a domain not permitted
+	CodeForbidden = 4030
+	// CodeNotFound is a record or a path not found
+	CodeNotFound = 4040
+	// CodeMethodNotAllowed is a method not supported by the path
+	CodeMethodNotAllowed = 4050
+	// CodeConflict is a record changed by another client, see ErrRecordConflict
+	CodeConflict = 4090
+	// CodeTooManyRequests is a client exceeding its rate limit
+	CodeTooManyRequests = 4290
+	// CodeBackendError is a failure of the configmap or the hosts file
+	CodeBackendError = 5000
+	// CodeUnavailable is the server not ready yet
+	CodeUnavailable = 5030
+	// CodeTimeout is a record not resolving in time after the write, see Args.VerifyResolver
+	CodeTimeout = 5040
+)
+
 type Response struct {
-	// 统一状态码，成功=0 失败>0
+	// 统一状态码，成功=0 失败>0，见 CodeSuccess 等
 	Code    int         `json:"code"`
 	Data    interface{} `json:"data"`
 	Message string      `json:"message"`
@@ -348,15 +1232,16 @@ func SuccessResponse(data interface{}, msg string) *Response {
 		msg = "operate successfully"
 	}
 	return &Response{
-		Code:    0,
+		Code:    CodeSuccess,
 		Data:    data,
 		Message: msg,
 	}
 }
 
-func ErrorResponse(err error) *Response {
+// ErrorResponse for error response, the code is one of CodeInvalidRequest etc.
+func ErrorResponse(code int, err error) *Response {
 	return &Response{
-		Code:    1,
+		Code:    code,
 		Data:    nil,
 		Message: err.Error(),
 	}
@@ -0,0 +1,821 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devincd/coredns-hosts-api/pkg/metrics"
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+	"github.com/gin-gonic/gin"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestServer returns the server of the args serving the records of a MemoryStore, its configmap
+// informer is not started yet, see startInformers.
+func newTestServer(t testing.TB, args Args) *Server {
+	t.Helper()
+	return newTestServerWithStore(t, args, fake.NewSimpleClientset(), controller.NewMemoryStore())
+}
+
+// newTestServerWithStore returns the server of newTestServer serving the records of the store
+func newTestServerWithStore(t testing.TB, args Args, clientset kubernetes.Interface, store controller.RecordStore) *Server {
+	t.Helper()
+	s := &Server{
+		args:      args,
+		clientset: clientset,
+		store:     store,
+	}
+	s.informerFactory = informers.NewSharedInformerFactory(s.clientset, 0)
+	s.configmapController = controller.NewConfigmapController(s.informerFactory.Core().V1().ConfigMaps(), s.store, args.ControllerArgs)
+	if err := s.initWebService(args); err != nil {
+		t.Fatalf("initWebService: %v", err)
+	}
+	return s
+}
+
+// failingStore is a MemoryStore whose every call fails with err unless it is nil
+type failingStore struct {
+	*controller.MemoryStore
+	err error
+}
+
+func (f *failingStore) Get(namespace, domain string) (string, bool, error) {
+	if f.err != nil {
+		return "", false, f.err
+	}
+	return f.MemoryStore.Get(namespace, domain)
+}
+
+func (f *failingStore) List(namespace string) (map[string]string, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.MemoryStore.List(namespace)
+}
+
+func (f *failingStore) Count(namespace string) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	return f.MemoryStore.Count(namespace)
+}
+
+func (f *failingStore) Update(namespace string, mutate func(data map[string]string) error) error {
+	if f.err != nil {
+		return f.err
+	}
+	return f.MemoryStore.Update(namespace, mutate)
+}
+
+func (f *failingStore) UpdateIfVersion(namespace, version string, mutate func(data map[string]string) error) error {
+	if f.err != nil {
+		return f.err
+	}
+	return f.MemoryStore.UpdateIfVersion(namespace, version, mutate)
+}
+
+func (f *failingStore) Version(namespace string) (string, error) {
+	if f.err != nil {
+		return "", f.err
+	}
+	return f.MemoryStore.Version(namespace)
+}
+
+// newSyncedTestServer returns the server of newTestServer whose informer has synced
+func newSyncedTestServer(t *testing.T, args Args) *Server {
+	t.Helper()
+	s := newTestServer(t, args)
+	startInformers(t, s)
+	return s
+}
+
+// startInformers starts the informers of the server until the test ends and waits for their sync
+func startInformers(t *testing.T, s *Server) {
+	t.Helper()
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	s.informerFactory.Start(stop)
+	s.informerFactory.WaitForCacheSync(stop)
+}
+
+// newRunningTestServer returns the server of the args serving the records of the configmaps of a fake
+// clientset, whose controller runs until the test ends and has synced the hosts file once.
+func newRunningTestServer(t *testing.T, args Args) *Server {
+	t.Helper()
+	// The fake clientset leaves the resourceVersion empty, so the updates of the configmaps are
+	// filtered out as resyncs and the controller only syncs by the full resync.
+	args.ControllerArgs.FullResyncPeriod = 20 * time.Millisecond
+	if len(args.ControllerArgs.FilePaths) == 0 {
+		args.ControllerArgs.FilePaths = []string{filepath.Join(t.TempDir(), "hosts")}
+	}
+	clientset := fake.NewSimpleClientset()
+	store := controller.NewConfigmapStore(clientset, nil, args.ControllerArgs, true, 0)
+	if err := store.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	s := newTestServerWithStore(t, args, clientset, store)
+	startInformers(t, s)
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	go func() {
+		if err := s.configmapController.Run(stop); err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	}()
+	for deadline := time.Now().Add(5 * time.Second); s.configmapController.Status().LastSyncTime.IsZero(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the hosts file is never synced")
+		}
+	}
+	return s
+}
+
+// waitFile waits for the content of the file to be want
+func waitFile(t *testing.T, path, want string) {
+	t.Helper()
+	var content []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if content, _ = os.ReadFile(path); string(content) == want {
+			return
+		}
+	}
+	t.Fatalf("the file %s = %q, want %q", path, content, want)
+}
+
+// serve sends the request to the handler, header is the pairs of the names and the values of the headers
+func serve(handler http.Handler, method, path, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// decodeResponse decodes the Response of the recorder, the data is decoded into data unless it is nil
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder, data interface{}) Response {
+	t.Helper()
+	resp := Response{Data: data}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to decode the response %q: %v", w.Body.String(), err)
+	}
+	return resp
+}
+
+func TestUnknownPathAndMethod(t *testing.T) {
+	s := newSyncedTestServer(t, Args{})
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+		code   int
+		allow  string
+	}{
+		{name: "unknown path", method: http.MethodGet, path: "/api/v1/unknown", status: http.StatusNotFound, code: CodeNotFound},
+		{name: "unsupported method", method: http.MethodPatch, path: "/api/v1/records", status: http.StatusMethodNotAllowed, code: CodeMethodNotAllowed, allow: "DELETE, GET, POST"},
+		{name: "unsupported method of a path parameter", method: http.MethodPost, path: "/api/v1/record/a.com", status: http.StatusMethodNotAllowed, code: CodeMethodNotAllowed, allow: "DELETE, GET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(s.webServer.Handler, tt.method, tt.path, "")
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if resp := decodeResponse(t, w, nil); resp.Code != tt.code || resp.Message == "" {
+				t.Errorf("response = %+v, want the code %d with a message", resp, tt.code)
+			}
+			if allow := w.Header().Get("Allow"); allow != tt.allow {
+				t.Errorf("Allow = %q, want %q", allow, tt.allow)
+			}
+		})
+	}
+}
+
+func TestRecordWeights(t *testing.T) {
+	s := newSyncedTestServer(t, Args{})
+	h := s.webServer.Handler
+	w := serve(h, http.MethodPost, "/api/v1/records", `{"domain": "a.com", "ips": ["10.0.0.1", "10.0.0.2"], "weights": {"10.0.0.1": 3}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST = %d %s", w.Code, w.Body)
+	}
+	var record Record
+	decodeResponse(t, serve(h, http.MethodGet, "/api/v1/record/a.com", ""), &record)
+	if record.Weights["10.0.0.1"] != 3 {
+		t.Errorf("weights = %v, want 10.0.0.1 weighing 3", record.Weights)
+	}
+
+	// The weight goes together with its ip
+	if w := serve(h, http.MethodDelete, "/api/v1/record/a.com/ips/10.0.0.1", ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE = %d %s", w.Code, w.Body)
+	}
+	record = Record{}
+	decodeResponse(t, serve(h, http.MethodGet, "/api/v1/record/a.com", ""), &record)
+	if len(record.Weights) != 0 || record.IP != "10.0.0.2" {
+		t.Errorf("record = %+v, want 10.0.0.2 without weights", record)
+	}
+
+	for _, body := range []string{
+		`{"domain": "b.com", "ip": "10.0.0.1", "weights": {"10.0.0.9": 1}}`,
+		`{"domain": "b.com", "ip": "10.0.0.1", "weights": {"10.0.0.1": 0}}`,
+		`{"domain": "b.com", "cname": "a.com", "weights": {"10.0.0.1": 1}}`,
+	} {
+		w := serve(h, http.MethodPost, "/api/v1/records", body)
+		if resp := decodeResponse(t, w, nil); w.Code != http.StatusBadRequest || resp.Code != CodeInvalidRequest {
+			t.Errorf("POST %s = %d %+v, want 400", body, w.Code, resp)
+		}
+	}
+}
+
+func TestRecordNoReverse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	s := newRunningTestServer(t, Args{ControllerArgs: controller.Args{FilePaths: []string{path}, ReverseFile: true}})
+	h := s.webServer.Handler
+	for _, body := range []string{
+		`{"domain": "a.com", "ip": "10.0.0.1"}`,
+		`{"domain": "b.com", "ip": "10.0.0.1", "noReverse": true}`,
+	} {
+		if w := serve(h, http.MethodPost, "/api/v1/records", body); w.Code != http.StatusOK {
+			t.Fatalf("POST %s = %d %s", body, w.Code, w.Body)
+		}
+	}
+	var record Record
+	decodeResponse(t, serve(h, http.MethodGet, "/api/v1/record/b.com", ""), &record)
+	if !record.NoReverse {
+		t.Errorf("record = %+v, want noReverse", record)
+	}
+	waitFile(t, path, "10.0.0.1 a.com\n10.0.0.1 b.com\n")
+	waitFile(t, controller.ReverseFilePath(path), "10.0.0.1 a.com\n")
+}
+
+func TestMaxIPsPerDomain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	s := newRunningTestServer(t, Args{ControllerArgs: controller.Args{FilePaths: []string{path}, MaxIPsPerDomain: 2}})
+	h := s.webServer.Handler
+	// Every write keeps all the ips beyond the cap, which only applies to the hosts file
+	for _, req := range []struct{ method, path, body string }{
+		{method: http.MethodPost, path: "/api/v1/records", body: `{"domain": "a.com", "ips": ["10.0.0.1", "10.0.0.2", "10.0.0.3"]}`},
+		{method: http.MethodPost, path: "/api/v1/records", body: `{"domain": "b.com", "ips": ["10.0.1.1", "10.0.1.2"]}`},
+		{method: http.MethodPost, path: "/api/v1/record/b.com/ips", body: `{"ip": "10.0.1.3"}`},
+		{method: http.MethodPost, path: "/api/v1/records/import", body: "10.0.2.1 c.com\n10.0.2.2 c.com\n10.0.2.3 c.com\n"},
+	} {
+		if w := serve(h, req.method, req.path, req.body); w.Code != http.StatusOK {
+			t.Fatalf("%s %s = %d %s", req.method, req.path, w.Code, w.Body)
+		}
+	}
+	for domain, want := range map[string][]string{
+		"a.com": {"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		"b.com": {"10.0.1.1", "10.0.1.2", "10.0.1.3"},
+		"c.com": {"10.0.2.1", "10.0.2.2", "10.0.2.3"},
+	} {
+		var record Record
+		w := serve(h, http.MethodGet, "/api/v1/record/"+domain, "")
+		decodeResponse(t, w, &record)
+		if got := record.ips(); !reflect.DeepEqual(got, want) {
+			t.Errorf("GET %s = %v, want all of %v", domain, got, want)
+		}
+	}
+	waitFile(t, path, "10.0.0.1 a.com\n10.0.0.2 a.com\n10.0.1.1 b.com\n10.0.1.2 b.com\n10.0.2.1 c.com\n10.0.2.2 c.com\n")
+}
+
+func TestMetricsServer(t *testing.T) {
+	metrics.Register()
+	tests := []struct {
+		name string
+		args Args
+		// api and separate are the paths of the metrics on the api and on the listener of their own
+		api      string
+		separate string
+	}{
+		{name: "with the api", args: Args{}, api: DefaultMetricsPath},
+		{name: "separate", args: Args{MetricsAddr: ":9154", MetricsPath: "/prom"}, separate: "/prom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.args)
+			if (s.metricsServer != nil) != (tt.separate != "") {
+				t.Fatalf("metrics server = %v, want it only with --metrics-addr", s.metricsServer)
+			}
+			for _, path := range []string{DefaultMetricsPath, "/prom"} {
+				w := serve(s.webServer.Handler, http.MethodGet, path, "")
+				if want := path == tt.api; (w.Code == http.StatusOK) != want {
+					t.Errorf("GET %s on the api = %d, want the metrics %v", path, w.Code, want)
+				}
+				if s.metricsServer == nil {
+					continue
+				}
+				w = serve(s.metricsServer.Handler, http.MethodGet, path, "")
+				if want := path == tt.separate; (w.Code == http.StatusOK) != want {
+					t.Errorf("GET %s on the metrics server = %d, want the metrics %v", path, w.Code, want)
+				}
+				if path == tt.separate && !strings.Contains(w.Body.String(), "coredns_hosts_api_") {
+					t.Errorf("GET %s = %q, want the metrics of coredns_hosts_api_", path, w.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestNamespacedRecords(t *testing.T) {
+	s := newSyncedTestServer(t, Args{ControllerArgs: controller.Args{RecordNamespaces: []string{"team-a", "team-b"}}})
+	h := s.webServer.Handler
+	for ns, ip := range map[string]string{"team-a": "10.0.0.1", "team-b": "10.0.0.2"} {
+		if w := serve(h, http.MethodPost, "/api/v1/namespaces/"+ns+"/records", `{"domain": "a.com", "ip": "`+ip+`"}`); w.Code != http.StatusOK {
+			t.Fatalf("POST to %s = %d %s", ns, w.Code, w.Body)
+		}
+	}
+	for ns, ip := range map[string]string{"team-a": "10.0.0.1", "team-b": "10.0.0.2"} {
+		var record Record
+		decodeResponse(t, serve(h, http.MethodGet, "/api/v1/namespaces/"+ns+"/record/a.com", ""), &record)
+		if record.IP != ip {
+			t.Errorf("a.com in %s = %+v, want %s", ns, record, ip)
+		}
+	}
+	if w := serve(h, http.MethodGet, "/api/v1/record/a.com", ""); w.Code != http.StatusNotFound {
+		t.Errorf("a.com in the global namespace = %d, want 404", w.Code)
+	}
+	if w := serve(h, http.MethodDelete, "/api/v1/namespaces/team-b/record/a.com", ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE from team-b = %d %s", w.Code, w.Body)
+	}
+	if data, _ := s.store.List("team-a"); data["a.com"] != "10.0.0.1" {
+		t.Errorf("team-a = %v, want a.com untouched by the delete of team-b", data)
+	}
+
+	w := serve(h, http.MethodPost, "/api/v1/namespaces/team-c/records", `{"domain": "a.com", "ip": "10.0.0.3"}`)
+	if resp := decodeResponse(t, w, nil); w.Code != http.StatusForbidden || resp.Code != CodeForbidden {
+		t.Errorf("POST to a namespace not permitted = %d %+v, want 403", w.Code, resp)
+	}
+}
+
+func TestPendingRecord(t *testing.T) {
+	s := newSyncedTestServer(t, Args{})
+	h := s.webServer.Handler
+	if w := serve(h, http.MethodPost, "/api/v1/records", `{"domain": "a.com"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("POST without an ip = %d, want 400", w.Code)
+	}
+	if w := serve(h, http.MethodPost, "/api/v1/records?allowEmptyIP=true", `{"domain": "a.com"}`); w.Code != http.StatusOK {
+		t.Fatalf("POST pending = %d %s", w.Code, w.Body)
+	}
+	var record Record
+	decodeResponse(t, serve(h, http.MethodGet, "/api/v1/record/a.com", ""), &record)
+	if !record.Pending || record.IP != "" {
+		t.Errorf("record = %+v, want it pending", record)
+	}
+	if content, err := s.configmapController.RenderHosts(); err != nil || content != "" {
+		t.Errorf("hosts = %q, %v, want the pending record left out", content, err)
+	}
+
+	if w := serve(h, http.MethodPut, "/api/v1/records/a.com", `{"ip": "10.0.0.1"}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT the ip = %d %s", w.Code, w.Body)
+	}
+	record = Record{}
+	decodeResponse(t, serve(h, http.MethodGet, "/api/v1/record/a.com", ""), &record)
+	if record.Pending || record.IP != "10.0.0.1" {
+		t.Errorf("record = %+v, want it resolved to 10.0.0.1", record)
+	}
+	if content, err := s.configmapController.RenderHosts(); err != nil || content != "10.0.0.1 a.com\n" {
+		t.Errorf("hosts = %q, %v, want the resolved record", content, err)
+	}
+}
+
+func TestDefaultIP(t *testing.T) {
+	s := newSyncedTestServer(t, Args{DefaultIP: "10.0.0.9"})
+	h := s.webServer.Handler
+	if w := serve(h, http.MethodPost, "/api/v1/records", `{"domain": "a.com"}`); w.Code != http.StatusOK {
+		t.Fatalf("POST without an ip = %d %s", w.Code, w.Body)
+	}
+	var record Record
+	decodeResponse(t, serve(h, http.MethodGet, "/api/v1/record/a.com", ""), &record)
+	if record.Pending || record.IP != "10.0.0.9" {
+		t.Errorf("record = %+v, want the default ip", record)
+	}
+}
+
+func TestForceDeleteMalformedRecord(t *testing.T) {
+	s := newSyncedTestServer(t, Args{})
+	ns := s.args.ControllerArgs.Namespace()
+	// A manual edit left a malformed value under a key stored before the normalization
+	if err := s.store.Set(ns, "Bad.com", `{"value": `); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.Set(ns, "a.com", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(s.webServer.Handler, http.MethodDelete, "/api/v1/record/Bad.com?force=true", ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE ?force=true = %d %s", w.Code, w.Body)
+	}
+	if data, _ := s.store.List(ns); len(data) != 1 || data["a.com"] != "10.0.0.1" {
+		t.Errorf("the records = %v, want only a.com left", data)
+	}
+}
+
+func TestRecordIPs(t *testing.T) {
+	s := newSyncedTestServer(t, Args{})
+	h := s.webServer.Handler
+	get := func() Record {
+		var record Record
+		decodeResponse(t, serve(h, http.MethodGet, "/api/v1/record/a.com", ""), &record)
+		return record
+	}
+	if w := serve(h, http.MethodPost, "/api/v1/records", `{"domain": "a.com", "ip": "10.0.0.1"}`); w.Code != http.StatusOK {
+		t.Fatalf("POST a single ip = %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, http.MethodPost, "/api/v1/records", `{"domain": "a.com", "ips": ["10.0.0.1", "10.0.0.2"]}`); w.Code != http.StatusOK {
+		t.Fatalf("POST the ips = %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, http.MethodPost, "/api/v1/record/a.com/ips", `{"ip": "fd00::1"}`); w.Code != http.StatusOK {
+		t.Fatalf("add an ip = %d %s", w.Code, w.Body)
+	}
+	if record := get(); !reflect.DeepEqual(record.IPs, []string{"10.0.0.1", "10.0.0.2", "fd00::1"}) {
+		t.Errorf("ips = %v, want the added one kept with the others", record.IPs)
+	}
+	if content, _ := s.configmapController.RenderHosts(); content != "10.0.0.1 a.com\n10.0.0.2 a.com\nfd00::1 a.com\n" {
+		t.Errorf("hosts = %q, want a line per ip", content)
+	}
+
+	if w := serve(h, http.MethodDelete, "/api/v1/record/a.com/ips/10.0.0.1", ""); w.Code != http.StatusOK {
+		t.Fatalf("remove an ip = %d %s", w.Code, w.Body)
+	}
+	if record := get(); !reflect.DeepEqual(record.IPs, []string{"10.0.0.2", "fd00::1"}) {
+		t.Errorf("ips = %v, want the others kept", record.IPs)
+	}
+	// Removing an ip the domain doesn't have changes nothing
+	if w := serve(h, http.MethodDelete, "/api/v1/record/a.com/ips/10.0.0.9", ""); w.Code != http.StatusOK {
+		t.Errorf("remove a missing ip = %d %s", w.Code, w.Body)
+	}
+	if record := get(); !reflect.DeepEqual(record.IPs, []string{"10.0.0.2", "fd00::1"}) {
+		t.Errorf("ips = %v, want them untouched", record.IPs)
+	}
+}
+
+func TestGetRecord(t *testing.T) {
+	store := &failingStore{MemoryStore: controller.NewMemoryStore()}
+	s := newTestServerWithStore(t, Args{}, fake.NewSimpleClientset(), store)
+	startInformers(t, s)
+	if err := store.Set(s.args.ControllerArgs.Namespace(), "a.com", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		domain string
+		err    error
+		status int
+		code   int
+	}{
+		{name: "found", domain: "a.com", status: http.StatusOK, code: CodeSuccess},
+		{name: "not found", domain: "b.com", status: http.StatusNotFound, code: CodeNotFound},
+		{name: "backend error", domain: "a.com", err: errors.New("the apiserver is down"), status: http.StatusInternalServerError, code: CodeBackendError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store.err = tt.err
+			w := serve(s.webServer.Handler, http.MethodGet, "/api/v1/record/"+tt.domain, "")
+			if resp := decodeResponse(t, w, nil); w.Code != tt.status || resp.Code != tt.code {
+				t.Errorf("GET = %d %+v, want %d with the code %d", w.Code, resp, tt.status, tt.code)
+			}
+		})
+	}
+}
+
+func TestUpdateRecord(t *testing.T) {
+	s := newSyncedTestServer(t, Args{})
+	h := s.webServer.Handler
+	ns := s.args.ControllerArgs.Namespace()
+	w := serve(h, http.MethodPut, "/api/v1/records/a.com", `{"ip": "10.0.0.1"}`)
+	if resp := decodeResponse(t, w, nil); w.Code != http.StatusNotFound || resp.Code != CodeNotFound {
+		t.Errorf("PUT a missing record = %d %+v, want 404", w.Code, resp)
+	}
+	if data, _ := s.store.List(ns); len(data) != 0 {
+		t.Errorf("the records = %v, want the PUT creating nothing", data)
+	}
+
+	if err := s.store.Set(ns, "a.com", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(h, http.MethodPut, "/api/v1/records/a.com", `{"ip": "10.0.0.2"}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT = %d %s", w.Code, w.Body)
+	}
+	if value, _, _ := s.store.Get(ns, "a.com"); value != "10.0.0.2" {
+		t.Errorf("a.com = %q, want it updated to 10.0.0.2", value)
+	}
+}
+
+func TestDeleteRecordsByIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		status   int
+		wantKept bool
+	}{
+		{name: "match", body: `{"domain": "a.com", "ip": "10.0.0.1"}`, status: http.StatusOK},
+		{name: "mismatch", body: `{"domain": "a.com", "ip": "10.0.0.2"}`, status: http.StatusConflict, wantKept: true},
+		{name: "empty ip", body: `{"domain": "a.com"}`, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSyncedTestServer(t, Args{})
+			ns := s.args.ControllerArgs.Namespace()
+			if err := s.store.Set(ns, "a.com", "10.0.0.1"); err != nil {
+				t.Fatal(err)
+			}
+			w := serve(s.webServer.Handler, http.MethodDelete, "/api/v1/records", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("DELETE = %d %s, want %d", w.Code, w.Body, tt.status)
+			}
+			if _, ok, _ := s.store.Get(ns, "a.com"); ok != tt.wantKept {
+				t.Errorf("a.com kept = %v, want %v", ok, tt.wantKept)
+			}
+		})
+	}
+}
+
+func TestNormalizeDomain(t *testing.T) {
+	s := newSyncedTestServer(t, Args{})
+	h := s.webServer.Handler
+	if w := serve(h, http.MethodPost, "/api/v1/records", `{"domain": "API.Example.com.", "ip": "10.0.0.1"}`); w.Code != http.StatusOK {
+		t.Fatalf("POST = %d %s", w.Code, w.Body)
+	}
+	if data, _ := s.store.List(s.args.ControllerArgs.Namespace()); !reflect.DeepEqual(data, map[string]string{"api.example.com": "10.0.0.1"}) {
+		t.Errorf("the records = %v, want the normalized domain", data)
+	}
+	for _, domain := range []string{"api.example.com", "API.EXAMPLE.COM", "api.example.com."} {
+		var record Record
+		w := serve(h, http.MethodGet, "/api/v1/record/"+domain, "")
+		decodeResponse(t, w, &record)
+		if w.Code != http.StatusOK || record.Domain != "api.example.com" {
+			t.Errorf("GET %s = %d %+v, want api.example.com", domain, w.Code, record)
+		}
+	}
+	if w := serve(h, http.MethodDelete, "/api/v1/records", `{"domain": "Api.Example.Com."}`); w.Code != http.StatusOK {
+		t.Fatalf("DELETE = %d %s", w.Code, w.Body)
+	}
+	if data, _ := s.store.List(s.args.ControllerArgs.Namespace()); len(data) != 0 {
+		t.Errorf("the records = %v, want the record deleted", data)
+	}
+}
+
+// scrape returns the value of the sample of the metrics served by the handler, 0 if it is absent
+func scrape(t *testing.T, handler http.Handler, sample string) float64 {
+	t.Helper()
+	w := serve(handler, http.MethodGet, DefaultMetricsPath, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d", DefaultMetricsPath, w.Code)
+	}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, sample+" ") {
+			value, err := strconv.ParseFloat(strings.TrimPrefix(line, sample+" "), 64)
+			if err != nil {
+				t.Fatalf("malformed sample %q: %v", line, err)
+			}
+			return value
+		}
+	}
+	return 0
+}
+
+func TestMetricsAfterAPost(t *testing.T) {
+	metrics.Register()
+	s := newSyncedTestServer(t, Args{})
+	h := s.webServer.Handler
+	const requests = `coredns_hosts_api_http_requests_total{code="200",method="POST",route="/api/v1/records"}`
+	const durations = `coredns_hosts_api_http_request_duration_seconds_count{method="POST",route="/api/v1/records"}`
+	requestsBefore, durationsBefore := scrape(t, h, requests), scrape(t, h, durations)
+	if w := serve(h, http.MethodPost, "/api/v1/records", `{"domain": "a.com", "ip": "10.0.0.1"}`); w.Code != http.StatusOK {
+		t.Fatalf("POST = %d %s", w.Code, w.Body)
+	}
+	if got := scrape(t, h, requests); got != requestsBefore+1 {
+		t.Errorf("%s = %v, want %v", requests, got, requestsBefore+1)
+	}
+	if got := scrape(t, h, durations); got != durationsBefore+1 {
+		t.Errorf("%s = %v, want %v", durations, got, durationsBefore+1)
+	}
+}
+
+func TestConcurrentReadsAndWrites(t *testing.T) {
+	s := newSyncedTestServer(t, Args{})
+	h := s.webServer.Handler
+	const workers, rounds = 8, 20
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				body := fmt.Sprintf(`{"domain": "d%d-%d.com", "ip": "10.0.%d.%d"}`, w, i, w, i+1)
+				if resp := serve(h, http.MethodPost, "/api/v1/records", body); resp.Code != http.StatusOK {
+					t.Errorf("POST %s = %d %s", body, resp.Code, resp.Body)
+				}
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				if resp := serve(h, http.MethodGet, "/api/v1/records", ""); resp.Code != http.StatusOK {
+					t.Errorf("GET = %d %s", resp.Code, resp.Body)
+				}
+				serve(h, http.MethodGet, fmt.Sprintf("/api/v1/record/d%d-%d.com", w, i), "")
+			}
+		}(w)
+	}
+	wg.Wait()
+	if count, err := s.store.Count(controller.DefaultConfigmapNamespace); err != nil || count != workers*rounds {
+		t.Errorf("Count = %d, %v, want %d", count, err, workers*rounds)
+	}
+}
+
+func BenchmarkListRecords(b *testing.B) {
+	store := controller.NewMemoryStore()
+	for i := 0; i < 1000; i++ {
+		store.Set(controller.DefaultConfigmapNamespace, fmt.Sprintf("d%d.com", i), fmt.Sprintf("10.0.%d.%d", i/250, i%250+1))
+	}
+	s := newTestServerWithStore(b, Args{}, fake.NewSimpleClientset(), store)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if w := serve(s.webServer.Handler, http.MethodGet, "/api/v1/records?limit=10", ""); w.Code != http.StatusOK {
+				b.Fatalf("GET = %d %s", w.Code, w.Body)
+			}
+		}
+	})
+}
+
+func TestRunDrainsTheRequestsOnShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	s := newTestServer(t, Args{Port: int32(port), ShutdownTimeout: 5 * time.Second, ControllerArgs: controller.Args{
+		FullResyncPeriod: 20 * time.Millisecond,
+		FilePaths:        []string{filepath.Join(t.TempDir(), "hosts")},
+	}})
+	started := make(chan struct{})
+	s.webServer.Handler.(*gin.Engine).GET("/slow", func(c *gin.Context) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		c.String(http.StatusOK, "done")
+	})
+
+	stop := make(chan struct{})
+	runErr := make(chan error, 1)
+	go func() { runErr <- s.Run(stop) }()
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		url := fmt.Sprintf("http://127.0.0.1:%d/slow", port)
+		// The server may not be listening yet
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			resp, err := http.Get(url)
+			if err != nil && time.Now().Before(deadline) {
+				continue
+			}
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			results <- result{body: string(body), err: err}
+			return
+		}
+	}()
+
+	select {
+	case <-started:
+	case r := <-results:
+		t.Fatalf("the slow request ended before it started: %+v", r)
+	}
+	// The controller fails the server if it is stopped before its caches sync, which the first sync follows
+	for deadline := time.Now().Add(5 * time.Second); s.configmapController.Status().LastSyncTime.IsZero(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the hosts file is never synced")
+		}
+	}
+	close(stop)
+	if r := <-results; r.err != nil || r.body != "done" {
+		t.Errorf("the slow request = %q, %v, want it completed", r.body, r.err)
+	}
+	if err := <-runErr; err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	store := &failingStore{MemoryStore: controller.NewMemoryStore()}
+	s := newTestServerWithStore(t, Args{ControllerArgs: controller.Args{RecordNamespaces: []string{"team-a"}}}, fake.NewSimpleClientset(), store)
+	startInformers(t, s)
+	if err := store.Set(s.args.ControllerArgs.Namespace(), "a.com", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	backendErr := errors.New("the apiserver is down")
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		header []string
+		err    error
+		status int
+		code   int
+	}{
+		{name: "PostRecords invalid", method: http.MethodPost, path: "/api/v1/records", body: `{"domain": "a.com", "ip": "10.0.0.300"}`, status: http.StatusBadRequest, code: CodeInvalidRequest},
+		{name: "PostRecords malformed", method: http.MethodPost, path: "/api/v1/records", body: `{"domain":`, status: http.StatusBadRequest, code: CodeInvalidRequest},
+		{name: "PostRecords stale", method: http.MethodPost, path: "/api/v1/records", body: `{"domain": "a.com", "ip": "10.0.0.2"}`, header: []string{"If-Match", `"0"`}, status: http.StatusConflict, code: CodeConflict},
+		{name: "PostRecords backend", method: http.MethodPost, path: "/api/v1/records", body: `{"domain": "b.com", "ip": "10.0.0.2"}`, err: backendErr, status: http.StatusInternalServerError, code: CodeBackendError},
+		{name: "PostRecords forbidden namespace", method: http.MethodPost, path: "/api/v1/namespaces/team-b/records", body: `{"domain": "b.com", "ip": "10.0.0.2"}`, status: http.StatusForbidden, code: CodeForbidden},
+		{name: "ListRecords backend", method: http.MethodGet, path: "/api/v1/records", err: backendErr, status: http.StatusInternalServerError, code: CodeBackendError},
+		{name: "GetRecord not found", method: http.MethodGet, path: "/api/v1/record/b.com", status: http.StatusNotFound, code: CodeNotFound},
+		{name: "UpdateRecord not found", method: http.MethodPut, path: "/api/v1/records/b.com", body: `{"ip": "10.0.0.2"}`, status: http.StatusNotFound, code: CodeNotFound},
+		{name: "UpdateRecord invalid", method: http.MethodPut, path: "/api/v1/records/a.com", body: `{"ip": "a.com"}`, status: http.StatusBadRequest, code: CodeInvalidRequest},
+		{name: "DeleteRecord backend", method: http.MethodDelete, path: "/api/v1/record/a.com", err: backendErr, status: http.StatusInternalServerError, code: CodeBackendError},
+		{name: "AddRecordIP stale", method: http.MethodPost, path: "/api/v1/record/a.com/ips", body: `{"ip": "10.0.0.2"}`, header: []string{"If-Match", `"0"`}, status: http.StatusConflict, code: CodeConflict},
+		{name: "AddRecordIP invalid", method: http.MethodPost, path: "/api/v1/record/a.com/ips", body: `{"ip": "10.0.0.300"}`, status: http.StatusBadRequest, code: CodeInvalidRequest},
+		{name: "RemoveRecordIP backend", method: http.MethodDelete, path: "/api/v1/record/a.com/ips/10.0.0.1", err: backendErr, status: http.StatusInternalServerError, code: CodeBackendError},
+		{name: "PostRecordsBatch malformed", method: http.MethodPost, path: "/api/v1/records/batch", body: `[`, status: http.StatusBadRequest, code: CodeInvalidRequest},
+		{name: "ImportRecords backend", method: http.MethodPost, path: "/api/v1/records/import", body: "10.0.0.2 b.com\n", err: backendErr, status: http.StatusInternalServerError, code: CodeBackendError},
+		{name: "CountRecords backend", method: http.MethodGet, path: "/api/v1/records/count", err: backendErr, status: http.StatusInternalServerError, code: CodeBackendError},
+		{name: "GetRecordsByIP invalid", method: http.MethodGet, path: "/api/v1/records/by-ip/a.com", status: http.StatusBadRequest, code: CodeInvalidRequest},
+		{name: "unknown path", method: http.MethodGet, path: "/api/v1/unknown", status: http.StatusNotFound, code: CodeNotFound},
+		{name: "unsupported method", method: http.MethodPatch, path: "/api/v1/records", status: http.StatusMethodNotAllowed, code: CodeMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store.err = tt.err
+			w := serve(s.webServer.Handler, tt.method, tt.path, tt.body, tt.header...)
+			if resp := decodeResponse(t, w, nil); w.Code != tt.status || resp.Code != tt.code || resp.Message == "" {
+				t.Errorf("%s %s = %d %+v, want %d with the code %d", tt.method, tt.path, w.Code, resp, tt.status, tt.code)
+			}
+		})
+	}
+}
+
+func TestNonDefaultConfigmap(t *testing.T) {
+	args := Args{ControllerArgs: controller.Args{ConfigmapName: "hosts-records", ConfigmapNamespace: "dns"}}
+	s := newRunningTestServer(t, args)
+	if w := serve(s.webServer.Handler, http.MethodPost, "/api/v1/records", `{"domain": "a.com", "ip": "10.0.0.1"}`); w.Code != http.StatusOK {
+		t.Fatalf("PostRecords = %d %s", w.Code, w.Body.String())
+	}
+	cm, err := s.clientset.CoreV1().ConfigMaps("dns").Get(context.TODO(), "hosts-records", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get the configmap dns/hosts-records: %v", err)
+	}
+	if cm.Data["a.com"] != "10.0.0.1" {
+		t.Errorf("the data = %v, want a.com", cm.Data)
+	}
+	if _, err := s.clientset.CoreV1().ConfigMaps(controller.DefaultConfigmapNamespace).Get(context.TODO(), controller.DefaultConfigmapName, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("the default configmap = %v, want it not created", err)
+	}
+	waitFile(t, s.args.ControllerArgs.FilePaths[0], "10.0.0.1 a.com\n")
+}
+
+func TestWritesWaitForTheSync(t *testing.T) {
+	s := newTestServer(t, Args{})
+	post := func() *httptest.ResponseRecorder {
+		return serve(s.webServer.Handler, http.MethodPost, "/api/v1/records", `{"domain": "a.com", "ip": "10.0.0.1"}`)
+	}
+	w := post()
+	if resp := decodeResponse(t, w, nil); w.Code != http.StatusServiceUnavailable || resp.Code != CodeUnavailable {
+		t.Fatalf("PostRecords before the sync = %d %+v, want %d", w.Code, resp, http.StatusServiceUnavailable)
+	}
+	if got := w.Header().Get("Retry-After"); got == "" {
+		t.Errorf("the Retry-After header is missing")
+	}
+	// The reads are served before the sync
+	if w := serve(s.webServer.Handler, http.MethodGet, "/api/v1/records", ""); w.Code != http.StatusOK {
+		t.Errorf("ListRecords before the sync = %d, want %d", w.Code, http.StatusOK)
+	}
+	startInformers(t, s)
+	if w := post(); w.Code != http.StatusOK {
+		t.Errorf("PostRecords after the sync = %d %s, want %d", w.Code, w.Body.String(), http.StatusOK)
+	}
+}
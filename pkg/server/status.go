@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// statusConfigmapName is the configmap showing the status of the server, so that
+// `kubectl get cm coredns-hosts-api-status -o yaml` gives a quick insight.
+func (s *Server) statusConfigmapName() string {
+	return s.args.ControllerArgs.Name() + "-status"
+}
+
+// runStatusReporter updates the status configmap every period until stop is closed
+func (s *Server) runStatusReporter(period time.Duration, stop <-chan struct{}) {
+	wait.Until(func() {
+		if err := s.reportStatus(); err != nil {
+			klog.ErrorS(err, "Failed to report the status", "configmap", klog.KRef(s.args.ControllerArgs.Namespace(), s.statusConfigmapName()))
+		}
+	}, period, stop)
+}
+
+func (s *Server) reportStatus() error {
+	status := s.configmapController.Status()
+	reporter, _ := os.Hostname()
+	data := map[string]string{
+		"reporter":      reporter,
+		"recordCount":   strconv.Itoa(status.RecordCount),
+		"healthy":       strconv.FormatBool(status.Healthy()),
+		"watchFailures": strconv.Itoa(status.WatchFailures),
+		"conflicts":     strconv.Itoa(len(status.Conflicts)),
+	}
+	if !status.WatchFailingSince.IsZero() {
+		data["watchFailingSince"] = status.WatchFailingSince.Format(time.RFC3339)
+	}
+	if !status.LastSyncTime.IsZero() {
+		data["lastSyncTime"] = status.LastSyncTime.Format(time.RFC3339)
+	}
+	if status.LastError != nil {
+		data["lastError"] = status.LastError.Error()
+	}
+	var unhealthyFiles []string
+	for path, err := range status.FileErrors {
+		if err != nil {
+			unhealthyFiles = append(unhealthyFiles, path)
+		}
+	}
+	if len(unhealthyFiles) > 0 {
+		sort.Strings(unhealthyFiles)
+		data["unhealthyFiles"] = strings.Join(unhealthyFiles, ",")
+	}
+
+	cms := s.clientset.CoreV1().ConfigMaps(s.args.ControllerArgs.Namespace())
+	cm, err := cms.Get(context.TODO(), s.statusConfigmapName(), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = cms.Create(context.TODO(), &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s.statusConfigmapName(),
+				Namespace: s.args.ControllerArgs.Namespace(),
+			},
+			Data: data,
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	cm.Data = data
+	_, err = cms.Update(context.TODO(), cm, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	maxDomainLength = 253
+	maxLabelLength  = 63
+)
+
+var labelRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([-a-zA-Z0-9]*[a-zA-Z0-9])?$`)
+
+// ValidationError is returned when a field of a record is malformed
+type ValidationError struct {
+	Field  string
+	Value  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s %q: %s", e.Field, e.Value, e.Reason)
+}
+
+// ValidateRecord checks the record before it is written, which is shared by
+// the single record and the bulk paths so that the rules never diverge.
+func ValidateRecord(r Record) error {
+	if err := validateRecordDomain(r.Domain); err != nil {
+		return err
+	}
+	if err := validateLabels(r.Labels); err != nil {
+		return err
+	}
+	if r.TTLSeconds < 0 {
+		return &ValidationError{Field: "ttlSeconds", Value: strconv.FormatInt(r.TTLSeconds, 10), Reason: "can not be negative"}
+	}
+	ips := r.ips()
+	if len(r.Weights) > 0 && (r.Pending || r.CNAME != "") {
+		return &ValidationError{Field: "weights", Value: fmt.Sprint(r.Weights), Reason: "can only be set together with the ips"}
+	}
+	if r.Pending {
+		if len(ips) != 0 || r.CNAME != "" {
+			return &ValidationError{Field: "pending", Value: "true", Reason: "can not be set together with the ip or the cname"}
+		}
+		return nil
+	}
+	if r.CNAME != "" {
+		if len(ips) != 0 {
+			return &ValidationError{Field: "cname", Value: r.CNAME, Reason: "can not be set together with the ip"}
+		}
+		if r.CNAME == r.Domain {
+			return &ValidationError{Field: "cname", Value: r.CNAME, Reason: "can not point to the domain itself"}
+		}
+		return validateDomain(r.CNAME)
+	}
+	if len(ips) == 0 {
+		return validateIP("")
+	}
+	for _, ip := range ips {
+		if err := validateIP(ip); err != nil {
+			return err
+		}
+	}
+	return validateWeights(r.Weights, ips)
+}
+
+// validateWeights checks every weight is positive and belongs to one of the ips
+func validateWeights(weights map[string]int, ips []string) error {
+	for ip, weight := range weights {
+		if !ExistString(ip, ips) {
+			return &ValidationError{Field: "weights", Value: ip, Reason: "is not one of the ips of the record"}
+		}
+		if weight < 1 {
+			return &ValidationError{Field: "weights", Value: ip, Reason: "must be a positive integer"}
+		}
+	}
+	return nil
+}
+
+// NormalizeDomain lowercases the domain and trims a single trailing dot, see controller.NormalizeDomain
+func NormalizeDomain(domain string) string {
+	return controller.NormalizeDomain(domain)
+}
+
+// normalize applies NormalizeDomain to the domain and the CNAME target of the record
+func (r *Record) normalize() {
+	r.Domain = NormalizeDomain(r.Domain)
+	if r.CNAME != "" {
+		r.CNAME = NormalizeDomain(r.CNAME)
+	}
+}
+
+// validateIP checks the ip is a valid IPv4 or IPv6 address
+func validateIP(ip string) error {
+	if net.ParseIP(ip) == nil {
+		return &ValidationError{Field: "ip", Value: ip, Reason: "must be a valid IPv4 or IPv6 address"}
+	}
+	return nil
+}
+
+// validateRecordDomain checks the domain of a record, which is a hostname or a wildcard of the
+// subdomains of a hostname, e.g. *.dev.example.com.
+func validateRecordDomain(domain string) error {
+	if !controller.IsWildcard(domain) {
+		return validateDomain(domain)
+	}
+	if err := validateDomain(strings.TrimPrefix(domain, controller.WildcardPrefix)); err != nil {
+		return &ValidationError{Field: "domain", Value: domain, Reason: "must be *. followed by a valid RFC 1123 hostname"}
+	}
+	return nil
+}
+
+// validateLabels checks the labels follow the syntax of the labels of Kubernetes, e.g. team.example.com/owner=team-x
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return &ValidationError{Field: "label key", Value: key, Reason: strings.Join(errs, "; ")}
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return &ValidationError{Field: "label value", Value: value, Reason: strings.Join(errs, "; ")}
+		}
+	}
+	return nil
+}
+
+// validateConfigmap checks the configmap of the records is a valid name, which leaves room for the
+// suffix of the shards, in a valid namespace.
+func validateConfigmap(name, namespace string) error {
+	if errs := validation.IsDNS1123Subdomain(name + "-status"); len(errs) > 0 {
+		return fmt.Errorf("invalid record configmap name %q: %s", name, strings.Join(errs, "; "))
+	}
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		return fmt.Errorf("invalid record configmap namespace %q: %s", namespace, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// validateDomain checks the domain is a valid RFC 1123 hostname
+func validateDomain(domain string) error {
+	if domain == "" {
+		return &ValidationError{Field: "domain", Value: domain, Reason: "can not be empty"}
+	}
+	if len(domain) > maxDomainLength {
+		return &ValidationError{Field: "domain", Value: domain, Reason: fmt.Sprintf("must be no more than %d characters", maxDomainLength)}
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) > maxLabelLength || !labelRegexp.MatchString(label) {
+			return &ValidationError{Field: "domain", Value: domain, Reason: "must be a valid RFC 1123 hostname"}
+		}
+	}
+	return nil
+}
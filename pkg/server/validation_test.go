@@ -0,0 +1,87 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+)
+
+func TestValidateRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		record  Record
+		wantErr bool
+	}{
+		{name: "IPv4", record: Record{Domain: "a.example.com", IP: "10.0.0.1"}},
+		{name: "IPv6", record: Record{Domain: "a.example.com", IP: "fd00::1"}},
+		{name: "single label", record: Record{Domain: "localhost", IP: "127.0.0.1"}},
+		{name: "hyphen", record: Record{Domain: "my-host.example.com", IP: "10.0.0.1"}},
+		{name: "IPv4 out of range", record: Record{Domain: "a.example.com", IP: "10.0.0.300"}, wantErr: true},
+		{name: "not an ip", record: Record{Domain: "a.example.com", IP: "localhost"}, wantErr: true},
+		{name: "empty domain", record: Record{Domain: "", IP: "10.0.0.1"}, wantErr: true},
+		{name: "invalid characters", record: Record{Domain: "my_host!", IP: "10.0.0.1"}, wantErr: true},
+		{name: "leading hyphen", record: Record{Domain: "-a.example.com", IP: "10.0.0.1"}, wantErr: true},
+		{name: "empty label", record: Record{Domain: "a..example.com", IP: "10.0.0.1"}, wantErr: true},
+		{name: "label too long", record: Record{Domain: strings.Repeat("a", 64) + ".com", IP: "10.0.0.1"}, wantErr: true},
+		{name: "domain too long", record: Record{Domain: strings.Repeat("a.", 127) + "com", IP: "10.0.0.1"}, wantErr: true},
+		{name: "wildcard", record: Record{Domain: "*.dev.example.com", IP: "10.0.0.1"}},
+		{name: "nested wildcard", record: Record{Domain: "*.*.example.com", IP: "10.0.0.1"}, wantErr: true},
+		{name: "wildcard in the middle", record: Record{Domain: "a.*.example.com", IP: "10.0.0.1"}, wantErr: true},
+		{name: "wildcard of a label", record: Record{Domain: "*dev.example.com", IP: "10.0.0.1"}, wantErr: true},
+		{name: "bare wildcard", record: Record{Domain: "*.", IP: "10.0.0.1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateRecord(tt.record)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateRecord = %v, want an error %v", err, tt.wantErr)
+			}
+			var validationErr *ValidationError
+			if err != nil && !errors.As(err, &validationErr) {
+				t.Errorf("ValidateRecord = %T, want a *ValidationError", err)
+			}
+		})
+	}
+}
+
+func TestPostInvalidRecord(t *testing.T) {
+	s := newSyncedTestServer(t, Args{})
+	for _, body := range []string{
+		`{"domain": "a.example.com", "ip": "10.0.0.300"}`,
+		`{"domain": "my_host!", "ip": "10.0.0.1"}`,
+	} {
+		w := serve(s.webServer.Handler, http.MethodPost, "/api/v1/records", body)
+		if resp := decodeResponse(t, w, nil); w.Code != http.StatusBadRequest || resp.Code != CodeInvalidRequest || resp.Message == "" {
+			t.Errorf("POST %s = %d %+v, want 400 with the reason", body, w.Code, resp)
+		}
+	}
+	if data, _ := s.store.List(s.args.ControllerArgs.Namespace()); len(data) != 0 {
+		t.Errorf("the records = %v, want nothing written", data)
+	}
+}
+
+func TestWildcardRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	s := newRunningTestServer(t, Args{ControllerArgs: controller.Args{FilePaths: []string{path}}})
+	h := s.webServer.Handler
+	for _, body := range []string{
+		`{"domain": "*.Dev.Example.com", "ip": "10.0.0.1"}`,
+		`{"domain": "b.com", "ip": "10.0.0.2"}`,
+	} {
+		if w := serve(h, http.MethodPost, "/api/v1/records", body); w.Code != http.StatusOK {
+			t.Fatalf("POST %s = %d %s", body, w.Code, w.Body)
+		}
+	}
+	// The wildcard is stored and served by the api, but never written into the hosts file
+	var record Record
+	if w := serve(h, http.MethodGet, "/api/v1/record/*.dev.example.com", ""); w.Code != http.StatusOK {
+		t.Fatalf("GET = %d %s", w.Code, w.Body)
+	} else if decodeResponse(t, w, &record); record.IP != "10.0.0.1" {
+		t.Errorf("record = %+v, want 10.0.0.1", record)
+	}
+	waitFile(t, path, "10.0.0.2 b.com\n")
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+	"github.com/gin-gonic/gin"
+)
+
+// watchHeartbeatPeriod is the period of the comments sent on an idle watch, so that the proxies
+// in between don't close the connection.
+const watchHeartbeatPeriod = 30 * time.Second
+
+// recordWatcher is the source of the changes of the records
+type recordWatcher interface {
+	Watch() (<-chan controller.RecordEvent, func())
+}
+
+// WatchRecords streams the changes of the records of the namespace as Server-Sent Events until
+// the client disconnects, the event name is the type of the change and the data is the RecordEvent.
+func (r *recordController) WatchRecords(c *gin.Context) {
+	namespace, ok := r.recordNamespace(c)
+	if !ok {
+		return
+	}
+	events, stop := r.watcher.Watch()
+	defer stop()
+	heartbeat := time.NewTicker(watchHeartbeatPeriod)
+	defer heartbeat.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-r.done:
+			return false
+		case event, ok := <-events:
+			// The watcher falling behind is dropped, and the client has to watch again
+			if !ok {
+				return false
+			}
+			if event.Namespace == namespace {
+				c.SSEvent(event.Type, event)
+			}
+			return true
+		case <-heartbeat.C:
+			_, err := fmt.Fprint(w, ": heartbeat\n\n")
+			return err == nil
+		}
+	})
+}
+
+// shutdown ends the watches, which would otherwise hold the graceful shutdown of the http server
+func (r *recordController) shutdown() {
+	close(r.done)
+}
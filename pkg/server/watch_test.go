@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devincd/coredns-hosts-api/pkg/server/controller"
+)
+
+func TestWatchRecords(t *testing.T) {
+	s := newRunningTestServer(t, Args{})
+	ts := httptest.NewServer(s.webServer.Handler)
+	defer ts.Close()
+	// The watch ends before the server closes, which waits for it otherwise
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan controller.RecordEvent)
+	go func() {
+		defer close(events)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/api/v1/records/watch", nil)
+		if err != nil {
+			t.Errorf("watch: %v", err)
+			return
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("watch: %v", err)
+			return
+		}
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data := strings.TrimPrefix(scanner.Text(), "data:")
+			if data == scanner.Text() {
+				continue
+			}
+			var event controller.RecordEvent
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				t.Errorf("failed to decode the event %q: %v", data, err)
+				return
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+			}
+			return
+		}
+	}()
+
+	// The headers of the stream are only sent with its first event, so the records are written
+	// until the watch, which may not be registered yet, gets one of them.
+	ips := make(map[string]string)
+	for i := 0; ; i++ {
+		domain, ip := fmt.Sprintf("w%d.com", i), fmt.Sprintf("10.0.0.%d", i+1)
+		ips[domain] = ip
+		if w := serve(s.webServer.Handler, http.MethodPost, "/api/v1/records", fmt.Sprintf(`{"domain": %q, "ip": %q}`, domain, ip)); w.Code != http.StatusOK {
+			t.Fatalf("POST = %d %s", w.Code, w.Body)
+		}
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatal("the watch ended without an event")
+			}
+			if event.Type != controller.RecordEventAdded || event.Namespace != controller.DefaultConfigmapNamespace || event.Value != ips[event.Domain] {
+				t.Errorf("event = %+v, want a record added", event)
+			}
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+		if i == 25 {
+			t.Fatal("no event is delivered")
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// webhookQueueSize bounds the changes waiting for the delivery, a change beyond it is dropped
+	webhookQueueSize = 1000
+	// webhookRetryBackoff is the delay before the first retry, which doubles with every retry
+	webhookRetryBackoff = time.Second
+)
+
+// WebhookEvent is posted to the change webhook for every change of a record
+type WebhookEvent struct {
+	Time time.Time `json:"time"`
+	// Action is one of HistoryActionSet, HistoryActionDelete and HistoryActionExpire
+	Action string `json:"action"`
+	// Namespace is the record namespace of the change
+	Namespace string `json:"namespace"`
+	Domain    string `json:"domain"`
+	// IP is the first ip of the record after the change, empty for a deletion, a CNAME or a pending record
+	IP string `json:"ip,omitempty"`
+	// Record and OldRecord are the record after and before the change, nil if it doesn't exist
+	Record    *Record `json:"record,omitempty"`
+	OldRecord *Record `json:"oldRecord,omitempty"`
+}
+
+func newWebhookEvent(namespace, domain, action, oldValue, newValue string) WebhookEvent {
+	event := WebhookEvent{
+		Time:      time.Now(),
+		Action:    action,
+		Namespace: namespace,
+		Domain:    domain,
+	}
+	if newValue != "" {
+		event.Record = recordFromValue(domain, newValue)
+		event.IP = event.Record.IP
+	}
+	if oldValue != "" {
+		event.OldRecord = recordFromValue(domain, oldValue)
+	}
+	return event
+}
+
+// webhookNotifier posts the changes of the records to the change webhook in the background and in
+// order, so that a slow or failing webhook never fails nor delays the api request making the change.
+type webhookNotifier struct {
+	url     string
+	client  *http.Client
+	retries int
+	queue   chan WebhookEvent
+}
+
+func newWebhookNotifier(url string, timeout time.Duration, retries int) *webhookNotifier {
+	return &webhookNotifier{
+		url:     url,
+		client:  &http.Client{Timeout: timeout},
+		retries: retries,
+		queue:   make(chan WebhookEvent, webhookQueueSize),
+	}
+}
+
+// notify queues the event without blocking, the event is dropped if the queue is full
+func (w *webhookNotifier) notify(event WebhookEvent) {
+	select {
+	case w.queue <- event:
+	default:
+		klog.ErrorS(fmt.Errorf("the queue of the change webhook is full"), "Drop the change", "domain", event.Domain, "action", event.Action)
+	}
+}
+
+// run delivers the queued events until stop is closed, the events still queued then are dropped
+func (w *webhookNotifier) run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case event := <-w.queue:
+			w.deliver(event, stop)
+		}
+	}
+}
+
+// deliver posts the event and retries with a backoff until it is accepted with a 2xx status
+func (w *webhookNotifier) deliver(event WebhookEvent, stop <-chan struct{}) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		klog.ErrorS(err, "Failed to marshal the change", "domain", event.Domain)
+		return
+	}
+	backoff := webhookRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err = w.post(body)
+		if err == nil {
+			return
+		}
+		if attempt >= w.retries {
+			break
+		}
+		klog.ErrorS(err, "Failed to post the change to the webhook, retrying", "domain", event.Domain, "action", event.Action, "attempt", attempt+1, "backoff", backoff)
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	klog.ErrorS(err, "Failed to post the change to the webhook, giving up", "domain", event.Domain, "action", event.Action, "retries", w.retries)
+}
+
+func (w *webhookNotifier) post(body []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body so that the connection is reused
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("the webhook answered %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newStubWebhook returns the url of a webhook answering status and the channel of the events posted to it
+func newStubWebhook(t *testing.T, status int) (string, <-chan WebhookEvent) {
+	t.Helper()
+	events := make(chan WebhookEvent, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var event WebhookEvent
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("the webhook got %s with the content type %q, want a JSON POST", req.Method, req.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+			t.Errorf("failed to decode the payload: %v", err)
+		}
+		events <- event
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL, events
+}
+
+func receiveEvent(t *testing.T, events <-chan WebhookEvent) WebhookEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change is posted to the webhook")
+		return WebhookEvent{}
+	}
+}
+
+func newWebhookTestServer(t *testing.T, url string) *Server {
+	t.Helper()
+	s := newSyncedTestServer(t, Args{ChangeWebhookURL: url, ChangeWebhookTimeout: time.Second})
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	go s.record.webhook.run(stop)
+	return s
+}
+
+func TestWebhookPayload(t *testing.T) {
+	url, events := newStubWebhook(t, http.StatusOK)
+	s := newWebhookTestServer(t, url)
+	namespace := s.args.ControllerArgs.Namespace()
+
+	if w := serve(s.webServer.Handler, http.MethodPost, "/api/v1/records", `{"domain": "a.com", "ip": "10.0.0.1"}`); w.Code != http.StatusOK {
+		t.Fatalf("PostRecords = %d %s", w.Code, w.Body.String())
+	}
+	event := receiveEvent(t, events)
+	if event.Action != HistoryActionSet || event.Namespace != namespace || event.Domain != "a.com" || event.IP != "10.0.0.1" ||
+		event.Record == nil || event.OldRecord != nil || event.Time.IsZero() {
+		t.Errorf("the set event = %+v, want a.com set to 10.0.0.1", event)
+	}
+
+	if w := serve(s.webServer.Handler, http.MethodDelete, "/api/v1/records", `{"domain": "a.com"}`); w.Code != http.StatusOK {
+		t.Fatalf("DeleteRecords = %d %s", w.Code, w.Body.String())
+	}
+	event = receiveEvent(t, events)
+	if event.Action != HistoryActionDelete || event.Domain != "a.com" || event.IP != "" || event.Record != nil ||
+		event.OldRecord == nil || event.OldRecord.IP != "10.0.0.1" {
+		t.Errorf("the delete event = %+v, want a.com deleted from 10.0.0.1", event)
+	}
+}
+
+func TestWebhookFailureKeepsTheRequest(t *testing.T) {
+	url, events := newStubWebhook(t, http.StatusInternalServerError)
+	s := newWebhookTestServer(t, url)
+	if w := serve(s.webServer.Handler, http.MethodPost, "/api/v1/records", `{"domain": "a.com", "ip": "10.0.0.1"}`); w.Code != http.StatusOK {
+		t.Fatalf("PostRecords = %d %s, want %d whatever the webhook answers", w.Code, w.Body.String(), http.StatusOK)
+	}
+	receiveEvent(t, events)
+	if w := serve(s.webServer.Handler, http.MethodGet, "/api/v1/record/a.com", ""); w.Code != http.StatusOK {
+		t.Errorf("GetRecord = %d, want the record written", w.Code)
+	}
+}
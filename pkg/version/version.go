@@ -0,0 +1,48 @@
+package version
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/spf13/cobra"
+)
+
+// Version, GitCommit and BuildDate are injected by -ldflags at build time, see the Makefile
+var (
+	Version   = "unknown"
+	GitCommit = "unknown"
+	BuildDate = "unknown"
+)
+
+// Info is the build information of the binary
+type Info struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+func Get() Info {
+	return Info{
+		Version:   Version,
+		GitCommit: GitCommit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+}
+
+func (i Info) String() string {
+	return fmt.Sprintf("%s (gitCommit: %s, buildDate: %s, goVersion: %s)", i.Version, i.GitCommit, i.BuildDate, i.GoVersion)
+}
+
+// NewCommand returns the version subcommand printing the build information
+func NewCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "version",
+		Short: "print the version of the binary",
+		Args:  cobra.ExactArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Fprintln(cmd.OutOrStdout(), Get().String())
+		},
+	}
+}